@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/prite36/auto-irrigation-system/internal/config"
@@ -15,6 +19,10 @@ import (
 )
 
 func main() {
+	deviceFlag := flag.String("device", "", "comma-separated IDs of the devices to run (default: all devices)")
+	jsonFlag := flag.Bool("json", false, "print a JSON summary of each device's result to stdout")
+	flag.Parse()
+
 	log.Println("Starting application...")
 
 	// Load configuration
@@ -39,17 +47,12 @@ func main() {
 
 	// Auto-migrate the schema
 	log.Println("Auto-migrating database schema...")
-	if err := db.AutoMigrate(&models.IrrigationHistory{}); err != nil {
+	if err := db.AutoMigrate(&models.IrrigationHistory{}, &models.DeviceState{}, &models.CommandLog{}); err != nil {
 		log.Fatalf("Failed to auto-migrate database schema: %v", err)
 	}
 
 	// Initialize MQTT Client
-	mqttClient, err := mqtt.NewClient(
-		cfg.MQTT.Broker,
-		cfg.MQTT.ClientID,
-		cfg.MQTT.Username,
-		cfg.MQTT.Password,
-	)
+	mqttClient, err := mqtt.NewClient(cfg.MQTT)
 	if err != nil {
 		log.Fatalf("Failed to initialize MQTT client: %v", err)
 	}
@@ -57,20 +60,42 @@ func main() {
 
 	// Subscribe to topics for all configured devices
 	log.Println("Subscribing to topics for configured devices...")
-	for _, device := range cfg.Devices {
-		mqttClient.SubscribeToDeviceTopics(device)
-	}
+	mqttClient.SubscribeToDevices(cfg.Devices)
 
 	// Initialize Slack Client
 	slackClient := slack.NewClient(cfg.Slack.BotToken, cfg.Slack.ChannelID)
+	slackClient.SetSeverityChannel(slack.SeverityError, cfg.Slack.AlertsChannelID)
+	slackClient.SetPlainText(cfg.Slack.PlainText)
+	slackClient.SetSimpleText(cfg.Slack.SimpleText)
+	slackClient.SetRetry(cfg.Slack.RetryAttempts, time.Duration(cfg.Slack.RetryBackoffMs)*time.Millisecond)
+	slackClient.SetSuppressionSummary(cfg.Slack.SuppressionSummary)
 
 	// Initialize Scheduler
 	scheduler := scheduler.NewScheduler(cfg, mqttClient, db, slackClient)
 
+	var deviceIDs []string
+	for _, id := range strings.Split(*deviceFlag, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			deviceIDs = append(deviceIDs, id)
+		}
+	}
+
 	time.Sleep(5 * time.Second)
-	// Run the job directly
-	log.Println("Executing RunJob directly...")
-	scheduler.RunAllJobsOnce()
+	// Run the jobs directly
+	log.Println("Executing device jobs directly...")
+	results := scheduler.RunJobsOnce(deviceIDs)
+
+	if *jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(summarize(results)); err != nil {
+			log.Fatalf("Failed to write JSON summary: %v", err)
+		}
+	} else {
+		for _, summary := range summarize(results) {
+			log.Printf("Device %s: %s in %.1fs %s", summary.DeviceID, summary.Status, summary.DurationSeconds, summary.Error)
+		}
+	}
 
 	log.Println("Debug run finished.")
 }
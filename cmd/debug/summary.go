@@ -0,0 +1,39 @@
+package main
+
+import "github.com/prite36/auto-irrigation-system/internal/scheduler"
+
+// Statuses reported for a device in the debug summary.
+const (
+	statusCompleted = "completed"
+	statusFailed    = "failed"
+	statusSkipped   = "skipped"
+)
+
+// deviceSummary is the machine-readable result of one device's job.
+type deviceSummary struct {
+	DeviceID        string  `json:"deviceId"`
+	Status          string  `json:"status"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// summarize converts job results into their summaries, keeping the run order.
+func summarize(results []scheduler.JobResult) []deviceSummary {
+	summaries := make([]deviceSummary, 0, len(results))
+	for _, result := range results {
+		summary := deviceSummary{
+			DeviceID:        result.DeviceID,
+			Status:          statusCompleted,
+			DurationSeconds: result.Duration.Seconds(),
+		}
+		if result.Err != nil {
+			summary.Status = statusFailed
+			if result.Skipped() {
+				summary.Status = statusSkipped
+			}
+			summary.Error = result.Err.Error()
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+)
+
+func TestSummarizeSerialization(t *testing.T) {
+	results := []scheduler.JobResult{
+		{DeviceID: "pot-1", Duration: 1500 * time.Millisecond},
+		{DeviceID: "sprinkler-1", Duration: 2 * time.Second, Err: errors.New("task timed out")},
+		{DeviceID: "sprinkler-2", Err: fmt.Errorf("%w: sprinkler-2", scheduler.ErrDeviceNotFound)},
+	}
+
+	got, err := json.Marshal(summarize(results))
+	if err != nil {
+		t.Fatalf("marshal summary: %v", err)
+	}
+	want := `[{"deviceId":"pot-1","status":"completed","durationSeconds":1.5},` +
+		`{"deviceId":"sprinkler-1","status":"failed","durationSeconds":2,"error":"task timed out"},` +
+		`{"deviceId":"sprinkler-2","status":"skipped","durationSeconds":0,"error":"device not found: sprinkler-2"}]`
+	if string(got) != want {
+		t.Errorf("summary JSON = %s, want %s", got, want)
+	}
+}
+
+func TestSummarizeEmpty(t *testing.T) {
+	got, err := json.Marshal(summarize(nil))
+	if err != nil {
+		t.Fatalf("marshal summary: %v", err)
+	}
+	if string(got) != "[]" {
+		t.Errorf("summary JSON = %s, want []", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,6 +17,7 @@ import (
 	"github.com/prite36/auto-irrigation-system/internal/scheduler"
 	"github.com/prite36/auto-irrigation-system/internal/server"
 	"github.com/prite36/auto-irrigation-system/internal/slack"
+	"github.com/prite36/auto-irrigation-system/internal/weather"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -25,10 +27,20 @@ func main() {
 
 	// Load configuration
 	cfg, err := config.LoadConfig()
-	if err != nil {
+	if errors.Is(err, config.ErrDeviceConfigMissing) {
+		// Devices can be added later with a reload; a malformed or invalid file is still fatal.
+		log.Printf("Warning: %v. Starting without devices.", err)
+	} else if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	if cfg.Schedule.ValidateTaskFiles {
+		limits := scheduler.TaskTimeoutLimitsFromConfig(cfg.Schedule)
+		if err := scheduler.ValidateTaskFiles(scheduler.DefaultTasksDir, cfg.Devices, limits); err != nil {
+			log.Fatalf("Invalid task files: %v", err)
+		}
+	}
+
 	// Initialize Database
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
 		cfg.Database.Host,
@@ -45,44 +57,71 @@ func main() {
 
 	// Auto-migrate the schema
 	log.Println("Auto-migrating database schema...")
-	if err := db.AutoMigrate(&models.IrrigationHistory{}); err != nil {
+	if err := db.AutoMigrate(&models.IrrigationHistory{}, &models.DeviceState{}, &models.CommandLog{}); err != nil {
 		log.Fatalf("Failed to auto-migrate database schema: %v", err)
 	}
 
 	// Initialize MQTT Client
-	mqttClient, err := mqtt.NewClient(
-		cfg.MQTT.Broker,
-		cfg.MQTT.ClientID,
-		cfg.MQTT.Username,
-		cfg.MQTT.Password,
-	)
+	mqttClient, err := mqtt.NewClient(cfg.MQTT)
 	if err != nil {
 		log.Fatalf("Failed to initialize MQTT client: %v", err)
 	}
 	defer mqttClient.Close()
 
-	// Subscribe to topics for all configured devices
-	log.Println("Subscribing to topics for configured devices...")
-	for _, device := range cfg.Devices {
-		mqttClient.SubscribeToDeviceTopics(device)
+	// Subscribe to topics for all configured devices, or leave it to the scheduler once it is armed
+	if cfg.MQTT.SubscribeAfterStart {
+		log.Println("Device topics will be subscribed once the scheduler has armed its jobs.")
+	} else {
+		log.Println("Subscribing to topics for configured devices...")
+		mqttClient.SubscribeToDevices(cfg.Devices)
+	}
+	if err := mqttClient.PublishPresence(); err != nil {
+		log.Printf("Failed to publish presence: %v", err)
 	}
 
 	// Initialize Slack Client
 	slackClient := slack.NewClient(cfg.Slack.BotToken, cfg.Slack.ChannelID)
+	slackClient.SetSeverityChannel(slack.SeverityError, cfg.Slack.AlertsChannelID)
+	slackClient.SetPlainText(cfg.Slack.PlainText)
+	slackClient.SetSimpleText(cfg.Slack.SimpleText)
+	slackClient.SetRetry(cfg.Slack.RetryAttempts, time.Duration(cfg.Slack.RetryBackoffMs)*time.Millisecond)
+	slackClient.SetSuppressionSummary(cfg.Slack.SuppressionSummary)
 
 	// Initialize Scheduler
 	scheduler := scheduler.NewScheduler(cfg, mqttClient, db, slackClient)
 
+	// Notify on broker connection loss and resume interrupted jobs on reconnect
+	mqttClient.SetConnectionHandlers(scheduler.HandleConnectionLost, scheduler.HandleReconnect)
+
+	// Force a reconnect if messages stop arriving while jobs are running
+	mqttClient.SetStallHandler(scheduler.HandleStall)
+	mqttClient.StartWatchdog(time.Duration(cfg.MQTT.WatchdogSecs)*time.Second, scheduler.HasRunningJobs)
+	mqttClient.SetPresenceHandler(scheduler.HandlePresenceChange)
+	mqttClient.StartPresenceMonitor()
+
+	// Skip scheduled watering when rain is forecast
+	if cfg.Weather.Enabled {
+		log.Printf("Rain check enabled (threshold: %.0f%%)", cfg.Weather.RainThreshold)
+		scheduler.SetWeatherProvider(weather.NewHTTPProvider(cfg.Weather))
+	}
+
 	// Initialize the API server
-	srv := server.New(cfg, scheduler)
+	srv := server.New(cfg, scheduler, mqttClient, db)
 
 	// Start services in goroutines
 	go func() {
 		log.Println("Starting scheduler...")
-		scheduler.Start()
+		if err := scheduler.Start(); err != nil {
+			log.Printf("Warning: Scheduler started with unscheduled jobs: %v", err)
+		}
 	}()
 	defer scheduler.Stop()
 
+	// Check device subscriptions and health before the first scheduled run
+	if cfg.Schedule.SelfTestOnBoot {
+		go scheduler.RunSelfTest(mqttClient, time.Duration(cfg.Schedule.SelfTestTimeoutSecs)*time.Second)
+	}
+
 	go func() {
 		log.Println("Starting API server on port 3005...")
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -92,6 +131,23 @@ func main() {
 
 	log.Println("Application is running with both Scheduler and API Server. Press CTRL+C to exit.")
 
+	// Reload the device configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP, reloading device configuration...")
+			devices, err := config.LoadDevices(cfg.DeviceCfgPath, cfg.Schedule)
+			if err != nil {
+				log.Printf("Device configuration reload rejected: %v", err)
+				continue
+			}
+			if _, err := scheduler.ReloadDevices(devices); err != nil {
+				log.Printf("Device configuration reload applied with errors: %v", err)
+			}
+		}
+	}()
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -105,5 +161,10 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	// Deliver notifications that jobs are still posting before the process exits
+	if err := slackClient.Flush(ctx); err != nil {
+		log.Printf("Slack notifications lost on shutdown: %v", err)
+	}
+
 	log.Println("Application exiting.")
 }
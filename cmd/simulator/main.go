@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/simulator"
+)
+
+func main() {
+	var timing simulator.Timing
+	flag.DurationVar(&timing.CalibrationDelay, "calibration-delay", 2*time.Second, "delay before homing commands report calibration complete")
+	flag.DurationVar(&timing.StepDelay, "step-delay", time.Second, "delay between task steps")
+	flag.Parse()
+
+	log.Println("Starting device simulator...")
+
+	// Load configuration
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	var client mqtt.Client
+	sim := simulator.New(cfg.Devices, timing, func(topic, payload string, retained bool) {
+		if token := client.Publish(topic, 1, retained, payload); token.Wait() && token.Error() != nil {
+			log.Printf("Failed to publish to topic %s: %v", topic, token.Error())
+		}
+	})
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.MQTT.Broker)
+	opts.SetClientID(cfg.MQTT.ClientID + "-simulator")
+	opts.SetUsername(cfg.MQTT.Username)
+	opts.SetPassword(cfg.MQTT.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Println("Simulator connected to MQTT broker.")
+		for _, topic := range sim.CommandTopics() {
+			if token := c.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+				sim.HandleCommand(msg.Topic(), msg.Payload())
+			}); token.Wait() && token.Error() != nil {
+				log.Printf("Failed to subscribe to topic %s: %v", topic, token.Error())
+			} else {
+				log.Printf("Subscribed to topic: %s", topic)
+			}
+		}
+		sim.Announce()
+	})
+
+	client = mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
+	}
+	defer client.Disconnect(250)
+
+	log.Printf("Simulating %d device(s). Press CTRL+C to exit.", len(cfg.Devices))
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("Simulator exiting.")
+}
@@ -2,19 +2,52 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type MQTTConfig struct {
-	Broker   string
-	ClientID string
-	Username string
-	Password string
+	Broker               string
+	Brokers              []string // failover brokers; used instead of Broker when set
+	ClientID             string
+	Username             string
+	Password             string
+	ClientIDSuffix       string // appended to ClientID; generated from the hostname when empty
+	ExactClientID        bool   // connect with ClientID as-is, e.g. to resume a persistent session
+	NotifyConnectionLoss bool
+	ResumeOnReconnect    bool
+	PublishTimeoutSecs   int // how long to wait for the broker to confirm a publish; 0 waits forever
+	StatusQoS            int // subscribe QoS for frequent readings such as positions and task progress
+	FlagQoS              int // subscribe QoS for flags that jobs wait on, such as calib_complete and all_complete
+	SubscribeConcurrency int // devices subscribed at once at startup and on reconnect
+	// ClearRetainedTypes lists device types whose command topics are cleared of retained messages on status reset.
+	ClearRetainedTypes []string
+	// JobStatusTopic is where job lifecycle events are published as retained JSON; {deviceId} is
+	// replaced with the device ID. Empty disables the events.
+	JobStatusTopic string
+	// PresenceTopic is where the list of managed devices is published as retained JSON on connect
+	// and reload, and cleared on shutdown. Empty disables it.
+	PresenceTopic string
+
+	MaxReconnectIntervalSecs int // longest wait between reconnect attempts; the wait doubles from 1s up to this
+	ReconnectJitterMs        int // random delay up to this added before each reconnect attempt; 0 disables
+	FlapThreshold            int // reconnects within FlapWindowMins that trigger a Slack alert; 0 disables
+	FlapWindowMins           int
+	// WatchdogSecs forces a reconnect when no message arrives for this long while jobs are running; 0 disables.
+	WatchdogSecs int
+	// OfflineAfterSecs marks a device offline, and alerts, when it has not reported for this long; 0 disables.
+	OfflineAfterSecs int
+	// SubscribeAfterStart leaves subscribing to device topics to the scheduler, once its jobs are
+	// armed, so no device status is tracked while the controller is still starting.
+	SubscribeAfterStart bool
 }
 
 type DatabaseConfig struct {
@@ -26,12 +59,180 @@ type DatabaseConfig struct {
 	SSLMode  string
 }
 
-type ScheduleConfig struct{}
+type ScheduleConfig struct {
+	Paused                 bool // start with scheduled watering paused
+	AllowManualWhilePaused bool // let manual triggers run while paused
+	StartupGraceSeconds    int  // wait up to this long for the MQTT connection before arming jobs
+	RejectOverlap          bool // reject device files whose schedule times overlap a device's run instead of warning
+	MaxConcurrentManual    int  // manual runs (API triggers) allowed in flight at once; 0 is unlimited
+	TaskDefaultTimeoutMins int  // timeout for task files without a timeoutMinutes; 0 uses the file value as is
+	TaskMaxTimeoutMins     int  // longer task timeouts are clamped to this with a warning; 0 disables the cap
+	SelfTestOnBoot         bool // check device subscriptions and health at startup and report to Slack
+	SelfTestTimeoutSecs    int  // how long the boot self-test waits for devices to pass
+	CooldownMinutes        int  // refuse a run within this many minutes of the device's last run; 0 disables
+	RequireDevices         bool // fail startup when no devices are configured instead of warning
+	VerifyTaskReset        bool // ignore task completion until the device reports the task restarted
+	TaskAckTimeoutSecs     int  // wait this long for the device to report a task count after publishing; 0 waits a fixed settle delay instead
+	NotifyStartup          bool // post a summary of the armed jobs to Slack once the scheduler starts
+	FailureThreshold       int  // disable a device after this many consecutive failed runs; 0 never disables
+	// HealthProbeTimeoutSecs makes plant pot jobs request a health check and wait this long for the
+	// answer instead of trusting the last reported value; 0 disables the request.
+	HealthProbeTimeoutSecs int
+	HealthProbeTopic       string // command topic of the request, relative to the device ID
+	HealthProbePayload     string // payload of the request
+	// RequireFreshCalibration always homes sprinklers before watering and only accepts calibration
+	// flags the device reports after the home command, never a value left from an earlier run.
+	RequireFreshCalibration bool
+	// TaskEstimateTimeout estimates the timeout of task files without a timeoutMinutes from their
+	// payload, plus TaskEstimateMarginPercent, before falling back to TaskDefaultTimeoutMins.
+	TaskEstimateTimeout       bool
+	TaskEstimateMarginPercent int
+	// SafeAbort publishes SafeAbortStopTopic and homes the valve and sprinkler when a sprinkler run
+	// fails after its health check, so the device is not left mid-task.
+	SafeAbort          bool
+	SafeAbortStopTopic string // command topic relative to the device ID; empty skips the stop command
+	// ValidateTaskFiles fails startup when a sprinkler's task file is missing, does not parse, has an
+	// empty payload or no positive timeout, instead of failing its run later.
+	ValidateTaskFiles bool
+	// TaskReadRetries re-reads a task file this many times, TaskReadRetryDelayMs apart, when reading or
+	// parsing it fails, e.g. while a deploy rewrites it. A missing file is never retried.
+	TaskReadRetries      int
+	TaskReadRetryDelayMs int
+	// InterruptedJobs is what to do at startup with sprinkler runs a restart left started: mark them
+	// failed (InterruptedJobsFail), or also resume them (InterruptedJobsResume). Empty leaves them.
+	InterruptedJobs string
+	// TaskFailurePolicy is what a sprinkler run does when one of its tasks fails: stop the run
+	// (TaskFailureAbort, also when empty) or go on with its remaining tasks (TaskFailureContinue).
+	TaskFailurePolicy string
+	// MaxTasksPerDevice rejects a device configuration when a device lists more tasks than this,
+	// as a guard against a runaway config that would water for hours. 0 disables the limit.
+	MaxTasksPerDevice int
+}
+
+type HistoryConfig struct {
+	RetentionDays int  // history older than this is deleted by the daily cleanup; 0 keeps everything
+	HardDelete    bool // permanently delete rows instead of soft-deleting them
+}
 
 type SlackConfig struct {
-	BotToken      string
-	ChannelID     string
-	SigningSecret string
+	BotToken        string
+	ChannelID       string
+	AlertsChannelID string // error notifications go here instead of ChannelID when set
+	SigningSecret   string
+	ProgressUpdates bool
+	PlainText       bool // strip emoji and prefix titles with [INFO]/[OK]/[WARN]/[ERROR]
+	SimpleText      bool // send plain text messages instead of rich attachments
+	RetryAttempts   int  // retries after a transient network or 5xx error; 0 disables retries
+	RetryBackoffMs  int  // wait before the first retry, doubled for each further retry
+	// SuppressionSummary posts how many messages were dropped once a rate limit backoff ends.
+	SuppressionSummary bool
+	// VerifyRawBody verifies Slack event signatures against the body as received, before any middleware.
+	VerifyRawBody bool
+	// ThreadRuns posts a message when a device job starts and sends the job's other notifications as replies in its thread.
+	ThreadRuns bool
+	// BatchRunSummary replaces the per-device info and success messages of a run of all devices with
+	// one summary of every device's result, posted when the run ends.
+	BatchRunSummary bool
+	// NotificationLabels are the device labels shown, in this order, in the device's notifications.
+	NotificationLabels []string
+}
+
+// Built-in device types. Others can be added with RegisterDeviceType.
+const (
+	DeviceTypeSprinkler = "iot_sprinkler"
+	DeviceTypePlantPot  = "iot_plant_pot"
+)
+
+// ErrUnknownDeviceType is returned when a device is configured with an unsupported type.
+var ErrUnknownDeviceType = errors.New("unknown device type")
+
+// Supported command formats. Raw publishes the bare payload, JSON wraps it in a models.CommandEnvelope.
+const (
+	CommandFormatRaw  = "raw"
+	CommandFormatJSON = "json"
+)
+
+// ErrUnknownCommandFormat is returned when a device is configured with an unsupported command format.
+var ErrUnknownCommandFormat = errors.New("unknown command format")
+
+// Actions for runs found interrupted by a restart. Without one, they are left as they are.
+const (
+	InterruptedJobsFail   = "fail"
+	InterruptedJobsResume = "resume"
+)
+
+// ErrUnknownInterruptedJobsAction is returned when SCHEDULE_INTERRUPTED_JOBS is not a supported action.
+var ErrUnknownInterruptedJobsAction = errors.New("unknown interrupted jobs action")
+
+// Policies for a failed task of a sprinkler run.
+const (
+	TaskFailureAbort    = "abort"
+	TaskFailureContinue = "continue"
+)
+
+// ErrUnknownTaskFailurePolicy is returned when SCHEDULE_TASK_FAILURE_POLICY is not a supported policy.
+var ErrUnknownTaskFailurePolicy = errors.New("unknown task failure policy")
+
+// ErrInvalidWarmupCommand is returned when a device's warmup command has no topic or a negative delay.
+var ErrInvalidWarmupCommand = errors.New("invalid warmup command")
+
+// ErrInvalidSleepCommand is returned when a device's sleep command has no topic.
+var ErrInvalidSleepCommand = errors.New("invalid sleep command")
+
+// ErrInvalidScheduleTime is returned when a device's schedule time is not a 24-hour HH:MM or HH:MM:SS time.
+var ErrInvalidScheduleTime = errors.New("invalid schedule time")
+
+// ErrInvalidMoistureRecheck is returned when a moisture re-check has a negative settle time or
+// no expected rise, or is set on a device that is not a plant pot.
+var ErrInvalidMoistureRecheck = errors.New("invalid moisture re-check")
+
+// ErrTooManyTasks is returned when a device lists more tasks than SCHEDULE_MAX_TASKS_PER_DEVICE allows.
+var ErrTooManyTasks = errors.New("too many tasks")
+
+// ErrScheduleOverlap is returned when overlap rejection is enabled and a device is scheduled
+// again before its previous run is expected to finish.
+var ErrScheduleOverlap = errors.New("overlapping schedule times")
+
+// ErrNoDevices is returned when SCHEDULE_REQUIRE_DEVICES is set and the device list is empty.
+var ErrNoDevices = errors.New("no devices configured")
+
+// Device configuration file errors, so callers can tell a missing file (which may be tolerable)
+// from one that is broken. They wrap the underlying error.
+var (
+	ErrDeviceConfigMissing    = errors.New("device config file not found")
+	ErrDeviceConfigUnreadable = errors.New("device config file unreadable")
+	ErrDeviceConfigMalformed  = errors.New("device config file is not valid JSON")
+	ErrDeviceConfigInvalid    = errors.New("invalid device configuration")
+)
+
+// ErrConfigMalformed is returned when the environment settings cannot be decoded, e.g. a
+// non-numeric value for a numeric setting.
+var ErrConfigMalformed = errors.New("malformed configuration")
+
+type ServerConfig struct {
+	APIToken     string // bearer token required by protected API endpoints; they are disabled when empty
+	MaxBodyBytes int64  // largest accepted request body
+	// ReadyRequireStatus makes /health/ready also wait for a first status from every device.
+	ReadyRequireStatus bool
+	// ReadyRequireDevices makes /health/ready report not ready while no devices are configured.
+	ReadyRequireDevices bool
+
+	ReadTimeoutSecs       int // time allowed to read a whole request, including the body; 0 disables
+	ReadHeaderTimeoutSecs int // time allowed to read request headers; 0 falls back to ReadTimeoutSecs
+	WriteTimeoutSecs      int // time allowed to write a response; 0 disables
+	IdleTimeoutSecs       int // how long keep-alive connections stay open between requests; 0 uses ReadTimeoutSecs
+
+	// TestMode enables endpoints for staging only, such as injecting a fake device status.
+	TestMode bool
+}
+
+type WeatherConfig struct {
+	Enabled       bool
+	Endpoint      string
+	APIKey        string
+	Latitude      float64
+	Longitude     float64
+	RainThreshold float64 // precipitation probability (percent) above which scheduled watering is skipped
 }
 
 type DeviceConfig struct {
@@ -40,19 +241,93 @@ type DeviceConfig struct {
 	ScheduleTimes    []string `json:"scheduleTimes"`
 	ScheduleDuration int      `json:"scheduleDuration"`
 	TaskIDs          []string `json:"taskIds"`
+	// RecalibrateAfterMinutes skips homing when the device was calibrated within this window. 0 always checks live flags.
+	RecalibrateAfterMinutes int `json:"recalibrateAfterMinutes"`
+	// RequireHealthCheck makes sprinklers report a passing health_check before calibration; plant pots always do.
+	RequireHealthCheck bool `json:"requireHealthCheck,omitempty"`
+	// HealthCheckRetries repeats an unanswered health check request this many times before a plant
+	// pot job fails. It applies when SCHEDULE_HEALTH_PROBE_TIMEOUT_SECONDS is set.
+	HealthCheckRetries int `json:"healthCheckRetries,omitempty"`
+	// FlowRateLitersPerMinute estimates water usage from run duration. 0 disables the estimate.
+	FlowRateLitersPerMinute float64 `json:"flowRateLitersPerMinute,omitempty"`
+	// ReportsVolume marks a volume-mode device, which publishes its water meter total in liters on
+	// status/volume. Its runs record the meter's rise instead of the flow rate estimate.
+	ReportsVolume bool `json:"reportsVolume,omitempty"`
+	// SlackChannelID overrides the Slack channel for this device's notifications.
+	SlackChannelID string `json:"slackChannelId,omitempty"`
+	// CommandFormat is "raw" (default) for bare payloads or "json" to wrap commands in an envelope.
+	CommandFormat string `json:"commandFormat,omitempty"`
+	// ConfirmValveClosedSeconds waits this long after the tasks (sprinklers) or the watering duration
+	// (plant pots) for the valve to report closed. 0 skips the check.
+	ConfirmValveClosedSeconds int `json:"confirmValveClosedSeconds,omitempty"`
+	// CooldownMinutes overrides SCHEDULE_COOLDOWN_MINUTES for this device; 0 disables its cooldown.
+	CooldownMinutes *int `json:"cooldownMinutes,omitempty"`
+	// Priority orders devices in runs of all devices: higher values run first, ties keep file order.
+	Priority int `json:"priority,omitempty"`
+	// MQTT gives the device its own broker session instead of the shared connection.
+	MQTT *DeviceMQTTConfig `json:"mqtt,omitempty"`
+	// WarmupCommand is published to sprinklers after calibration and before their tasks, e.g. to prime a pump.
+	WarmupCommand *WarmupCommand `json:"warmupCommand,omitempty"`
+	// MoistureRecheck warns when a plant pot's moisture has not risen after watering.
+	MoistureRecheck *MoistureRecheck `json:"moistureRecheck,omitempty"`
+	// SleepCommand is published after a successful run, e.g. to put a battery device to sleep.
+	SleepCommand *SleepCommand `json:"sleepCommand,omitempty"`
+	// DryRun runs the device's jobs without publishing its commands, so the job flow can be observed
+	// without moving the hardware. Other devices are unaffected.
+	DryRun bool `json:"dryRun,omitempty"`
+	// MuteNotifications suppresses the device's info and success Slack messages; warnings and
+	// errors are still sent.
+	MuteNotifications bool `json:"muteNotifications,omitempty"`
+	// Labels are arbitrary tags such as zone, crop or owner. They are stored on the device's history
+	// and those listed in SLACK_NOTIFICATION_LABELS are shown in its notifications.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// MoistureRecheck compares a plant pot's moisture before watering with the reading SettleSeconds
+// after watering ends, and warns when it rose by less than MinRise, e.g. because an emitter is
+// clogged or the reservoir is empty.
+type MoistureRecheck struct {
+	SettleSeconds int     `json:"settleSeconds"`
+	MinRise       float64 `json:"minRise"`
+}
+
+// WarmupCommand primes a device before its tasks: Payload is published to Topic, relative to the
+// device ID, and the run then waits DelaySeconds before the first task.
+type WarmupCommand struct {
+	Topic        string `json:"topic"`
+	Payload      string `json:"payload"`
+	DelaySeconds int    `json:"delaySeconds,omitempty"`
+}
+
+// SleepCommand puts a device to sleep after its job: Payload is published to Topic, relative to the
+// device ID. Failed runs leave the device awake for diagnostics unless OnFailure is set.
+type SleepCommand struct {
+	Topic     string `json:"topic"`
+	Payload   string `json:"payload"`
+	OnFailure bool   `json:"onFailure,omitempty"`
+}
+
+// DeviceMQTTConfig overrides the shared broker connection for one device, e.g. where broker ACLs
+// require per-device credentials. Empty fields fall back to the shared MQTT settings.
+type DeviceMQTTConfig struct {
+	Broker   string `json:"broker,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 type Config struct {
 	MQTT          MQTTConfig
 	Database      DatabaseConfig
 	Schedule      ScheduleConfig
+	History       HistoryConfig
 	Slack         SlackConfig
+	Server        ServerConfig
+	Weather       WeatherConfig
 	Devices       []DeviceConfig `json:"devices"`
 	DeviceCfgPath string         `json:"devicecfgpath"`
 }
 
 func LoadConfig() (*Config, error) {
-	log.Println("--- Starting Configuration Loading ---")
 	v := viper.New()
 
 	v.BindEnv("database.host", "DB_HOST")
@@ -64,28 +339,135 @@ func LoadConfig() (*Config, error) {
 	v.BindEnv("database.dbname", "POSTGRES_DB")
 
 	v.BindEnv("mqtt.broker", "MQTT_BROKER")
+	v.BindEnv("mqtt.brokers", "MQTT_BROKERS")
+	v.BindEnv("mqtt.clearretainedtypes", "MQTT_CLEAR_RETAINED_TYPES")
+	v.BindEnv("mqtt.maxreconnectintervalsecs", "MQTT_MAX_RECONNECT_INTERVAL_SECONDS")
+	v.BindEnv("mqtt.reconnectjitterms", "MQTT_RECONNECT_JITTER_MS")
+	v.BindEnv("mqtt.flapthreshold", "MQTT_FLAP_THRESHOLD")
+	v.BindEnv("mqtt.flapwindowmins", "MQTT_FLAP_WINDOW_MINUTES")
+	v.SetDefault("mqtt.maxreconnectintervalsecs", 60)
+	v.SetDefault("mqtt.reconnectjitterms", 1000)
+	v.SetDefault("mqtt.flapthreshold", 5)
+	v.SetDefault("mqtt.flapwindowmins", 10)
+	v.BindEnv("mqtt.watchdogsecs", "MQTT_WATCHDOG_SECONDS")
+	v.BindEnv("mqtt.offlineaftersecs", "MQTT_OFFLINE_AFTER_SECONDS")
+	v.BindEnv("mqtt.subscribeafterstart", "MQTT_SUBSCRIBE_AFTER_START")
 	v.BindEnv("mqtt.clientid", "MQTT_CLIENT_ID")
 	v.BindEnv("mqtt.username", "MQTT_USERNAME")
 	v.BindEnv("mqtt.password", "MQTT_PASSWORD")
+	v.BindEnv("mqtt.clientidsuffix", "MQTT_CLIENT_ID_SUFFIX")
+	v.BindEnv("mqtt.exactclientid", "MQTT_EXACT_CLIENT_ID")
+	v.BindEnv("mqtt.notifyconnectionloss", "MQTT_NOTIFY_CONNECTION_LOSS")
+	v.BindEnv("mqtt.resumeonreconnect", "MQTT_RESUME_ON_RECONNECT")
+	v.BindEnv("mqtt.publishtimeoutsecs", "MQTT_PUBLISH_TIMEOUT_SECONDS")
+	v.SetDefault("mqtt.publishtimeoutsecs", 10)
+	v.BindEnv("mqtt.statusqos", "MQTT_STATUS_QOS")
+	v.BindEnv("mqtt.flagqos", "MQTT_FLAG_QOS")
+	v.SetDefault("mqtt.statusqos", 1)
+	v.SetDefault("mqtt.flagqos", 1)
+	v.BindEnv("mqtt.subscribeconcurrency", "MQTT_SUBSCRIBE_CONCURRENCY")
+	v.SetDefault("mqtt.subscribeconcurrency", 4)
+	v.BindEnv("mqtt.jobstatustopic", "MQTT_JOB_STATUS_TOPIC")
+	v.BindEnv("mqtt.presencetopic", "MQTT_PRESENCE_TOPIC")
 
 	v.BindEnv("slack.bottoken", "SLACK_BOT_TOKEN")
 	v.BindEnv("slack.channelid", "SLACK_CHANNEL_ID")
+	v.BindEnv("slack.alertschannelid", "SLACK_ALERTS_CHANNEL_ID")
 	v.BindEnv("slack.signingsecret", "SLACK_SIGNING_SECRET")
+	v.BindEnv("slack.progressupdates", "SLACK_PROGRESS_UPDATES")
+	v.BindEnv("slack.plaintext", "SLACK_PLAIN_TEXT")
+	v.BindEnv("slack.simpletext", "SLACK_SIMPLE_TEXT")
+	v.BindEnv("slack.retryattempts", "SLACK_RETRY_ATTEMPTS")
+	v.BindEnv("slack.retrybackoffms", "SLACK_RETRY_BACKOFF_MS")
+	v.SetDefault("slack.retryattempts", 2)
+	v.SetDefault("slack.retrybackoffms", 500)
+	v.BindEnv("slack.suppressionsummary", "SLACK_SUPPRESSION_SUMMARY")
+	v.SetDefault("slack.suppressionsummary", true)
+	v.BindEnv("slack.verifyrawbody", "SLACK_VERIFY_RAW_BODY")
+	v.BindEnv("slack.threadruns", "SLACK_THREAD_RUNS")
+	v.BindEnv("slack.batchrunsummary", "SLACK_BATCH_RUN_SUMMARY")
+	v.BindEnv("slack.notificationlabels", "SLACK_NOTIFICATION_LABELS")
 
-	v.BindEnv("devicecfgpath", "DEVICE_CONFIG_PATH")
+	v.BindEnv("schedule.paused", "SCHEDULE_PAUSED")
+	v.BindEnv("schedule.allowmanualwhilepaused", "SCHEDULE_ALLOW_MANUAL_WHILE_PAUSED")
+	v.SetDefault("schedule.allowmanualwhilepaused", true)
+	v.BindEnv("schedule.startupgraceseconds", "SCHEDULE_STARTUP_GRACE_SECONDS")
+	v.BindEnv("schedule.rejectoverlap", "SCHEDULE_REJECT_OVERLAP")
+	v.BindEnv("schedule.maxconcurrentmanual", "SCHEDULE_MAX_CONCURRENT_MANUAL")
+	v.SetDefault("schedule.maxconcurrentmanual", 4)
+	v.BindEnv("schedule.taskdefaulttimeoutmins", "SCHEDULE_TASK_DEFAULT_TIMEOUT_MINUTES")
+	v.BindEnv("schedule.taskmaxtimeoutmins", "SCHEDULE_TASK_MAX_TIMEOUT_MINUTES")
+	v.SetDefault("schedule.taskdefaulttimeoutmins", 30)
+	v.SetDefault("schedule.taskmaxtimeoutmins", 120)
+	v.BindEnv("schedule.taskestimatetimeout", "SCHEDULE_TASK_ESTIMATE_TIMEOUT")
+	v.BindEnv("schedule.taskestimatemarginpercent", "SCHEDULE_TASK_ESTIMATE_MARGIN_PERCENT")
+	v.SetDefault("schedule.taskestimatemarginpercent", 50)
+	v.BindEnv("schedule.safeabort", "SCHEDULE_SAFE_ABORT")
+	v.BindEnv("schedule.safeabortstoptopic", "SCHEDULE_SAFE_ABORT_STOP_TOPIC")
+	v.SetDefault("schedule.safeabortstoptopic", "cmd/task/stop")
+	v.BindEnv("schedule.validatetaskfiles", "SCHEDULE_VALIDATE_TASK_FILES")
+	v.BindEnv("schedule.taskreadretries", "SCHEDULE_TASK_READ_RETRIES")
+	v.BindEnv("schedule.taskreadretrydelayms", "SCHEDULE_TASK_READ_RETRY_DELAY_MS")
+	v.SetDefault("schedule.taskreadretries", 2)
+	v.SetDefault("schedule.taskreadretrydelayms", 500)
+	v.BindEnv("schedule.interruptedjobs", "SCHEDULE_INTERRUPTED_JOBS")
+	v.BindEnv("schedule.taskfailurepolicy", "SCHEDULE_TASK_FAILURE_POLICY")
+	v.BindEnv("schedule.maxtasksperdevice", "SCHEDULE_MAX_TASKS_PER_DEVICE")
+	v.SetDefault("schedule.maxtasksperdevice", 50)
+	v.BindEnv("schedule.selftestonboot", "SCHEDULE_SELF_TEST_ON_BOOT")
+	v.BindEnv("schedule.selftesttimeoutsecs", "SCHEDULE_SELF_TEST_TIMEOUT_SECONDS")
+	v.SetDefault("schedule.selftesttimeoutsecs", 60)
+	v.BindEnv("schedule.cooldownminutes", "SCHEDULE_COOLDOWN_MINUTES")
+	v.BindEnv("schedule.requiredevices", "SCHEDULE_REQUIRE_DEVICES")
+	v.BindEnv("schedule.verifytaskreset", "SCHEDULE_VERIFY_TASK_RESET")
+	v.BindEnv("schedule.taskacktimeoutsecs", "SCHEDULE_TASK_ACK_TIMEOUT_SECONDS")
+	v.SetDefault("schedule.taskacktimeoutsecs", 30)
+	v.BindEnv("schedule.notifystartup", "SCHEDULE_NOTIFY_STARTUP")
+	v.SetDefault("schedule.notifystartup", true)
+	v.BindEnv("schedule.failurethreshold", "SCHEDULE_FAILURE_THRESHOLD")
+	v.BindEnv("schedule.healthprobetimeoutsecs", "SCHEDULE_HEALTH_PROBE_TIMEOUT_SECONDS")
+	v.BindEnv("schedule.healthprobetopic", "SCHEDULE_HEALTH_PROBE_TOPIC")
+	v.BindEnv("schedule.healthprobepayload", "SCHEDULE_HEALTH_PROBE_PAYLOAD")
+	v.SetDefault("schedule.healthprobetopic", "cmd/health_check")
+	v.SetDefault("schedule.healthprobepayload", "1")
+	v.BindEnv("schedule.requirefreshcalibration", "SCHEDULE_REQUIRE_FRESH_CALIBRATION")
+
+	v.BindEnv("history.retentiondays", "HISTORY_RETENTION_DAYS")
+	v.BindEnv("history.harddelete", "HISTORY_HARD_DELETE")
+	v.SetDefault("history.retentiondays", 90)
+
+	v.BindEnv("server.apitoken", "API_TOKEN")
+	v.BindEnv("server.maxbodybytes", "API_MAX_BODY_BYTES")
+	v.SetDefault("server.maxbodybytes", 1<<20)
+	v.BindEnv("server.readyrequirestatus", "API_READY_REQUIRE_STATUS")
+	v.BindEnv("server.readyrequiredevices", "API_READY_REQUIRE_DEVICES")
+	v.BindEnv("server.readtimeoutsecs", "API_READ_TIMEOUT_SECONDS")
+	v.BindEnv("server.readheadertimeoutsecs", "API_READ_HEADER_TIMEOUT_SECONDS")
+	v.BindEnv("server.writetimeoutsecs", "API_WRITE_TIMEOUT_SECONDS")
+	v.BindEnv("server.idletimeoutsecs", "API_IDLE_TIMEOUT_SECONDS")
+	v.SetDefault("server.readtimeoutsecs", 30)
+	v.SetDefault("server.readheadertimeoutsecs", 10)
+	v.SetDefault("server.writetimeoutsecs", 60)
+	v.SetDefault("server.idletimeoutsecs", 120)
+	v.BindEnv("server.testmode", "TEST_MODE")
+
+	v.BindEnv("weather.enabled", "WEATHER_ENABLED")
+	v.BindEnv("weather.endpoint", "WEATHER_ENDPOINT")
+	v.BindEnv("weather.apikey", "WEATHER_API_KEY")
+	v.BindEnv("weather.latitude", "WEATHER_LATITUDE")
+	v.BindEnv("weather.longitude", "WEATHER_LONGITUDE")
+	v.BindEnv("weather.rainthreshold", "WEATHER_RAIN_THRESHOLD")
+	v.SetDefault("weather.rainthreshold", 70)
 
-	log.Println("[1] Explicit environment variable binding configured.")
+	v.BindEnv("devicecfgpath", "DEVICE_CONFIG_PATH")
 
 	env := os.Getenv("APP_ENV")
 	if env == "" {
-		log.Println("[2] APP_ENV not set, defaulting to 'local'.")
 		env = "local"
-	} else {
-		log.Printf("[2] APP_ENV is set to '%s'.", env)
 	}
 
+	source := "environment"
 	if env == "local" {
-		log.Println("[3] Attempting to load .env.local file...")
 		v.SetConfigFile(".env.local")
 		v.SetConfigType("env")
 
@@ -96,7 +478,7 @@ func LoadConfig() (*Config, error) {
 			}
 			log.Println("Info: .env.local not found, which is acceptable. Relying on environment variables.")
 		} else {
-			log.Printf("Success: Loaded configuration from %s", v.ConfigFileUsed())
+			source = v.ConfigFileUsed() + " and environment"
 			// Explicitly set all known config values from .env.local to ensure correct unmarshalling
 			configMappings := map[string]string{
 				"database.host":    "DB_HOST",
@@ -108,13 +490,101 @@ func LoadConfig() (*Config, error) {
 				"database.dbname":   "POSTGRES_DB",
 
 				"mqtt.broker":   "MQTT_BROKER",
+				"mqtt.brokers":  "MQTT_BROKERS",
 				"mqtt.clientid": "MQTT_CLIENT_ID",
 				"mqtt.username": "MQTT_USERNAME",
 				"mqtt.password": "MQTT_PASSWORD",
 
-				"slack.bottoken":      "SLACK_BOT_TOKEN",
-				"slack.channelid":     "SLACK_CHANNEL_ID",
-				"slack.signingsecret": "SLACK_SIGNING_SECRET",
+				"mqtt.clientidsuffix": "MQTT_CLIENT_ID_SUFFIX",
+				"mqtt.exactclientid":  "MQTT_EXACT_CLIENT_ID",
+
+				"mqtt.notifyconnectionloss": "MQTT_NOTIFY_CONNECTION_LOSS",
+				"mqtt.resumeonreconnect":    "MQTT_RESUME_ON_RECONNECT",
+				"mqtt.publishtimeoutsecs":   "MQTT_PUBLISH_TIMEOUT_SECONDS",
+				"mqtt.statusqos":            "MQTT_STATUS_QOS",
+				"mqtt.flagqos":              "MQTT_FLAG_QOS",
+				"mqtt.subscribeconcurrency": "MQTT_SUBSCRIBE_CONCURRENCY",
+				"mqtt.clearretainedtypes":   "MQTT_CLEAR_RETAINED_TYPES",
+				"mqtt.jobstatustopic":       "MQTT_JOB_STATUS_TOPIC",
+				"mqtt.presencetopic":        "MQTT_PRESENCE_TOPIC",
+
+				"mqtt.maxreconnectintervalsecs": "MQTT_MAX_RECONNECT_INTERVAL_SECONDS",
+				"mqtt.reconnectjitterms":        "MQTT_RECONNECT_JITTER_MS",
+				"mqtt.flapthreshold":            "MQTT_FLAP_THRESHOLD",
+				"mqtt.flapwindowmins":           "MQTT_FLAP_WINDOW_MINUTES",
+				"mqtt.watchdogsecs":             "MQTT_WATCHDOG_SECONDS",
+				"mqtt.offlineaftersecs":         "MQTT_OFFLINE_AFTER_SECONDS",
+				"mqtt.subscribeafterstart":      "MQTT_SUBSCRIBE_AFTER_START",
+
+				"slack.bottoken":        "SLACK_BOT_TOKEN",
+				"slack.channelid":       "SLACK_CHANNEL_ID",
+				"slack.alertschannelid": "SLACK_ALERTS_CHANNEL_ID",
+				"slack.signingsecret":   "SLACK_SIGNING_SECRET",
+				"slack.progressupdates": "SLACK_PROGRESS_UPDATES",
+				"slack.plaintext":       "SLACK_PLAIN_TEXT",
+				"slack.simpletext":      "SLACK_SIMPLE_TEXT",
+				"slack.retryattempts":   "SLACK_RETRY_ATTEMPTS",
+				"slack.retrybackoffms":  "SLACK_RETRY_BACKOFF_MS",
+
+				"slack.suppressionsummary": "SLACK_SUPPRESSION_SUMMARY",
+				"slack.verifyrawbody":      "SLACK_VERIFY_RAW_BODY",
+				"slack.threadruns":         "SLACK_THREAD_RUNS",
+				"slack.batchrunsummary":    "SLACK_BATCH_RUN_SUMMARY",
+				"slack.notificationlabels": "SLACK_NOTIFICATION_LABELS",
+
+				"schedule.paused":                 "SCHEDULE_PAUSED",
+				"schedule.allowmanualwhilepaused": "SCHEDULE_ALLOW_MANUAL_WHILE_PAUSED",
+				"schedule.startupgraceseconds":    "SCHEDULE_STARTUP_GRACE_SECONDS",
+				"schedule.rejectoverlap":          "SCHEDULE_REJECT_OVERLAP",
+				"schedule.maxconcurrentmanual":    "SCHEDULE_MAX_CONCURRENT_MANUAL",
+				"schedule.taskdefaulttimeoutmins": "SCHEDULE_TASK_DEFAULT_TIMEOUT_MINUTES",
+				"schedule.taskmaxtimeoutmins":     "SCHEDULE_TASK_MAX_TIMEOUT_MINUTES",
+				"schedule.taskestimatetimeout":    "SCHEDULE_TASK_ESTIMATE_TIMEOUT",
+				"schedule.selftestonboot":         "SCHEDULE_SELF_TEST_ON_BOOT",
+				"schedule.selftesttimeoutsecs":    "SCHEDULE_SELF_TEST_TIMEOUT_SECONDS",
+				"schedule.cooldownminutes":        "SCHEDULE_COOLDOWN_MINUTES",
+				"schedule.requiredevices":         "SCHEDULE_REQUIRE_DEVICES",
+				"schedule.verifytaskreset":        "SCHEDULE_VERIFY_TASK_RESET",
+				"schedule.taskacktimeoutsecs":     "SCHEDULE_TASK_ACK_TIMEOUT_SECONDS",
+				"schedule.notifystartup":          "SCHEDULE_NOTIFY_STARTUP",
+				"schedule.failurethreshold":       "SCHEDULE_FAILURE_THRESHOLD",
+				"schedule.healthprobetimeoutsecs": "SCHEDULE_HEALTH_PROBE_TIMEOUT_SECONDS",
+				"schedule.healthprobetopic":       "SCHEDULE_HEALTH_PROBE_TOPIC",
+				"schedule.healthprobepayload":     "SCHEDULE_HEALTH_PROBE_PAYLOAD",
+
+				"schedule.requirefreshcalibration":   "SCHEDULE_REQUIRE_FRESH_CALIBRATION",
+				"schedule.taskestimatemarginpercent": "SCHEDULE_TASK_ESTIMATE_MARGIN_PERCENT",
+				"schedule.safeabort":                 "SCHEDULE_SAFE_ABORT",
+				"schedule.safeabortstoptopic":        "SCHEDULE_SAFE_ABORT_STOP_TOPIC",
+				"schedule.validatetaskfiles":         "SCHEDULE_VALIDATE_TASK_FILES",
+				"schedule.taskreadretries":           "SCHEDULE_TASK_READ_RETRIES",
+				"schedule.taskreadretrydelayms":      "SCHEDULE_TASK_READ_RETRY_DELAY_MS",
+				"schedule.interruptedjobs":           "SCHEDULE_INTERRUPTED_JOBS",
+				"schedule.taskfailurepolicy":         "SCHEDULE_TASK_FAILURE_POLICY",
+				"schedule.maxtasksperdevice":         "SCHEDULE_MAX_TASKS_PER_DEVICE",
+
+				"history.retentiondays": "HISTORY_RETENTION_DAYS",
+				"history.harddelete":    "HISTORY_HARD_DELETE",
+
+				"server.apitoken":     "API_TOKEN",
+				"server.maxbodybytes": "API_MAX_BODY_BYTES",
+
+				"server.readyrequirestatus":  "API_READY_REQUIRE_STATUS",
+				"server.readyrequiredevices": "API_READY_REQUIRE_DEVICES",
+
+				"server.readtimeoutsecs":       "API_READ_TIMEOUT_SECONDS",
+				"server.readheadertimeoutsecs": "API_READ_HEADER_TIMEOUT_SECONDS",
+				"server.writetimeoutsecs":      "API_WRITE_TIMEOUT_SECONDS",
+				"server.idletimeoutsecs":       "API_IDLE_TIMEOUT_SECONDS",
+
+				"server.testmode": "TEST_MODE",
+
+				"weather.enabled":       "WEATHER_ENABLED",
+				"weather.endpoint":      "WEATHER_ENDPOINT",
+				"weather.apikey":        "WEATHER_API_KEY",
+				"weather.latitude":      "WEATHER_LATITUDE",
+				"weather.longitude":     "WEATHER_LONGITUDE",
+				"weather.rainthreshold": "WEATHER_RAIN_THRESHOLD",
 
 				"devicecfgpath": "DEVICE_CONFIG_PATH",
 			}
@@ -123,51 +593,226 @@ func LoadConfig() (*Config, error) {
 				if val := v.Get(envFileKey); val != nil {
 					if s, ok := val.(string); ok && s != "" {
 						v.Set(internalKey, s)
-						log.Printf("[DEBUG] Manually set Viper key '%s' to string value '%s' (from .env key '%s')", internalKey, s, envFileKey)
 					} else if !ok { // val is not nil here (due to outer if) and not a string
 						// If it's not a string but has a value (e.g. int if Viper auto-converted from .env, or other types)
 						v.Set(internalKey, val)
-						log.Printf("[DEBUG] Manually set Viper key '%s' to non-string value '%v' (type %T) (from .env key '%s')", internalKey, val, val, envFileKey)
 					}
 					// If val was a string but empty, it's skipped, allowing default Go zero values during Unmarshal if that's desired.
 				}
 			}
 		}
-	} else {
-		log.Printf("[3] Skipping .env file loading because APP_ENV is '%s'.", env)
 	}
 
-	log.Println("[4] Dumping all settings found by Viper (sensitive info redacted):")
-
 	var config Config
-	log.Println("[5] Unmarshaling settings into Config struct...")
 	if err := v.Unmarshal(&config); err != nil {
 		log.Printf("Error: Failed to unmarshal config: %v", err)
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrConfigMalformed, err)
+	}
+	switch config.Schedule.InterruptedJobs {
+	case "", InterruptedJobsFail, InterruptedJobsResume:
+	default:
+		return nil, fmt.Errorf("%w '%s' in SCHEDULE_INTERRUPTED_JOBS: use '%s' or '%s'", ErrUnknownInterruptedJobsAction, config.Schedule.InterruptedJobs, InterruptedJobsFail, InterruptedJobsResume)
+	}
+	switch config.Schedule.TaskFailurePolicy {
+	case "", TaskFailureAbort, TaskFailureContinue:
+	default:
+		return nil, fmt.Errorf("%w '%s' in SCHEDULE_TASK_FAILURE_POLICY: use '%s' or '%s'", ErrUnknownTaskFailurePolicy, config.Schedule.TaskFailurePolicy, TaskFailureAbort, TaskFailureContinue)
 	}
-	log.Println("[6] Final configuration struct (sensitive info redacted):")
 
-	// Load device configurations from the specified JSON file
+	// Load device configurations from the specified JSON file. A missing file is returned along
+	// with the config, so callers may choose to start without devices.
+	var missingDevices error
 	if config.DeviceCfgPath != "" {
-		jsonFile, err := os.Open(config.DeviceCfgPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open device config file '%s': %w", config.DeviceCfgPath, err)
+		devices, err := LoadDevices(config.DeviceCfgPath, config.Schedule)
+		switch {
+		case errors.Is(err, ErrDeviceConfigMissing) && !config.Schedule.RequireDevices:
+			missingDevices = err
+		case errors.Is(err, ErrDeviceConfigMissing):
+			return nil, fmt.Errorf("%w: %w", ErrNoDevices, err)
+		case err != nil:
+			return nil, err
+		}
+		config.Devices = devices
+	}
+	if len(config.Devices) == 0 {
+		if config.Schedule.RequireDevices {
+			return nil, fmt.Errorf("%w (DEVICE_CONFIG_PATH=%q)", ErrNoDevices, config.DeviceCfgPath)
 		}
-		defer jsonFile.Close()
+		log.Printf("Warning: No devices configured (DEVICE_CONFIG_PATH=%q); nothing will be subscribed or scheduled", config.DeviceCfgPath)
+	}
+
+	summary, err := json.Marshal(config.redacted(config.Devices, false))
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize config: %w", err)
+	}
+	log.Printf("Configuration loaded (APP_ENV=%s, from %s): %s", env, source, summary)
+
+	return &config, missingDevices
+}
+
+// LoadDevices reads and validates the device configurations from a JSON file.
+// The validation settings are taken from schedule: overlapping schedule times are logged, or
+// rejected with RejectOverlap, and devices with more than MaxTasksPerDevice tasks are rejected.
+func LoadDevices(path string, schedule ScheduleConfig) ([]DeviceConfig, error) {
+	jsonFile, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: '%s': %w", ErrDeviceConfigMissing, path, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open '%s': %w", ErrDeviceConfigUnreadable, path, err)
+	}
+	defer jsonFile.Close()
+
+	byteValue, err := io.ReadAll(jsonFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read '%s': %w", ErrDeviceConfigUnreadable, path, err)
+	}
+
+	// The JSON structure should be an object with a "devices" key, e.g. { "devices": [ ... ] }
+	var deviceFile struct {
+		Devices []DeviceConfig `json:"devices"`
+	}
+	if err := json.Unmarshal(byteValue, &deviceFile); err != nil {
+		return nil, fmt.Errorf("%w: '%s': %w", ErrDeviceConfigMalformed, path, err)
+	}
 
-		byteValue, err := io.ReadAll(jsonFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read device config file: %w", err)
+	cfg := Config{Devices: deviceFile.Devices, Schedule: schedule}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDeviceConfigInvalid, err)
+	}
+	return deviceFile.Devices, nil
+}
+
+// Validate checks the device configuration for mistakes that would otherwise only surface at run time.
+func (cfg *Config) Validate() error {
+	for _, device := range cfg.Devices {
+		if _, ok := LookupDeviceType(device.Type); !ok {
+			return fmt.Errorf("%w '%s' for device '%s'", ErrUnknownDeviceType, device.Type, device.ID)
+		}
+		if limit := cfg.Schedule.MaxTasksPerDevice; limit > 0 && len(device.TaskIDs) > limit {
+			return fmt.Errorf("%w for device '%s': it lists %d tasks, more than the %d allowed by SCHEDULE_MAX_TASKS_PER_DEVICE", ErrTooManyTasks, device.ID, len(device.TaskIDs), limit)
 		}
+		for _, raw := range device.ScheduleTimes {
+			if raw = strings.TrimSpace(raw); raw == "" {
+				continue // blank entries are skipped by the scheduler
+			}
+			if _, err := parseScheduleTime(raw); err != nil {
+				return fmt.Errorf("%w '%s' for device '%s': use a 24-hour HH:MM or HH:MM:SS time", ErrInvalidScheduleTime, raw, device.ID)
+			}
+		}
+		switch device.CommandFormat {
+		case "", CommandFormatRaw, CommandFormatJSON:
+		default:
+			return fmt.Errorf("%w '%s' for device '%s'", ErrUnknownCommandFormat, device.CommandFormat, device.ID)
+		}
+		if warmup := device.WarmupCommand; warmup != nil && (strings.TrimSpace(warmup.Topic) == "" || warmup.DelaySeconds < 0) {
+			return fmt.Errorf("%w for device '%s': a topic and a delay of 0 or more seconds are required", ErrInvalidWarmupCommand, device.ID)
+		}
+		if sleep := device.SleepCommand; sleep != nil && strings.TrimSpace(sleep.Topic) == "" {
+			return fmt.Errorf("%w for device '%s': a topic is required", ErrInvalidSleepCommand, device.ID)
+		}
+		if recheck := device.MoistureRecheck; recheck != nil {
+			if device.Type != DeviceTypePlantPot {
+				return fmt.Errorf("%w for device '%s': only plant pots report moisture", ErrInvalidMoistureRecheck, device.ID)
+			}
+			if recheck.SettleSeconds < 0 || recheck.MinRise <= 0 {
+				return fmt.Errorf("%w for device '%s': a settle time of 0 or more seconds and a positive minimum rise are required", ErrInvalidMoistureRecheck, device.ID)
+			}
+		}
+	}
 
-		// The JSON structure should be an object with a "devices" key, e.g. { "devices": [ ... ] }
-		// We unmarshal into the config struct which has the `json:"devices"` tag on the Devices field.
-		if err := json.Unmarshal(byteValue, &config); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal device config JSON: %w", err)
+	overlaps := findScheduleOverlaps(cfg.Devices)
+	if len(overlaps) > 0 && cfg.Schedule.RejectOverlap {
+		msgs := make([]string, len(overlaps))
+		for i, overlap := range overlaps {
+			msgs[i] = overlap.String()
 		}
+		return fmt.Errorf("%w: %s", ErrScheduleOverlap, strings.Join(msgs, "; "))
+	}
+	for _, overlap := range overlaps {
+		log.Printf("[WARN] Overlapping schedule: %s", overlap)
 	}
+	return nil
+}
+
+// expectedRunDuration is how long a run of the device is expected to take. Sprinklers are
+// configured in minutes and plant pots in seconds.
+func (d DeviceConfig) expectedRunDuration() time.Duration {
+	if d.Type == DeviceTypePlantPot {
+		return time.Duration(d.ScheduleDuration) * time.Second
+	}
+	return time.Duration(d.ScheduleDuration) * time.Minute
+}
 
-	return &config, nil
+// scheduleOverlap is a pair of schedule times for one device that start within the device's run duration.
+type scheduleOverlap struct {
+	deviceID    string
+	first       string
+	second      string
+	runDuration time.Duration
+}
+
+func (o scheduleOverlap) String() string {
+	return fmt.Sprintf("device '%s' is scheduled at %s and %s, less than its run duration of %s apart", o.deviceID, o.first, o.second, o.runDuration)
+}
+
+// parseScheduleTime parses a daily schedule time in the formats the scheduler accepts, HH:MM or
+// HH:MM:SS in 24-hour time, into its offset from midnight.
+func parseScheduleTime(raw string) (time.Duration, error) {
+	t, err := time.Parse("15:04:05", raw)
+	if err != nil {
+		t, err = time.Parse("15:04", raw)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+}
+
+// findScheduleOverlaps returns every pair of a device's daily schedule times that start closer
+// together than the device's expected run duration, including duplicate times. Gaps wrap around
+// midnight. Times that don't parse are skipped; Validate rejects them.
+func findScheduleOverlaps(devices []DeviceConfig) []scheduleOverlap {
+	const day = 24 * time.Hour
+	var overlaps []scheduleOverlap
+	for _, device := range devices {
+		runDuration := device.expectedRunDuration()
+
+		type scheduleTime struct {
+			raw    string
+			offset time.Duration
+		}
+		var times []scheduleTime
+		for _, raw := range device.ScheduleTimes {
+			raw = strings.TrimSpace(raw)
+			offset, err := parseScheduleTime(raw)
+			if err != nil {
+				continue
+			}
+			times = append(times, scheduleTime{raw: raw, offset: offset})
+		}
+
+		for i := 0; i < len(times); i++ {
+			for j := i + 1; j < len(times); j++ {
+				gap := times[j].offset - times[i].offset
+				if gap < 0 {
+					gap = -gap
+				}
+				if day-gap < gap {
+					gap = day - gap
+				}
+				if gap == 0 || gap < runDuration {
+					overlaps = append(overlaps, scheduleOverlap{
+						deviceID:    device.ID,
+						first:       times[i].raw,
+						second:      times[j].raw,
+						runDuration: runDuration,
+					})
+				}
+			}
+		}
+	}
+	return overlaps
 }
 
 // DefaultConfig is kept for backward compatibility but will be removed in the future
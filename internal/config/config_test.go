@@ -0,0 +1,545 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDeviceTypes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		devices []DeviceConfig
+		wantErr error
+	}{
+		{
+			name: "known types",
+			devices: []DeviceConfig{
+				{ID: "sprinkler_01", Type: DeviceTypeSprinkler},
+				{ID: "plant_pot_01", Type: DeviceTypePlantPot},
+			},
+		},
+		{
+			name:    "unknown type",
+			devices: []DeviceConfig{{ID: "sprinkler_01", Type: "iot_sprinklr"}},
+			wantErr: ErrUnknownDeviceType,
+		},
+		{
+			name:    "empty type",
+			devices: []DeviceConfig{{ID: "sprinkler_01"}},
+			wantErr: ErrUnknownDeviceType,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Devices: tc.devices}
+			err := cfg.Validate()
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), tc.devices[0].ID) {
+				t.Errorf("Expected error to name the device, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateScheduleOverlaps(t *testing.T) {
+	testCases := []struct {
+		name        string
+		device      DeviceConfig
+		wantOverlap bool
+	}{
+		{
+			name:   "safely spaced sprinkler",
+			device: DeviceConfig{ID: "sprinkler_01", Type: DeviceTypeSprinkler, ScheduleTimes: []string{"08:00", "17:00"}, ScheduleDuration: 10},
+		},
+		{
+			name:        "sprinkler within run duration",
+			device:      DeviceConfig{ID: "sprinkler_01", Type: DeviceTypeSprinkler, ScheduleTimes: []string{"08:00", "08:05"}, ScheduleDuration: 10},
+			wantOverlap: true,
+		},
+		{
+			name:        "duplicate times",
+			device:      DeviceConfig{ID: "sprinkler_01", Type: DeviceTypeSprinkler, ScheduleTimes: []string{"08:00", " 08:00"}},
+			wantOverlap: true,
+		},
+		{
+			name:        "overlap across midnight",
+			device:      DeviceConfig{ID: "sprinkler_01", Type: DeviceTypeSprinkler, ScheduleTimes: []string{"23:55", "00:02"}, ScheduleDuration: 10},
+			wantOverlap: true,
+		},
+		{
+			name:   "plant pot duration is in seconds",
+			device: DeviceConfig{ID: "plant_pot_01", Type: DeviceTypePlantPot, ScheduleTimes: []string{"07:56", "07:58"}, ScheduleDuration: 60},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			warnOnly := &Config{Devices: []DeviceConfig{tc.device}}
+			if err := warnOnly.Validate(); err != nil {
+				t.Fatalf("Expected overlaps to only warn by default, got %v", err)
+			}
+
+			strict := &Config{Devices: []DeviceConfig{tc.device}, Schedule: ScheduleConfig{RejectOverlap: true}}
+			err := strict.Validate()
+			if !tc.wantOverlap {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrScheduleOverlap) {
+				t.Fatalf("Expected error %v, got %v", ErrScheduleOverlap, err)
+			}
+			for _, scheduleTime := range tc.device.ScheduleTimes {
+				if !strings.Contains(err.Error(), strings.TrimSpace(scheduleTime)) {
+					t.Errorf("Expected error to include %s, got %v", scheduleTime, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateScheduleTimes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		times   []string
+		wantErr error
+	}{
+		{name: "hours and minutes", times: []string{"06:00", "18:30"}},
+		{name: "with seconds", times: []string{"06:00:30"}},
+		{name: "single digit hour", times: []string{"6:00"}},
+		{name: "surrounding spaces and blanks", times: []string{" 06:00 ", ""}},
+		{name: "hour out of range", times: []string{"25:00"}, wantErr: ErrInvalidScheduleTime},
+		{name: "minute out of range", times: []string{"06:99"}, wantErr: ErrInvalidScheduleTime},
+		{name: "second out of range", times: []string{"06:00:60"}, wantErr: ErrInvalidScheduleTime},
+		{name: "twelve hour clock", times: []string{"6:00pm"}, wantErr: ErrInvalidScheduleTime},
+		{name: "not a time", times: []string{"06:00", "noon"}, wantErr: ErrInvalidScheduleTime},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Devices: []DeviceConfig{{ID: "sprinkler_01", Type: DeviceTypeSprinkler, ScheduleTimes: tc.times}}}
+			err := cfg.Validate()
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "device 'sprinkler_01'") {
+				t.Errorf("Expected the error to name the device, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateCommandFormat(t *testing.T) {
+	testCases := []struct {
+		name    string
+		format  string
+		wantErr error
+	}{
+		{name: "default", format: ""},
+		{name: "raw", format: CommandFormatRaw},
+		{name: "json", format: CommandFormatJSON},
+		{name: "unknown", format: "xml", wantErr: ErrUnknownCommandFormat},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Devices: []DeviceConfig{{ID: "sprinkler_01", Type: DeviceTypeSprinkler, CommandFormat: tc.format}}}
+			if err := cfg.Validate(); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateWarmupCommand(t *testing.T) {
+	testCases := []struct {
+		name    string
+		warmup  *WarmupCommand
+		wantErr error
+	}{
+		{name: "unset"},
+		{name: "valid", warmup: &WarmupCommand{Topic: "cmd/pump/prime", Payload: "1", DelaySeconds: 20}},
+		{name: "no delay", warmup: &WarmupCommand{Topic: "cmd/pump/prime"}},
+		{name: "missing topic", warmup: &WarmupCommand{Payload: "1"}, wantErr: ErrInvalidWarmupCommand},
+		{name: "negative delay", warmup: &WarmupCommand{Topic: "cmd/pump/prime", DelaySeconds: -1}, wantErr: ErrInvalidWarmupCommand},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Devices: []DeviceConfig{{ID: "sprinkler_01", Type: DeviceTypeSprinkler, WarmupCommand: tc.warmup}}}
+			if err := cfg.Validate(); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateSleepCommand(t *testing.T) {
+	testCases := []struct {
+		name    string
+		sleep   *SleepCommand
+		wantErr error
+	}{
+		{name: "unset"},
+		{name: "valid", sleep: &SleepCommand{Topic: "cmd/power/sleep", Payload: "1"}},
+		{name: "no payload", sleep: &SleepCommand{Topic: "cmd/power/sleep", OnFailure: true}},
+		{name: "missing topic", sleep: &SleepCommand{Payload: "1"}, wantErr: ErrInvalidSleepCommand},
+		{name: "blank topic", sleep: &SleepCommand{Topic: " ", Payload: "1"}, wantErr: ErrInvalidSleepCommand},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Devices: []DeviceConfig{{ID: "plant_pot_01", Type: DeviceTypePlantPot, SleepCommand: tc.sleep}}}
+			if err := cfg.Validate(); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateMaxTasksPerDevice(t *testing.T) {
+	taskIDs := func(n int) []string {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("task_%d", i+1)
+		}
+		return ids
+	}
+	testCases := []struct {
+		name    string
+		limit   int
+		tasks   int
+		wantErr error
+	}{
+		{name: "under the limit", limit: 3, tasks: 2},
+		{name: "at the limit", limit: 3, tasks: 3},
+		{name: "over the limit", limit: 3, tasks: 4, wantErr: ErrTooManyTasks},
+		{name: "no limit", limit: 0, tasks: 500},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{
+				Devices:  []DeviceConfig{{ID: "sprinkler_01", Type: DeviceTypeSprinkler, TaskIDs: taskIDs(tc.tasks)}},
+				Schedule: ScheduleConfig{MaxTasksPerDevice: tc.limit},
+			}
+			err := cfg.Validate()
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "'sprinkler_01': it lists 4 tasks, more than the 3 allowed") {
+				t.Errorf("Expected the message to name the device, its task count and the limit, got %q", err)
+			}
+		})
+	}
+
+	t.Run("device file over the limit", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "devices.json")
+		content := `{"devices": [{"id": "sprinkler_01", "type": "iot_sprinkler", "taskIds": ["task_1", "task_2", "task_3"]}]}`
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write devices.json: %v", err)
+		}
+		_, err := LoadDevices(path, ScheduleConfig{MaxTasksPerDevice: 2})
+		if !errors.Is(err, ErrDeviceConfigInvalid) || !errors.Is(err, ErrTooManyTasks) {
+			t.Errorf("Expected an invalid config for too many tasks, got %v", err)
+		}
+	})
+}
+
+func TestValidateMoistureRecheck(t *testing.T) {
+	testCases := []struct {
+		name       string
+		deviceType string
+		recheck    *MoistureRecheck
+		wantErr    error
+	}{
+		{name: "unset", deviceType: DeviceTypePlantPot},
+		{name: "valid", deviceType: DeviceTypePlantPot, recheck: &MoistureRecheck{SettleSeconds: 120, MinRise: 5}},
+		{name: "no settle time", deviceType: DeviceTypePlantPot, recheck: &MoistureRecheck{MinRise: 5}},
+		{name: "no expected rise", deviceType: DeviceTypePlantPot, recheck: &MoistureRecheck{SettleSeconds: 120}, wantErr: ErrInvalidMoistureRecheck},
+		{name: "negative settle time", deviceType: DeviceTypePlantPot, recheck: &MoistureRecheck{SettleSeconds: -1, MinRise: 5}, wantErr: ErrInvalidMoistureRecheck},
+		{name: "sprinkler", deviceType: DeviceTypeSprinkler, recheck: &MoistureRecheck{SettleSeconds: 120, MinRise: 5}, wantErr: ErrInvalidMoistureRecheck},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Devices: []DeviceConfig{{ID: "device_01", Type: tc.deviceType, MoistureRecheck: tc.recheck}}}
+			if err := cfg.Validate(); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRedactsSecretsInLogs(t *testing.T) {
+	secrets := map[string]string{
+		"POSTGRES_PASSWORD":    "pg-hunter2",
+		"MQTT_PASSWORD":        "mqtt-hunter2",
+		"SLACK_BOT_TOKEN":      "xoxb-hunter2",
+		"SLACK_SIGNING_SECRET": "signing-hunter2",
+		"API_TOKEN":            "api-hunter2",
+		"WEATHER_API_KEY":      "weather-hunter2",
+	}
+	var env strings.Builder
+	for key, value := range secrets {
+		env.WriteString(key + "=" + value + "\n")
+	}
+	env.WriteString("MQTT_USERNAME=irrigation\n")
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env.local"), []byte(env.String()), 0o644); err != nil {
+		t.Fatalf("Failed to write .env.local: %v", err)
+	}
+	t.Chdir(dir)
+	t.Setenv("APP_ENV", "local")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected config to load, got %v", err)
+	}
+	if cfg.MQTT.Password != secrets["MQTT_PASSWORD"] {
+		t.Errorf("Expected the MQTT password to still be loaded, got %q", cfg.MQTT.Password)
+	}
+
+	output := logs.String()
+	for key, value := range secrets {
+		if strings.Contains(output, value) {
+			t.Errorf("Expected %s to be redacted from the logs", key)
+		}
+	}
+	if !strings.Contains(output, redactedValue) {
+		t.Error("Expected redacted placeholders in the logs")
+	}
+	if !strings.Contains(output, "irrigation") {
+		t.Error("Expected non-secret values to still be logged")
+	}
+}
+
+func TestIsSensitiveKey(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected bool
+	}{
+		{key: "database.password", expected: true},
+		{key: "SLACK_BOT_TOKEN", expected: true},
+		{key: "slack.signingsecret", expected: true},
+		{key: "weather_api_key", expected: true},
+		{key: "mqtt.username", expected: false},
+		{key: "slack.channelid", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			if got := isSensitiveKey(tc.key); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithoutDevices(t *testing.T) {
+	testCases := []struct {
+		name        string
+		env         string
+		expectError bool
+	}{
+		{name: "warns by default", env: "MQTT_USERNAME=irrigation\n"},
+		{name: "fatal when required", env: "SCHEDULE_REQUIRE_DEVICES=true\n", expectError: true},
+		{name: "fatal with an empty device file", env: "SCHEDULE_REQUIRE_DEVICES=true\nDEVICE_CONFIG_PATH=devices.json\n", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, ".env.local"), []byte(tc.env), 0o644); err != nil {
+				t.Fatalf("Failed to write .env.local: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "devices.json"), []byte(`{"devices": []}`), 0o644); err != nil {
+				t.Fatalf("Failed to write devices.json: %v", err)
+			}
+			t.Chdir(dir)
+			t.Setenv("APP_ENV", "local")
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			_, err := LoadConfig()
+			if tc.expectError {
+				if !errors.Is(err, ErrNoDevices) {
+					t.Fatalf("Expected ErrNoDevices, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected config to load, got %v", err)
+			}
+			if !strings.Contains(logs.String(), "No devices configured") {
+				t.Errorf("Expected a warning about the empty device list, got %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestLoadDevicesErrorTypes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		missing bool
+		content string
+		wantErr error
+	}{
+		{name: "missing file", missing: true, wantErr: ErrDeviceConfigMissing},
+		{name: "malformed JSON", content: `{"devices": [`, wantErr: ErrDeviceConfigMalformed},
+		{name: "invalid device", content: `{"devices": [{"id": "sprinkler_01", "type": "iot_sprinklr"}]}`, wantErr: ErrDeviceConfigInvalid},
+		{name: "valid", content: `{"devices": [{"id": "sprinkler_01", "type": "iot_sprinkler"}]}`},
+	}
+	kinds := []error{ErrDeviceConfigMissing, ErrDeviceConfigUnreadable, ErrDeviceConfigMalformed, ErrDeviceConfigInvalid}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "devices.json")
+			if !tc.missing {
+				if err := os.WriteFile(path, []byte(tc.content), 0o644); err != nil {
+					t.Fatalf("Failed to write devices.json: %v", err)
+				}
+			}
+
+			_, err := LoadDevices(path, ScheduleConfig{})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			for _, kind := range kinds {
+				if kind != tc.wantErr && errors.Is(err, kind) {
+					t.Errorf("Expected %v not to also match %v", err, kind)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid device keeps its cause", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "devices.json")
+		if err := os.WriteFile(path, []byte(`{"devices": [{"id": "sprinkler_01", "type": "iot_sprinklr"}]}`), 0o644); err != nil {
+			t.Fatalf("Failed to write devices.json: %v", err)
+		}
+		if _, err := LoadDevices(path, ScheduleConfig{}); !errors.Is(err, ErrUnknownDeviceType) {
+			t.Errorf("Expected ErrUnknownDeviceType to be wrapped, got %v", err)
+		}
+	})
+}
+
+func TestLoadConfigMissingDeviceFile(t *testing.T) {
+	testCases := []struct {
+		name       string
+		env        string
+		wantErr    error
+		wantConfig bool
+	}{
+		{name: "returned with the config", env: "DEVICE_CONFIG_PATH=missing.json\n", wantErr: ErrDeviceConfigMissing, wantConfig: true},
+		{name: "fatal when devices are required", env: "DEVICE_CONFIG_PATH=missing.json\nSCHEDULE_REQUIRE_DEVICES=true\n", wantErr: ErrNoDevices},
+		{name: "malformed file is fatal", env: "DEVICE_CONFIG_PATH=devices.json\n", wantErr: ErrDeviceConfigMalformed},
+		{name: "malformed setting", env: "MQTT_PUBLISH_TIMEOUT_SECONDS=soon\n", wantErr: ErrConfigMalformed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, ".env.local"), []byte(tc.env), 0o644); err != nil {
+				t.Fatalf("Failed to write .env.local: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "devices.json"), []byte(`{"devices": `), 0o644); err != nil {
+				t.Fatalf("Failed to write devices.json: %v", err)
+			}
+			t.Chdir(dir)
+			t.Setenv("APP_ENV", "local")
+			log.SetOutput(io.Discard)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			cfg, err := LoadConfig()
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if (cfg != nil) != tc.wantConfig {
+				t.Errorf("Expected a config %v, got %+v", tc.wantConfig, cfg)
+			}
+			if cfg != nil && len(cfg.Devices) != 0 {
+				t.Errorf("Expected no devices, got %+v", cfg.Devices)
+			}
+		})
+	}
+}
+
+func TestPlantPotTopicsIncludeValvePositionWhenConfirming(t *testing.T) {
+	hasValvePosition := func(device DeviceConfig) bool {
+		for _, topic := range plantPotTopics(device) {
+			if topic.Path == "status/valve/position" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if hasValvePosition(DeviceConfig{ID: "plant_pot_01", Type: DeviceTypePlantPot}) {
+		t.Error("Expected no valve position topic without confirmValveClosedSeconds")
+	}
+	if !hasValvePosition(DeviceConfig{ID: "plant_pot_01", Type: DeviceTypePlantPot, ConfirmValveClosedSeconds: 5}) {
+		t.Error("Expected the valve position topic with confirmValveClosedSeconds")
+	}
+}
+
+func TestPlantPotTopicsIncludeMoistureWhenRechecking(t *testing.T) {
+	hasMoisture := func(device DeviceConfig) bool {
+		for _, topic := range plantPotTopics(device) {
+			if topic.Path == "status/moisture" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if hasMoisture(DeviceConfig{ID: "plant_pot_01", Type: DeviceTypePlantPot}) {
+		t.Error("Expected no moisture topic without moistureRecheck")
+	}
+	if !hasMoisture(DeviceConfig{ID: "plant_pot_01", Type: DeviceTypePlantPot, MoistureRecheck: &MoistureRecheck{MinRise: 5}}) {
+		t.Error("Expected the moisture topic with moistureRecheck")
+	}
+}
+
+func TestLoadConfigDefaultsServerTimeouts(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".env.local"), []byte("MQTT_USERNAME=irrigation\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write .env.local: %v", err)
+	}
+	t.Chdir(dir)
+	t.Setenv("APP_ENV", "local")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("Expected config to load, got %v", err)
+	}
+	timeouts := map[string]int{
+		"read":        cfg.Server.ReadTimeoutSecs,
+		"read header": cfg.Server.ReadHeaderTimeoutSecs,
+		"write":       cfg.Server.WriteTimeoutSecs,
+		"idle":        cfg.Server.IdleTimeoutSecs,
+	}
+	for name, secs := range timeouts {
+		if secs <= 0 {
+			t.Errorf("Expected a non-zero default %s timeout, got %d", name, secs)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import "sync"
+
+// StatusTopic is a status topic a device publishes, relative to its ID, e.g. "status/valve/position".
+type StatusTopic struct {
+	Path string
+	Flag bool // carries a flag jobs wait on, such as calib_complete; subscribed with the flag QoS
+}
+
+// DeviceType describes a kind of device: the status topics its devices publish and the
+// command topics they listen on.
+type DeviceType struct {
+	Topics func(device DeviceConfig) []StatusTopic
+	// Commands lists command topics relative to the device ID, e.g. "cmd/task/set". They are
+	// cleared of retained messages on status reset when MQTT_CLEAR_RETAINED_TYPES includes the type.
+	Commands func(device DeviceConfig) []string
+}
+
+var (
+	deviceTypesMu sync.RWMutex
+	deviceTypes   = map[string]DeviceType{
+		DeviceTypeSprinkler: {Topics: sprinklerTopics, Commands: sprinklerCommands},
+		DeviceTypePlantPot:  {Topics: plantPotTopics, Commands: plantPotCommands},
+	}
+)
+
+// RegisterDeviceType makes a device type known to validation and MQTT subscriptions.
+// Registering an existing name replaces it. Jobs are registered with the scheduler.
+func RegisterDeviceType(name string, deviceType DeviceType) {
+	deviceTypesMu.Lock()
+	defer deviceTypesMu.Unlock()
+	deviceTypes[name] = deviceType
+}
+
+// LookupDeviceType returns the registered device type with the given name.
+func LookupDeviceType(name string) (DeviceType, bool) {
+	deviceTypesMu.RLock()
+	defer deviceTypesMu.RUnlock()
+	deviceType, ok := deviceTypes[name]
+	return deviceType, ok
+}
+
+func sprinklerTopics(device DeviceConfig) []StatusTopic {
+	topics := []StatusTopic{
+		{Path: "status/sprinkler/position"},
+		{Path: "status/valve/position"},
+		{Path: "status/sprinkler/calib_complete", Flag: true},
+		{Path: "status/valve/calib_complete", Flag: true},
+		{Path: "status/valve/target", Flag: true},
+		{Path: "status/task/current_index"},
+		{Path: "status/task/current_count"},
+		{Path: "status/task/all_complete", Flag: true},
+		{Path: "status/task/array"},
+	}
+	if device.RequireHealthCheck {
+		topics = append(topics, StatusTopic{Path: "status/health_check", Flag: true})
+	}
+	if device.ReportsVolume {
+		topics = append(topics, StatusTopic{Path: "status/volume"})
+	}
+	return topics
+}
+
+func plantPotTopics(device DeviceConfig) []StatusTopic {
+	topics := []StatusTopic{{Path: "status/health_check", Flag: true}}
+	if device.ConfirmValveClosedSeconds > 0 {
+		topics = append(topics, StatusTopic{Path: "status/valve/position"})
+	}
+	if device.MoistureRecheck != nil {
+		topics = append(topics, StatusTopic{Path: "status/moisture"})
+	}
+	if device.ReportsVolume {
+		topics = append(topics, StatusTopic{Path: "status/volume"})
+	}
+	return topics
+}
+
+func sprinklerCommands(device DeviceConfig) []string {
+	return []string{"cmd/sprinkler/home", "cmd/valve/home", "cmd/task/set"}
+}
+
+func plantPotCommands(device DeviceConfig) []string {
+	return []string{"cmd/trigger_solenoid_valve"}
+}
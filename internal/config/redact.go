@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// redactedValue replaces the value of sensitive settings in log output.
+const redactedValue = "***"
+
+// sensitiveKeyMarkers are substrings of setting names whose values must never be logged. Names are
+// compared lowercased with underscores removed, so "slack.bottoken" and "SLACK_BOT_TOKEN" both match.
+var sensitiveKeyMarkers = []string{"password", "token", "secret", "apikey"}
+
+// isSensitiveKey reports whether the setting named key holds a secret.
+func isSensitiveKey(key string) bool {
+	normalized := strings.ReplaceAll(strings.ToLower(key), "_", "")
+	for _, marker := range sensitiveKeyMarkers {
+		if strings.Contains(normalized, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Public returns the configuration with every secret setting removed, ready to be encoded as JSON for
+// operators. devices replaces c.Devices, which may have been reloaded since startup.
+func (c *Config) Public(devices []DeviceConfig) map[string]interface{} {
+	return c.redacted(devices, true)
+}
+
+// redacted converts the configuration to generic JSON values, then removes secret settings (omit) or
+// masks the ones that are set.
+func (c *Config) redacted(devices []DeviceConfig, omit bool) map[string]interface{} {
+	sections := map[string]interface{}{
+		"mqtt":          c.MQTT,
+		"database":      c.Database,
+		"schedule":      c.Schedule,
+		"history":       c.History,
+		"slack":         c.Slack,
+		"server":        c.Server,
+		"weather":       c.Weather,
+		"devices":       devices,
+		"devicecfgpath": c.DeviceCfgPath,
+	}
+	// The sections are plain data, so marshaling cannot fail.
+	data, _ := json.Marshal(sections)
+	var generic map[string]interface{}
+	json.Unmarshal(data, &generic)
+	redactSecrets(generic, omit)
+	return generic
+}
+
+// redactSecrets walks decoded JSON, removing or masking the values of secret keys.
+func redactSecrets(value interface{}, omit bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if !isSensitiveKey(key) {
+				redactSecrets(child, omit)
+				continue
+			}
+			if omit {
+				delete(v, key)
+			} else if child != "" && child != nil {
+				v[key] = redactedValue
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactSecrets(child, omit)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// WaterLitersTotal is the estimated volume of water dispensed per device.
+var WaterLitersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "irrigation_water_liters_total",
+	Help: "Estimated liters of water dispensed, computed from run duration and the device flow rate.",
+}, []string{"device_id"})
+
+// MQTTReconnectsTotal counts automatic reconnects to the MQTT broker after a connection loss.
+var MQTTReconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "irrigation_mqtt_reconnects_total",
+	Help: "Reconnects to the MQTT broker after the connection was lost.",
+})
+
+// MQTTConnectionLossesTotal counts lost connections to the MQTT broker.
+var MQTTConnectionLossesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "irrigation_mqtt_connection_losses_total",
+	Help: "Times the connection to the MQTT broker was lost.",
+})
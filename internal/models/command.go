@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// CommandLog records a command published to a device, for safety reviews.
+type CommandLog struct {
+	ID          uint          `gorm:"primaryKey"`
+	DeviceID    string        `gorm:"index"`
+	Topic       string        `gorm:"not null"`
+	Payload     string        `gorm:"type:text"` // as sent, after any JSON command envelope
+	PublishedAt time.Time     `gorm:"index;not null"`
+	HistoryID   *uint         `gorm:"index"` // the run that sent the command, when known
+	Source      TriggerSource `gorm:"type:varchar(20)"`
+	Error       string        // why the publish failed; empty when the broker confirmed it
+	DryRun      bool          // the command was not published because the device is in dry-run
+}
+
+func (CommandLog) TableName() string {
+	return "command_logs"
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// DeviceState holds per-device state that must survive process restarts.
+type DeviceState struct {
+	DeviceID            string `gorm:"primaryKey"`
+	LastCalibratedAt    *time.Time
+	ConsecutiveFailures int        // failed runs since the last success or re-enable
+	DisabledAt          *time.Time // set while the device is disabled; its runs are skipped
+	DisabledReason      string
+	UpdatedAt           time.Time
+}
+
+func (DeviceState) TableName() string {
+	return "device_states"
+}
+
+// ConnectionStats counts broker connection losses and reconnects since startup.
+type ConnectionStats struct {
+	Reconnects           int64      `json:"reconnects"`
+	ConnectionLosses     int64      `json:"connectionLosses"`
+	LastReconnectAt      *time.Time `json:"lastReconnectAt,omitempty"`
+	LastConnectionLostAt *time.Time `json:"lastConnectionLostAt,omitempty"`
+	LastMessageAt        *time.Time `json:"lastMessageAt,omitempty"` // last message received on any topic
+	WatchdogReconnects   int64      `json:"watchdogReconnects"`      // reconnects forced because messages stopped
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
@@ -10,37 +13,240 @@ type IrrigationStatus string
 
 const (
 	StatusScheduled IrrigationStatus = "scheduled"
-	StatusStarted  IrrigationStatus = "started"
+	StatusStarted   IrrigationStatus = "started"
 	StatusCompleted IrrigationStatus = "completed"
-	StatusFailed   IrrigationStatus = "failed"
+	StatusFailed    IrrigationStatus = "failed"
+	StatusSkipped   IrrigationStatus = "skipped"
+	// StatusCalibrated marks an on-demand calibration that homed the device without watering.
+	StatusCalibrated IrrigationStatus = "calibrated"
+	// StatusInterrupted marks a run that was still started when the controller restarted.
+	StatusInterrupted IrrigationStatus = "interrupted"
+	// StatusPartial marks a sprinkler run that went on past a failed task and had some tasks succeed.
+	StatusPartial IrrigationStatus = "partial"
+)
+
+// JobPhase is the stage a sprinkler run is in. It is saved on the run's history as the run
+// progresses, so a run interrupted by a restart can be told apart and resumed.
+type JobPhase string
+
+const (
+	PhaseCalibration JobPhase = "calibration"
+	PhaseWarmup      JobPhase = "warmup"
+	PhaseTasks       JobPhase = "tasks"
+	PhaseValveCheck  JobPhase = "valve_check"
+)
+
+// TriggerSource records what started an irrigation run.
+type TriggerSource string
+
+const (
+	SourceScheduled TriggerSource = "scheduled"
+	SourceManual    TriggerSource = "manual"
+	SourceSlack     TriggerSource = "slack"
 )
 
 type IrrigationHistory struct {
 	gorm.Model
-	ScheduledAt time.Time       `gorm:"not null"`
+	DeviceID    string    `gorm:"index"`
+	ScheduledAt time.Time `gorm:"not null"`
 	StartedAt   *time.Time
 	EndedAt     *time.Time
 	Status      IrrigationStatus `gorm:"type:varchar(20);not null"`
-	Duration    int             `gorm:"not null"` // in minutes
+	Duration    int              `gorm:"not null"` // in minutes
+	WaterLiters float64          // estimated from the run duration and the device flow rate
 	Notes       string
+	Source      TriggerSource `gorm:"type:varchar(20)"`
+	TriggeredBy string        // who requested a manual run, if known
+	Reason      string        // why a manual run was requested, if given
+	TaskResults TaskResults   `gorm:"type:text"` // per-task outcomes of a sprinkler run, stored as JSON
+	Labels      Labels        `gorm:"type:text"` // the device's labels when the run was recorded, stored as JSON
+
+	// The progress of a sprinkler run: its phase and, in the tasks phase, the task in progress.
+	Phase         JobPhase `gorm:"type:varchar(20)"`
+	TaskIndex     int      // position of CurrentTaskID among the run's tasks, from 0
+	CurrentTaskID string
+
+	// How many of a sprinkler run's tasks succeeded and failed.
+	TasksSucceeded int
+	TasksFailed    int
 }
 
 func (IrrigationHistory) TableName() string {
 	return "irrigation_history"
 }
 
+// TaskOutcome records how a single task of a run ended.
+type TaskOutcome string
+
+const (
+	TaskSucceeded   TaskOutcome = "success"
+	TaskTimedOut    TaskOutcome = "timeout"
+	TaskFailed      TaskOutcome = "error"       // the task could not be loaded or sent
+	TaskInterrupted TaskOutcome = "interrupted" // the broker connection was lost while waiting
+
+	TaskNotAcknowledged TaskOutcome = "not_acknowledged" // the device never reported receiving the task
+)
+
+// TaskResult is the outcome of one task of a sprinkler run.
+type TaskResult struct {
+	TaskID         string      `json:"taskId"`
+	StartedAt      time.Time   `json:"startedAt"`
+	EndedAt        time.Time   `json:"endedAt"`
+	Outcome        TaskOutcome `json:"outcome"`
+	TimeoutMinutes int         `json:"timeoutMinutes,omitempty"` // effective timeout after defaulting and clamping
+}
+
+// JobStatus is a job lifecycle stage published to MQTT_JOB_STATUS_TOPIC.
+type JobStatus string
+
+const (
+	JobStarted   JobStatus = "started"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+)
+
+// JobStatusEvent is the retained JSON message published when a device job starts or ends.
+type JobStatusEvent struct {
+	DeviceID  string        `json:"deviceId"`
+	Status    JobStatus     `json:"status"`
+	Trigger   TriggerSource `json:"trigger"`
+	Error     string        `json:"error,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// PresenceDocument is the retained JSON message listing the devices the controller manages, so
+// a monitor knows which devices are expected online.
+type PresenceDocument struct {
+	ControllerID string           `json:"controllerId"`
+	Devices      []PresenceDevice `json:"devices"`
+	UpdatedAt    time.Time        `json:"updatedAt"`
+}
+
+// PresenceDevice is a managed device in a PresenceDocument.
+type PresenceDevice struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// TaskResults is stored in a single column as a JSON array.
+type TaskResults []TaskResult
+
+// Value implements driver.Valuer.
+func (r TaskResults) Value() (driver.Value, error) {
+	if r == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner.
+func (r *TaskResults) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, r)
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	default:
+		return fmt.Errorf("cannot scan %T into TaskResults", value)
+	}
+}
+
+// Labels are a device's arbitrary key/value tags, e.g. zone or crop. They are stored in a single
+// column as a JSON object.
+type Labels map[string]string
+
+// Value implements driver.Valuer.
+func (l Labels) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner.
+func (l *Labels) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, l)
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	default:
+		return fmt.Errorf("cannot scan %T into Labels", value)
+	}
+}
+
 // DeviceStatus holds the most recent status from a device.
 // This data is updated via MQTT messages.
 type DeviceStatus struct {
-	DeviceID                  string  `json:"deviceId"`
-	HealthCheck               bool    `json:"healthCheck"`
-	SprinklerPosition         float64 `json:"sprinklerPosition"`
-	ValvePosition             float64 `json:"valvePosition"`
-	SprinklerCalibComplete    bool    `json:"sprinklerCalibComplete"`
-	ValveCalibComplete        bool    `json:"valveCalibComplete"`
-		ValveIsAtTarget           bool    `json:"valveIsAtTarget"`
-	TaskCurrentIndex          int     `json:"taskCurrentIndex"`
-	TaskCurrentCount          int     `json:"taskCurrentCount"`
-	TaskAllComplete           bool    `json:"taskAllComplete"`
-	TaskArray                 string  `json:"taskArray"` // Storing as raw JSON string
+	DeviceID               string     `json:"deviceId"`
+	HealthCheck            bool       `json:"healthCheck"`
+	SprinklerPosition      float64    `json:"sprinklerPosition"`
+	ValvePosition          float64    `json:"valvePosition"`
+	SprinklerCalibComplete bool       `json:"sprinklerCalibComplete"`
+	ValveCalibComplete     bool       `json:"valveCalibComplete"`
+	ValveIsAtTarget        bool       `json:"valveIsAtTarget"`
+	TaskCurrentIndex       int        `json:"taskCurrentIndex"`
+	TaskCurrentCount       int        `json:"taskCurrentCount"`
+	TaskAllComplete        bool       `json:"taskAllComplete"`
+	TaskArray              string     `json:"taskArray"` // Storing as raw JSON string
+	TaskSteps              []TaskStep `json:"taskSteps"` // TaskArray parsed; nil if the payload was malformed
+
+	// Counters of what the device reported since its status was last reset, so a stale flag can
+	// be told apart from a fresh one.
+	TaskAllCompleteReports int  `json:"-"` // all_complete messages received
+	TaskIndexReported      bool `json:"-"` // a current_index message was received
+	HealthCheckReports     int  `json:"-"` // health_check messages received; kept across resets like HealthCheck
+	MoistureReports        int  `json:"-"` // moisture messages received
+
+	// When each calibration flag was last received as true; zero if not since the last reset.
+	SprinklerCalibAt time.Time `json:"-"`
+	ValveCalibAt     time.Time `json:"-"`
+
+	// ValvePositionAt is when ValvePosition was last received; zero if not since the last reset.
+	ValvePositionAt time.Time `json:"-"`
+
+	// Moisture is the soil moisture last reported by plant pots with a moisture re-check.
+	Moisture float64 `json:"moisture,omitempty"`
+
+	// VolumeLiters is the water meter total last reported by volume-mode devices. It and
+	// VolumeReports, the number of readings received, are kept across resets like HealthCheck.
+	VolumeLiters  float64 `json:"volumeLiters,omitempty"`
+	VolumeReports int     `json:"-"`
+
+	// LastMessageAt is when the device last reported anything; kept across resets.
+	LastMessageAt *time.Time `json:"lastMessageAt,omitempty"`
+	// Online is computed when the status is read: the device reported within MQTT_OFFLINE_AFTER_SECONDS,
+	// or at all when that is 0.
+	Online bool `json:"online"`
+}
+
+// CommandEnvelope wraps a command payload for devices configured with the JSON command format.
+type CommandEnvelope struct {
+	Cmd     string          `json:"cmd"`               // last segment of the command topic, e.g. "home" or "set"
+	TS      int64           `json:"ts"`                // Unix time in seconds when the command was sent
+	Payload json.RawMessage `json:"payload,omitempty"` // the raw payload; JSON payloads are embedded as-is
+}
+
+// TaskStep is a single step of a sprinkler task, as published in task payloads and reported on status/task/array.
+type TaskStep struct {
+	From           float64 `json:"fr"`   // sprinkler start position
+	To             float64 `json:"to"`   // sprinkler end position
+	Speed          float64 `json:"sp"`   // sprinkler speed
+	ValvePosition  float64 `json:"wv"`   // water valve position
+	ValveEndAction string  `json:"wvea"` // valve action once the step ends, e.g. "STOP"
+	Count          int     `json:"ct"`   // number of sweeps
 }
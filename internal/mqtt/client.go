@@ -1,37 +1,97 @@
 package mqtt
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	mathrand "math/rand/v2"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/metrics"
 	"github.com/prite36/auto-irrigation-system/internal/models"
 )
 
+// ErrPublishTimeout is returned when the broker does not confirm a publish within the configured timeout.
+var ErrPublishTimeout = errors.New("publish not confirmed in time")
+
+// subscribeQoS holds the QoS requested for each category of status topic.
+type subscribeQoS struct {
+	status byte // frequent readings: positions, task index/count, task array
+	flag   byte // flags that jobs wait on: calibration, valve target, task completion, health check
+}
+
+// newSubscribeQoS validates the configured QoS levels.
+func newSubscribeQoS(cfg config.MQTTConfig) (subscribeQoS, error) {
+	for name, qos := range map[string]int{"status": cfg.StatusQoS, "flag": cfg.FlagQoS} {
+		if qos < 0 || qos > 2 {
+			return subscribeQoS{}, fmt.Errorf("invalid %s QoS %d: must be 0, 1 or 2", name, qos)
+		}
+	}
+	return subscribeQoS{status: byte(cfg.StatusQoS), flag: byte(cfg.FlagQoS)}, nil
+}
+
 // Client manages the MQTT connection and subscriptions.
 type Client struct {
 	client            mqtt.Client
-	deviceStatuses    sync.Map // Maps deviceID (string) to *models.DeviceStatus
+	publishTimeout    time.Duration
+	qos               subscribeQoS
+	deviceStatuses    sync.Map // Maps deviceID (string) to *models.DeviceStatus; stored values are never mutated
 	subscribedDevices sync.Map // To track which devices we are subscribed to (key: deviceID, value: config.DeviceConfig)
+	subscriptionsDone sync.Map // Devices whose topics are all subscribed on the current connection (key: deviceID)
+	statusReceived    sync.Map // Devices that have reported at least one status (key: deviceID)
+	publishes         publishQueue
+	clearRetained     map[string]bool // device types whose retained commands are cleared on status reset
+
+	cfg           config.MQTTConfig                     // shared connection settings device sessions start from
+	sessionsMu    sync.Mutex                            // Guards sessions
+	sessions      map[string]mqtt.Client                // Connections of devices with their own credentials (key: deviceID)
+	newPahoClient func(*mqtt.ClientOptions) mqtt.Client // creates device sessions; mqtt.NewClient when nil
+
+	statusMu         sync.Mutex // Serializes read-modify-write updates of deviceStatuses
+	handlersMu       sync.RWMutex
+	onConnectionLost func(err error)
+	onReconnect      func()
+	onStall          func(silence time.Duration)
+	connectedOnce    atomic.Bool
+
+	lastMessageAt atomic.Int64 // Unix nanoseconds of the last message received on any topic; 0 if none yet
+
+	now              func() time.Time // clock for device presence; time.Now when nil
+	onPresenceChange func(deviceID string, online bool, lastSeen time.Time)
+
+	backgroundOnce sync.Once
+	backgroundStop chan struct{}  // closed by Close to stop the watchdog and presence monitor
+	background     sync.WaitGroup // running background loops
+
+	statsMu sync.Mutex
+	stats   models.ConnectionStats
 }
 
 // NewClient creates and configures a new MQTT client.
-func NewClient(broker, clientID, username, password string) (*Client, error) {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(clientID)
-	opts.SetUsername(username)
-	opts.SetPassword(password)
-	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-	opts.SetConnectTimeout(30 * time.Second)
+func NewClient(cfg config.MQTTConfig) (*Client, error) {
+	qos, err := newSubscribeQoS(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	c := &Client{}
+	opts := newClientOptions(cfg)
+	log.Printf("Connecting to MQTT broker with client ID: %s", opts.ClientID)
+
+	c := &Client{publishTimeout: time.Duration(cfg.PublishTimeoutSecs) * time.Second, qos: qos, clearRetained: make(map[string]bool), cfg: cfg}
+	for _, deviceType := range splitList(cfg.ClearRetainedTypes) {
+		c.clearRetained[deviceType] = true
+	}
 	opts.SetDefaultPublishHandler(c.messageHandler)
 	opts.SetOnConnectHandler(c.onConnectHandler)
 	opts.SetConnectionLostHandler(c.connectionLostHandler)
@@ -45,26 +105,359 @@ func NewClient(broker, clientID, username, password string) (*Client, error) {
 	return c, nil
 }
 
+// newClientOptions builds the paho options for the given configuration.
+func newClientOptions(cfg config.MQTTConfig) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	for _, broker := range brokerURLs(cfg) {
+		opts.AddBroker(broker)
+	}
+	opts.SetClientID(effectiveClientID(cfg))
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectTimeout(30 * time.Second)
+	if cfg.MaxReconnectIntervalSecs > 0 {
+		opts.SetMaxReconnectInterval(time.Duration(cfg.MaxReconnectIntervalSecs) * time.Second)
+	}
+	if cfg.ReconnectJitterMs > 0 {
+		// Spread reconnect attempts so controllers that lost the same broker don't retry in lockstep.
+		jitter := time.Duration(cfg.ReconnectJitterMs) * time.Millisecond
+		opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+			time.Sleep(mathrand.N(jitter))
+		})
+	}
+	return opts
+}
+
+// brokerURLs returns the brokers to connect to, in failover order. Brokers takes precedence over the
+// single Broker; entries may themselves be comma-separated, as when read from MQTT_BROKERS.
+func brokerURLs(cfg config.MQTTConfig) []string {
+	brokers := splitList(cfg.Brokers)
+	if len(brokers) == 0 {
+		return []string{cfg.Broker}
+	}
+	return brokers
+}
+
+// splitList flattens list entries that may themselves be comma-separated, as when read from
+// an environment variable, dropping blanks.
+func splitList(entries []string) []string {
+	var items []string
+	for _, entry := range entries {
+		for _, item := range strings.Split(entry, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// effectiveClientID returns the client ID to connect with. Brokers disconnect clients that share
+// an ID, so unless ExactClientID is set a suffix is appended: the configured one, or the
+// hostname plus a short random string so concurrent instances never clash.
+func effectiveClientID(cfg config.MQTTConfig) string {
+	if cfg.ExactClientID {
+		return cfg.ClientID
+	}
+
+	suffix := cfg.ClientIDSuffix
+	if suffix == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		random := make([]byte, 3)
+		rand.Read(random)
+		suffix = fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(random))
+	}
+	return fmt.Sprintf("%s-%s", cfg.ClientID, suffix)
+}
+
 // onConnectHandler is called when the client connects or reconnects.
 func (c *Client) onConnectHandler(client mqtt.Client) {
 	log.Println("Connected to MQTT broker.")
+	isReconnect := c.connectedOnce.Swap(true)
+	if isReconnect {
+		now := time.Now()
+		c.statsMu.Lock()
+		c.stats.Reconnects++
+		c.stats.LastReconnectAt = &now
+		c.statsMu.Unlock()
+		metrics.MQTTReconnectsTotal.Inc()
+	}
 	// Re-subscribe to topics for all previously subscribed devices
+	var devices []config.DeviceConfig
 	c.subscribedDevices.Range(func(key, value interface{}) bool {
-		device := value.(config.DeviceConfig)
-		log.Printf("Re-subscribing to topics for device: %s", device.ID)
-		c.SubscribeToDeviceTopics(device)
+		devices = append(devices, value.(config.DeviceConfig))
 		return true
 	})
+	log.Printf("Re-subscribing to topics for %d devices", len(devices))
+	c.SubscribeToDevices(devices)
+	// On the first connect no devices are subscribed yet; the caller publishes presence once they are.
+	if len(devices) > 0 {
+		if err := c.PublishPresence(); err != nil {
+			log.Printf("Error: Failed to publish presence: %v", err)
+		}
+	}
+
+	if isReconnect {
+		c.handlersMu.RLock()
+		onReconnect := c.onReconnect
+		c.handlersMu.RUnlock()
+		if onReconnect != nil {
+			onReconnect()
+		}
+	}
 }
 
 // connectionLostHandler is called when the connection is lost.
 func (c *Client) connectionLostHandler(client mqtt.Client, err error) {
 	log.Printf("Connection to MQTT broker lost: %v", err)
+	now := time.Now()
+	c.statsMu.Lock()
+	c.stats.ConnectionLosses++
+	c.stats.LastConnectionLostAt = &now
+	c.statsMu.Unlock()
+	metrics.MQTTConnectionLossesTotal.Inc()
+
+	// Subscriptions are re-made by onConnectHandler, so devices are not ready until then.
+	c.subscriptionsDone.Clear()
+
+	c.handlersMu.RLock()
+	onConnectionLost := c.onConnectionLost
+	c.handlersMu.RUnlock()
+	if onConnectionLost != nil {
+		onConnectionLost(err)
+	}
+}
+
+// SetConnectionHandlers registers callbacks invoked when the broker connection is lost
+// and when it is re-established after a loss. Either callback may be nil.
+func (c *Client) SetConnectionHandlers(onConnectionLost func(err error), onReconnect func()) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.onConnectionLost = onConnectionLost
+	c.onReconnect = onReconnect
+}
+
+// SetStallHandler registers a callback invoked when the watchdog forces a reconnect because no
+// messages arrived for the given silence while jobs were running. It may be nil.
+func (c *Client) SetStallHandler(onStall func(silence time.Duration)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.onStall = onStall
+}
+
+// ConnectionStats returns how often the broker connection was lost and re-established since startup.
+func (c *Client) ConnectionStats() models.ConnectionStats {
+	c.statsMu.Lock()
+	stats := c.stats
+	c.statsMu.Unlock()
+	if last := c.LastMessageAt(); !last.IsZero() {
+		stats.LastMessageAt = &last
+	}
+	return stats
+}
+
+// LastMessageAt returns when a message was last received on any subscribed topic, or the zero
+// time if none has been received yet.
+func (c *Client) LastMessageAt() time.Time {
+	if nanos := c.lastMessageAt.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// StartWatchdog forces a reconnect when the connection looks open but no message has arrived
+// within window while active reports that jobs expect device activity. This catches half-open
+// connections that paho still reports as connected. Silence is only counted from the last time
+// active returned false, so an idle controller never trips it. It runs until Close.
+func (c *Client) StartWatchdog(window time.Duration, active func() bool) {
+	if window <= 0 {
+		return
+	}
+	c.goBackground(func(stop <-chan struct{}) { c.runWatchdog(window, active, stop) })
+}
+
+// goBackground runs loop in a goroutine until Close, which waits for it to return.
+func (c *Client) goBackground(loop func(stop <-chan struct{})) {
+	c.backgroundOnce.Do(func() { c.backgroundStop = make(chan struct{}) })
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		loop(c.backgroundStop)
+	}()
+}
+
+// runWatchdog checks for silence a few times per window until stop is closed.
+func (c *Client) runWatchdog(window time.Duration, active func() bool, stop <-chan struct{}) {
+	ticker := time.NewTicker(window / 4)
+	defer ticker.Stop()
+	quietSince := time.Now() // start of the current stretch in which jobs were running and connected
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if !c.IsConnected() || !active() {
+				quietSince = now
+				continue
+			}
+			since := quietSince
+			if last := c.LastMessageAt(); last.After(since) {
+				since = last
+			}
+			if silence := now.Sub(since); silence >= window {
+				c.forceReconnect(silence)
+				quietSince = time.Now()
+			}
+		}
+	}
+}
+
+// forceReconnect drops and re-opens the shared broker connection after the watchdog saw silence.
+// Subscriptions are re-made by onConnectHandler once connected.
+func (c *Client) forceReconnect(silence time.Duration) {
+	log.Printf("No MQTT messages received for %v while jobs are running, although the connection looks open. Forcing a reconnect.", silence.Round(time.Millisecond))
+	c.statsMu.Lock()
+	c.stats.WatchdogReconnects++
+	c.statsMu.Unlock()
+
+	c.handlersMu.RLock()
+	onStall := c.onStall
+	c.handlersMu.RUnlock()
+	if onStall != nil {
+		onStall(silence)
+	}
+
+	c.subscriptionsDone.Clear()
+	c.client.Disconnect(250)
+	if token := c.client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("Forced reconnect to the MQTT broker failed: %v", token.Error())
+	}
+}
+
+// deviceSessionOptions builds the paho options for a device's own session: the shared settings with
+// the device's overrides applied and a client ID of its own.
+func deviceSessionOptions(cfg config.MQTTConfig, device config.DeviceConfig) *mqtt.ClientOptions {
+	override := device.MQTT
+	if override.Broker != "" {
+		cfg.Broker = override.Broker
+		cfg.Brokers = nil
+	}
+	if override.Username != "" {
+		cfg.Username = override.Username
+		cfg.Password = override.Password
+	}
+	cfg.ClientID = fmt.Sprintf("%s-%s", cfg.ClientID, device.ID)
+	return newClientOptions(cfg)
+}
+
+// session returns the connection a device's topics are subscribed and published on, and whether it
+// is open. Devices with MQTT overrides get their own session, created and connected on first use;
+// a session that cannot connect in time keeps retrying and subscribes once it is up.
+func (c *Client) session(device config.DeviceConfig) (mqtt.Client, bool) {
+	if device.MQTT == nil {
+		return c.client, true
+	}
+
+	c.sessionsMu.Lock()
+	session, ok := c.sessions[device.ID]
+	var opts *mqtt.ClientOptions
+	var token mqtt.Token
+	if !ok {
+		opts = deviceSessionOptions(c.cfg, device)
+		opts.SetDefaultPublishHandler(c.messageHandler)
+		opts.SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("Device %s session connected to MQTT broker.", device.ID)
+			if value, tracked := c.subscribedDevices.Load(device.ID); tracked {
+				if err := c.SubscribeToDeviceTopics(value.(config.DeviceConfig)); err != nil {
+					log.Printf("Error: Failed to re-subscribe device %s: %v", device.ID, err)
+				}
+			}
+		})
+		opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Device %s session lost its MQTT connection: %v", device.ID, err)
+			c.subscriptionsDone.Delete(device.ID)
+		})
+
+		newPahoClient := c.newPahoClient
+		if newPahoClient == nil {
+			newPahoClient = mqtt.NewClient
+		}
+		session = newPahoClient(opts)
+		if c.sessions == nil {
+			c.sessions = make(map[string]mqtt.Client)
+		}
+		c.sessions[device.ID] = session
+		log.Printf("Connecting device %s to MQTT broker with its own session, client ID: %s", device.ID, opts.ClientID)
+		token = session.Connect()
+	}
+	c.sessionsMu.Unlock()
+
+	if token != nil {
+		if !token.WaitTimeout(opts.ConnectTimeout) {
+			log.Printf("Warning: Device %s session not connected after %v; it will subscribe once connected", device.ID, opts.ConnectTimeout)
+		} else if err := token.Error(); err != nil {
+			log.Printf("Warning: Device %s session failed to connect: %v", device.ID, err)
+		}
+	}
+	return session, session.IsConnectionOpen()
+}
+
+// deviceClient returns the connection commands to deviceID are published on.
+func (c *Client) deviceClient(deviceID string) mqtt.Client {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	if session, ok := c.sessions[deviceID]; ok {
+		return session
+	}
+	return c.client
+}
+
+// closeSession disconnects and forgets a device's own session, if it has one.
+func (c *Client) closeSession(deviceID string) {
+	c.sessionsMu.Lock()
+	session, ok := c.sessions[deviceID]
+	delete(c.sessions, deviceID)
+	c.sessionsMu.Unlock()
+	if ok {
+		session.Disconnect(250)
+		log.Printf("Device %s session disconnected.", deviceID)
+	}
+}
+
+// IsConnected reports whether the client currently has an open connection to the broker.
+// paho's IsConnected also returns true while auto-reconnecting, so IsConnectionOpen is used instead.
+func (c *Client) IsConnected() bool {
+	return c.client != nil && c.client.IsConnectionOpen()
+}
+
+// IsDeviceConnected reports whether the connection deviceID's commands are published on is open:
+// the device's own session if it has one, otherwise the shared connection.
+func (c *Client) IsDeviceConnected(deviceID string) bool {
+	session := c.deviceClient(deviceID)
+	return session != nil && session.IsConnectionOpen()
+}
+
+// parseBool parses a boolean status payload. Firmware differs in how it reports flags, so
+// 1/0, true/false, t/f, on/off and yes/no are accepted in any case, ignoring surrounding whitespace.
+func parseBool(payload string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(payload)) {
+	case "1", "true", "t", "on", "yes":
+		return true, nil
+	case "0", "false", "f", "off", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean payload %q", payload)
 }
 
 // messageHandler processes incoming MQTT messages.
 func (c *Client) messageHandler(client mqtt.Client, msg mqtt.Message) {
 	log.Printf("Received message on topic: %s with payload: %s", msg.Topic(), msg.Payload())
+	c.lastMessageAt.Store(time.Now().UnixNano())
 
 	parts := strings.Split(msg.Topic(), "/")
 	if len(parts) < 3 {
@@ -74,107 +467,500 @@ func (c *Client) messageHandler(client mqtt.Client, msg mqtt.Message) {
 	deviceID := parts[0]
 	payloadStr := string(msg.Payload())
 
-	// Get or create the status object for the device. IMPORTANT: Store POINTERS in the map.
-	value, _ := c.deviceStatuses.LoadOrStore(deviceID, &models.DeviceStatus{DeviceID: deviceID})
-	status := value.(*models.DeviceStatus)
-
+	// Parse the payload before touching the device status, so a malformed payload neither
+	// creates an empty status nor overwrites the last good value with a zero value
+	// (e.g. a garbled health_check must not read as "unhealthy").
+	var update func(status *models.DeviceStatus)
 	var err error
 	switch {
 	case strings.HasSuffix(msg.Topic(), "/status/health_check"):
-		status.HealthCheck, err = strconv.ParseBool(payloadStr)
+		var healthy bool
+		healthy, err = parseBool(payloadStr)
+		update = func(status *models.DeviceStatus) {
+			status.HealthCheck = healthy
+			status.HealthCheckReports++
+		}
 	case strings.HasSuffix(msg.Topic(), "/status/sprinkler/position"):
-		status.SprinklerPosition, err = strconv.ParseFloat(payloadStr, 64)
+		var position float64
+		position, err = strconv.ParseFloat(payloadStr, 64)
+		update = func(status *models.DeviceStatus) { status.SprinklerPosition = position }
 	case strings.HasSuffix(msg.Topic(), "/status/valve/position"):
-		status.ValvePosition, err = strconv.ParseFloat(payloadStr, 64)
+		var position float64
+		position, err = strconv.ParseFloat(payloadStr, 64)
+		update = func(status *models.DeviceStatus) {
+			status.ValvePosition = position
+			status.ValvePositionAt = time.Now()
+		}
+	case strings.HasSuffix(msg.Topic(), "/status/moisture"):
+		var moisture float64
+		moisture, err = strconv.ParseFloat(payloadStr, 64)
+		update = func(status *models.DeviceStatus) {
+			status.Moisture = moisture
+			status.MoistureReports++
+		}
+	case strings.HasSuffix(msg.Topic(), "/status/volume"):
+		var liters float64
+		liters, err = strconv.ParseFloat(payloadStr, 64)
+		update = func(status *models.DeviceStatus) {
+			status.VolumeLiters = liters
+			status.VolumeReports++
+		}
 	case strings.HasSuffix(msg.Topic(), "/status/sprinkler/calib_complete"):
-		status.SprinklerCalibComplete, err = strconv.ParseBool(payloadStr)
+		var complete bool
+		complete, err = parseBool(payloadStr)
+		update = func(status *models.DeviceStatus) {
+			status.SprinklerCalibComplete = complete
+			if complete {
+				status.SprinklerCalibAt = time.Now()
+			}
+		}
 	case strings.HasSuffix(msg.Topic(), "/status/valve/calib_complete"):
-		status.ValveCalibComplete, err = strconv.ParseBool(payloadStr)
+		var complete bool
+		complete, err = parseBool(payloadStr)
+		update = func(status *models.DeviceStatus) {
+			status.ValveCalibComplete = complete
+			if complete {
+				status.ValveCalibAt = time.Now()
+			}
+		}
 	case strings.HasSuffix(msg.Topic(), "/status/valve/target"):
-		status.ValveIsAtTarget, err = strconv.ParseBool(payloadStr)
+		var atTarget bool
+		atTarget, err = parseBool(payloadStr)
+		update = func(status *models.DeviceStatus) { status.ValveIsAtTarget = atTarget }
 	case strings.HasSuffix(msg.Topic(), "/status/task/current_index"):
-		status.TaskCurrentIndex, err = strconv.Atoi(payloadStr)
+		var index int
+		index, err = strconv.Atoi(payloadStr)
+		update = func(status *models.DeviceStatus) {
+			status.TaskCurrentIndex = index
+			status.TaskIndexReported = true
+		}
 	case strings.HasSuffix(msg.Topic(), "/status/task/current_count"):
-		status.TaskCurrentCount, err = strconv.Atoi(payloadStr)
+		var count int
+		count, err = strconv.Atoi(payloadStr)
+		update = func(status *models.DeviceStatus) { status.TaskCurrentCount = count }
 	case strings.HasSuffix(msg.Topic(), "/status/task/all_complete"):
-		status.TaskAllComplete, err = strconv.ParseBool(payloadStr)
+		var complete bool
+		complete, err = parseBool(payloadStr)
+		update = func(status *models.DeviceStatus) {
+			status.TaskAllComplete = complete
+			status.TaskAllCompleteReports++
+		}
 	case strings.HasSuffix(msg.Topic(), "/status/task/array"):
-		status.TaskArray = payloadStr
+		var steps []models.TaskStep
+		if jsonErr := json.Unmarshal(msg.Payload(), &steps); jsonErr != nil {
+			log.Printf("Warning: Could not parse task array for device %s, keeping raw payload: %v", deviceID, jsonErr)
+			steps = nil
+		}
+		update = func(status *models.DeviceStatus) {
+			status.TaskArray = payloadStr
+			status.TaskSteps = steps
+		}
 	default:
 		log.Printf("Warning: No handler for topic: %s", msg.Topic())
 		return // No need to store status again if topic is unknown
 	}
 
 	if err != nil {
-		log.Printf("Error parsing payload for topic %s: %v", msg.Topic(), err)
+		log.Printf("Error parsing payload for topic %s, keeping previous value: %v", msg.Topic(), err)
 		return
 	}
 
-	// No need to store back, as we are modifying the pointer.
+	// Apply the update to a copy and swap it in, so statuses already handed out are never written to.
+	c.statusMu.Lock()
+	status := models.DeviceStatus{DeviceID: deviceID}
+	if value, ok := c.deviceStatuses.Load(deviceID); ok {
+		status = *value.(*models.DeviceStatus)
+	}
+	update(&status)
+	received := c.clock()
+	status.LastMessageAt = &received
+	c.deviceStatuses.Store(deviceID, &status)
+	c.statusMu.Unlock()
+	c.statusReceived.Store(deviceID, struct{}{})
 }
 
-// Publish sends a message to a given topic.
-func (c *Client) Publish(topic, payload string) {
-	if token := c.client.Publish(topic, 1, false, payload); token.Wait() && token.Error() != nil {
-		log.Printf("Failed to publish to topic %s: %v", topic, token.Error())
+// Publish sends a message to a given topic and waits up to the publish timeout for the broker to confirm it.
+// It is queued behind earlier commands for the same device, so a device always receives them in order.
+func (c *Client) Publish(topic, payload string) error {
+	return <-c.Enqueue(topic, payload)
+}
+
+// PublishRetained is like Publish but asks the broker to retain the message, so subscribers that
+// connect later receive the latest one.
+func (c *Client) PublishRetained(topic, payload string) error {
+	return <-c.publishes.enqueue(topic, payload, true, c.publish)
+}
+
+// PublishPresence publishes the subscribed devices, sorted by ID, as a retained presence document
+// to MQTT_PRESENCE_TOPIC. It does nothing when no presence topic is configured.
+func (c *Client) PublishPresence() error {
+	if c.cfg.PresenceTopic == "" {
+		return nil
 	}
+	doc := models.PresenceDocument{ControllerID: c.cfg.ClientID, Devices: []models.PresenceDevice{}, UpdatedAt: c.clock().UTC()}
+	c.subscribedDevices.Range(func(key, value interface{}) bool {
+		device := value.(config.DeviceConfig)
+		doc.Devices = append(doc.Devices, models.PresenceDevice{ID: device.ID, Type: device.Type})
+		return true
+	})
+	sort.Slice(doc.Devices, func(i, j int) bool { return doc.Devices[i].ID < doc.Devices[j].ID })
+
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to encode presence: %w", err)
+	}
+	return c.PublishRetained(c.cfg.PresenceTopic, string(payload))
+}
+
+// Enqueue queues a message for the device the topic is addressed to without waiting for it. Messages for
+// one device are published in the order they are enqueued; the returned channel receives the result.
+func (c *Client) Enqueue(topic, payload string) <-chan error {
+	return c.publishes.enqueue(topic, payload, false, c.publish)
+}
+
+// publish sends a message and waits up to the publish timeout for the broker to confirm it.
+func (c *Client) publish(topic, payload string, retained bool) error {
+	token := c.deviceClient(topicDeviceID(topic)).Publish(topic, 1, retained, payload)
+	if c.publishTimeout > 0 {
+		if !token.WaitTimeout(c.publishTimeout) {
+			log.Printf("Publish to topic %s was not confirmed within %v", topic, c.publishTimeout)
+			return fmt.Errorf("%w: topic %s after %v", ErrPublishTimeout, topic, c.publishTimeout)
+		}
+	} else {
+		token.Wait()
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("Failed to publish to topic %s: %v", topic, err)
+		return fmt.Errorf("failed to publish to topic %s: %w", topic, err)
+	}
+	return nil
 }
 
-// Close disconnects the MQTT client.
+// Close disconnects the MQTT client and any device sessions.
 func (c *Client) Close() {
+	c.sessionsMu.Lock()
+	deviceIDs := make([]string, 0, len(c.sessions))
+	for deviceID := range c.sessions {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	c.sessionsMu.Unlock()
+	for _, deviceID := range deviceIDs {
+		c.closeSession(deviceID)
+	}
+	if c.backgroundStop != nil {
+		close(c.backgroundStop)
+		c.background.Wait()
+	}
+	if c.cfg.PresenceTopic != "" && c.client.IsConnectionOpen() {
+		// An empty retained message removes the presence document, so monitors see a clean shutdown.
+		if err := c.PublishRetained(c.cfg.PresenceTopic, ""); err != nil {
+			log.Printf("Error: Failed to clear presence: %v", err)
+		}
+	}
 	c.client.Disconnect(250)
 	log.Println("MQTT client disconnected.")
 }
 
+// deviceTopics returns the status topics to subscribe to for a given device, mapped to their QoS.
+func deviceTopics(device config.DeviceConfig, qos subscribeQoS) (map[string]byte, error) {
+	deviceType, ok := config.LookupDeviceType(device.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w '%s' for device '%s': no topics subscribed", config.ErrUnknownDeviceType, device.Type, device.ID)
+	}
+
+	topics := make(map[string]byte)
+	for _, topic := range deviceType.Topics(device) {
+		level := qos.status
+		if topic.Flag {
+			level = qos.flag
+		}
+		topics[fmt.Sprintf("%s/%s", device.ID, topic.Path)] = level
+	}
+	return topics, nil
+}
+
 // SubscribeToDeviceTopics subscribes to all relevant status topics for a given device.
-func (c *Client) SubscribeToDeviceTopics(device config.DeviceConfig) {
+// It returns an error if the device type is unknown.
+func (c *Client) SubscribeToDeviceTopics(device config.DeviceConfig) error {
+	topics, err := deviceTopics(device, c.qos)
+	if err != nil {
+		return err
+	}
+
+	session, connected := c.session(device)
+
 	// Mark this device as one we want to be subscribed to, for reconnections.
 	c.subscribedDevices.Store(device.ID, device)
+	c.subscriptionsDone.Delete(device.ID)
+	if !connected {
+		return nil
+	}
 
-	var topics map[string]byte
-
-	switch device.Type {
-	case "iot_sprinkler":
-		topics = map[string]byte{
-			fmt.Sprintf("%s/status/sprinkler/position", device.ID):       0,
-			fmt.Sprintf("%s/status/valve/position", device.ID):           0,
-			fmt.Sprintf("%s/status/sprinkler/calib_complete", device.ID): 0,
-			fmt.Sprintf("%s/status/valve/calib_complete", device.ID):     0,
-			fmt.Sprintf("%s/status/valve/target", device.ID):             0,
-			fmt.Sprintf("%s/status/task/current_index", device.ID):       0,
-			fmt.Sprintf("%s/status/task/current_count", device.ID):       0,
-			fmt.Sprintf("%s/status/task/all_complete", device.ID):        0,
-			fmt.Sprintf("%s/status/task/array", device.ID):               0,
-		}
-	case "iot_plant_pot":
-		topics = map[string]byte{
-			fmt.Sprintf("%s/status/health_check", device.ID): 0,
+	// One SUBSCRIBE packet for all of the device's topics costs a single broker round trip.
+	token := session.SubscribeMultiple(topics, nil)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Failed to subscribe to topics for device %s: %v", device.ID, token.Error())
+		return nil
+	}
+	if subToken, ok := token.(*mqtt.SubscribeToken); ok {
+		for topic, code := range subToken.Result() {
+			if code == 0x80 { // the broker refused this topic
+				log.Printf("Failed to subscribe to topic %s: refused by the broker", topic)
+				return nil
+			}
 		}
-	default:
-		log.Printf("Warning: Unknown device type '%s' for device '%s'. No topics will be subscribed.", device.Type, device.ID)
-		return
 	}
+	log.Printf("Subscribed to %d topics for device: %s", len(topics), device.ID)
+	c.subscriptionsDone.Store(device.ID, struct{}{})
+	return nil
+}
 
-	for topic := range topics {
-		if token := c.client.Subscribe(topic, 1, nil); token.Wait() && token.Error() != nil {
-			log.Printf("Failed to subscribe to topic %s: %v", topic, token.Error())
-		} else {
-			log.Printf("Subscribed to topic: %s", topic)
+// SubscribeToDevices subscribes to the topics of every device, up to MQTT_SUBSCRIBE_CONCURRENCY
+// devices at a time, so startup with many devices is not held up by one broker round trip after another.
+// Devices that fail are logged and left pending.
+func (c *Client) SubscribeToDevices(devices []config.DeviceConfig) {
+	concurrency := c.cfg.SubscribeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := c.SubscribeToDeviceTopics(device); err != nil {
+				log.Printf("Error: Failed to subscribe device %s: %v", device.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// PendingDevices returns the IDs of the given devices that are not ready to be observed: their
+// topics are not all subscribed on the current connection or, with requireStatus, they have not
+// reported any status yet. It returns nil when every device is ready.
+func (c *Client) PendingDevices(deviceIDs []string, requireStatus bool) []string {
+	var pending []string
+	for _, id := range deviceIDs {
+		_, subscribed := c.subscriptionsDone.Load(id)
+		_, reported := c.statusReceived.Load(id)
+		if !subscribed || (requireStatus && !reported) {
+			pending = append(pending, id)
 		}
 	}
+	return pending
+}
+
+// UnsubscribeFromDeviceTopics removes the status subscriptions and cached status for a device.
+func (c *Client) UnsubscribeFromDeviceTopics(device config.DeviceConfig) {
+	c.subscribedDevices.Delete(device.ID)
+	c.subscriptionsDone.Delete(device.ID)
+	c.deviceStatuses.Delete(device.ID)
+	c.statusReceived.Delete(device.ID)
+
+	topics, err := deviceTopics(device, c.qos)
+	if err != nil {
+		return
+	}
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	if token := c.deviceClient(device.ID).Unsubscribe(names...); token.Wait() && token.Error() != nil {
+		log.Printf("Failed to unsubscribe device %s: %v", device.ID, token.Error())
+	} else {
+		log.Printf("Unsubscribed from topics for device: %s", device.ID)
+	}
+	c.closeSession(device.ID)
 }
 
 // GetDeviceStatus safely retrieves the status for a given device ID.
+// It returns a copy, so callers may read it while new messages arrive.
 func (c *Client) GetDeviceStatus(deviceID string) *models.DeviceStatus {
+	status, ok := c.GetDeviceStatusCopy(deviceID)
+	if !ok {
+		status.DeviceID = deviceID // Return a new empty status to avoid nil pointers
+	}
+	return &status
+}
+
+// GetDeviceStatusCopy returns a copy of the status for a given device ID and whether the device has
+// reported a status (or been reset) since startup. Nothing is allocated for devices never seen.
+func (c *Client) GetDeviceStatusCopy(deviceID string) (models.DeviceStatus, bool) {
 	value, ok := c.deviceStatuses.Load(deviceID)
 	if !ok {
-		return &models.DeviceStatus{DeviceID: deviceID} // Return a new empty status to avoid nil pointers
+		return models.DeviceStatus{}, false
+	}
+	status := *value.(*models.DeviceStatus)
+	status.Online = status.LastMessageAt != nil && c.online(*status.LastMessageAt)
+	return status, true
+}
+
+// clock returns the current time from the injected clock, if any.
+func (c *Client) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// online reports whether a device last seen at lastSeen still counts as online under
+// MQTT_OFFLINE_AFTER_SECONDS. Without a TTL, any device that has reported is online.
+func (c *Client) online(lastSeen time.Time) bool {
+	ttl := time.Duration(c.cfg.OfflineAfterSecs) * time.Second
+	return ttl <= 0 || c.clock().Sub(lastSeen) < ttl
+}
+
+// SetPresenceHandler registers a callback invoked when a subscribed device goes offline or comes
+// back online. lastSeen is when it last reported, or when monitoring started if it never has.
+func (c *Client) SetPresenceHandler(onPresenceChange func(deviceID string, online bool, lastSeen time.Time)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.onPresenceChange = onPresenceChange
+}
+
+// StartPresenceMonitor checks subscribed devices against MQTT_OFFLINE_AFTER_SECONDS a few times per
+// TTL and reports each online/offline transition to the presence handler until Close. It does
+// nothing without a TTL.
+func (c *Client) StartPresenceMonitor() {
+	ttl := time.Duration(c.cfg.OfflineAfterSecs) * time.Second
+	if ttl <= 0 {
+		return
 	}
-	return value.(*models.DeviceStatus)
+	monitor := newPresenceMonitor(c.clock())
+	c.goBackground(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(ttl / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.checkPresence(monitor)
+			}
+		}
+	})
+}
+
+// presenceMonitor remembers the last reported presence of each device.
+type presenceMonitor struct {
+	startedAt time.Time       // devices that never reported count as seen at this time
+	online    map[string]bool // last reported presence (key: deviceID)
+}
+
+func newPresenceMonitor(startedAt time.Time) *presenceMonitor {
+	return &presenceMonitor{startedAt: startedAt, online: make(map[string]bool)}
+}
+
+// checkPresence reports devices whose presence changed since the previous check. Devices start out
+// online, so one that never reports is reported offline once the TTL has passed since monitoring began.
+func (c *Client) checkPresence(monitor *presenceMonitor) {
+	c.handlersMu.RLock()
+	onPresenceChange := c.onPresenceChange
+	c.handlersMu.RUnlock()
+
+	c.subscribedDevices.Range(func(key, value interface{}) bool {
+		deviceID := key.(string)
+		lastSeen := monitor.startedAt
+		if status, ok := c.GetDeviceStatusCopy(deviceID); ok && status.LastMessageAt != nil && status.LastMessageAt.After(lastSeen) {
+			lastSeen = *status.LastMessageAt
+		}
+		online := c.online(lastSeen)
+		wasOnline, known := monitor.online[deviceID]
+		monitor.online[deviceID] = online
+		if (known && wasOnline == online) || (!known && online) {
+			return true
+		}
+		if online {
+			log.Printf("Device %s is back online.", deviceID)
+		} else {
+			log.Printf("Device %s is offline: no status since %s.", deviceID, lastSeen.Format(time.RFC3339))
+		}
+		if onPresenceChange != nil {
+			onPresenceChange(deviceID, online, lastSeen)
+		}
+		return true
+	})
 }
 
-// ResetDeviceStatus resets the status for a device, typically before a new operation.
+// ResetDeviceStatus resets the status for a device, typically before a new operation. For device types
+// in MQTT_CLEAR_RETAINED_TYPES it also clears retained messages on the device's command topics.
 func (c *Client) ResetDeviceStatus(deviceID string) {
 	log.Printf("Resetting status for device %s", deviceID)
-	c.deviceStatuses.Store(deviceID, &models.DeviceStatus{DeviceID: deviceID})
+	// Health, presence and the water meter are reported independently of tasks, so the last known values are kept.
+	status := &models.DeviceStatus{DeviceID: deviceID}
+	c.statusMu.Lock()
+	if value, ok := c.deviceStatuses.Load(deviceID); ok {
+		status.HealthCheck = value.(*models.DeviceStatus).HealthCheck
+		status.HealthCheckReports = value.(*models.DeviceStatus).HealthCheckReports
+		status.LastMessageAt = value.(*models.DeviceStatus).LastMessageAt
+		status.VolumeLiters = value.(*models.DeviceStatus).VolumeLiters
+		status.VolumeReports = value.(*models.DeviceStatus).VolumeReports
+	}
+	c.deviceStatuses.Store(deviceID, status)
+	c.statusMu.Unlock()
+
+	c.clearRetainedCommands(deviceID)
+}
+
+// InjectDeviceStatus stores status for its device as if the device had just reported every field,
+// so the scheduler's waits can be exercised without hardware. It is meant for TEST_MODE only.
+func (c *Client) InjectDeviceStatus(status models.DeviceStatus) {
+	log.Printf("Injecting status for device %s", status.DeviceID)
+	received := c.clock()
+	status.LastMessageAt = &received
+	status.TaskIndexReported = true
+	status.SprinklerCalibAt, status.ValveCalibAt = time.Time{}, time.Time{}
+	status.ValvePositionAt = received
+	if status.SprinklerCalibComplete {
+		status.SprinklerCalibAt = received
+	}
+	if status.ValveCalibComplete {
+		status.ValveCalibAt = received
+	}
+	if status.TaskArray != "" && status.TaskSteps == nil {
+		if err := json.Unmarshal([]byte(status.TaskArray), &status.TaskSteps); err != nil {
+			status.TaskSteps = nil
+		}
+	}
+
+	c.statusMu.Lock()
+	status.TaskAllCompleteReports, status.HealthCheckReports, status.MoistureReports, status.VolumeReports = 1, 1, 1, 1
+	if value, ok := c.deviceStatuses.Load(status.DeviceID); ok {
+		previous := value.(*models.DeviceStatus)
+		status.TaskAllCompleteReports = previous.TaskAllCompleteReports + 1
+		status.HealthCheckReports = previous.HealthCheckReports + 1
+		status.MoistureReports = previous.MoistureReports + 1
+		status.VolumeReports = previous.VolumeReports + 1
+	}
+	c.deviceStatuses.Store(status.DeviceID, &status)
+	c.statusMu.Unlock()
+	c.statusReceived.Store(status.DeviceID, struct{}{})
+}
+
+// clearRetainedCommands publishes empty retained messages to the device's command topics when its
+// type is configured for it, so a stale retained command such as task/set cannot re-trigger the
+// device on reconnect. The clears are queued ahead of any command published after the reset.
+func (c *Client) clearRetainedCommands(deviceID string) {
+	value, ok := c.subscribedDevices.Load(deviceID)
+	if !ok {
+		return
+	}
+	device := value.(config.DeviceConfig)
+	deviceType, ok := config.LookupDeviceType(device.Type)
+	if !c.clearRetained[device.Type] || !ok || deviceType.Commands == nil {
+		return
+	}
+
+	var results []<-chan error
+	for _, command := range deviceType.Commands(device) {
+		topic := fmt.Sprintf("%s/%s", device.ID, command)
+		log.Printf("Clearing retained command on %s", topic)
+		results = append(results, c.publishes.enqueue(topic, "", true, c.publish))
+	}
+	for _, result := range results {
+		<-result // failures are logged by publish
+	}
 }
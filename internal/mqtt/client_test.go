@@ -0,0 +1,1146 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/models"
+)
+
+func TestSubscribeToDeviceTopicsUnknownType(t *testing.T) {
+	c := &Client{}
+
+	err := c.SubscribeToDeviceTopics(config.DeviceConfig{ID: "sprinkler_01", Type: "iot_sprinklr"})
+	if !errors.Is(err, config.ErrUnknownDeviceType) {
+		t.Fatalf("Expected ErrUnknownDeviceType, got %v", err)
+	}
+	if _, ok := c.subscribedDevices.Load("sprinkler_01"); ok {
+		t.Error("Expected unknown device not to be tracked for re-subscription")
+	}
+}
+
+func TestEffectiveClientIDIsUniquePerConstruction(t *testing.T) {
+	cfg := config.MQTTConfig{Broker: "tcp://localhost:1883", ClientID: "irrigation-system"}
+
+	first := newClientOptions(cfg).ClientID
+	second := newClientOptions(cfg).ClientID
+
+	if first == second {
+		t.Errorf("Expected unique client IDs, got %q twice", first)
+	}
+	if !strings.HasPrefix(first, "irrigation-system-") {
+		t.Errorf("Expected client ID to keep the configured prefix, got %q", first)
+	}
+}
+
+func TestEffectiveClientIDOptions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      config.MQTTConfig
+		expected string
+	}{
+		{
+			name:     "exact client ID",
+			cfg:      config.MQTTConfig{ClientID: "irrigation-system", ExactClientID: true},
+			expected: "irrigation-system",
+		},
+		{
+			name:     "configured suffix",
+			cfg:      config.MQTTConfig{ClientID: "irrigation-system", ClientIDSuffix: "blue"},
+			expected: "irrigation-system-blue",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := effectiveClientID(tc.cfg); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewClientOptionsAddsAllBrokers(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      config.MQTTConfig
+		expected []string
+	}{
+		{
+			name:     "single broker",
+			cfg:      config.MQTTConfig{Broker: "tcp://primary:1883"},
+			expected: []string{"tcp://primary:1883"},
+		},
+		{
+			name:     "broker list",
+			cfg:      config.MQTTConfig{Broker: "tcp://ignored:1883", Brokers: []string{"tcp://primary:1883", "tcp://backup:1883"}},
+			expected: []string{"tcp://primary:1883", "tcp://backup:1883"},
+		},
+		{
+			name:     "comma-separated entry",
+			cfg:      config.MQTTConfig{Brokers: []string{"tcp://primary:1883, tcp://backup:1883,"}},
+			expected: []string{"tcp://primary:1883", "tcp://backup:1883"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := newClientOptions(tc.cfg)
+			var got []string
+			for _, server := range opts.Servers {
+				got = append(got, server.String())
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected brokers %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// fakeMessage is a minimal paho Message for driving messageHandler.
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+func TestMessageHandlerParsesTaskArray(t *testing.T) {
+	c := &Client{}
+	payload := `[{"fr": 297, "to": 328, "sp": 100, "wv": 8, "wvea": "STOP", "ct": 10}, {"fr": 0, "to": 90.5, "sp": 50, "wv": 12, "wvea": "STOP", "ct": 5}]`
+
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/array", payload: []byte(payload)})
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if status.TaskArray != payload {
+		t.Errorf("Expected raw task array to be kept, got %q", status.TaskArray)
+	}
+	expected := []models.TaskStep{
+		{From: 297, To: 328, Speed: 100, ValvePosition: 8, ValveEndAction: "STOP", Count: 10},
+		{From: 0, To: 90.5, Speed: 50, ValvePosition: 12, ValveEndAction: "STOP", Count: 5},
+	}
+	if !reflect.DeepEqual(status.TaskSteps, expected) {
+		t.Errorf("Expected task steps %+v, got %+v", expected, status.TaskSteps)
+	}
+}
+
+func TestMessageHandlerMalformedTaskArray(t *testing.T) {
+	c := &Client{}
+
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/array", payload: []byte(`[{"fr": 1}]`)})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/array", payload: []byte(`not json`)})
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if status.TaskArray != "not json" {
+		t.Errorf("Expected raw payload to be kept, got %q", status.TaskArray)
+	}
+	if status.TaskSteps != nil {
+		t.Errorf("Expected no parsed steps for a malformed payload, got %+v", status.TaskSteps)
+	}
+}
+
+// fakeToken is a paho Token that completes (or not) as configured.
+type fakeToken struct {
+	confirmed bool
+	err       error
+}
+
+func (t *fakeToken) Wait() bool                       { return t.confirmed }
+func (t *fakeToken) WaitTimeout(d time.Duration) bool { return t.confirmed }
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	if t.confirmed {
+		close(done)
+	}
+	return done
+}
+func (t *fakeToken) Error() error { return t.err }
+
+// fakePahoClient is a paho Client whose publishes and subscribes return the configured token.
+type fakePahoClient struct {
+	mqtt.Client
+	token      *fakeToken
+	mu         sync.Mutex
+	subscribed map[string]byte
+	subscribes int           // SUBSCRIBE round trips
+	inFlight   int           // subscribes currently waiting on hold
+	maxFlight  int           // most subscribes waiting at once
+	hold       chan struct{} // when set, each subscribe waits for a value before returning
+}
+
+func (f *fakePahoClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.mu.Lock()
+	if f.subscribed == nil {
+		f.subscribed = make(map[string]byte)
+	}
+	for topic, qos := range filters {
+		f.subscribed[topic] = qos
+	}
+	f.subscribes++
+	f.inFlight++
+	f.maxFlight = max(f.maxFlight, f.inFlight)
+	f.mu.Unlock()
+
+	if f.hold != nil {
+		<-f.hold
+	}
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+	return f.token
+}
+
+func (f *fakePahoClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return f.token
+}
+
+// openStateClient is a paho Client that only reports whether its connection is open.
+type openStateClient struct {
+	mqtt.Client
+	open bool
+}
+
+func (f *openStateClient) IsConnectionOpen() bool { return f.open }
+
+func TestIsDeviceConnectedUsesDeviceSession(t *testing.T) {
+	shared := &openStateClient{open: false}
+	session := &openStateClient{open: true}
+	c := &Client{client: shared, sessions: map[string]mqtt.Client{"sprinkler_02": session}}
+
+	if c.IsDeviceConnected("sprinkler_01") {
+		t.Error("Expected a device on the shared connection to follow it")
+	}
+	if !c.IsDeviceConnected("sprinkler_02") {
+		t.Error("Expected a device with its own session to ignore the shared connection")
+	}
+
+	session.open = false
+	shared.open = true
+	if c.IsDeviceConnected("sprinkler_02") {
+		t.Error("Expected a dropped device session to report disconnected")
+	}
+	if !c.IsDeviceConnected("sprinkler_01") {
+		t.Error("Expected a device on the open shared connection to report connected")
+	}
+}
+
+func TestPublishConfirmation(t *testing.T) {
+	brokerErr := errors.New("not connected")
+
+	testCases := []struct {
+		name     string
+		token    *fakeToken
+		expected error
+	}{
+		{name: "confirmed", token: &fakeToken{confirmed: true}, expected: nil},
+		{name: "timed out", token: &fakeToken{confirmed: false}, expected: ErrPublishTimeout},
+		{name: "broker error", token: &fakeToken{confirmed: true, err: brokerErr}, expected: brokerErr},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Client{client: &fakePahoClient{token: tc.token}, publishTimeout: time.Second}
+
+			err := c.Publish("sprinkler_01/cmd/task/set", "[]")
+			if tc.expected == nil && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tc.expected != nil && !errors.Is(err, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestMessageHandlerKeepsLastGoodValue(t *testing.T) {
+	testCases := []struct {
+		name  string
+		topic string
+		good  string
+		bad   string
+		check func(status *models.DeviceStatus) bool
+	}{
+		{
+			name:  "health check",
+			topic: "plant_pot_01/status/health_check",
+			good:  "true",
+			bad:   "yes-ish",
+			check: func(status *models.DeviceStatus) bool { return status.HealthCheck },
+		},
+		{
+			name:  "sprinkler position",
+			topic: "plant_pot_01/status/sprinkler/position",
+			good:  "42.5",
+			bad:   "forty",
+			check: func(status *models.DeviceStatus) bool { return status.SprinklerPosition == 42.5 },
+		},
+		{
+			name:  "calibration flag",
+			topic: "plant_pot_01/status/valve/calib_complete",
+			good:  "true",
+			bad:   "",
+			check: func(status *models.DeviceStatus) bool { return status.ValveCalibComplete },
+		},
+		{
+			name:  "task index",
+			topic: "plant_pot_01/status/task/current_index",
+			good:  "3",
+			bad:   "3.5",
+			check: func(status *models.DeviceStatus) bool { return status.TaskCurrentIndex == 3 },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Client{}
+			c.messageHandler(nil, fakeMessage{topic: tc.topic, payload: []byte(tc.good)})
+			c.messageHandler(nil, fakeMessage{topic: tc.topic, payload: []byte(tc.bad)})
+
+			if status := c.GetDeviceStatus("plant_pot_01"); !tc.check(status) {
+				t.Errorf("Expected value from %q to persist after %q, got %+v", tc.good, tc.bad, status)
+			}
+		})
+	}
+}
+
+func TestMessageHandlerMalformedPayloadDoesNotCreateStatus(t *testing.T) {
+	c := &Client{}
+
+	c.messageHandler(nil, fakeMessage{topic: "plant_pot_01/status/health_check", payload: []byte("garbage")})
+
+	if _, ok := c.deviceStatuses.Load("plant_pot_01"); ok {
+		t.Error("Expected no status to be created for a malformed payload")
+	}
+}
+
+func TestDeviceTopicsRequireHealthCheck(t *testing.T) {
+	const healthTopic = "sprinkler_01/status/health_check"
+
+	topics, err := deviceTopics(config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}, subscribeQoS{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := topics[healthTopic]; ok {
+		t.Errorf("Expected no health check subscription by default")
+	}
+
+	topics, err = deviceTopics(config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, RequireHealthCheck: true}, subscribeQoS{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := topics[healthTopic]; !ok {
+		t.Errorf("Expected health check subscription when required")
+	}
+}
+
+func TestResetDeviceStatusKeepsHealthCheck(t *testing.T) {
+	c := &Client{}
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/health_check", payload: []byte("true")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/all_complete", payload: []byte("true")})
+
+	c.ResetDeviceStatus("sprinkler_01")
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if !status.HealthCheck || status.HealthCheckReports != 1 {
+		t.Errorf("Expected health check and its report count to survive a reset, got %v after %d reports", status.HealthCheck, status.HealthCheckReports)
+	}
+	if status.TaskAllComplete {
+		t.Error("Expected task state to be cleared by a reset")
+	}
+}
+
+func TestInjectDeviceStatus(t *testing.T) {
+	now := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	c := &Client{now: func() time.Time { return now }}
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/all_complete", payload: []byte("false")})
+
+	c.InjectDeviceStatus(models.DeviceStatus{
+		DeviceID:               "sprinkler_01",
+		SprinklerCalibComplete: true,
+		TaskAllComplete:        true,
+		TaskArray:              `[{"fr": 0, "to": 90, "sp": 3}]`,
+	})
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if !status.SprinklerCalibComplete || status.ValveCalibComplete || !status.TaskAllComplete {
+		t.Errorf("Expected the injected flags, got %+v", status)
+	}
+	if status.TaskAllCompleteReports != 2 || !status.TaskIndexReported || status.HealthCheckReports != 1 {
+		t.Errorf("Expected the injection to count as a fresh report, got %d task and %d health reports, index reported %v", status.TaskAllCompleteReports, status.HealthCheckReports, status.TaskIndexReported)
+	}
+	if !status.SprinklerCalibAt.Equal(now) || !status.ValveCalibAt.IsZero() {
+		t.Errorf("Expected only the sprinkler calibration to be stamped, got %v and %v", status.SprinklerCalibAt, status.ValveCalibAt)
+	}
+	if len(status.TaskSteps) != 1 || status.TaskSteps[0].To != 90 {
+		t.Errorf("Expected the task array to be parsed, got %+v", status.TaskSteps)
+	}
+	if status.LastMessageAt == nil || !status.LastMessageAt.Equal(now) || !status.Online {
+		t.Errorf("Expected the device to count as online since the injection, got %v", status.LastMessageAt)
+	}
+}
+
+func TestMessageHandlerCountsTaskReportsSinceReset(t *testing.T) {
+	c := &Client{}
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/all_complete", payload: []byte("true")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/current_index", payload: []byte("3")})
+	c.ResetDeviceStatus("sprinkler_01")
+
+	if status := c.GetDeviceStatus("sprinkler_01"); status.TaskAllCompleteReports != 0 || status.TaskIndexReported {
+		t.Fatalf("Expected no reports after a reset, got %d reports and index reported %v", status.TaskAllCompleteReports, status.TaskIndexReported)
+	}
+
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/all_complete", payload: []byte("true")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/all_complete", payload: []byte("false")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/current_index", payload: []byte("0")})
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if status.TaskAllCompleteReports != 2 {
+		t.Errorf("Expected 2 all_complete reports, got %d", status.TaskAllCompleteReports)
+	}
+	if !status.TaskIndexReported {
+		t.Error("Expected current_index to be marked as reported")
+	}
+}
+
+func TestSubscribeToDeviceTopicsQoSPerCategory(t *testing.T) {
+	fake := &fakePahoClient{token: &fakeToken{confirmed: true}}
+	c := &Client{client: fake, qos: subscribeQoS{status: 0, flag: 2}}
+
+	if err := c.SubscribeToDeviceTopics(config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, RequireHealthCheck: true, ReportsVolume: true}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := map[string]byte{
+		"sprinkler_01/status/sprinkler/position":       0,
+		"sprinkler_01/status/valve/position":           0,
+		"sprinkler_01/status/task/current_index":       0,
+		"sprinkler_01/status/task/current_count":       0,
+		"sprinkler_01/status/task/array":               0,
+		"sprinkler_01/status/sprinkler/calib_complete": 2,
+		"sprinkler_01/status/valve/calib_complete":     2,
+		"sprinkler_01/status/valve/target":             2,
+		"sprinkler_01/status/task/all_complete":        2,
+		"sprinkler_01/status/health_check":             2,
+		"sprinkler_01/status/volume":                   0,
+	}
+	if !reflect.DeepEqual(fake.subscribed, expected) {
+		t.Errorf("Expected subscriptions %v, got %v", expected, fake.subscribed)
+	}
+}
+
+func TestNewSubscribeQoSRejectsInvalidLevels(t *testing.T) {
+	if _, err := newSubscribeQoS(config.MQTTConfig{StatusQoS: 0, FlagQoS: 3}); err == nil {
+		t.Error("Expected an error for QoS 3")
+	}
+	qos, err := newSubscribeQoS(config.MQTTConfig{StatusQoS: 0, FlagQoS: 1})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if qos.status != 0 || qos.flag != 1 {
+		t.Errorf("Expected status 0 and flag 1, got %+v", qos)
+	}
+}
+
+func TestPendingDevicesUntilSubscribedAndReported(t *testing.T) {
+	fake := &fakePahoClient{token: &fakeToken{confirmed: true}}
+	c := &Client{client: fake}
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot}
+	ids := []string{device.ID}
+
+	if pending := c.PendingDevices(ids, false); len(pending) != 1 {
+		t.Fatalf("Expected device to be pending before subscribing, got %v", pending)
+	}
+
+	if err := c.SubscribeToDeviceTopics(device); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	if pending := c.PendingDevices(ids, false); pending != nil {
+		t.Errorf("Expected no pending devices once subscribed, got %v", pending)
+	}
+	if pending := c.PendingDevices(ids, true); len(pending) != 1 {
+		t.Errorf("Expected device to be pending until it reports a status, got %v", pending)
+	}
+
+	c.messageHandler(nil, fakeMessage{topic: "plant_pot_01/status/health_check", payload: []byte("true")})
+	if pending := c.PendingDevices(ids, true); pending != nil {
+		t.Errorf("Expected no pending devices once a status arrived, got %v", pending)
+	}
+
+	c.connectionLostHandler(nil, errors.New("broker went away"))
+	if pending := c.PendingDevices(ids, false); len(pending) != 1 {
+		t.Errorf("Expected device to be pending after the connection was lost, got %v", pending)
+	}
+}
+
+func TestSubscribeToDevicesBatchesTopicsPerDevice(t *testing.T) {
+	fake := &fakePahoClient{token: &fakeToken{confirmed: true}, hold: make(chan struct{})}
+	c := &Client{client: fake, cfg: config.MQTTConfig{SubscribeConcurrency: 2}, qos: subscribeQoS{status: 0, flag: 1}}
+	var devices []config.DeviceConfig
+	expected := make(map[string]byte)
+	for i := 1; i <= 5; i++ {
+		device := config.DeviceConfig{ID: fmt.Sprintf("sprinkler_%02d", i), Type: config.DeviceTypeSprinkler}
+		devices = append(devices, device)
+		topics, err := deviceTopics(device, c.qos)
+		if err != nil {
+			t.Fatalf("Expected topics, got %v", err)
+		}
+		maps.Copy(expected, topics)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.SubscribeToDevices(devices)
+		close(done)
+	}()
+	for range devices {
+		fake.hold <- struct{}{}
+	}
+	<-done
+
+	if !reflect.DeepEqual(fake.subscribed, expected) {
+		t.Errorf("Expected subscriptions %v, got %v", expected, fake.subscribed)
+	}
+	if fake.subscribes != len(devices) {
+		t.Errorf("Expected one subscribe per device (%d), got %d", len(devices), fake.subscribes)
+	}
+	if fake.maxFlight > 2 {
+		t.Errorf("Expected at most 2 devices subscribing at once, got %d", fake.maxFlight)
+	}
+	if pending := c.PendingDevices([]string{"sprinkler_01", "sprinkler_05"}, false); pending != nil {
+		t.Errorf("Expected every device to be subscribed, got pending %v", pending)
+	}
+}
+
+func TestPendingDevicesAfterFailedSubscribe(t *testing.T) {
+	fake := &fakePahoClient{token: &fakeToken{confirmed: true, err: errors.New("not authorized")}}
+	c := &Client{client: fake}
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot}
+
+	if err := c.SubscribeToDeviceTopics(device); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	if pending := c.PendingDevices([]string{device.ID}, false); len(pending) != 1 {
+		t.Errorf("Expected device to be pending after a failed subscribe, got %v", pending)
+	}
+}
+
+func TestDeviceTopicsForRegisteredType(t *testing.T) {
+	config.RegisterDeviceType("test_soil_probe", config.DeviceType{
+		Topics: func(device config.DeviceConfig) []config.StatusTopic {
+			return []config.StatusTopic{{Path: "status/moisture"}, {Path: "status/health_check", Flag: true}}
+		},
+	})
+
+	topics, err := deviceTopics(config.DeviceConfig{ID: "probe_01", Type: "test_soil_probe"}, subscribeQoS{status: 0, flag: 2})
+	if err != nil {
+		t.Fatalf("Expected registered type to have topics, got %v", err)
+	}
+	expected := map[string]byte{"probe_01/status/moisture": 0, "probe_01/status/health_check": 2}
+	if !reflect.DeepEqual(topics, expected) {
+		t.Errorf("Expected %v, got %v", expected, topics)
+	}
+}
+
+func TestDeviceStatusConcurrentUpdatesAndReads(t *testing.T) {
+	c := &Client{}
+	const updates = 200
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= updates; i++ {
+			c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/current_index", payload: []byte(strconv.Itoa(i))})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < updates; i++ {
+			c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/valve/position", payload: []byte("12.5")})
+			if i%50 == 0 {
+				c.ResetDeviceStatus("sprinkler_01")
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < updates; i++ {
+			status := c.GetDeviceStatus("sprinkler_01")
+			_ = status.TaskCurrentIndex + int(status.ValvePosition)
+			status.TaskAllComplete = true // callers own the copy they get
+		}
+	}()
+	wg.Wait()
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if status.TaskAllComplete {
+		t.Error("Expected writes to a returned status not to leak into the stored status")
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	testCases := []struct {
+		payload     string
+		expected    bool
+		expectError bool
+	}{
+		{payload: "1", expected: true},
+		{payload: "0", expected: false},
+		{payload: "true", expected: true},
+		{payload: "TRUE", expected: true},
+		{payload: "false", expected: false},
+		{payload: "False", expected: false},
+		{payload: "t", expected: true},
+		{payload: "f", expected: false},
+		{payload: "on", expected: true},
+		{payload: "ON", expected: true},
+		{payload: "off", expected: false},
+		{payload: "Off", expected: false},
+		{payload: "yes", expected: true},
+		{payload: "YES", expected: true},
+		{payload: "no", expected: false},
+		{payload: " on\n", expected: true},
+		{payload: "", expectError: true},
+		{payload: "2", expectError: true},
+		{payload: "enabled", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strconv.Quote(tc.payload), func(t *testing.T) {
+			got, err := parseBool(tc.payload)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("Expected error %v, got %v", tc.expectError, err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestMessageHandlerParsesBooleanForms(t *testing.T) {
+	c := &Client{}
+
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/health_check", payload: []byte("ON")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/sprinkler/calib_complete", payload: []byte("1")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/valve/calib_complete", payload: []byte("yes")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/all_complete", payload: []byte("off")})
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if !status.HealthCheck || !status.SprinklerCalibComplete || !status.ValveCalibComplete || status.TaskAllComplete {
+		t.Errorf("Expected health and calibration flags set and task incomplete, got %+v", status)
+	}
+}
+
+func TestMessageHandlerRecordsCalibrationTimes(t *testing.T) {
+	c := &Client{}
+	before := time.Now()
+
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/sprinkler/calib_complete", payload: []byte("true")})
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/valve/calib_complete", payload: []byte("false")})
+
+	status := c.GetDeviceStatus("sprinkler_01")
+	if status.SprinklerCalibAt.Before(before) {
+		t.Errorf("Expected the sprinkler calibration time to be recorded, got %v", status.SprinklerCalibAt)
+	}
+	if !status.ValveCalibAt.IsZero() {
+		t.Errorf("Expected no valve calibration time for a false flag, got %v", status.ValveCalibAt)
+	}
+
+	c.ResetDeviceStatus("sprinkler_01")
+	if status := c.GetDeviceStatus("sprinkler_01"); !status.SprinklerCalibAt.IsZero() || status.SprinklerCalibComplete {
+		t.Errorf("Expected a reset to clear the calibration flag and time, got %+v", status)
+	}
+}
+
+func TestResetDeviceStatusClearsRetainedCommands(t *testing.T) {
+	testCases := []struct {
+		name     string
+		device   config.DeviceConfig
+		expected []recordedPublish
+	}{
+		{
+			name:   "configured sprinkler",
+			device: config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler},
+			expected: []recordedPublish{
+				{topic: "sprinkler_01/cmd/sprinkler/home", retained: true},
+				{topic: "sprinkler_01/cmd/valve/home", retained: true},
+				{topic: "sprinkler_01/cmd/task/set", retained: true},
+			},
+		},
+		{
+			name:   "type not configured",
+			device: config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &recordingPahoClient{published: make(map[string][]string)}
+			c := &Client{client: fake, publishTimeout: time.Second, clearRetained: map[string]bool{config.DeviceTypeSprinkler: true}}
+			c.subscribedDevices.Store(tc.device.ID, tc.device)
+
+			c.ResetDeviceStatus(tc.device.ID)
+			if !reflect.DeepEqual(fake.messages, tc.expected) {
+				t.Errorf("Expected publishes %+v, got %+v", tc.expected, fake.messages)
+			}
+		})
+	}
+}
+
+func TestPublishRetained(t *testing.T) {
+	fake := &recordingPahoClient{published: make(map[string][]string)}
+	c := &Client{client: fake, publishTimeout: time.Second}
+
+	if err := c.PublishRetained("irrigation/sprinkler_01/job/status", `{"status":"started"}`); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := c.Publish("sprinkler_01/cmd/task/set", "{}"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []recordedPublish{
+		{topic: "irrigation/sprinkler_01/job/status", payload: `{"status":"started"}`, retained: true},
+		{topic: "sprinkler_01/cmd/task/set", payload: "{}", retained: false},
+	}
+	if !reflect.DeepEqual(fake.messages, expected) {
+		t.Errorf("Expected publishes %+v, got %+v", expected, fake.messages)
+	}
+}
+
+// openRecordingPahoClient is a recordingPahoClient that reports an open connection and can be closed.
+type openRecordingPahoClient struct {
+	recordingPahoClient
+}
+
+func (f *openRecordingPahoClient) IsConnectionOpen() bool  { return true }
+func (f *openRecordingPahoClient) Disconnect(quiesce uint) {}
+
+func TestPresenceDocument(t *testing.T) {
+	fake := &openRecordingPahoClient{recordingPahoClient{published: make(map[string][]string)}}
+	now := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	c := &Client{
+		client:         fake,
+		publishTimeout: time.Second,
+		cfg:            config.MQTTConfig{ClientID: "irrigation-system", PresenceTopic: "irrigation/controller/presence"},
+		now:            func() time.Time { return now },
+	}
+	devices := []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler},
+		{ID: "plant_pot_01", Type: config.DeviceTypePlantPot},
+		{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler},
+	}
+	for _, device := range devices {
+		c.subscribedDevices.Store(device.ID, device)
+	}
+
+	if err := c.PublishPresence(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	c.subscribedDevices.Delete(devices[2].ID)
+	if err := c.PublishPresence(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	c.Close()
+
+	var presence []recordedPublish
+	for _, msg := range fake.messages {
+		if msg.topic == "irrigation/controller/presence" {
+			presence = append(presence, msg)
+		}
+	}
+	if len(presence) != 3 {
+		t.Fatalf("Expected two presence documents and a clear, got %+v", presence)
+	}
+
+	expected := []models.PresenceDocument{
+		{ControllerID: "irrigation-system", UpdatedAt: now, Devices: []models.PresenceDevice{
+			{ID: "plant_pot_01", Type: config.DeviceTypePlantPot},
+			{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler},
+			{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler},
+		}},
+		{ControllerID: "irrigation-system", UpdatedAt: now, Devices: []models.PresenceDevice{
+			{ID: "plant_pot_01", Type: config.DeviceTypePlantPot},
+			{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler},
+		}},
+	}
+	for i, want := range expected {
+		var doc models.PresenceDocument
+		if err := json.Unmarshal([]byte(presence[i].payload), &doc); err != nil {
+			t.Fatalf("Failed to decode presence document: %v", err)
+		}
+		if !reflect.DeepEqual(doc, want) || !presence[i].retained {
+			t.Errorf("Expected retained %+v, got %+v (retained %v)", want, doc, presence[i].retained)
+		}
+	}
+	if clear := presence[2]; clear.payload != "" || !clear.retained {
+		t.Errorf("Expected shutdown to clear the retained presence document, got %+v", clear)
+	}
+}
+
+func TestPublishPresenceDisabled(t *testing.T) {
+	fake := &recordingPahoClient{published: make(map[string][]string)}
+	c := &Client{client: fake, publishTimeout: time.Second}
+	c.subscribedDevices.Store("sprinkler_01", config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler})
+
+	if err := c.PublishPresence(); err != nil || len(fake.messages) != 0 {
+		t.Errorf("Expected nothing published without a presence topic, got %v and %+v", err, fake.messages)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList([]string{"iot_sprinkler, iot_plant_pot", "", " custom "})
+	expected := []string{"iot_sprinkler", "iot_plant_pot", "custom"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestVolumeReadingKeptAcrossReset(t *testing.T) {
+	c := &Client{}
+
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/volume", payload: []byte("123.5")})
+	c.ResetDeviceStatus("sprinkler_01")
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/volume", payload: []byte("not a number")})
+
+	status, _ := c.GetDeviceStatusCopy("sprinkler_01")
+	if status.VolumeLiters != 123.5 || status.VolumeReports != 1 {
+		t.Errorf("Expected the meter reading to survive the reset and the malformed payload, got %+v", status)
+	}
+}
+
+func TestGetDeviceStatusCopy(t *testing.T) {
+	c := &Client{}
+
+	if _, ok := c.GetDeviceStatusCopy("sprinkler_01"); ok {
+		t.Error("Expected a device that never reported to be not found")
+	}
+
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/valve/position", payload: []byte("45")})
+	status, ok := c.GetDeviceStatusCopy("sprinkler_01")
+	if !ok || status.ValvePosition != 45 || status.ValvePositionAt.IsZero() {
+		t.Fatalf("Expected the reported status with its receive time, got %+v (found %v)", status, ok)
+	}
+
+	status.ValvePosition = 0
+	status.TaskSteps = append(status.TaskSteps, models.TaskStep{Count: 1})
+	if again, _ := c.GetDeviceStatusCopy("sprinkler_01"); again.ValvePosition != 45 || again.TaskSteps != nil {
+		t.Errorf("Expected the stored status to be unaffected by changes to a copy, got %+v", again)
+	}
+
+	c.ResetDeviceStatus("sprinkler_01")
+	if status, ok := c.GetDeviceStatusCopy("sprinkler_01"); !ok || status.ValvePosition != 0 || !status.ValvePositionAt.IsZero() {
+		t.Errorf("Expected a reset device to be found with a cleared status, got %+v (found %v)", status, ok)
+	}
+}
+
+func TestConnectionStatsCountReconnects(t *testing.T) {
+	c := &Client{}
+
+	c.onConnectHandler(nil)
+	if stats := c.ConnectionStats(); stats.Reconnects != 0 || stats.LastReconnectAt != nil {
+		t.Errorf("Expected the first connect not to count as a reconnect, got %+v", stats)
+	}
+
+	for i := 1; i <= 3; i++ {
+		c.connectionLostHandler(nil, errors.New("EOF"))
+		c.onConnectHandler(nil)
+		stats := c.ConnectionStats()
+		if stats.ConnectionLosses != int64(i) || stats.Reconnects != int64(i) {
+			t.Errorf("Expected %d losses and reconnects, got %+v", i, stats)
+		}
+		if stats.LastReconnectAt == nil || stats.LastConnectionLostAt == nil || stats.LastReconnectAt.Before(*stats.LastConnectionLostAt) {
+			t.Errorf("Expected the reconnect to be timestamped after the loss, got %+v", stats)
+		}
+	}
+}
+
+func TestNewClientOptionsReconnectSettings(t *testing.T) {
+	opts := newClientOptions(config.MQTTConfig{Broker: "tcp://localhost:1883", MaxReconnectIntervalSecs: 30, ReconnectJitterMs: 1})
+	if opts.MaxReconnectInterval != 30*time.Second {
+		t.Errorf("Expected a 30s max reconnect interval, got %v", opts.MaxReconnectInterval)
+	}
+	if opts.OnReconnecting == nil {
+		t.Error("Expected a reconnecting handler that adds jitter")
+	}
+
+	opts = newClientOptions(config.MQTTConfig{Broker: "tcp://localhost:1883"})
+	if opts.OnReconnecting != nil {
+		t.Error("Expected no jitter handler when jitter is disabled")
+	}
+}
+
+// fakeSessionClient is a paho Client that connects at once and records what was published on it.
+type fakeSessionClient struct {
+	fakePahoClient
+	connected    bool
+	published    []string
+	disconnected bool
+}
+
+func newFakeSessionClient() *fakeSessionClient {
+	return &fakeSessionClient{fakePahoClient: fakePahoClient{token: &fakeToken{confirmed: true}}}
+}
+
+func (f *fakeSessionClient) Connect() mqtt.Token {
+	f.connected = true
+	return f.token
+}
+
+func (f *fakeSessionClient) IsConnectionOpen() bool { return f.connected }
+
+func (f *fakeSessionClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.published = append(f.published, topic)
+	return f.token
+}
+
+func (f *fakeSessionClient) Unsubscribe(topics ...string) mqtt.Token {
+	for _, topic := range topics {
+		delete(f.subscribed, topic)
+	}
+	return f.token
+}
+
+func (f *fakeSessionClient) Disconnect(quiesce uint) { f.disconnected = true }
+
+func TestDeviceWithMQTTOverridesGetsOwnSession(t *testing.T) {
+	shared := newFakeSessionClient()
+	session := newFakeSessionClient()
+	var sessionOpts *mqtt.ClientOptions
+	c := &Client{
+		client: shared,
+		cfg:    config.MQTTConfig{Broker: "tcp://shared:1883", ClientID: "irrigation-system", ExactClientID: true, Username: "controller", Password: "shared-secret"},
+		newPahoClient: func(opts *mqtt.ClientOptions) mqtt.Client {
+			sessionOpts = opts
+			return session
+		},
+	}
+
+	secure := config.DeviceConfig{
+		ID:   "plant_pot_01",
+		Type: config.DeviceTypePlantPot,
+		MQTT: &config.DeviceMQTTConfig{Broker: "ssl://secure:8883", Username: "plant_pot_01", Password: "device-secret"},
+	}
+	plain := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}
+	for _, device := range []config.DeviceConfig{secure, plain} {
+		if err := c.SubscribeToDeviceTopics(device); err != nil {
+			t.Fatalf("Expected no error subscribing %s, got %v", device.ID, err)
+		}
+	}
+
+	if sessionOpts == nil {
+		t.Fatal("Expected a session to be created for the device with overrides")
+	}
+	if len(sessionOpts.Servers) != 1 || sessionOpts.Servers[0].Host != "secure:8883" {
+		t.Errorf("Expected the device broker, got %v", sessionOpts.Servers)
+	}
+	if sessionOpts.Username != "plant_pot_01" || sessionOpts.Password != "device-secret" {
+		t.Errorf("Expected the device credentials, got %q/%q", sessionOpts.Username, sessionOpts.Password)
+	}
+	if sessionOpts.ClientID != "irrigation-system-plant_pot_01" {
+		t.Errorf("Expected a per-device client ID, got %q", sessionOpts.ClientID)
+	}
+
+	for topic := range session.subscribed {
+		if !strings.HasPrefix(topic, "plant_pot_01/") {
+			t.Errorf("Expected only the device's topics on its session, got %s", topic)
+		}
+	}
+	if len(session.subscribed) == 0 {
+		t.Error("Expected the device's topics to be subscribed on its session")
+	}
+	for topic := range shared.subscribed {
+		if strings.HasPrefix(topic, "plant_pot_01/") {
+			t.Errorf("Expected the device's topics not to use the shared client, got %s", topic)
+		}
+	}
+	if pending := c.PendingDevices([]string{secure.ID, plain.ID}, false); pending != nil {
+		t.Errorf("Expected both devices to be subscribed, got pending %v", pending)
+	}
+
+	if err := c.Publish("plant_pot_01/cmd/trigger_solenoid_valve", "10"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := c.Publish("sprinkler_01/cmd/sprinkler/home", "1"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(session.published, []string{"plant_pot_01/cmd/trigger_solenoid_valve"}) {
+		t.Errorf("Expected the device's command on its session, got %v", session.published)
+	}
+	if !reflect.DeepEqual(shared.published, []string{"sprinkler_01/cmd/sprinkler/home"}) {
+		t.Errorf("Expected other commands on the shared client, got %v", shared.published)
+	}
+
+	c.UnsubscribeFromDeviceTopics(secure)
+	if !session.disconnected || shared.disconnected {
+		t.Error("Expected unsubscribing to close only the device's session")
+	}
+	if got := c.deviceClient(secure.ID); got != shared {
+		t.Error("Expected the device to fall back to the shared client once its session is closed")
+	}
+}
+
+func TestDeviceSessionOptionsFallBackToSharedSettings(t *testing.T) {
+	cfg := config.MQTTConfig{Brokers: []string{"tcp://a:1883,tcp://b:1883"}, ClientID: "irrigation-system", ExactClientID: true, Username: "controller", Password: "shared-secret"}
+	opts := deviceSessionOptions(cfg, config.DeviceConfig{ID: "sprinkler_02", MQTT: &config.DeviceMQTTConfig{}})
+
+	if len(opts.Servers) != 2 {
+		t.Errorf("Expected the shared brokers, got %v", opts.Servers)
+	}
+	if opts.Username != "controller" || opts.Password != "shared-secret" {
+		t.Errorf("Expected the shared credentials, got %q/%q", opts.Username, opts.Password)
+	}
+	if opts.ClientID != "irrigation-system-sprinkler_02" {
+		t.Errorf("Expected a per-device client ID, got %q", opts.ClientID)
+	}
+}
+
+// stalledPahoClient is a connection that looks open but delivers nothing; it counts reconnects.
+type stalledPahoClient struct {
+	fakePahoClient
+	connects atomic.Int32
+}
+
+func (f *stalledPahoClient) IsConnectionOpen() bool  { return true }
+func (f *stalledPahoClient) Disconnect(quiesce uint) {}
+func (f *stalledPahoClient) Connect() mqtt.Token {
+	f.connects.Add(1)
+	return f.token
+}
+
+func TestWatchdogForcesReconnectOnSilence(t *testing.T) {
+	const window = 40 * time.Millisecond
+
+	testCases := []struct {
+		name          string
+		active        bool
+		messages      bool // whether a device keeps reporting while the watchdog runs
+		wantReconnect bool
+	}{
+		{name: "silence while jobs run", active: true, wantReconnect: true},
+		{name: "silence while idle", active: false},
+		{name: "messages while jobs run", active: true, messages: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &stalledPahoClient{fakePahoClient: fakePahoClient{token: &fakeToken{confirmed: true}}}
+			c := &Client{client: fake}
+			var stalls atomic.Int32
+			c.SetStallHandler(func(silence time.Duration) {
+				if silence < window {
+					t.Errorf("Expected a silence of at least %v, got %v", window, silence)
+				}
+				stalls.Add(1)
+			})
+
+			c.StartWatchdog(window, func() bool { return tc.active })
+			deadline := time.Now().Add(5 * window)
+			for time.Now().Before(deadline) {
+				if tc.messages {
+					c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/current_count", payload: []byte("1")})
+				}
+				time.Sleep(window / 8)
+			}
+			c.Close()
+
+			reconnected := fake.connects.Load() > 0
+			if reconnected != tc.wantReconnect {
+				t.Errorf("Expected reconnect %v, got %d reconnects", tc.wantReconnect, fake.connects.Load())
+			}
+			if stalls.Load() != fake.connects.Load() || c.ConnectionStats().WatchdogReconnects != int64(fake.connects.Load()) {
+				t.Errorf("Expected every forced reconnect to be alerted and counted, got %d alerts, %d reconnects and stats %+v", stalls.Load(), fake.connects.Load(), c.ConnectionStats())
+			}
+			if tc.messages && c.ConnectionStats().LastMessageAt == nil {
+				t.Error("Expected the last message time to be reported")
+			}
+		})
+	}
+}
+
+func TestPresenceTransitions(t *testing.T) {
+	type change struct {
+		deviceID string
+		online   bool
+	}
+
+	start := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	now := start
+	c := &Client{cfg: config.MQTTConfig{OfflineAfterSecs: 60}, now: func() time.Time { return now }}
+	c.subscribedDevices.Store("sprinkler_01", config.DeviceConfig{ID: "sprinkler_01"})
+	c.subscribedDevices.Store("pot_01", config.DeviceConfig{ID: "pot_01"})
+	var changes []change
+	c.SetPresenceHandler(func(deviceID string, online bool, lastSeen time.Time) {
+		changes = append(changes, change{deviceID, online})
+	})
+	monitor := newPresenceMonitor(now)
+	report := func() {
+		c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/current_count", payload: []byte("1")})
+	}
+
+	steps := []struct {
+		name        string
+		advance     time.Duration
+		report      bool
+		wantOnline  bool // sprinkler_01 as seen through GetDeviceStatus
+		wantChanges []change
+	}{
+		{name: "reported within ttl", advance: 10 * time.Second, report: true, wantOnline: true},
+		{name: "still fresh", advance: 45 * time.Second, wantOnline: true},
+		{name: "never reported goes offline after ttl", advance: 6 * time.Second, wantOnline: true, wantChanges: []change{{"pot_01", false}}},
+		{name: "stale goes offline", advance: 10 * time.Second, wantOnline: false, wantChanges: []change{{"sprinkler_01", false}}},
+		{name: "no repeat alert while offline", advance: time.Minute, wantOnline: false},
+		{name: "recovers on report", advance: time.Second, report: true, wantOnline: true, wantChanges: []change{{"sprinkler_01", true}}},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if step.report {
+			report()
+		}
+		changes = nil
+		c.checkPresence(monitor)
+
+		if !reflect.DeepEqual(changes, step.wantChanges) {
+			t.Errorf("%s: expected changes %v, got %v", step.name, step.wantChanges, changes)
+		}
+		if online := c.GetDeviceStatus("sprinkler_01").Online; online != step.wantOnline {
+			t.Errorf("%s: expected online %v, got %v", step.name, step.wantOnline, online)
+		}
+	}
+
+	if c.GetDeviceStatus("pot_01").Online {
+		t.Errorf("Expected a device that never reported to be offline")
+	}
+	c.ResetDeviceStatus("sprinkler_01")
+	if status := c.GetDeviceStatus("sprinkler_01"); !status.Online || status.LastMessageAt == nil {
+		t.Errorf("Expected reset to keep the last report time, got %+v", status)
+	}
+}
+
+func TestOnlineWithoutTTL(t *testing.T) {
+	c := &Client{}
+	if c.GetDeviceStatus("sprinkler_01").Online {
+		t.Errorf("Expected a device that never reported to be offline")
+	}
+	c.messageHandler(nil, fakeMessage{topic: "sprinkler_01/status/task/current_count", payload: []byte("1")})
+	if !c.GetDeviceStatus("sprinkler_01").Online {
+		t.Errorf("Expected a device that reported to be online without a TTL")
+	}
+}
@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+)
+
+// publishQueue serializes publishes per device: commands for one device are published one at a time
+// in the order they were enqueued, while different devices publish concurrently.
+// The zero value is ready to use.
+type publishQueue struct {
+	mu      sync.Mutex
+	devices map[string][]publishRequest // pending requests per device; present while a worker is draining them
+}
+
+// publishRequest is a queued publish and the channel its result is delivered on.
+type publishRequest struct {
+	topic    string
+	payload  string
+	retained bool
+	result   chan error
+}
+
+// publishFunc publishes a single message.
+type publishFunc func(topic, payload string, retained bool) error
+
+// enqueue queues a publish of payload to topic behind earlier publishes for the same device and
+// returns a channel that receives the result once publish has been called for it.
+func (q *publishQueue) enqueue(topic, payload string, retained bool, publish publishFunc) <-chan error {
+	req := publishRequest{topic: topic, payload: payload, retained: retained, result: make(chan error, 1)}
+	deviceID := topicDeviceID(topic)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.devices == nil {
+		q.devices = make(map[string][]publishRequest)
+	}
+	pending, draining := q.devices[deviceID]
+	q.devices[deviceID] = append(pending, req)
+	if !draining {
+		go q.drain(deviceID, publish)
+	}
+	return req.result
+}
+
+// drain publishes a device's queued requests in order and exits once the queue is empty,
+// so idle devices hold no goroutine.
+func (q *publishQueue) drain(deviceID string, publish publishFunc) {
+	for {
+		q.mu.Lock()
+		pending := q.devices[deviceID]
+		if len(pending) == 0 {
+			delete(q.devices, deviceID)
+			q.mu.Unlock()
+			return
+		}
+		req := pending[0]
+		q.devices[deviceID] = pending[1:]
+		q.mu.Unlock()
+
+		req.result <- publish(req.topic, req.payload, req.retained)
+	}
+}
+
+// topicDeviceID returns the device ID a command topic is addressed to: its first segment.
+func topicDeviceID(topic string) string {
+	deviceID, _, _ := strings.Cut(topic, "/")
+	return deviceID
+}
@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// recordingPahoClient is a paho Client that records published payloads per device, and every
+// publish in order, and can hold publishes for one device until released.
+type recordingPahoClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	published map[string][]string
+	messages  []recordedPublish
+	hold      map[string]chan struct{}
+}
+
+type recordedPublish struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+func (f *recordingPahoClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	deviceID := topicDeviceID(topic)
+	if release, ok := f.hold[deviceID]; ok {
+		<-release
+	}
+	// A short pause widens the window for out-of-order publishes if they were not serialized.
+	time.Sleep(time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published[deviceID] = append(f.published[deviceID], payload.(string))
+	f.messages = append(f.messages, recordedPublish{topic: topic, payload: payload.(string), retained: retained})
+	return &fakeToken{confirmed: true}
+}
+
+func TestEnqueuePreservesOrderPerDevice(t *testing.T) {
+	fake := &recordingPahoClient{published: make(map[string][]string)}
+	c := &Client{client: fake, publishTimeout: time.Second}
+
+	devices := []string{"sprinkler_01", "sprinkler_02", "plant_pot_01"}
+	const commands = 20
+
+	var wg sync.WaitGroup
+	for _, deviceID := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var results []<-chan error
+			for i := 0; i < commands; i++ {
+				results = append(results, c.Enqueue(deviceID+"/cmd/task/set", fmt.Sprint(i)))
+			}
+			for _, result := range results {
+				if err := <-result; err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var expected []string
+	for i := 0; i < commands; i++ {
+		expected = append(expected, fmt.Sprint(i))
+	}
+	for _, deviceID := range devices {
+		if !reflect.DeepEqual(fake.published[deviceID], expected) {
+			t.Errorf("Expected %s to receive %v in order, got %v", deviceID, expected, fake.published[deviceID])
+		}
+	}
+}
+
+func TestPublishDoesNotWaitOnOtherDevices(t *testing.T) {
+	release := make(chan struct{})
+	fake := &recordingPahoClient{
+		published: make(map[string][]string),
+		hold:      map[string]chan struct{}{"sprinkler_01": release},
+	}
+	c := &Client{client: fake, publishTimeout: time.Second}
+
+	held := c.Enqueue("sprinkler_01/cmd/reset", "reset")
+	queued := c.Enqueue("sprinkler_01/cmd/task/set", "[]")
+
+	done := make(chan error, 1)
+	go func() { done <- c.Publish("sprinkler_02/cmd/reset", "reset") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected sprinkler_02 to publish while sprinkler_01 is held")
+	}
+
+	select {
+	case <-queued:
+		t.Fatal("Expected sprinkler_01's second command to wait for the first")
+	default:
+	}
+
+	close(release)
+	if err := <-held; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err := <-queued; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if expected := []string{"reset", "[]"}; !reflect.DeepEqual(fake.published["sprinkler_01"], expected) {
+		t.Errorf("Expected %v, got %v", expected, fake.published["sprinkler_01"])
+	}
+}
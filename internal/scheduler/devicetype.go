@@ -0,0 +1,37 @@
+package scheduler
+
+import (
+	"sync"
+
+	"github.com/prite36/auto-irrigation-system/internal/config"
+)
+
+// DeviceProcessor runs one job for a device. It records history and sends notifications itself;
+// the returned error is reported by the caller.
+type DeviceProcessor func(s *Scheduler, device config.DeviceConfig, trigger Trigger) error
+
+var (
+	deviceProcessorsMu sync.RWMutex
+	deviceProcessors   = map[string]DeviceProcessor{
+		config.DeviceTypeSprinkler: (*Scheduler).processSprinklerDevice,
+		config.DeviceTypePlantPot:  (*Scheduler).processPlantPotDevice,
+	}
+)
+
+// RegisterDeviceType adds a device type: deviceType lists the status topics its devices publish,
+// for validation and MQTT subscriptions, and process runs its jobs. Registering an existing name
+// replaces it. Types must be registered before the device configuration is loaded.
+func RegisterDeviceType(name string, deviceType config.DeviceType, process DeviceProcessor) {
+	config.RegisterDeviceType(name, deviceType)
+
+	deviceProcessorsMu.Lock()
+	defer deviceProcessorsMu.Unlock()
+	deviceProcessors[name] = process
+}
+
+func lookupDeviceProcessor(name string) (DeviceProcessor, bool) {
+	deviceProcessorsMu.RLock()
+	defer deviceProcessorsMu.RUnlock()
+	process, ok := deviceProcessors[name]
+	return process, ok
+}
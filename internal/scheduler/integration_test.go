@@ -0,0 +1,105 @@
+package scheduler
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/models"
+	"github.com/prite36/auto-irrigation-system/internal/mqtt"
+	"github.com/prite36/auto-irrigation-system/internal/simulator"
+)
+
+// startTestBroker runs an embedded MQTT broker on a free local port and returns its URL.
+func startTestBroker(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	broker := mochi.New(nil)
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("Failed to add broker auth hook: %v", err)
+	}
+	if err := broker.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: address})); err != nil {
+		t.Fatalf("Failed to add broker listener: %v", err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return "tcp://" + address
+}
+
+// startSimulator connects a device simulator for devices to the broker.
+func startSimulator(t *testing.T, brokerURL string, devices []config.DeviceConfig, timing simulator.Timing) {
+	t.Helper()
+	var client pahomqtt.Client
+	sim := simulator.New(devices, timing, func(topic, payload string, retained bool) {
+		client.Publish(topic, 1, retained, payload).Wait()
+	})
+
+	opts := pahomqtt.NewClientOptions().AddBroker(brokerURL).SetClientID("simulator")
+	client = pahomqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("Simulator failed to connect: %v", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	for _, topic := range sim.CommandTopics() {
+		if token := client.Subscribe(topic, 1, func(_ pahomqtt.Client, msg pahomqtt.Message) {
+			sim.HandleCommand(msg.Topic(), msg.Payload())
+		}); token.Wait() && token.Error() != nil {
+			t.Fatalf("Simulator failed to subscribe: %v", token.Error())
+		}
+	}
+	sim.Announce()
+}
+
+func TestSprinklerJobCompletesAgainstSimulator(t *testing.T) {
+	brokerURL := startTestBroker(t)
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}, FlowRateLitersPerMinute: 3}
+	startSimulator(t, brokerURL, []config.DeviceConfig{device}, simulator.Timing{CalibrationDelay: 50 * time.Millisecond, StepDelay: 20 * time.Millisecond})
+
+	mqttClient, err := mqtt.NewClient(config.MQTTConfig{Broker: brokerURL, ClientID: "scheduler", PublishTimeoutSecs: 5})
+	if err != nil {
+		t.Fatalf("Failed to connect scheduler client: %v", err)
+	}
+	t.Cleanup(mqttClient.Close)
+	if err := mqttClient.SubscribeToDeviceTopics(device); err != nil {
+		t.Fatalf("Failed to subscribe device topics: %v", err)
+	}
+
+	db := newTestDB(t)
+	s := NewScheduler(&config.Config{Devices: []config.DeviceConfig{device}}, mqttClient, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 0, "to": 90, "sp": 1, "wv": 50, "wvea": "STOP", "ct": 1}, {"fr": 90, "to": 0, "sp": 1, "wv": 0, "wvea": "STOP", "ct": 1}], "timeoutMinutes": 1}`)
+
+	if err := s.processDevice(device, Trigger{Source: models.SourceManual}); err != nil {
+		t.Fatalf("Expected job to complete, got %v", err)
+	}
+
+	var history models.IrrigationHistory
+	if err := db.Where("device_id = ?", device.ID).First(&history).Error; err != nil {
+		t.Fatalf("Expected a history record, got %v", err)
+	}
+	if history.Status != models.StatusCompleted {
+		t.Errorf("Expected status %s, got %s", models.StatusCompleted, history.Status)
+	}
+	if history.WaterLiters <= 0 {
+		t.Errorf("Expected estimated water usage to be persisted, got %v", history.WaterLiters)
+	}
+	if steps := mqttClient.GetDeviceStatus(device.ID).TaskSteps; len(steps) != 2 {
+		t.Errorf("Expected the simulator to echo 2 task steps, got %v", steps)
+	}
+}
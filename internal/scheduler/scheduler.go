@@ -1,80 +1,796 @@
 package scheduler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	_ "time/tzdata" // embed the zone database so minimal images without tzdata still resolve scheduleTimezone
 
 	"github.com/go-co-op/gocron"
 	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/metrics"
 	"github.com/prite36/auto-irrigation-system/internal/models"
-	"github.com/prite36/auto-irrigation-system/internal/mqtt"
 	"github.com/prite36/auto-irrigation-system/internal/slack"
-	slackclient "github.com/slack-go/slack"
+	"github.com/prite36/auto-irrigation-system/internal/weather"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrSchedulerPaused is returned when a manual run is refused because the scheduler is paused.
+var ErrSchedulerPaused = errors.New("scheduler is paused")
+
+// historyCleanupTime is when the daily history cleanup job runs.
+const historyCleanupTime = "03:00"
+
+// historyCleanupTag tags the history cleanup job so it is not confused with device jobs.
+const historyCleanupTag = "history-cleanup"
+
+// ErrDeviceBusy is returned when a job is requested for a device that already has one in flight.
+var ErrDeviceBusy = errors.New("device job already running")
+
+// ErrTooManyManualRuns is returned when the configured number of concurrent manual runs is already in flight.
+var ErrTooManyManualRuns = errors.New("too many manual runs in flight")
+
+// ErrBrokerDisconnected is returned when the MQTT broker connection drops while a job is waiting on a device.
+var ErrBrokerDisconnected = errors.New("mqtt broker disconnected")
+
+// ErrFlagTimeout is returned when a device does not report the awaited status flag in time.
+var ErrFlagTimeout = errors.New("timed out waiting for flag")
+
+// ErrTaskNotAcknowledged is returned when a device does not report receiving a published task in time.
+var ErrTaskNotAcknowledged = errors.New("task not acknowledged")
+
+// ErrDeviceNotFound is returned when a request names a device that is not configured.
+var ErrDeviceNotFound = errors.New("device not found")
+
+// ErrCoolingDown is returned when a run is refused because the device ran within its cooldown.
+var ErrCoolingDown = errors.New("device is cooling down")
+
+// CooldownError reports when a device last ran and when it may run again. It matches ErrCoolingDown.
+type CooldownError struct {
+	DeviceID string
+	LastRun  time.Time
+	Until    time.Time
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("device %s last ran at %s; next run allowed after %s", e.DeviceID, e.LastRun.Format(time.RFC3339), e.Until.Format(time.RFC3339))
+}
+
+func (e *CooldownError) Unwrap() error {
+	return ErrCoolingDown
+}
+
+// ErrUnknownTask is returned when a trigger names tasks that are not configured for the device.
+var ErrUnknownTask = errors.New("unknown task")
+
+// ErrDeviceDisabled is returned when a run is refused because the device is disabled.
+var ErrDeviceDisabled = errors.New("device is disabled")
+
+// ErrCalibrationUnsupported is returned when calibration is requested for a device type that has none.
+var ErrCalibrationUnsupported = errors.New("device type has no calibration")
+
+// ErrPartialRun is returned when a run that went on past a failed task had some of its tasks succeed.
+var ErrPartialRun = errors.New("some tasks failed")
+
+// DeviceClient is the subset of the MQTT client used by the scheduler to drive devices.
+type DeviceClient interface {
+	Publish(topic, payload string) error
+	PublishRetained(topic, payload string) error
+	GetDeviceStatus(deviceID string) *models.DeviceStatus
+	GetDeviceStatusCopy(deviceID string) (models.DeviceStatus, bool)
+	ResetDeviceStatus(deviceID string)
+	IsConnected() bool
+	IsDeviceConnected(deviceID string) bool
+	SubscribeToDeviceTopics(device config.DeviceConfig) error
+	UnsubscribeFromDeviceTopics(device config.DeviceConfig)
+	PublishPresence() error
+}
+
+// ReloadSummary lists the device IDs affected by a device configuration reload.
+type ReloadSummary struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// Trigger describes what started a run. It is recorded on the run's history.
+type Trigger struct {
+	Source      models.TriggerSource
+	TriggeredBy string
+	Reason      string
+	// TaskParams are set on every step of each task payload for this run only, e.g. {"ct": 5}.
+	// Scheduled runs leave it empty and publish the task files unchanged.
+	TaskParams map[string]json.RawMessage
+	// TaskIDs runs only these of the device's tasks, in the given order, e.g. to re-run a failed task.
+	// Empty runs all of them.
+	TaskIDs []string
+}
+
+// pendingJob is a job interrupted by a broker disconnect, kept to be re-run on reconnect.
+type pendingJob struct {
+	device  config.DeviceConfig
+	trigger Trigger
+}
+
+// DefaultTasksDir is the directory task files are read from.
+const DefaultTasksDir = "tasks"
+
+// ErrInvalidTask is returned by ReadTaskDefinition when a task file cannot be parsed.
+var ErrInvalidTask = errors.New("invalid task definition")
+
 // TaskDefinition represents the structure of a task JSON file.
 type TaskDefinition struct {
 	Payload        json.RawMessage `json:"payload"`
 	TimeoutMinutes int             `json:"timeoutMinutes"`
 }
 
+// TaskTimeoutLimits bound the timeouts read from task files. A zero field disables that bound.
+type TaskTimeoutLimits struct {
+	DefaultMinutes int // used when a task file has no timeoutMinutes and none can be estimated
+	MaxMinutes     int // longer timeouts are clamped to this
+
+	// Estimator derives a timeout from the payload of task files without a timeoutMinutes; nil
+	// disables estimation. EstimateMarginPercent is added on top of its estimate.
+	Estimator             TaskTimeoutEstimator
+	EstimateMarginPercent int
+}
+
+// TaskTimeoutLimitsFromConfig returns the task timeout limits set by the schedule configuration.
+func TaskTimeoutLimitsFromConfig(cfg config.ScheduleConfig) TaskTimeoutLimits {
+	limits := TaskTimeoutLimits{
+		DefaultMinutes:        cfg.TaskDefaultTimeoutMins,
+		MaxMinutes:            cfg.TaskMaxTimeoutMins,
+		EstimateMarginPercent: cfg.TaskEstimateMarginPercent,
+	}
+	if cfg.TaskEstimateTimeout {
+		limits.Estimator = EstimateSprinklerTaskDuration
+	}
+	return limits
+}
+
+// TaskTimeoutEstimator estimates how long a device takes to run a task payload.
+type TaskTimeoutEstimator func(payload json.RawMessage) (time.Duration, error)
+
+// EstimateSprinklerTaskDuration estimates the run time of a sprinkler task payload, an array of
+// steps, assuming each of a step's sweeps (at least one) travels from its start to its end
+// position at its speed in position units per second.
+func EstimateSprinklerTaskDuration(payload json.RawMessage) (time.Duration, error) {
+	var steps []models.TaskStep
+	if err := json.Unmarshal(payload, &steps); err != nil {
+		return 0, fmt.Errorf("payload is not an array of sprinkler steps: %w", err)
+	}
+	if len(steps) == 0 {
+		return 0, errors.New("payload has no steps")
+	}
+	var seconds float64
+	for i, step := range steps {
+		if step.Speed <= 0 {
+			return 0, fmt.Errorf("step %d has no positive speed", i+1)
+		}
+		seconds += float64(max(step.Count, 1)) * math.Abs(step.To-step.From) / step.Speed
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// EffectiveTimeoutMinutes returns how long the scheduler waits for the task to report completion,
+// and why that differs from the file's timeoutMinutes when it does.
+func (t TaskDefinition) EffectiveTimeoutMinutes(limits TaskTimeoutLimits) (int, string) {
+	if t.TimeoutMinutes <= 0 && limits.Estimator != nil {
+		estimate, err := limits.Estimator(t.Payload)
+		if err == nil {
+			withMargin := estimate * time.Duration(100+max(limits.EstimateMarginPercent, 0)) / 100
+			minutes := max(int(math.Ceil(withMargin.Minutes())), 1)
+			if limits.MaxMinutes > 0 && minutes > limits.MaxMinutes {
+				return limits.MaxMinutes, fmt.Sprintf("timeoutMinutes is not set; the estimate of %d minutes exceeds the maximum; clamped to %d minutes", minutes, limits.MaxMinutes)
+			}
+			return minutes, fmt.Sprintf("timeoutMinutes is not set; estimated %d minutes from the payload", minutes)
+		}
+		if limits.DefaultMinutes > 0 {
+			return limits.DefaultMinutes, fmt.Sprintf("timeoutMinutes is not set and could not be estimated (%v); using the default of %d minutes", err, limits.DefaultMinutes)
+		}
+	}
+	switch {
+	case t.TimeoutMinutes <= 0 && limits.DefaultMinutes > 0:
+		return limits.DefaultMinutes, fmt.Sprintf("timeoutMinutes is not set; using the default of %d minutes", limits.DefaultMinutes)
+	case limits.MaxMinutes > 0 && t.TimeoutMinutes > limits.MaxMinutes:
+		return limits.MaxMinutes, fmt.Sprintf("timeoutMinutes %d exceeds the maximum; clamped to %d minutes", t.TimeoutMinutes, limits.MaxMinutes)
+	}
+	return t.TimeoutMinutes, ""
+}
+
+// TaskFilePath returns the path of the task file for taskID on deviceID within dir.
+func TaskFilePath(dir, deviceID, taskID string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_%s.json", deviceID, taskID))
+}
+
+// ReadTaskDefinition reads and parses the task file at path. A missing file returns an error
+// matching fs.ErrNotExist; a file that is not valid task JSON returns one matching ErrInvalidTask.
+func ReadTaskDefinition(path string) (*TaskDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var taskDef TaskDefinition
+	if err := json.Unmarshal(data, &taskDef); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	return &taskDef, nil
+}
+
+// ErrBrokenTaskFile is returned by ValidateTaskFiles for a task file that would fail its run.
+var ErrBrokenTaskFile = errors.New("broken task file")
+
+// ValidateTaskFiles checks every task file of the sprinkler devices in dir: it must exist, parse,
+// have a non-empty payload and, once limits are applied, a positive timeout. All problems are
+// returned together, each naming the device, the task and the reason.
+func ValidateTaskFiles(dir string, devices []config.DeviceConfig, limits TaskTimeoutLimits) error {
+	var errs []error
+	for _, device := range devices {
+		if device.Type != config.DeviceTypeSprinkler {
+			continue
+		}
+		for _, taskID := range device.TaskIDs {
+			if reason := taskFileProblem(TaskFilePath(dir, device.ID, taskID), limits); reason != "" {
+				errs = append(errs, fmt.Errorf("%w for device '%s', task '%s': %s", ErrBrokenTaskFile, device.ID, taskID, reason))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// taskFileProblem returns why the task file at path would fail its run, or "" when it is usable.
+func taskFileProblem(path string, limits TaskTimeoutLimits) string {
+	taskDef, err := ReadTaskDefinition(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Sprintf("%s does not exist", path)
+	} else if err != nil {
+		return err.Error()
+	}
+	switch string(bytes.TrimSpace(taskDef.Payload)) {
+	case "", "null", "[]", "{}", `""`:
+		return "the payload is empty"
+	}
+	if minutes, _ := taskDef.EffectiveTimeoutMinutes(limits); minutes <= 0 {
+		return fmt.Sprintf("timeoutMinutes is %d and no default applies; it must be positive", taskDef.TimeoutMinutes)
+	}
+	return ""
+}
+
 // Scheduler manages the scheduling of irrigation tasks.
 type Scheduler struct {
 	scheduler   *gocron.Scheduler
 	cfg         *config.Config
-	mqttClient  *mqtt.Client
+	mqttClient  DeviceClient
 	db          *gorm.DB
 	slackClient *slack.Client
+	weather     weather.Provider
+
+	paused           atomic.Bool
+	devicesMu        sync.RWMutex // guards cfg.Devices, which can be replaced by ReloadDevices
+	now              func() time.Time
+	pollInterval     time.Duration
+	taskSettleDelay  time.Duration
+	sleep            func(time.Duration) // waits out fixed delays such as a device's warmup
+	tasksDir         string
+	readTaskFile     func(path string) (*TaskDefinition, error)
+	calibrationSteps []calibrationStep // run in order by runCalibration
+	inFlight         sync.Map          // Devices with a running job (key: deviceID, value: time.Time started)
+	manualSlots      chan struct{}     // Bounds concurrent background manual runs; nil means unlimited
+	pendingResume    sync.Map          // Jobs interrupted by a broker disconnect (key: deviceID, value: pendingJob)
+	runThreads       sync.Map          // Slack threads of running jobs when SLACK_THREAD_RUNS is set (key: deviceID, value: runThread)
+	batchedDevices   sync.Map          // Devices in a run whose results are posted as one summary (key: deviceID)
+
+	startedAt  time.Time   // when the scheduler was created, for the uptime in Stats
+	runTotals  runCounters // finished jobs of all devices
+	deviceRuns sync.Map    // finished jobs per device (key: deviceID, value: *runCounters)
+
+	reconnectsMu  sync.Mutex
+	reconnects    []time.Time // recent broker reconnects, for flap detection
+	lastFlapAlert time.Time
+}
+
+// scheduleTimezone is the zone device schedule times are interpreted in.
+const scheduleTimezone = "Asia/Bangkok"
+
+// loadLocation loads the named time zone. If it is unavailable, UTC is returned with the error.
+func loadLocation(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC, fmt.Errorf("failed to load time zone %q: %w", name, err)
+	}
+	return loc, nil
 }
 
 // NewScheduler creates a new scheduler instance.
-func NewScheduler(cfg *config.Config, mqttClient *mqtt.Client, db *gorm.DB, slackClient *slack.Client) *Scheduler {
-	loc, err := time.LoadLocation("Asia/Bangkok")
+func NewScheduler(cfg *config.Config, mqttClient DeviceClient, db *gorm.DB, slackClient *slack.Client) *Scheduler {
+	loc, err := loadLocation(scheduleTimezone)
 	if err != nil {
-		log.Fatalf("Failed to load location: %v", err)
+		log.Printf("Warning: %v. Falling back to UTC; schedule times will be interpreted as UTC.", err)
 	}
 
 	s := gocron.NewScheduler(loc)
-	return &Scheduler{
-		scheduler:   s,
-		cfg:         cfg,
-		mqttClient:  mqttClient,
-		db:          db,
-		slackClient: slackClient,
+	sched := &Scheduler{
+		scheduler:        s,
+		cfg:              cfg,
+		mqttClient:       mqttClient,
+		db:               db,
+		slackClient:      slackClient,
+		now:              time.Now,
+		sleep:            time.Sleep,
+		pollInterval:     2 * time.Second,
+		taskSettleDelay:  3 * time.Second,
+		tasksDir:         DefaultTasksDir,
+		readTaskFile:     ReadTaskDefinition,
+		calibrationSteps: sprinklerCalibrationSteps,
+		startedAt:        time.Now(),
+	}
+	if cfg.Schedule.MaxConcurrentManual > 0 {
+		sched.manualSlots = make(chan struct{}, cfg.Schedule.MaxConcurrentManual)
 	}
+	sched.paused.Store(cfg.Schedule.Paused)
+	return sched
 }
 
-// Start begins the scheduler's job execution.
-func (s *Scheduler) Start() {
+// Start begins the scheduler's job execution. Jobs that cannot be scheduled are skipped and reported
+// in the returned error; the rest still run. With MQTT_SUBSCRIBE_AFTER_START, device topics are
+// subscribed once the jobs are armed, before interrupted runs are resumed and any job can fire.
+func (s *Scheduler) Start() error {
+	s.awaitStartup()
+
+	if s.cfg.Schedule.InterruptedJobs != "" && s.db != nil && !s.cfg.MQTT.SubscribeAfterStart {
+		s.resolveInterruptedJobs()
+	}
+
 	log.Println("Scheduling jobs based on device configurations...")
+	if len(s.devices()) == 0 {
+		s.notifySlackRich(slack.NewWarningMessage("⚠️ No Devices Configured", "The irrigation controller started without any devices, so no watering is scheduled. Check DEVICE_CONFIG_PATH."))
+	}
 
-	for _, device := range s.cfg.Devices {
-		for _, scheduleTime := range device.ScheduleTimes {
-			trimmedTime := strings.TrimSpace(scheduleTime)
-			if trimmedTime == "" {
+	// A job that cannot be scheduled is reported without keeping the other devices from running.
+	var errs []error
+	for _, device := range s.devices() {
+		if err := s.scheduleDevice(device); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.cfg.History.RetentionDays > 0 {
+		log.Printf("Scheduling history cleanup at %s (retention: %d days)", historyCleanupTime, s.cfg.History.RetentionDays)
+		if _, err := s.scheduler.Every(1).Day().At(historyCleanupTime).Tag(historyCleanupTag).Do(s.runHistoryCleanup); err != nil {
+			errs = append(errs, fmt.Errorf("failed to schedule history cleanup: %w", err))
+		}
+	}
+
+	if s.cfg.MQTT.SubscribeAfterStart {
+		s.subscribeDevices()
+		if s.cfg.Schedule.InterruptedJobs != "" && s.db != nil {
+			s.resolveInterruptedJobs()
+		}
+	}
+
+	s.scheduler.StartAsync()
+
+	if s.cfg.Schedule.NotifyStartup {
+		s.notifySlackRich(slack.NewInfoMessage("📅 Scheduler Started", s.startupSummary()))
+	}
+	if err := errors.Join(errs...); err != nil {
+		s.notifySlackRich(slack.NewErrorMessage("🚨 Scheduling Failed", fmt.Sprintf("Some jobs were not scheduled and will not run:\n%v", err)))
+		return err
+	}
+	return nil
+}
+
+// bulkSubscriber subscribes to the topics of many devices at once; the MQTT client does so concurrently.
+type bulkSubscriber interface {
+	SubscribeToDevices(devices []config.DeviceConfig)
+}
+
+// subscribeDevices subscribes to the topics of every configured device, starting their status tracking.
+func (s *Scheduler) subscribeDevices() {
+	devices := s.devices()
+	log.Printf("Subscribing to topics for %d configured devices...", len(devices))
+	if bulk, ok := s.mqttClient.(bulkSubscriber); ok {
+		bulk.SubscribeToDevices(devices)
+		return
+	}
+	for _, device := range devices {
+		if err := s.mqttClient.SubscribeToDeviceTopics(device); err != nil {
+			log.Printf("Error: Failed to subscribe device %s: %v", device.ID, err)
+		}
+	}
+}
+
+// resolveInterruptedJobs marks the runs a restart left started as interrupted and reports each to
+// Slack. With SCHEDULE_INTERRUPTED_JOBS=resume, sprinkler runs are also re-run in the background
+// from the task they were on.
+func (s *Scheduler) resolveInterruptedJobs() {
+	var interrupted []models.IrrigationHistory
+	if err := s.db.Where("status = ?", models.StatusStarted).Order("id").Find(&interrupted).Error; err != nil {
+		log.Printf("Warning: Failed to look up runs interrupted by a restart: %v", err)
+		return
+	}
+	for i := range interrupted {
+		s.resolveInterruptedJob(&interrupted[i])
+	}
+}
+
+// resolveInterruptedJob marks history interrupted, reports it and resumes it when configured and possible.
+func (s *Scheduler) resolveInterruptedJob(history *models.IrrigationHistory) {
+	devices := s.devices()
+	index := slices.IndexFunc(devices, func(device config.DeviceConfig) bool { return device.ID == history.DeviceID })
+	found := index >= 0
+	device := config.DeviceConfig{ID: history.DeviceID}
+	if found {
+		device = devices[index]
+	}
+
+	note := fmt.Sprintf("Interrupted by a controller restart %s.", interruptedAt(history))
+	var resume *Trigger
+	if s.cfg.Schedule.InterruptedJobs == config.InterruptedJobsResume {
+		taskIDs, reason := resumableTasks(history, device, found)
+		if reason == "" && s.IsPaused() {
+			reason = "the scheduler is paused"
+		}
+		if reason != "" {
+			note += " Not resumed: " + reason + "."
+		} else {
+			note += fmt.Sprintf(" Resuming with %s.", strings.Join(taskIDs, ", "))
+			resume = &Trigger{
+				Source:      history.Source,
+				TriggeredBy: history.TriggeredBy,
+				Reason:      fmt.Sprintf("resumes run %d, interrupted by a restart", history.ID),
+				TaskIDs:     taskIDs,
+			}
+		}
+	}
+
+	endedAt := s.now()
+	history.Status = models.StatusInterrupted
+	history.EndedAt = &endedAt
+	history.Notes = strings.TrimSpace(history.Notes + " " + note)
+	if err := s.db.Save(history).Error; err != nil {
+		log.Printf("Warning: Failed to mark run %d of device %s interrupted: %v", history.ID, history.DeviceID, err)
+		return
+	}
+	log.Printf("Run %d of device %s: %s", history.ID, history.DeviceID, note)
+	s.notifyDevice(device, slack.NewErrorMessage(fmt.Sprintf("🔁 Run Interrupted: %s", history.DeviceID), note))
+
+	if resume != nil {
+		go s.runDeviceJob(device, *resume)
+	}
+}
+
+// interruptedAt describes where in its progress an interrupted run stopped.
+func interruptedAt(history *models.IrrigationHistory) string {
+	switch history.Phase {
+	case "":
+		return "at an unknown point"
+	case models.PhaseTasks:
+		return fmt.Sprintf("during task %d (%s)", history.TaskIndex+1, history.CurrentTaskID)
+	default:
+		return "during " + strings.ReplaceAll(string(history.Phase), "_", " ")
+	}
+}
+
+// resumableTasks returns the tasks to re-run to finish an interrupted run: the device's tasks from
+// the one in progress, or all of them when the run stopped before its tasks. When the run cannot be
+// resumed, it returns why instead.
+func resumableTasks(history *models.IrrigationHistory, device config.DeviceConfig, found bool) ([]string, string) {
+	switch {
+	case !found:
+		return nil, "the device is no longer configured"
+	case device.Type != config.DeviceTypeSprinkler:
+		return nil, "only sprinkler runs are resumed"
+	case history.Phase == "":
+		return nil, "the run recorded no progress"
+	case history.Phase == models.PhaseValveCheck:
+		return nil, "its tasks had finished"
+	case history.Phase != models.PhaseTasks:
+		return device.TaskIDs, ""
+	}
+	index := slices.Index(device.TaskIDs, history.CurrentTaskID)
+	if index < 0 {
+		return nil, fmt.Sprintf("task %s is no longer configured", history.CurrentTaskID)
+	}
+	return device.TaskIDs[index:], ""
+}
+
+// startupSummary describes the armed schedule: how many devices and device jobs there are and when
+// each device runs next, so operators can confirm a restart re-armed everything.
+func (s *Scheduler) startupSummary() string {
+	devices := s.devices()
+	nextRuns := make(map[string]time.Time)
+	jobCount := 0
+	for _, job := range s.scheduler.Jobs() {
+		for _, tag := range job.Tags() {
+			if tag == historyCleanupTag {
 				continue
 			}
+			jobCount++
+			if next, ok := nextRuns[tag]; !ok || job.NextRun().Before(next) {
+				nextRuns[tag] = job.NextRun()
+			}
+		}
+	}
 
-			// Capture device for the closure
-			deviceToSchedule := device
+	var b strings.Builder
+	fmt.Fprintf(&b, "Devices: %d\nScheduled jobs: %d", len(devices), jobCount)
+	if s.IsPaused() {
+		b.WriteString("\nScheduled watering is paused.")
+	}
+	for _, device := range devices {
+		if next, ok := nextRuns[device.ID]; ok {
+			fmt.Fprintf(&b, "\n• %s: next run %s", device.ID, next.In(s.Location()).Format("Mon 02 Jan 15:04 MST"))
+		} else {
+			fmt.Fprintf(&b, "\n• %s: no schedule times", device.ID)
+		}
+	}
+	return b.String()
+}
 
-			log.Printf("Scheduling job for device '%s' at %s", deviceToSchedule.ID, trimmedTime)
-			_, err := s.scheduler.Every(1).Day().At(trimmedTime).Do(func() {
-				s.runDeviceJob(deviceToSchedule)
-			})
-			if err != nil {
-				log.Fatalf("Failed to schedule job for device '%s' at %s: %v", deviceToSchedule.ID, trimmedTime, err)
+// UpcomingRun is a future scheduled run of a device.
+type UpcomingRun struct {
+	DeviceID string    `json:"deviceId"`
+	Time     time.Time `json:"time"`
+	TaskIDs  []string  `json:"taskIds,omitempty"`
+}
+
+// UpcomingRuns returns the next count scheduled runs across all devices, earliest first. Device
+// jobs run daily, so later runs are projected from each job's next run time.
+func (s *Scheduler) UpcomingRuns(count int) []UpcomingRun {
+	if count <= 0 {
+		return []UpcomingRun{}
+	}
+	taskIDs := make(map[string][]string)
+	for _, device := range s.devices() {
+		taskIDs[device.ID] = device.TaskIDs
+	}
+
+	var runs []UpcomingRun
+	for _, job := range s.scheduler.Jobs() {
+		next := job.NextRun()
+		if next.IsZero() {
+			continue
+		}
+		for _, tag := range job.Tags() {
+			if tag == historyCleanupTag {
+				continue
+			}
+			for day := 0; day < count; day++ {
+				runs = append(runs, UpcomingRun{DeviceID: tag, Time: next.In(s.Location()).AddDate(0, 0, day), TaskIDs: taskIDs[tag]})
 			}
 		}
 	}
 
-	s.scheduler.StartAsync()
+	sort.SliceStable(runs, func(i, j int) bool {
+		if !runs[i].Time.Equal(runs[j].Time) {
+			return runs[i].Time.Before(runs[j].Time)
+		}
+		return runs[i].DeviceID < runs[j].DeviceID
+	})
+	if len(runs) > count {
+		runs = runs[:count]
+	}
+	if runs == nil {
+		runs = []UpcomingRun{}
+	}
+	return runs
+}
+
+// awaitStartup delays arming jobs for up to the startup grace period, returning as soon as
+// the MQTT connection of every configured device is confirmed.
+func (s *Scheduler) awaitStartup() {
+	grace := time.Duration(s.cfg.Schedule.StartupGraceSeconds) * time.Second
+	if grace <= 0 {
+		return
+	}
+
+	log.Printf("Waiting up to %v for the MQTT connection before scheduling jobs...", grace)
+	deadline := time.After(grace)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		if s.devicesConnected() {
+			log.Println("MQTT connection confirmed.")
+			return
+		}
+		select {
+		case <-deadline:
+			log.Printf("Startup grace period of %v elapsed without a confirmed MQTT connection. Scheduling jobs anyway.", grace)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// devicesConnected reports whether every configured device has an open connection to the broker,
+// checking the shared connection when no devices are configured. Devices with their own MQTT
+// session depend on that session rather than the shared connection.
+func (s *Scheduler) devicesConnected() bool {
+	devices := s.devices()
+	if len(devices) == 0 {
+		return s.mqttClient.IsConnected()
+	}
+	for _, device := range devices {
+		if !s.mqttClient.IsDeviceConnected(device.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// runHistoryCleanup is the scheduled entry point for CleanupHistory.
+func (s *Scheduler) runHistoryCleanup() {
+	removed, err := s.CleanupHistory()
+	if err != nil {
+		log.Printf("Error: History cleanup failed: %v", err)
+		return
+	}
+	log.Printf("History cleanup removed %d record(s) older than %d days.", removed, s.cfg.History.RetentionDays)
+}
+
+// CleanupHistory deletes irrigation history created before the retention window and returns the number of rows removed.
+// Rows are soft-deleted unless hard deletes are configured.
+func (s *Scheduler) CleanupHistory() (int64, error) {
+	if s.db == nil || s.cfg.History.RetentionDays <= 0 {
+		return 0, nil
+	}
+
+	cutoff := s.now().AddDate(0, 0, -s.cfg.History.RetentionDays)
+	query := s.db
+	if s.cfg.History.HardDelete {
+		query = query.Unscoped()
+	}
+	result := query.Where("created_at < ?", cutoff).Delete(&models.IrrigationHistory{})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete history older than %s: %w", cutoff.Format(time.RFC3339), result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// scheduleDevice arms a daily job for each of the device's schedule times, tagged with the device ID.
+func (s *Scheduler) scheduleDevice(device config.DeviceConfig) error {
+	for _, scheduleTime := range device.ScheduleTimes {
+		trimmedTime := strings.TrimSpace(scheduleTime)
+		if trimmedTime == "" {
+			continue
+		}
+
+		// Capture device for the closure
+		deviceToSchedule := device
+
+		log.Printf("Scheduling job for device '%s' at %s", deviceToSchedule.ID, trimmedTime)
+		_, err := s.scheduler.Every(1).Day().At(trimmedTime).Tag(deviceToSchedule.ID).Do(func() {
+			s.runScheduledDeviceJob(deviceToSchedule)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to schedule job for device '%s' at %s: %w", deviceToSchedule.ID, trimmedTime, err)
+		}
+	}
+	return nil
+}
+
+// DeviceIDs returns the IDs of the currently configured devices.
+func (s *Scheduler) DeviceIDs() []string {
+	devices := s.devices()
+	ids := make([]string, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+	}
+	return ids
+}
+
+// Devices returns a snapshot of the currently configured devices.
+func (s *Scheduler) Devices() []config.DeviceConfig {
+	return s.devices()
+}
+
+// Location returns the time zone device schedule times are interpreted in.
+func (s *Scheduler) Location() *time.Location {
+	return s.scheduler.Location()
+}
+
+// devices returns a snapshot of the currently configured devices.
+func (s *Scheduler) devices() []config.DeviceConfig {
+	s.devicesMu.RLock()
+	defer s.devicesMu.RUnlock()
+	return append([]config.DeviceConfig(nil), s.cfg.Devices...)
+}
+
+// ReloadDevices replaces the device configuration, rescheduling and re-subscribing only the
+// devices that were added, removed or changed. The devices must already be validated.
+func (s *Scheduler) ReloadDevices(devices []config.DeviceConfig) (ReloadSummary, error) {
+	s.devicesMu.Lock()
+	defer s.devicesMu.Unlock()
+
+	current := make(map[string]config.DeviceConfig, len(s.cfg.Devices))
+	for _, device := range s.cfg.Devices {
+		current[device.ID] = device
+	}
+
+	summary := ReloadSummary{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	var errs []error
+	for _, device := range devices {
+		old, exists := current[device.ID]
+		delete(current, device.ID)
+
+		switch {
+		case !exists:
+			summary.Added = append(summary.Added, device.ID)
+		case !reflect.DeepEqual(old, device):
+			summary.Changed = append(summary.Changed, device.ID)
+			s.scheduler.RemoveByTag(device.ID)
+			s.mqttClient.UnsubscribeFromDeviceTopics(old)
+		default:
+			continue
+		}
+
+		if err := s.mqttClient.SubscribeToDeviceTopics(device); err != nil {
+			errs = append(errs, err)
+		}
+		if err := s.scheduleDevice(device); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, old := range current {
+		summary.Removed = append(summary.Removed, old.ID)
+		s.scheduler.RemoveByTag(old.ID)
+		s.mqttClient.UnsubscribeFromDeviceTopics(old)
+	}
+	sort.Strings(summary.Removed)
+
+	s.cfg.Devices = devices
+	if len(summary.Added) > 0 || len(summary.Removed) > 0 || len(summary.Changed) > 0 {
+		if err := s.mqttClient.PublishPresence(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	log.Printf("Device configuration reloaded: added=%v removed=%v changed=%v", summary.Added, summary.Removed, summary.Changed)
+	return summary, errors.Join(errs...)
+}
+
+// Pause stops scheduled jobs from running until Resume is called. Jobs stay armed.
+func (s *Scheduler) Pause() {
+	s.paused.Store(true)
+	log.Println("Scheduler paused. Scheduled jobs will be skipped.")
+}
+
+// Resume lets scheduled jobs run again after Pause.
+func (s *Scheduler) Resume() {
+	s.paused.Store(false)
+	log.Println("Scheduler resumed.")
+}
+
+// IsPaused reports whether scheduled jobs are currently paused.
+func (s *Scheduler) IsPaused() bool {
+	return s.paused.Load()
+}
+
+// manualRunAllowed reports whether manual runs may start given the pause state.
+func (s *Scheduler) manualRunAllowed() bool {
+	return !s.IsPaused() || s.cfg.Schedule.AllowManualWhilePaused
+}
+
+// SetWeatherProvider enables the rain check for scheduled jobs using the given provider.
+func (s *Scheduler) SetWeatherProvider(provider weather.Provider) {
+	s.weather = provider
 }
 
 // Stop gracefully shuts down the scheduler.
@@ -83,240 +799,1624 @@ func (s *Scheduler) Stop() {
 	s.scheduler.Stop()
 }
 
-// RunJobForDevice runs the job for a specific device ID.
-func (s *Scheduler) RunJobForDevice(deviceID string) error {
+// RunJobForDevice runs the job for a specific device ID, recording trigger on its history.
+// It blocks until the job finishes and returns ErrDeviceBusy if the device already has a job in flight.
+func (s *Scheduler) RunJobForDevice(deviceID string, trigger Trigger) error {
+	if !s.claimDevice(deviceID) {
+		log.Printf("Manual run for device %s skipped: a job is already running.", deviceID)
+		return ErrDeviceBusy
+	}
+	defer s.releaseDevice(deviceID)
+	return s.runManualJob(deviceID, trigger)
+}
+
+// StartJobForDevice claims the device and runs its job in the background, so callers can reject
+// a request straight away with ErrDeviceBusy when the device already has a job in flight, with
+// ErrTooManyManualRuns when the limit on concurrent manual runs is reached, with
+// ErrSchedulerPaused when manual runs are not allowed while paused, or with the errors of
+// checkManualRun, such as ErrDeviceNotFound.
+func (s *Scheduler) StartJobForDevice(deviceID string, trigger Trigger) error {
+	if !s.manualRunAllowed() {
+		log.Printf("Manual run for device %s rejected: paused.", deviceID)
+		return ErrSchedulerPaused
+	}
+	if !s.acquireManualSlot() {
+		log.Printf("Manual run for device %s rejected: too many manual runs in flight.", deviceID)
+		return ErrTooManyManualRuns
+	}
+	if !s.claimDevice(deviceID) {
+		s.releaseManualSlot()
+		log.Printf("Manual run for device %s rejected: a job is already running.", deviceID)
+		return ErrDeviceBusy
+	}
+	if err := s.checkManualRun(deviceID, trigger); err != nil {
+		s.releaseDevice(deviceID)
+		s.releaseManualSlot()
+		return err
+	}
+	go func() {
+		defer s.releaseManualSlot()
+		defer s.releaseDevice(deviceID)
+		if err := s.runManualJob(deviceID, trigger); err != nil {
+			log.Printf("Manual run for device %s failed: %v", deviceID, err)
+		}
+	}()
+	return nil
+}
+
+// checkManualRun returns why a manual run of the device must be refused before it starts: the
+// device is not configured, names unknown tasks, is disabled or is cooling down. A cooldown
+// refusal is recorded on history.
+func (s *Scheduler) checkManualRun(deviceID string, trigger Trigger) error {
+	for _, device := range s.devices() {
+		if device.ID != deviceID {
+			continue
+		}
+		if err := checkTaskIDs(device, trigger.TaskIDs); err != nil {
+			return err
+		}
+		if s.isDisabled(deviceID) {
+			log.Printf("Manual run for device %s rejected: the device is disabled.", deviceID)
+			return fmt.Errorf("%w: %s", ErrDeviceDisabled, deviceID)
+		}
+		if err := s.checkCooldown(device); err != nil {
+			s.recordCooldownSkip(device, trigger, err)
+			return err
+		}
+		return nil
+	}
+	log.Printf("Manual run for device %s rejected: device not found.", deviceID)
+	return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID)
+}
+
+// checkTaskIDs returns an ErrUnknownTask error naming any of taskIDs not configured for the device.
+func checkTaskIDs(device config.DeviceConfig, taskIDs []string) error {
+	var unknown []string
+	for _, taskID := range taskIDs {
+		if !slices.Contains(device.TaskIDs, taskID) {
+			unknown = append(unknown, taskID)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%w for device %s: %s", ErrUnknownTask, device.ID, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// IsDeviceRunning reports whether the device has a job in flight.
+func (s *Scheduler) IsDeviceRunning(deviceID string) bool {
+	_, running := s.inFlight.Load(deviceID)
+	return running
+}
+
+// HasRunningJobs reports whether any device has a job in flight.
+func (s *Scheduler) HasRunningJobs() bool {
+	running := false
+	s.inFlight.Range(func(key, value interface{}) bool {
+		running = true
+		return false
+	})
+	return running
+}
+
+// claimDevice marks the device as running, returning false if it already was.
+func (s *Scheduler) claimDevice(deviceID string) bool {
+	_, loaded := s.inFlight.LoadOrStore(deviceID, s.now())
+	return !loaded
+}
+
+// releaseDevice marks the device's job as finished.
+func (s *Scheduler) releaseDevice(deviceID string) {
+	s.inFlight.Delete(deviceID)
+}
+
+// acquireManualSlot reserves one of the concurrent manual run slots without blocking.
+func (s *Scheduler) acquireManualSlot() bool {
+	if s.manualSlots == nil {
+		return true
+	}
+	select {
+	case s.manualSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseManualSlot frees a slot reserved by acquireManualSlot.
+func (s *Scheduler) releaseManualSlot() {
+	if s.manualSlots != nil {
+		<-s.manualSlots
+	}
+}
+
+// runManualJob runs a manual job for a device the caller has already claimed.
+func (s *Scheduler) runManualJob(deviceID string, trigger Trigger) error {
+	if !s.manualRunAllowed() {
+		log.Printf("Manual run for device %s skipped: paused.", deviceID)
+		return ErrSchedulerPaused
+	}
 	log.Printf("Starting manual run for device: %s...", deviceID)
-	s.notifySlackRich(slack.NewInfoMessage(fmt.Sprintf("🚀 Manual Run Started for %s", deviceID), fmt.Sprintf("Manual run for device %s has commenced.", deviceID)))
 
-	for _, device := range s.cfg.Devices {
+	for _, device := range s.devices() {
+		if device.ID == deviceID {
+			s.notifyDevice(device, slack.NewInfoMessage(fmt.Sprintf("🚀 Manual Run Started for %s", deviceID), fmt.Sprintf("Manual run for device %s has commenced.", deviceID)))
+			if err := s.executeDeviceJob(device, trigger); err != nil {
+				return err // Error is already logged and reported in executeDeviceJob
+			}
+			log.Printf("Manual run for device %s finished.", deviceID)
+			s.notifyDevice(device, slack.NewSuccessMessage(fmt.Sprintf("✅ Manual Run Completed for %s", deviceID), fmt.Sprintf("Finished processing device %s for the manual run.", deviceID)))
+			return nil
+		}
+	}
+
+	log.Printf("Manual run for device %s failed: device not found.", deviceID)
+	s.notifySlackRich(slack.NewErrorMessage(fmt.Sprintf("🚨 Manual Run Failed for %s", deviceID), fmt.Sprintf("Device with ID '%s' not found.", deviceID)))
+	return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID)
+}
+
+// CalibrateDevice homes every axis of a sprinkler and waits for the result, without running its tasks.
+// Unlike a job, it always publishes the home commands, ignoring a recent calibration or cached flags.
+// It counts against the manual run limit and is refused while the device has a job in flight.
+func (s *Scheduler) CalibrateDevice(deviceID string, trigger Trigger) error {
+	var device config.DeviceConfig
+	found := false
+	for _, candidate := range s.devices() {
+		if candidate.ID == deviceID {
+			device, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID)
+	}
+	if device.Type != config.DeviceTypeSprinkler {
+		return fmt.Errorf("%w: %s is a %s", ErrCalibrationUnsupported, deviceID, device.Type)
+	}
+	if !s.manualRunAllowed() {
+		return ErrSchedulerPaused
+	}
+	if !s.acquireManualSlot() {
+		return ErrTooManyManualRuns
+	}
+	defer s.releaseManualSlot()
+	if !s.claimDevice(deviceID) {
+		return ErrDeviceBusy
+	}
+	defer s.releaseDevice(deviceID)
+
+	log.Printf("Starting on-demand calibration for device %s...", deviceID)
+	now := s.now()
+	history := &models.IrrigationHistory{
+		DeviceID:    deviceID,
+		ScheduledAt: now,
+		StartedAt:   &now,
+		Status:      models.StatusStarted,
+		Notes:       "Calibration only.",
+		Source:      trigger.Source,
+		TriggeredBy: trigger.TriggeredBy,
+		Reason:      trigger.Reason,
+		Labels:      device.Labels,
+	}
+	s.db.Create(history)
+
+	s.mqttClient.ResetDeviceStatus(deviceID)
+	if err := s.calibrate(device, history); err != nil {
+		return err // Error is already logged and saved in runCalibrationStep
+	}
+
+	endedAt := s.now()
+	history.Status = models.StatusCalibrated
+	endRun(history, endedAt)
+	history.Notes = "Calibration only. All axes calibrated."
+	s.db.Save(history)
+	return nil
+}
+
+// StartAllJobsOnce runs all device jobs in the background. It counts as a single manual run
+// against the concurrency limit and returns ErrTooManyManualRuns when no slot is free.
+func (s *Scheduler) StartAllJobsOnce() error {
+	if !s.acquireManualSlot() {
+		log.Println("Manual run for all devices rejected: too many manual runs in flight.")
+		return ErrTooManyManualRuns
+	}
+	go func() {
+		defer s.releaseManualSlot()
+		s.RunAllJobsOnce()
+	}()
+	return nil
+}
+
+// RunAllJobsOnce is a debug function to run all device jobs immediately.
+func (s *Scheduler) RunAllJobsOnce() {
+	s.RunJobsOnce(nil)
+}
+
+// JobResult is the outcome of one device job run by RunJobsOnce.
+type JobResult struct {
+	DeviceID  string
+	StartedAt time.Time
+	Duration  time.Duration
+	// Err is nil when the job completed. It wraps ErrSchedulerPaused, ErrDeviceNotFound, ErrCoolingDown,
+	// ErrDeviceBusy or ErrDeviceDisabled when the job was skipped, and the job's error when it failed.
+	Err error
+}
+
+// Skipped reports whether the job was not run at all.
+func (r JobResult) Skipped() bool {
+	for _, target := range []error{ErrSchedulerPaused, ErrDeviceNotFound, ErrCoolingDown, ErrDeviceBusy, ErrDeviceDisabled} {
+		if errors.Is(r.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunJobsOnce runs the jobs of the given devices, or of all devices when none are given, one after
+// another in priority order, and returns the outcome of each.
+func (s *Scheduler) RunJobsOnce(deviceIDs []string) []JobResult {
+	devices := byPriority(s.devices())
+	scope := "all devices"
+	var results []JobResult
+	if len(deviceIDs) > 0 {
+		scope = strings.Join(deviceIDs, ", ")
+		var selected []config.DeviceConfig
+		for _, id := range deviceIDs {
+			index := slices.IndexFunc(devices, func(device config.DeviceConfig) bool { return device.ID == id })
+			if index < 0 {
+				results = append(results, JobResult{DeviceID: id, Err: fmt.Errorf("%w: %s", ErrDeviceNotFound, id)})
+				continue
+			}
+			selected = append(selected, devices[index])
+		}
+		devices = byPriority(selected)
+	}
+
+	if !s.manualRunAllowed() {
+		log.Printf("Manual run for %s skipped: paused.", scope)
+		for _, device := range devices {
+			results = append(results, JobResult{DeviceID: device.ID, Err: ErrSchedulerPaused})
+		}
+		return results
+	}
+	batched := s.cfg.Slack.BatchRunSummary
+	log.Printf("Starting manual run for %s...", scope)
+	if !batched {
+		s.notifySlackRich(slack.NewInfoMessage("🚀 Manual Run Started", fmt.Sprintf("Manual run for %s has commenced.", scope)))
+	}
+
+	for _, device := range devices {
+		if batched {
+			s.batchedDevices.Store(device.ID, struct{}{})
+		}
+		trigger := Trigger{Source: models.SourceManual}
+		result := JobResult{DeviceID: device.ID, StartedAt: s.now()}
+		if err := s.checkCooldown(device); err != nil {
+			s.recordCooldownSkip(device, trigger, err)
+			result.Err = err
+		} else {
+			result.Err = s.runDeviceJob(device, trigger)
+		}
+		result.Duration = s.now().Sub(result.StartedAt)
+		results = append(results, result)
+		s.batchedDevices.Delete(device.ID)
+	}
+
+	log.Printf("Manual run for %s finished.", scope)
+	if batched {
+		s.notifySlackRich(runSummaryMessage(results))
+	} else {
+		s.notifySlackRich(slack.NewSuccessMessage("✅ Manual Run Completed", fmt.Sprintf("Finished processing %s for the manual run.", scope)))
+	}
+	return results
+}
+
+// runSummaryMessage lists the result of each device of a manual run in one message. It is an error
+// when any device failed.
+func runSummaryMessage(results []JobResult) slack.Message {
+	lines := make([]string, 0, len(results))
+	failed := 0
+	for _, result := range results {
+		duration := result.Duration.Round(time.Second)
+		switch {
+		case result.Err == nil:
+			lines = append(lines, fmt.Sprintf("✅ %s completed in %v", result.DeviceID, duration))
+		case result.Skipped():
+			lines = append(lines, fmt.Sprintf("⏭️ %s skipped: %v", result.DeviceID, result.Err))
+		default:
+			failed++
+			lines = append(lines, fmt.Sprintf("🚨 %s failed after %v: %v", result.DeviceID, duration, result.Err))
+		}
+	}
+	details := strings.Join(lines, "\n")
+	if failed > 0 {
+		return slack.NewErrorMessage(fmt.Sprintf("📋 Manual Run Summary: %d of %d failed", failed, len(results)), details)
+	}
+	return slack.NewSuccessMessage("📋 Manual Run Summary", details)
+}
+
+// byPriority sorts devices so higher priorities come first, keeping file order between equal priorities.
+func byPriority(devices []config.DeviceConfig) []config.DeviceConfig {
+	slices.SortStableFunc(devices, func(a, b config.DeviceConfig) int {
+		return b.Priority - a.Priority
+	})
+	return devices
+}
+
+// runScheduledDeviceJob runs a scheduled job for a device unless the scheduler is paused or rain is forecast.
+func (s *Scheduler) runScheduledDeviceJob(device config.DeviceConfig) {
+	if s.IsPaused() {
+		log.Printf("Scheduled job for device %s skipped: paused.", device.ID)
+		return
+	}
+
+	if err := s.checkCooldown(device); err != nil {
+		s.recordCooldownSkip(device, Trigger{Source: models.SourceScheduled}, err)
+		return
+	}
+
+	if skip, probability := s.rainCheck(); skip {
+		msg := fmt.Sprintf("Skipping scheduled watering for device %s: %.0f%% chance of rain (threshold %.0f%%).", device.ID, probability, s.cfg.Weather.RainThreshold)
+		log.Println(msg)
+		now := s.now()
+		s.db.Create(&models.IrrigationHistory{
+			DeviceID:    device.ID,
+			ScheduledAt: now,
+			EndedAt:     &now,
+			Status:      models.StatusSkipped,
+			Notes:       msg,
+			Source:      models.SourceScheduled,
+			Labels:      device.Labels,
+		})
+		s.notifyDevice(device, slack.NewInfoMessage(fmt.Sprintf("🌧️ Watering Skipped: %s", device.ID), msg))
+		return
+	}
+	s.runDeviceJob(device, Trigger{Source: models.SourceScheduled})
+}
+
+// cooldown returns the minimum interval between the starts of two runs of the device.
+// The device's cooldownMinutes overrides the global setting; 0 disables the cooldown.
+func (s *Scheduler) cooldown(device config.DeviceConfig) time.Duration {
+	minutes := s.cfg.Schedule.CooldownMinutes
+	if device.CooldownMinutes != nil {
+		minutes = *device.CooldownMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// checkCooldown returns a *CooldownError when the device started a run within its cooldown.
+// The last run is read from history; skipped runs and on-demand calibrations do not count.
+func (s *Scheduler) checkCooldown(device config.DeviceConfig) error {
+	cooldown := s.cooldown(device)
+	if cooldown <= 0 {
+		return nil
+	}
+
+	var last models.IrrigationHistory
+	err := s.db.Where("device_id = ? AND started_at IS NOT NULL AND status <> ?", device.ID, models.StatusCalibrated).
+		Order("started_at DESC").Limit(1).Find(&last).Error
+	if err != nil {
+		log.Printf("Warning: Failed to load the last run of device %s, ignoring cooldown: %v", device.ID, err)
+		return nil
+	}
+	if last.ID == 0 {
+		return nil
+	}
+
+	until := last.StartedAt.Add(cooldown)
+	if s.now().Before(until) {
+		return &CooldownError{DeviceID: device.ID, LastRun: *last.StartedAt, Until: until}
+	}
+	return nil
+}
+
+// recordCooldownSkip records a run refused by checkCooldown as skipped and reports it to Slack.
+func (s *Scheduler) recordCooldownSkip(device config.DeviceConfig, trigger Trigger, err error) {
+	msg := fmt.Sprintf("Skipping %s watering for device %s: %v.", trigger.Source, device.ID, err)
+	log.Println(msg)
+	now := s.now()
+	s.db.Create(&models.IrrigationHistory{
+		DeviceID:    device.ID,
+		ScheduledAt: now,
+		EndedAt:     &now,
+		Status:      models.StatusSkipped,
+		Notes:       msg,
+		Source:      trigger.Source,
+		TriggeredBy: trigger.TriggeredBy,
+		Reason:      trigger.Reason,
+		Labels:      device.Labels,
+	})
+	s.notifyDevice(device, slack.NewInfoMessage(fmt.Sprintf("⏸️ Watering Skipped (cooldown): %s", device.ID), msg))
+}
+
+// rainCheck reports whether the forecast precipitation probability exceeds the configured threshold.
+// If no weather provider is set or the forecast cannot be fetched, watering proceeds.
+func (s *Scheduler) rainCheck() (bool, float64) {
+	if s.weather == nil {
+		return false, 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	probability, err := s.weather.PrecipitationProbability(ctx)
+	if err != nil {
+		log.Printf("Warning: Rain check failed, watering as scheduled: %v", err)
+		return false, 0
+	}
+	return probability > s.cfg.Weather.RainThreshold, probability
+}
+
+// runDeviceJob runs the job for a device unless it already has one in flight.
+func (s *Scheduler) runDeviceJob(device config.DeviceConfig, trigger Trigger) error {
+	if !s.claimDevice(device.ID) {
+		log.Printf("Skipping %s job for device %s: a job is already running.", trigger.Source, device.ID)
+		return ErrDeviceBusy
+	}
+	defer s.releaseDevice(device.ID)
+	return s.executeDeviceJob(device, trigger)
+}
+
+// executeDeviceJob runs the processor for a device the caller has already claimed, reports any
+// failure and returns it.
+func (s *Scheduler) executeDeviceJob(device config.DeviceConfig, trigger Trigger) error {
+	if s.isDisabled(device.ID) {
+		log.Printf("Skipping %s job for device %s: the device is disabled.", trigger.Source, device.ID)
+		return ErrDeviceDisabled
+	}
+
+	log.Printf("Starting %s job for device %s of type %s", trigger.Source, device.ID, device.Type)
+	s.startRunThread(device, trigger)
+	defer s.runThreads.Delete(device.ID)
+	s.publishJobStatus(device, trigger, models.JobStarted, nil)
+	err := s.processDevice(device, trigger)
+	s.countRun(device.ID, err)
+	if err != nil {
+		s.publishJobStatus(device, trigger, models.JobFailed, err)
+	} else {
+		s.publishJobStatus(device, trigger, models.JobCompleted, nil)
+	}
+
+	if errors.Is(err, config.ErrUnknownDeviceType) {
+		log.Printf("Warning: %v. Skipping.", err)
+		s.notifyDevice(device, slack.NewWarningMessage(fmt.Sprintf("⚠️ Unknown Device Type: %s", device.ID), fmt.Sprintf("Device was not processed: %v", err)))
+		return err
+	}
+
+	if err != nil {
+		log.Printf("Error processing device %s: %v.", device.ID, err)
+		s.notifyDevice(device, slack.NewErrorMessage(fmt.Sprintf("🚨 ERROR: Device %s", device.ID), fmt.Sprintf("Error processing device: %v", err)))
+
+		if errors.Is(err, ErrBrokerDisconnected) && s.cfg.MQTT.ResumeOnReconnect {
+			log.Printf("Job for device %s will be re-run once the broker connection is restored.", device.ID)
+			s.pendingResume.Store(device.ID, pendingJob{device: device, trigger: trigger})
+		}
+	}
+	if !errors.Is(err, ErrBrokerDisconnected) {
+		s.sendSleepCommand(device, err)
+	}
+	s.recordRunOutcome(device, err)
+	return err
+}
+
+// sendSleepCommand publishes the device's sleep command after its run, unless the run failed and the
+// command does not apply on failure. A failed publish is logged and leaves the run's outcome unchanged.
+func (s *Scheduler) sendSleepCommand(device config.DeviceConfig, runErr error) {
+	sleep := device.SleepCommand
+	if sleep == nil || (runErr != nil && !sleep.OnFailure) {
+		return
+	}
+	topic := fmt.Sprintf("%s/%s", device.ID, sleep.Topic)
+	payload := sleep.Payload
+	if device.CommandFormat == config.CommandFormatJSON {
+		payload = s.commandEnvelope(topic, payload)
+	}
+	err := s.publish(device, topic, payload)
+	s.recordCommand(device, nil, topic, payload, err)
+	if err != nil {
+		log.Printf("Warning: Failed to send the sleep command to device %s: %v", device.ID, err)
+		return
+	}
+	log.Printf("Sent the sleep command to device %s.", device.ID)
+}
+
+// publishJobStatus mirrors a job lifecycle event onto MQTT_JOB_STATUS_TOPIC as retained JSON,
+// so other systems on the bus can follow irrigation jobs. Failures are logged and never fail the job.
+func (s *Scheduler) publishJobStatus(device config.DeviceConfig, trigger Trigger, status models.JobStatus, runErr error) {
+	if s.cfg.MQTT.JobStatusTopic == "" {
+		return
+	}
+	event := models.JobStatusEvent{DeviceID: device.ID, Status: status, Trigger: trigger.Source, Timestamp: s.now()}
+	if runErr != nil {
+		event.Error = runErr.Error()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Warning: Failed to encode the %s job status of device %s: %v", status, device.ID, err)
+		return
+	}
+	topic := strings.ReplaceAll(s.cfg.MQTT.JobStatusTopic, "{deviceId}", device.ID)
+	if err := s.mqttClient.PublishRetained(topic, string(payload)); err != nil {
+		log.Printf("Warning: Failed to publish the %s job status of device %s to %s: %v", status, device.ID, topic, err)
+	}
+}
+
+// recordRunOutcome counts consecutive failed runs of the device and disables it once they reach
+// SCHEDULE_FAILURE_THRESHOLD; a successful run resets the count. Broker disconnects are not the
+// device's fault and leave the count unchanged.
+func (s *Scheduler) recordRunOutcome(device config.DeviceConfig, runErr error) {
+	threshold := s.cfg.Schedule.FailureThreshold
+	if threshold <= 0 || s.db == nil || errors.Is(runErr, ErrBrokerDisconnected) {
+		return
+	}
+
+	state, err := s.loadDeviceState(device.ID)
+	if err != nil {
+		log.Printf("Warning: Failed to load the failure count of device %s: %v", device.ID, err)
+		return
+	}
+	if runErr == nil {
+		if state.ConsecutiveFailures > 0 {
+			state.ConsecutiveFailures = 0
+			s.saveDeviceState(state)
+		}
+		return
+	}
+
+	state.ConsecutiveFailures++
+	disable := state.ConsecutiveFailures >= threshold && state.DisabledAt == nil
+	if disable {
+		disabledAt := s.now()
+		state.DisabledAt = &disabledAt
+		state.DisabledReason = fmt.Sprintf("%d consecutive failed runs; last error: %v", state.ConsecutiveFailures, runErr)
+	}
+	s.saveDeviceState(state)
+
+	if disable {
+		msg := fmt.Sprintf("Device %s failed %d runs in a row and has been disabled. Its scheduled and manual runs are skipped until it is re-enabled with POST /api/v1/devices/%s/enable. Last error: %v", device.ID, state.ConsecutiveFailures, device.ID, runErr)
+		log.Println(msg)
+		s.notifyDevice(device, slack.NewErrorMessage(fmt.Sprintf("⛔ Device Disabled: %s", device.ID), msg))
+	}
+}
+
+// isDisabled reports whether the device is disabled, either manually or after repeated failures.
+func (s *Scheduler) isDisabled(deviceID string) bool {
+	if s.db == nil {
+		return false
+	}
+	state, err := s.loadDeviceState(deviceID)
+	if err != nil {
+		log.Printf("Warning: Failed to load the state of device %s, treating it as enabled: %v", deviceID, err)
+		return false
+	}
+	return state.DisabledAt != nil
+}
+
+// DeviceState returns the persisted state of a configured device, including whether it is disabled.
+func (s *Scheduler) DeviceState(deviceID string) (models.DeviceState, error) {
+	if !s.hasDevice(deviceID) {
+		return models.DeviceState{}, fmt.Errorf("%w: %s", ErrDeviceNotFound, deviceID)
+	}
+	return s.loadDeviceState(deviceID)
+}
+
+// EnableDevice re-enables a disabled device and resets its failure count.
+func (s *Scheduler) EnableDevice(deviceID string) (models.DeviceState, error) {
+	state, err := s.DeviceState(deviceID)
+	if err != nil {
+		return state, err
+	}
+	wasDisabled := state.DisabledAt != nil
+	state.ConsecutiveFailures = 0
+	state.DisabledAt = nil
+	state.DisabledReason = ""
+	if err := s.saveDeviceState(state); err != nil {
+		return state, err
+	}
+	if wasDisabled {
+		log.Printf("Device %s re-enabled.", deviceID)
+		s.notifySlackRich(slack.NewSuccessMessage(fmt.Sprintf("✅ Device Re-enabled: %s", deviceID), fmt.Sprintf("Runs of device %s will no longer be skipped.", deviceID)))
+	}
+	return state, nil
+}
+
+// DisableDevice disables a device so its scheduled and manual runs are skipped until it is re-enabled.
+func (s *Scheduler) DisableDevice(deviceID, reason string) (models.DeviceState, error) {
+	state, err := s.DeviceState(deviceID)
+	if err != nil {
+		return state, err
+	}
+	if state.DisabledAt != nil {
+		return state, nil
+	}
+	disabledAt := s.now()
+	state.DisabledAt = &disabledAt
+	state.DisabledReason = reason
+	if err := s.saveDeviceState(state); err != nil {
+		return state, err
+	}
+	log.Printf("Device %s disabled: %s", deviceID, reason)
+	return state, nil
+}
+
+// hasDevice reports whether deviceID is configured.
+func (s *Scheduler) hasDevice(deviceID string) bool {
+	return slices.ContainsFunc(s.devices(), func(device config.DeviceConfig) bool { return device.ID == deviceID })
+}
+
+// loadDeviceState returns the persisted state of a device, or an empty state when none is stored.
+func (s *Scheduler) loadDeviceState(deviceID string) (models.DeviceState, error) {
+	state := models.DeviceState{DeviceID: deviceID}
+	err := s.db.Where("device_id = ?", deviceID).Limit(1).Find(&state).Error
+	return state, err
+}
+
+// saveDeviceState persists the failure count and disabled state of a device, leaving its calibration time untouched.
+func (s *Scheduler) saveDeviceState(state models.DeviceState) error {
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"consecutive_failures", "disabled_at", "disabled_reason", "updated_at"}),
+	}).Create(&state).Error
+	if err != nil {
+		log.Printf("Warning: Failed to save the state of device %s: %v", state.DeviceID, err)
+	}
+	return err
+}
+
+// processDevice selects the registered processor for a given device and executes it.
+func (s *Scheduler) processDevice(device config.DeviceConfig, trigger Trigger) error {
+	process, ok := lookupDeviceProcessor(device.Type)
+	if !ok {
+		return fmt.Errorf("%w '%s' for device '%s'", config.ErrUnknownDeviceType, device.Type, device.ID)
+	}
+	return process(s, device, trigger)
+}
+
+// HandleConnectionLost is invoked by the MQTT client when the broker connection drops.
+func (s *Scheduler) HandleConnectionLost(err error) {
+	if s.cfg.MQTT.NotifyConnectionLoss {
+		s.notifySlackRich(slack.NewErrorMessage("🔌 MQTT Connection Lost", fmt.Sprintf("Connection to the MQTT broker was lost: %v. In-flight jobs will be aborted.", err)))
+	}
+}
+
+// HandleStall is invoked by the MQTT watchdog before it forces a reconnect because no messages
+// arrived while jobs were running.
+func (s *Scheduler) HandleStall(silence time.Duration) {
+	s.notifySlackRich(slack.NewErrorMessage("🔌 MQTT Connection Stalled", fmt.Sprintf("No MQTT messages were received for %v while jobs were running, although the broker connection looked open. Forcing a reconnect; in-flight jobs may be aborted.", silence.Round(time.Second))))
+}
+
+// HandlePresenceChange is invoked by the MQTT presence monitor when a device goes offline or comes
+// back online, and alerts the device's Slack channel.
+func (s *Scheduler) HandlePresenceChange(deviceID string, online bool, lastSeen time.Time) {
+	msg := slack.NewWarningMessage("📴 Device Offline: "+deviceID, fmt.Sprintf("No status received since %s.", lastSeen.Format(time.RFC3339)))
+	if online {
+		msg = slack.NewSuccessMessage("📶 Device Online: "+deviceID, fmt.Sprintf("Status received again at %s.", lastSeen.Format(time.RFC3339)))
+	}
+	for _, device := range s.devices() {
 		if device.ID == deviceID {
-			s.runDeviceJob(device)
-			log.Printf("Manual run for device %s finished.", deviceID)
-			s.notifySlackRich(slack.NewSuccessMessage(fmt.Sprintf("✅ Manual Run Completed for %s", deviceID), fmt.Sprintf("Finished processing device %s for the manual run.", deviceID)))
-			return nil
+			s.notifyDevice(device, msg)
+			return
 		}
 	}
-
-	log.Printf("Manual run for device %s failed: device not found.", deviceID)
-	s.notifySlackRich(slack.NewErrorMessage(fmt.Sprintf("🚨 Manual Run Failed for %s", deviceID), fmt.Sprintf("Device with ID '%s' not found.", deviceID)))
-	return fmt.Errorf("device with ID '%s' not found", deviceID)
+	s.notifySlackRich(msg)
 }
 
-// RunAllJobsOnce is a debug function to run all device jobs immediately.
-func (s *Scheduler) RunAllJobsOnce() {
-	log.Println("Starting manual run for all devices...")
-	s.notifySlackRich(slack.NewInfoMessage("🚀 Manual Run Started", "Manual run for all devices has commenced."))
-
-	for _, device := range s.cfg.Devices {
-		s.runDeviceJob(device)
+// HandleReconnect is invoked by the MQTT client once the broker connection is re-established.
+// Jobs interrupted by the disconnect are re-run when ResumeOnReconnect is enabled.
+func (s *Scheduler) HandleReconnect() {
+	if s.cfg.MQTT.NotifyConnectionLoss {
+		s.notifySlackRich(slack.NewSuccessMessage("🔌 MQTT Reconnected", "Connection to the MQTT broker has been restored."))
 	}
+	s.checkBrokerFlapping()
 
-	log.Println("Manual run for all devices finished.")
-	s.notifySlackRich(slack.NewSuccessMessage("✅ Manual Run Completed", "Finished processing all devices for the manual run."))
+	s.pendingResume.Range(func(key, value interface{}) bool {
+		job := value.(pendingJob)
+		s.pendingResume.Delete(key)
+		log.Printf("Resuming interrupted job for device %s after reconnect.", job.device.ID)
+		go s.runDeviceJob(job.device, job.trigger)
+		return true
+	})
 }
 
-// runDeviceJob selects the appropriate processor for a given device and executes it.
-func (s *Scheduler) runDeviceJob(device config.DeviceConfig) {
-	log.Printf("Starting job for device %s of type %s", device.ID, device.Type)
-	var err error
-	switch device.Type {
-	case "iot_sprinkler":
-		err = s.processSprinklerDevice(device)
-	case "iot_plant_pot":
-		err = s.processPlantPotDevice(device)
-	default:
-		log.Printf("Warning: Unknown device type '%s' for device '%s'. Skipping.", device.Type, device.ID)
+// checkBrokerFlapping records a reconnect and alerts Slack, at most once per window, when the
+// reconnects within the last FlapWindowMins reach FlapThreshold.
+func (s *Scheduler) checkBrokerFlapping() {
+	threshold := s.cfg.MQTT.FlapThreshold
+	window := time.Duration(s.cfg.MQTT.FlapWindowMins) * time.Minute
+	if threshold <= 0 || window <= 0 {
+		return
 	}
 
-	if err != nil {
-		log.Printf("Error processing device %s: %v.", device.ID, err)
-		s.notifySlackRich(slack.NewErrorMessage(fmt.Sprintf("🚨 ERROR: Device %s", device.ID), fmt.Sprintf("Error processing device: %v", err)))
+	now := s.now()
+	s.reconnectsMu.Lock()
+	recent := s.reconnects[:0]
+	for _, at := range s.reconnects {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	s.reconnects = append(recent, now)
+	count := len(s.reconnects)
+	alert := count >= threshold && now.Sub(s.lastFlapAlert) >= window
+	if alert {
+		s.lastFlapAlert = now
+	}
+	s.reconnectsMu.Unlock()
+
+	if alert {
+		msg := fmt.Sprintf("The MQTT broker connection was re-established %d times in the last %v. Check the broker and network.", count, window)
+		log.Printf("Warning: %s", msg)
+		s.notifySlackRich(slack.NewErrorMessage("🔁 MQTT Broker Flapping", msg))
 	}
 }
 
 // processPlantPotDevice handles the logic for a single iot_plant_pot device.
-func (s *Scheduler) processPlantPotDevice(device config.DeviceConfig) error {
+func (s *Scheduler) processPlantPotDevice(device config.DeviceConfig, trigger Trigger) error {
 	log.Printf("Processing plant pot device: %s", device.ID)
-	s.notifySlackRich(slack.NewInfoMessage(fmt.Sprintf("🪴 Plant Pot Job Started: %s", device.ID), "Starting health check and watering process."))
+	now := s.now()
+	history := &models.IrrigationHistory{
+		DeviceID:    device.ID,
+		ScheduledAt: now,
+		StartedAt:   &now,
+		Status:      models.StatusStarted,
+		Notes:       fmt.Sprintf("Processing device: %s", device.ID),
+		Source:      trigger.Source,
+		TriggeredBy: trigger.TriggeredBy,
+		Reason:      trigger.Reason,
+		Labels:      device.Labels,
+	}
+	s.db.Create(history)
+	s.notifyDevice(device, slack.NewInfoMessage(fmt.Sprintf("🪴 Plant Pot Job Started: %s", device.ID), "Starting health check and watering process."))
 
-	// 1. Check health_check
+	// 1. Check health_check, asking the device for a fresh one first when probing is enabled
+	if err := s.probeHealth(device); err != nil {
+		errMsg := fmt.Sprintf("Health check failed for plant pot %s: %v. Aborting job for this device.", device.ID, err)
+		log.Println(errMsg)
+		history.Status = "HEALTH_CHECK_FAILED"
+		history.Notes = errMsg
+		s.db.Save(history)
+		s.notifyDevice(device, slack.NewErrorMessage(fmt.Sprintf("🚨 ERROR: Plant Pot %s", device.ID), errMsg))
+		return fmt.Errorf("%s", errMsg)
+	}
 	status := s.mqttClient.GetDeviceStatus(device.ID)
 	if !status.HealthCheck {
 		errMsg := fmt.Sprintf("Health check failed for plant pot %s. Aborting job for this device.", device.ID)
 		log.Println(errMsg)
-		s.notifySlackRich(slack.NewErrorMessage(fmt.Sprintf("🚨 ERROR: Plant Pot %s", device.ID), errMsg))
+		history.Status = "HEALTH_CHECK_FAILED"
+		history.Notes = errMsg
+		s.db.Save(history)
+		s.notifyDevice(device, slack.NewErrorMessage(fmt.Sprintf("🚨 ERROR: Plant Pot %s", device.ID), errMsg))
 		return fmt.Errorf("%s", errMsg)
 	}
 
 	log.Printf("Health check passed for %s.", device.ID)
+	beforeWatering, _ := s.mqttClient.GetDeviceStatusCopy(device.ID)
 
 	// 2. Publish trigger command
 	topic := fmt.Sprintf("%s/cmd/trigger_solenoid_valve", device.ID)
 	payload := fmt.Sprintf("%d", device.ScheduleDuration)
 	log.Printf("Publishing to %s with payload '%s' for %d seconds", topic, payload, device.ScheduleDuration)
-	s.mqttClient.Publish(topic, payload)
+	// Wall clock rather than s.now, to compare with the receive times the MQTT client records.
+	commandedAt := time.Now()
+	if err := s.publishCommand(device, history, topic, payload); err != nil {
+		return err // Error is already logged and saved in publishCommand
+	}
+
+	// 3. Confirm the valve closed, read the water meter and re-check moisture once watering should
+	// have ended, when enabled
+	if device.ConfirmValveClosedSeconds > 0 || device.ReportsVolume || device.MoistureRecheck != nil {
+		wateringTime := time.Duration(device.ScheduleDuration) * time.Second
+		log.Printf("Waiting %v for plant pot %s to finish watering...", wateringTime, device.ID)
+		s.sleep(wateringTime)
+	}
+	history.WaterLiters = s.recordWaterUsage(device, beforeWatering, time.Duration(device.ScheduleDuration)*time.Second)
+	if err := s.confirmValveClosed(device, history, commandedAt); err != nil {
+		return err // Error is already logged and saved in confirmValveClosed
+	}
+	s.recheckMoisture(device, beforeWatering)
 
-	// 3. Send success notification
+	// 4. Record the run and send success notification
 	successMsg := fmt.Sprintf("Successfully triggered solenoid valve for plant pot %s.", device.ID)
 	log.Println(successMsg)
-	s.notifySlackRich(slack.NewSuccessMessage(fmt.Sprintf("✅ Plant Pot Job Completed: %s", device.ID), successMsg))
+	endedAt := s.now()
+	history.Status = models.StatusCompleted
+	endRun(history, endedAt)
+	history.Notes = successMsg
+	s.db.Save(history)
+	s.notifyDevice(device, slack.NewSuccessMessage(fmt.Sprintf("✅ Plant Pot Job Completed: %s", device.ID), successMsg))
 
 	return nil
 }
 
+// probeHealth publishes a health check request to the device and waits for it to report
+// health_check again, so the job acts on a fresh answer rather than the last one the device
+// happened to publish. It does nothing unless SCHEDULE_HEALTH_PROBE_TIMEOUT_SECONDS is set.
+// An unanswered request is repeated up to the device's HealthCheckRetries times; the first
+// retry is announced on Slack as info and later ones as warnings, and the caller reports the
+// final failure as an error.
+func (s *Scheduler) probeHealth(device config.DeviceConfig) error {
+	timeout := time.Duration(s.cfg.Schedule.HealthProbeTimeoutSecs) * time.Second
+	if timeout <= 0 {
+		return nil
+	}
+
+	attempts := 1 + max(device.HealthCheckRetries, 0)
+	topic := fmt.Sprintf("%s/%s", device.ID, s.cfg.Schedule.HealthProbeTopic)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		before, _ := s.mqttClient.GetDeviceStatusCopy(device.ID)
+		log.Printf("Requesting a health check from device %s on %s (attempt %d of %d)", device.ID, topic, attempt, attempts)
+		if err := s.publishCommand(device, nil, topic, s.cfg.Schedule.HealthProbePayload); err != nil {
+			return err
+		}
+
+		err = s.waitForFlag(device.ID, timeout, func(status *models.DeviceStatus) bool {
+			return status.HealthCheckReports > before.HealthCheckReports
+		})
+		if !errors.Is(err, ErrFlagTimeout) || attempt == attempts {
+			break
+		}
+
+		msg := fmt.Sprintf("Plant pot %s did not answer health check request %d of %d within %v. Retrying.", device.ID, attempt, attempts, timeout)
+		log.Println(msg)
+		title := fmt.Sprintf("🩺 Health Check Retry: %s", device.ID)
+		if attempt == 1 {
+			s.notifyDevice(device, slack.NewInfoMessage(title, msg))
+		} else {
+			s.notifyDevice(device, slack.NewWarningMessage(title, msg))
+		}
+	}
+	if errors.Is(err, ErrFlagTimeout) {
+		if attempts > 1 {
+			return fmt.Errorf("no health check response within %v to any of %d requests: %w", timeout, attempts, err)
+		}
+		return fmt.Errorf("no health check response within %v: %w", timeout, err)
+	}
+	return err
+}
+
 // processSprinklerDevice handles the full workflow for a single sprinkler device.
-func (s *Scheduler) processSprinklerDevice(device config.DeviceConfig) error {
+func (s *Scheduler) processSprinklerDevice(device config.DeviceConfig, trigger Trigger) (err error) {
 	log.Printf("Processing sprinkler device: %s", device.ID)
-	now := time.Now()
+	now := s.now()
 	history := &models.IrrigationHistory{
+		DeviceID:    device.ID,
 		ScheduledAt: now,
 		StartedAt:   &now,
 		Status:      models.StatusStarted,
 		Notes:       fmt.Sprintf("Processing device: %s", device.ID),
+		Source:      trigger.Source,
+		TriggeredBy: trigger.TriggeredBy,
+		Reason:      trigger.Reason,
+		Labels:      device.Labels,
 	}
 	s.db.Create(history)
+	beforeRun, _ := s.mqttClient.GetDeviceStatusCopy(device.ID)
+
+	// 0. Health check, when required
+	if device.RequireHealthCheck && !s.mqttClient.GetDeviceStatus(device.ID).HealthCheck {
+		errMsg := fmt.Sprintf("Health check failed for sprinkler %s. Aborting job for this device.", device.ID)
+		log.Println(errMsg)
+		history.Status = "HEALTH_CHECK_FAILED"
+		history.Notes = errMsg
+		s.db.Save(history)
+		s.notifyDevice(device, slack.NewErrorMessage(fmt.Sprintf("🚨 ERROR: Sprinkler %s", device.ID), errMsg))
+		return fmt.Errorf("%s", errMsg)
+	}
+
+	// From here on the device may be moving or watering, so a failure leaves it in a safe state when enabled
+	defer func() {
+		if err != nil && s.cfg.Schedule.SafeAbort {
+			s.safeAbort(device, history)
+		}
+	}()
 
 	// 1. Calibration Phase
+	s.setPhase(history, models.PhaseCalibration)
 	if err := s.runCalibration(device, history); err != nil {
 		return err // Error is already logged and saved in runCalibration
 	}
 
-	// 2. Task Execution Phase
-	if err := s.runDeviceTasks(device, history); err != nil {
-		return err // Error is already logged and saved in runDeviceTasks
+	// 2. Warmup, when configured
+	if device.WarmupCommand != nil {
+		s.setPhase(history, models.PhaseWarmup)
+	}
+	if err := s.runWarmup(device, history); err != nil {
+		return err // Error is already logged and saved in publishCommand
+	}
+
+	// 3. Task Execution Phase, limited to the requested tasks if any
+	if len(trigger.TaskIDs) > 0 {
+		device.TaskIDs = trigger.TaskIDs
+	}
+	// Wall clock rather than s.now, to compare with the receive times the MQTT client records.
+	tasksStartedAt := time.Now()
+	tasksErr := s.runDeviceTasks(device, history, trigger.TaskParams)
+	if tasksErr != nil && !errors.Is(tasksErr, ErrPartialRun) {
+		return tasksErr // Error is already logged and saved in runDeviceTasks
+	}
+
+	// 4. Valve check, when configured
+	s.setPhase(history, models.PhaseValveCheck)
+	if err := s.confirmValveClosed(device, history, tasksStartedAt); err != nil {
+		return err // Error is already logged and saved in confirmValveClosed
+	}
+
+	endedAt := s.now()
+	if tasksErr != nil {
+		history.Status = models.StatusPartial
+		endRun(history, endedAt)
+		history.WaterLiters = s.recordWaterUsage(device, beforeRun, endedAt.Sub(*history.StartedAt))
+		history.Notes = partialRunNotes(history)
+		s.db.Save(history)
+		s.notifyDevice(device, slack.NewWarningMessage(fmt.Sprintf("⚠️ Sprinkler Job Partially Completed: %s", device.ID), history.Notes))
+		return tasksErr
 	}
 
 	// If all went well
-	endedAt := time.Now()
 	history.Status = models.StatusCompleted
-	history.EndedAt = &endedAt
+	endRun(history, endedAt)
+	history.WaterLiters = s.recordWaterUsage(device, beforeRun, endedAt.Sub(*history.StartedAt))
 	history.Notes = "All tasks completed successfully."
 	s.db.Save(history)
 	log.Printf("Successfully completed all tasks")
 
 	// Send success notification
 	successMsg := fmt.Sprintf("Successfully completed all tasks for device %s.", device.ID)
-	s.notifySlackRich(slack.NewSuccessMessage(fmt.Sprintf("✅ Sprinkler Job Completed: %s", device.ID), successMsg))
+	s.notifyDevice(device, slack.NewSuccessMessage(fmt.Sprintf("✅ Sprinkler Job Completed: %s", device.ID), successMsg))
 
 	return nil
 }
 
+// safeAbort runs the cleanup sequence after a failed sprinkler run, so the device does not stay
+// mid-task with water flowing: it publishes the stop command, then homes the valve and the
+// sprinkler without waiting for them to report. The outcome is appended to the run's history notes.
+func (s *Scheduler) safeAbort(device config.DeviceConfig, history *models.IrrigationHistory) {
+	note := "Safe abort: stopped the task and homed the valve and sprinkler."
+	if !s.mqttClient.IsDeviceConnected(device.ID) {
+		note = "Safe abort skipped: the MQTT broker is disconnected."
+	} else {
+		commands := []string{"cmd/valve/home", "cmd/sprinkler/home"}
+		if stop := s.cfg.Schedule.SafeAbortStopTopic; stop != "" {
+			commands = append([]string{stop}, commands...)
+		}
+		var failed []string
+		for _, command := range commands {
+			topic := fmt.Sprintf("%s/%s", device.ID, command)
+			payload := "1"
+			if device.CommandFormat == config.CommandFormatJSON {
+				payload = s.commandEnvelope(topic, payload)
+			}
+			err := s.publish(device, topic, payload)
+			s.recordCommand(device, history, topic, payload, err)
+			if err != nil {
+				log.Printf("Warning: Safe abort command %s failed for device %s: %v", topic, device.ID, err)
+				failed = append(failed, command)
+			}
+		}
+		if len(failed) > 0 {
+			note = fmt.Sprintf("Safe abort incomplete: failed to publish %s.", strings.Join(failed, ", "))
+			s.notifyDevice(device, slack.NewWarningMessage("⚠️ Safe Abort Incomplete: "+device.ID, note+" Check the device for a task left running."))
+		}
+	}
+
+	log.Printf("Device %s: %s", device.ID, note)
+	history.Notes = strings.TrimSpace(history.Notes + " " + note)
+	s.db.Save(history)
+}
+
+// calibrationStep homes one axis of a device and waits for the device to report it calibrated.
+type calibrationStep struct {
+	name          string // e.g. "Water valve"; used in logs, notes and notifications
+	command       string // command topic below the device ID, e.g. "cmd/valve/home"
+	calibrated    func(status *models.DeviceStatus) bool
+	calibratedAt  func(status *models.DeviceStatus) time.Time // when the flag was received; nil if not tracked
+	timeout       time.Duration
+	timeoutStatus models.IrrigationStatus // history status when the device does not report in time
+}
+
+// sprinklerCalibrationSteps is the calibration sequence for sprinkler devices, run in order.
+var sprinklerCalibrationSteps = []calibrationStep{
+	{
+		name:          "Sprinkler",
+		command:       "cmd/sprinkler/home",
+		calibrated:    func(status *models.DeviceStatus) bool { return status.SprinklerCalibComplete },
+		calibratedAt:  func(status *models.DeviceStatus) time.Time { return status.SprinklerCalibAt },
+		timeout:       2 * time.Minute,
+		timeoutStatus: "SPRINKLER_CALIB_TIMEOUT",
+	},
+	{
+		name:          "Water valve",
+		command:       "cmd/valve/home",
+		calibrated:    func(status *models.DeviceStatus) bool { return status.ValveCalibComplete },
+		calibratedAt:  func(status *models.DeviceStatus) time.Time { return status.ValveCalibAt },
+		timeout:       2 * time.Minute,
+		timeoutStatus: "VALVE_CALIB_TIMEOUT",
+	},
+}
+
 // runCalibration handles the calibration sequence for a device.
 func (s *Scheduler) runCalibration(device config.DeviceConfig, history *models.IrrigationHistory) error {
 	log.Printf("Starting calibration check for device %s...", device.ID)
 
-	// Get current device status
-	currentStatus := s.mqttClient.GetDeviceStatus(device.ID)
+	if s.recentlyCalibrated(device) {
+		log.Printf("Device %s was calibrated within the last %d minutes. Skipping calibration.", device.ID, device.RecalibrateAfterMinutes)
+		return nil
+	}
+
+	if s.cfg.Schedule.RequireFreshCalibration {
+		// Drop flags cached from an earlier run, so only reports after this reset count.
+		s.mqttClient.ResetDeviceStatus(device.ID)
+	}
+	return s.calibrate(device, history)
+}
 
-	// --- Calibrate Sprinkler ---
-	if currentStatus != nil && currentStatus.SprinklerCalibComplete {
-		log.Printf("Sprinkler for device %s is already calibrated. Skipping.", device.ID)
-	} else {
-		log.Printf("Calibrating sprinkler for device %s...", device.ID)
-		s.mqttClient.Publish(fmt.Sprintf("%s/cmd/sprinkler/home", device.ID), "1")
-		if err := s.waitForFlag(device.ID, 2*time.Minute, func(status *models.DeviceStatus) bool {
-			return status != nil && status.SprinklerCalibComplete
-		}); err != nil {
-			history.Status = "SPRINKLER_CALIB_TIMEOUT"
-			history.Notes = "Sprinkler calibration timed out."
-			s.db.Save(history)
-			errMsg := fmt.Sprintf("Timeout waiting for sprinkler calibration on device %s", device.ID)
-			log.Println(errMsg)
-			s.notifySlackRich(slack.NewErrorMessage("🚨 Calibration Timeout", errMsg))
-			return fmt.Errorf("sprinkler calibration timed out: %w", err)
+// calibrate runs every calibration step in order and records the calibration time once all succeed.
+func (s *Scheduler) calibrate(device config.DeviceConfig, history *models.IrrigationHistory) error {
+	for _, step := range s.calibrationSteps {
+		if err := s.runCalibrationStep(device, history, step); err != nil {
+			return err
 		}
-		log.Printf("Sprinkler calibration completed for device %s", device.ID)
 	}
 
-	// --- Calibrate Water Valve ---
-	// Re-fetch status in case it was updated during sprinkler calibration
-	currentStatus = s.mqttClient.GetDeviceStatus(device.ID)
-	if currentStatus != nil && currentStatus.ValveCalibComplete {
-		log.Printf("Water valve for device %s is already calibrated. Skipping.", device.ID)
-	} else {
-		log.Printf("Calibrating water valve for device %s...", device.ID)
-		s.mqttClient.Publish(fmt.Sprintf("%s/cmd/valve/home", device.ID), "1")
-		if err := s.waitForFlag(device.ID, 2*time.Minute, func(status *models.DeviceStatus) bool {
-			return status != nil && status.ValveCalibComplete
-		}); err != nil {
-			history.Status = "VALVE_CALIB_TIMEOUT"
-			history.Notes = "Water valve calibration timed out."
+	log.Printf("Calibration phase completed for device %s", device.ID)
+	s.recordCalibration(device.ID)
+	return nil
+}
+
+// runCalibrationStep homes one axis unless the device already reports it calibrated, then waits for
+// the completion flag. With SCHEDULE_REQUIRE_FRESH_CALIBRATION the axis is always homed and only a
+// flag received after the home command counts. Timeouts are recorded on history and reported to Slack.
+func (s *Scheduler) runCalibrationStep(device config.DeviceConfig, history *models.IrrigationHistory, step calibrationStep) error {
+	axis := strings.ToLower(step.name)
+	fresh := s.cfg.Schedule.RequireFreshCalibration && step.calibratedAt != nil
+	// Fetched per step, since earlier steps may have updated the status
+	if status := s.mqttClient.GetDeviceStatus(device.ID); !fresh && status != nil && step.calibrated(status) {
+		log.Printf("%s for device %s is already calibrated. Skipping.", step.name, device.ID)
+		return nil
+	}
+
+	log.Printf("Calibrating %s for device %s...", axis, device.ID)
+	// Wall clock rather than s.now, to compare with the receive times the MQTT client records.
+	homedAt := time.Now()
+	if err := s.publishCommand(device, history, fmt.Sprintf("%s/%s", device.ID, step.command), "1"); err != nil {
+		return err
+	}
+	if err := s.waitForFlag(device.ID, step.timeout, func(status *models.DeviceStatus) bool {
+		if status == nil || !step.calibrated(status) {
+			return false
+		}
+		return !fresh || !step.calibratedAt(status).Before(homedAt)
+	}); err != nil {
+		history.Status = failureStatus(err, step.timeoutStatus)
+		if errors.Is(err, ErrBrokerDisconnected) {
+			history.Notes = fmt.Sprintf("%s calibration interrupted: the MQTT broker disconnected.", step.name)
 			s.db.Save(history)
-			errMsg := fmt.Sprintf("Timeout waiting for water valve calibration on device %s", device.ID)
+			errMsg := fmt.Sprintf("MQTT broker disconnected during %s calibration on device %s", axis, device.ID)
 			log.Println(errMsg)
-			s.notifySlackRich(slack.NewErrorMessage("🚨 Calibration Timeout", errMsg))
-			return fmt.Errorf("water valve calibration timed out: %w", err)
+			s.notifyDevice(device, slack.NewErrorMessage("🚨 Calibration Interrupted", errMsg))
+			return fmt.Errorf("%s calibration interrupted: %w", axis, err)
 		}
-		log.Printf("Water valve calibration completed for device %s", device.ID)
+		history.Notes = fmt.Sprintf("%s calibration timed out.", step.name)
+		s.db.Save(history)
+		errMsg := fmt.Sprintf("Timeout waiting for %s calibration on device %s", axis, device.ID)
+		log.Println(errMsg)
+		s.notifyDevice(device, slack.NewErrorMessage("🚨 Calibration Timeout", errMsg))
+		return fmt.Errorf("%s calibration timed out: %w", axis, err)
+	}
+	log.Printf("%s calibration completed for device %s", step.name, device.ID)
+	return nil
+}
+
+// runWarmup publishes the device's warmup command, if it has one, and waits its delay so the
+// device (e.g. a pump being primed) is ready before the first task.
+func (s *Scheduler) runWarmup(device config.DeviceConfig, history *models.IrrigationHistory) error {
+	warmup := device.WarmupCommand
+	if warmup == nil {
+		return nil
 	}
 
-	log.Printf("Calibration phase completed for device %s", device.ID)
+	topic := fmt.Sprintf("%s/%s", device.ID, warmup.Topic)
+	log.Printf("Warming up device %s on %s...", device.ID, topic)
+	if err := s.publishCommand(device, history, topic, warmup.Payload); err != nil {
+		return err
+	}
+	if warmup.DelaySeconds > 0 {
+		delay := time.Duration(warmup.DelaySeconds) * time.Second
+		log.Printf("Waiting %v for device %s to warm up", delay, device.ID)
+		s.sleep(delay)
+	}
+	return nil
+}
+
+// recheckMoisture waits the device's settle time after watering and warns when its moisture did
+// not rise by the configured minimum since before, the status read before watering. The job
+// still succeeds: the valve opened, but the water may not have reached the soil.
+func (s *Scheduler) recheckMoisture(device config.DeviceConfig, before models.DeviceStatus) {
+	recheck := device.MoistureRecheck
+	if recheck == nil {
+		return
+	}
+	if before.MoistureReports == 0 {
+		log.Printf("Warning: Skipping moisture re-check for device %s: no moisture reading before watering.", device.ID)
+		return
+	}
+
+	if settle := time.Duration(recheck.SettleSeconds) * time.Second; settle > 0 {
+		log.Printf("Waiting %v for moisture on plant pot %s to settle...", settle, device.ID)
+		s.sleep(settle)
+	}
+
+	after, _ := s.mqttClient.GetDeviceStatusCopy(device.ID)
+	var msg string
+	switch rise := after.Moisture - before.Moisture; {
+	case after.MoistureReports == before.MoistureReports:
+		msg = fmt.Sprintf("Plant pot %s has not reported moisture since watering (last reading %g).", device.ID, before.Moisture)
+	case rise < recheck.MinRise:
+		msg = fmt.Sprintf("Moisture on plant pot %s rose by %g (from %g to %g) after watering, less than the expected %g.", device.ID, rise, before.Moisture, after.Moisture, recheck.MinRise)
+	default:
+		log.Printf("Moisture on plant pot %s rose from %g to %g after watering.", device.ID, before.Moisture, after.Moisture)
+		return
+	}
+	msg += " Check for a clogged emitter or an empty reservoir."
+	log.Printf("Warning: %s", msg)
+	s.notifyDevice(device, slack.NewWarningMessage("💧 Moisture Did Not Rise: "+device.ID, msg))
+}
+
+// valveClosedTolerance is the largest valve position still treated as closed.
+const valveClosedTolerance = 0.5
+
+// confirmValveClosed waits up to the device's ConfirmValveClosedSeconds for the valve to report a
+// closed position, so a valve stuck open after watering is reported (and recorded on history, when given)
+// instead of passing as success. Only a position received at or after since, when the valve was
+// commanded, counts: a device that stays silent fails the check rather than passing on a stale
+// or reset position.
+func (s *Scheduler) confirmValveClosed(device config.DeviceConfig, history *models.IrrigationHistory, since time.Time) error {
+	if device.ConfirmValveClosedSeconds <= 0 {
+		return nil
+	}
+
+	log.Printf("Confirming valve closed for device %s...", device.ID)
+	timeout := time.Duration(device.ConfirmValveClosedSeconds) * time.Second
+	if err := s.waitForFlag(device.ID, timeout, func(status *models.DeviceStatus) bool {
+		return status != nil && !status.ValvePositionAt.IsZero() && !status.ValvePositionAt.Before(since) &&
+			math.Abs(status.ValvePosition) <= valveClosedTolerance
+	}); err != nil {
+		position := "not reported"
+		if status := s.mqttClient.GetDeviceStatus(device.ID); status != nil && !status.ValvePositionAt.IsZero() && !status.ValvePositionAt.Before(since) {
+			position = strconv.FormatFloat(status.ValvePosition, 'f', -1, 64)
+		}
+		if history != nil {
+			history.Status = failureStatus(err, "VALVE_NOT_CLOSED")
+			history.Notes = fmt.Sprintf("Valve did not report closed within %v after watering (position %s).", timeout, position)
+			s.db.Save(history)
+		}
+		errMsg := fmt.Sprintf("Valve on device %s did not close within %v after watering (position %s). Check for a stuck-open valve.", device.ID, timeout, position)
+		log.Println(errMsg)
+		s.notifyDevice(device, slack.NewErrorMessage("🚨 Valve Not Closed", errMsg))
+		return fmt.Errorf("valve not closed: %w", err)
+	}
+	log.Printf("Valve confirmed closed for device %s", device.ID)
 	return nil
 }
 
+// recentlyCalibrated reports whether the persisted calibration time for the device falls within its recalibration window.
+func (s *Scheduler) recentlyCalibrated(device config.DeviceConfig) bool {
+	if device.RecalibrateAfterMinutes <= 0 {
+		return false
+	}
+
+	var state models.DeviceState
+	if err := s.db.Where("device_id = ?", device.ID).Limit(1).Find(&state).Error; err != nil {
+		log.Printf("Warning: Failed to load calibration state for device %s: %v", device.ID, err)
+		return false
+	}
+	if state.LastCalibratedAt == nil {
+		return false
+	}
+	window := time.Duration(device.RecalibrateAfterMinutes) * time.Minute
+	return s.now().Sub(*state.LastCalibratedAt) < window
+}
+
+// recordCalibration persists the time the device was last successfully calibrated.
+func (s *Scheduler) recordCalibration(deviceID string) {
+	calibratedAt := s.now()
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_calibrated_at", "updated_at"}),
+	}).Create(&models.DeviceState{DeviceID: deviceID, LastCalibratedAt: &calibratedAt}).Error
+	if err != nil {
+		log.Printf("Warning: Failed to record calibration time for device %s: %v", deviceID, err)
+	}
+}
+
+// endRun sets when the run ended on its history, and its duration in minutes, rounded, since it
+// started.
+func endRun(history *models.IrrigationHistory, endedAt time.Time) {
+	history.EndedAt = &endedAt
+	if history.StartedAt != nil {
+		history.Duration = int(endedAt.Sub(*history.StartedAt).Round(time.Minute).Minutes())
+	}
+}
+
+// setPhase saves the phase the run is entering on its history, so a restart can tell where the
+// run was interrupted.
+func (s *Scheduler) setPhase(history *models.IrrigationHistory, phase models.JobPhase) {
+	history.Phase = phase
+	if s.db == nil {
+		return
+	}
+	if err := s.db.Save(history).Error; err != nil {
+		log.Printf("Warning: Failed to save the %s phase of the run of device %s: %v", phase, history.DeviceID, err)
+	}
+}
+
 // runDeviceTasks handles executing all JSON-defined tasks for a device based on TaskIDs.
-func (s *Scheduler) runDeviceTasks(device config.DeviceConfig, history *models.IrrigationHistory) error {
+// params, when given, override the matching fields of every task step before publishing.
+func (s *Scheduler) runDeviceTasks(device config.DeviceConfig, history *models.IrrigationHistory, params map[string]json.RawMessage) error {
 	log.Printf("Starting tasks for device %s...", device.ID)
 
-	for _, taskID := range device.TaskIDs {
+	// With SCHEDULE_TASK_FAILURE_POLICY=continue a failed task is collected here and the run goes on.
+	continueOnFailure := s.cfg.Schedule.TaskFailurePolicy == config.TaskFailureContinue
+	var failures []error
+
+	for i, taskID := range device.TaskIDs {
+		taskNumber := i + 1
+		result := models.TaskResult{TaskID: taskID, StartedAt: s.now()}
+		finish := func(outcome models.TaskOutcome) {
+			result.EndedAt = s.now()
+			result.Outcome = outcome
+			history.TaskResults = append(history.TaskResults, result)
+			if outcome == models.TaskSucceeded {
+				history.TasksSucceeded++
+			} else {
+				history.TasksFailed++
+			}
+		}
+
+		history.TaskIndex, history.CurrentTaskID = i, taskID
+		s.setPhase(history, models.PhaseTasks)
+
 		// Reset device status for the new task to ensure a clean state.
 		s.mqttClient.ResetDeviceStatus(device.ID)
 
-		taskFilePath := fmt.Sprintf("tasks/%s_%s.json", device.ID, taskID)
+		taskFilePath := TaskFilePath(s.tasksDir, device.ID, taskID)
 		log.Printf("Processing task ID '%s' for device '%s' from file: %s", taskID, device.ID, taskFilePath)
 
 		// 1. Read and parse the task JSON file
-		taskData, err := os.ReadFile(taskFilePath)
+		taskDef, err := s.readTaskDefinition(device, taskFilePath)
 		if err != nil {
 			errMsg := fmt.Sprintf("failed to read task file %s", taskFilePath)
+			if errors.Is(err, ErrInvalidTask) {
+				errMsg = fmt.Sprintf("failed to parse task JSON from %s", taskFilePath)
+			}
+			finish(models.TaskFailed)
 			history.Status = "TASK_ERROR"
 			history.Notes = errMsg
 			s.db.Save(history)
-			s.notifySlackRich(slack.NewErrorMessage("🚨 Task Error", errMsg))
-			return fmt.Errorf("%s: %w", errMsg, err)
+			s.notifyDevice(device, slack.NewErrorMessage("🚨 Task Error", errMsg))
+			if !continueOnFailure {
+				return fmt.Errorf("%s: %w", errMsg, err)
+			}
+			failures = append(failures, fmt.Errorf("%s: %w", errMsg, err))
+			continue
 		}
 
-		var taskDef TaskDefinition
-		if err := json.Unmarshal(taskData, &taskDef); err != nil {
-			errMsg := fmt.Sprintf("failed to parse task JSON from %s", taskFilePath)
+		payload, err := applyTaskParams(taskDef.Payload, params)
+		if err != nil {
+			errMsg := fmt.Sprintf("failed to apply task parameters to %s", taskFilePath)
+			finish(models.TaskFailed)
 			history.Status = "TASK_ERROR"
 			history.Notes = errMsg
 			s.db.Save(history)
-			s.notifySlackRich(slack.NewErrorMessage("🚨 Task Error", errMsg))
-			return fmt.Errorf("%s: %w", errMsg, err)
+			s.notifyDevice(device, slack.NewErrorMessage("🚨 Task Error", errMsg))
+			if !continueOnFailure {
+				return fmt.Errorf("%s: %w", errMsg, err)
+			}
+			failures = append(failures, fmt.Errorf("%s: %w", errMsg, err))
+			continue
 		}
 
 		// 2.1 Publish task payload and wait
 		topic := fmt.Sprintf("%s/cmd/task/set", device.ID)
 		log.Printf("Publishing task payload to %s", topic)
-		s.mqttClient.Publish(topic, string(taskDef.Payload))
+		if err := s.publishCommand(device, history, topic, string(payload)); err != nil {
+			finish(models.TaskFailed)
+			s.db.Save(history)
+			return err
+		}
 
-		log.Printf("Waiting 3 seconds after publishing task...")
-		time.Sleep(3 * time.Second)
+		if ackTimeout := time.Duration(s.cfg.Schedule.TaskAckTimeoutSecs) * time.Second; ackTimeout > 0 {
+			if err := s.waitForTaskAck(device.ID, ackTimeout); err != nil {
+				if errors.Is(err, ErrBrokerDisconnected) {
+					finish(models.TaskInterrupted)
+				} else {
+					finish(models.TaskNotAcknowledged)
+				}
+				history.Status = failureStatus(err, "TASK_NOT_ACKNOWLEDGED")
+				history.Notes = fmt.Sprintf("Device '%s' did not acknowledge task '%s' within %v.", device.ID, taskID, ackTimeout)
+				s.db.Save(history)
+				errMsg := fmt.Sprintf("Device %s, Task %s: No acknowledgement within %v", device.ID, taskID, ackTimeout)
+				log.Println(errMsg)
+				s.notifyDevice(device, slack.NewErrorMessage("🚨 Task Not Acknowledged", errMsg))
+				if !continueOnFailure || errors.Is(err, ErrBrokerDisconnected) {
+					return fmt.Errorf("task '%s' was not acknowledged: %w", taskID, err)
+				}
+				failures = append(failures, fmt.Errorf("task '%s' was not acknowledged: %w", taskID, err))
+				continue
+			}
+		} else {
+			log.Printf("Waiting %v after publishing task...", s.taskSettleDelay)
+			s.sleep(s.taskSettleDelay)
+		}
 
 		// 2.2 Wait for task completion with timeout
-		log.Printf("Waiting for task completion flag with timeout: %d minutes", taskDef.TimeoutMinutes)
-		timeout := time.Duration(taskDef.TimeoutMinutes) * time.Minute
+		timeoutMinutes, adjustment := taskDef.EffectiveTimeoutMinutes(TaskTimeoutLimitsFromConfig(s.cfg.Schedule))
+		if adjustment != "" {
+			log.Printf("Warning: Task '%s' for device '%s': %s.", taskID, device.ID, adjustment)
+		}
+		result.TimeoutMinutes = timeoutMinutes
+		log.Printf("Waiting for task completion flag with timeout: %d minutes", timeoutMinutes)
+		timeout := time.Duration(timeoutMinutes) * time.Minute
+		lastIndex := -1
+		guard := newTaskResetGuard(s.cfg.Schedule.VerifyTaskReset)
 		if err := s.waitForFlag(device.ID, timeout, func(status *models.DeviceStatus) bool {
 			if status == nil {
 				return false
 			}
-			return status.TaskAllComplete
+			if !guard.ready(status) {
+				return false
+			}
+			if status.TaskCurrentCount > 0 && status.TaskCurrentIndex != lastIndex {
+				if lastIndex >= 0 {
+					s.notifyProgress(device, fmt.Sprintf("⏳ Task %d/%d (%s) on %s: step %d/%d", taskNumber, len(device.TaskIDs), taskID, device.ID, status.TaskCurrentIndex, status.TaskCurrentCount))
+				}
+				lastIndex = status.TaskCurrentIndex
+			}
+			return guard.complete(status)
 		}); err != nil {
-			history.Status = "TASK_TIMEOUT"
-			history.Notes = fmt.Sprintf("Task '%s' for device '%s' timed out after %d minutes.", taskID, device.ID, taskDef.TimeoutMinutes)
+			if errors.Is(err, ErrBrokerDisconnected) {
+				finish(models.TaskInterrupted)
+			} else {
+				finish(models.TaskTimedOut)
+			}
+			history.Status = failureStatus(err, "TASK_TIMEOUT")
+			history.Notes = fmt.Sprintf("Task '%s' for device '%s' timed out after %d minutes.", taskID, device.ID, timeoutMinutes)
 			s.db.Save(history)
 			errMsg := fmt.Sprintf("Device %s, Task %s: Timeout waiting for completion", device.ID, taskID)
 			log.Println(errMsg)
-			s.notifySlackRich(slack.NewErrorMessage("🚨 Task Timeout", errMsg))
-			return fmt.Errorf("task '%s' timed out: %w", taskID, err)
+			s.notifyDevice(device, slack.NewErrorMessage("🚨 Task Timeout", errMsg))
+			if !continueOnFailure || errors.Is(err, ErrBrokerDisconnected) {
+				return fmt.Errorf("task '%s' timed out: %w", taskID, err)
+			}
+			failures = append(failures, fmt.Errorf("task '%s' timed out: %w", taskID, err))
+			continue
 		}
 
+		finish(models.TaskSucceeded)
 		log.Printf("Task '%s' completed successfully for device '%s'.", taskID, device.ID)
+		s.notifyProgress(device, fmt.Sprintf("✔️ Task %d/%d (%s) complete on %s", taskNumber, len(device.TaskIDs), taskID, device.ID))
 	}
 
-	log.Printf("All tasks for device %s completed successfully.", device.ID)
-	return nil
+	switch {
+	case len(failures) == 0:
+		log.Printf("All tasks for device %s completed successfully.", device.ID)
+		return nil
+	case history.TasksSucceeded == 0:
+		// The status and notes of the last failure stay on the history.
+		return fmt.Errorf("all %d tasks failed: %w", len(failures), errors.Join(failures...))
+	default:
+		log.Printf("%d of %d tasks for device %s failed.", len(failures), len(device.TaskIDs), device.ID)
+		return fmt.Errorf("%w: %d of %d: %w", ErrPartialRun, len(failures), len(device.TaskIDs), errors.Join(failures...))
+	}
+}
+
+// partialRunNotes summarizes a partial run for its history notes, e.g.
+// "2 of 3 tasks completed. Failed: task_2 (timeout)."
+func partialRunNotes(history *models.IrrigationHistory) string {
+	var failed []string
+	for _, result := range history.TaskResults {
+		if result.Outcome != models.TaskSucceeded {
+			failed = append(failed, fmt.Sprintf("%s (%s)", result.TaskID, result.Outcome))
+		}
+	}
+	return fmt.Sprintf("%d of %d tasks completed. Failed: %s.", history.TasksSucceeded, len(history.TaskResults), strings.Join(failed, ", "))
+}
+
+// waitForTaskAck waits for the device to report a task count, showing it received the published task.
+// A task already reported complete counts too, as the device may clear the count when it finishes.
+func (s *Scheduler) waitForTaskAck(deviceID string, timeout time.Duration) error {
+	log.Printf("Waiting up to %v for device %s to acknowledge the task...", timeout, deviceID)
+	err := s.waitForFlag(deviceID, timeout, func(status *models.DeviceStatus) bool {
+		return status.TaskCurrentCount > 0 || status.TaskAllComplete
+	})
+	if errors.Is(err, ErrFlagTimeout) {
+		return fmt.Errorf("%w by device %s: %w", ErrTaskNotAcknowledged, deviceID, err)
+	}
+	return err
+}
+
+// taskResetGuard keeps a stale all_complete=true, left over from a previous run, from ending a task.
+// Until armed, it waits for the device to show the new task started: a reported all_complete=false
+// or a reported current_index of 0. Once armed, only an all_complete=true reported after that counts.
+type taskResetGuard struct {
+	armed   bool
+	reports int // all_complete reports seen when the guard armed; -1 when it is disabled
+}
+
+// newTaskResetGuard returns a guard for one task; when verify is false it accepts any completion.
+func newTaskResetGuard(verify bool) taskResetGuard {
+	if !verify {
+		return taskResetGuard{armed: true, reports: -1}
+	}
+	return taskResetGuard{}
+}
+
+// ready reports whether the guard is armed, arming it if status shows the task restarted.
+func (g *taskResetGuard) ready(status *models.DeviceStatus) bool {
+	if g.armed {
+		return true
+	}
+	restarted := (status.TaskAllCompleteReports > 0 && !status.TaskAllComplete) ||
+		(status.TaskIndexReported && status.TaskCurrentIndex == 0)
+	if !restarted {
+		return false
+	}
+	g.armed = true
+	g.reports = status.TaskAllCompleteReports
+	return true
+}
+
+// complete reports whether status shows the task complete.
+func (g *taskResetGuard) complete(status *models.DeviceStatus) bool {
+	return status.TaskAllComplete && status.TaskAllCompleteReports > g.reports
+}
+
+// readTaskDefinition reads the task file at path, reading it again up to SCHEDULE_TASK_READ_RETRIES
+// times when that fails, e.g. because a deploy is rewriting it. A missing file fails at once.
+func (s *Scheduler) readTaskDefinition(device config.DeviceConfig, path string) (*TaskDefinition, error) {
+	retries := max(s.cfg.Schedule.TaskReadRetries, 0)
+	delay := time.Duration(s.cfg.Schedule.TaskReadRetryDelayMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		taskDef, err := s.readTaskFile(path)
+		if err == nil || errors.Is(err, fs.ErrNotExist) || attempt == retries {
+			return taskDef, err
+		}
+		log.Printf("Warning: Failed to read task file %s for device %s (attempt %d of %d), retrying in %v: %v", path, device.ID, attempt+1, retries+1, delay, err)
+		s.sleep(delay)
+	}
+}
+
+// applyTaskParams sets params on every step of a task payload, which is either a single step object
+// or an array of them. The payload is returned unchanged when there are no params.
+func applyTaskParams(payload json.RawMessage, params map[string]json.RawMessage) (json.RawMessage, error) {
+	if len(params) == 0 {
+		return payload, nil
+	}
+
+	merge := func(step map[string]json.RawMessage) {
+		for key, value := range params {
+			step[key] = value
+		}
+	}
+
+	var steps []map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &steps); err == nil {
+		for _, step := range steps {
+			if step == nil {
+				return nil, fmt.Errorf("task payload contains a step that is not an object")
+			}
+			merge(step)
+		}
+		return json.Marshal(steps)
+	}
+
+	var step map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &step); err != nil || step == nil {
+		return nil, fmt.Errorf("task payload must be a step object or an array of step objects")
+	}
+	merge(step)
+	return json.Marshal(step)
+}
+
+// estimateLiters returns the water dispensed over d at flowRate liters per minute.
+func estimateLiters(flowRate float64, d time.Duration) float64 {
+	if flowRate <= 0 || d <= 0 {
+		return 0
+	}
+	return flowRate * d.Minutes()
+}
+
+// recordWaterUsage adds the water dispensed by a run of length d to the device's usage counter
+// and returns it. For a volume-mode device it is the rise of its water meter since before, the
+// status read when the run started; without a reading before and after the run, or when the
+// meter went back, it is estimated from the flow rate like for other devices.
+func (s *Scheduler) recordWaterUsage(device config.DeviceConfig, before models.DeviceStatus, d time.Duration) float64 {
+	liters := estimateLiters(device.FlowRateLitersPerMinute, d)
+	if device.ReportsVolume {
+		after, _ := s.mqttClient.GetDeviceStatusCopy(device.ID)
+		switch {
+		case before.VolumeReports == 0 || after.VolumeReports == before.VolumeReports:
+			log.Printf("Warning: Device %s did not report its water meter before and after the run; estimating its water usage.", device.ID)
+		case after.VolumeLiters < before.VolumeLiters:
+			log.Printf("Warning: The water meter of device %s went back from %g to %g liters; estimating its water usage.", device.ID, before.VolumeLiters, after.VolumeLiters)
+		default:
+			liters = after.VolumeLiters - before.VolumeLiters
+		}
+	}
+	if liters > 0 {
+		metrics.WaterLitersTotal.WithLabelValues(device.ID).Add(liters)
+		log.Printf("Device %s dispensed an estimated %.2f liters.", device.ID, liters)
+	}
+	return liters
+}
+
+// publishCommand publishes a command to the device. If the broker does not confirm it, the failure
+// is recorded on history (when given) and reported, so the job stops instead of waiting on a flag.
+func (s *Scheduler) publishCommand(device config.DeviceConfig, history *models.IrrigationHistory, topic, payload string) error {
+	if device.CommandFormat == config.CommandFormatJSON {
+		payload = s.commandEnvelope(topic, payload)
+	}
+	err := s.publish(device, topic, payload)
+	s.recordCommand(device, history, topic, payload, err)
+	if err == nil {
+		return nil
+	}
+
+	errMsg := fmt.Sprintf("Failed to publish command to %s for device %s", topic, device.ID)
+	log.Printf("%s: %v", errMsg, err)
+	if history != nil {
+		history.Status = "PUBLISH_FAILED"
+		history.Notes = errMsg
+		s.db.Save(history)
+	}
+	s.notifyDevice(device, slack.NewErrorMessage("🚨 Publish Failed", fmt.Sprintf("%s: %v", errMsg, err)))
+	return fmt.Errorf("%s: %w", errMsg, err)
+}
+
+// publish sends a command to the broker, or only logs it when the device is in dry-run.
+func (s *Scheduler) publish(device config.DeviceConfig, topic, payload string) error {
+	if device.DryRun {
+		log.Printf("Dry run: not publishing %s to %s for device %s.", payload, topic, device.ID)
+		return nil
+	}
+	return s.mqttClient.Publish(topic, payload)
+}
+
+// recordCommand writes the published command to the command log, linked to the run that sent it
+// when history is given.
+func (s *Scheduler) recordCommand(device config.DeviceConfig, history *models.IrrigationHistory, topic, payload string, publishErr error) {
+	if s.db == nil {
+		return
+	}
+	entry := models.CommandLog{DeviceID: device.ID, Topic: topic, Payload: payload, PublishedAt: s.now(), DryRun: device.DryRun}
+	if history != nil && history.ID != 0 {
+		historyID := history.ID
+		entry.HistoryID = &historyID
+		entry.Source = history.Source
+	}
+	if publishErr != nil {
+		entry.Error = publishErr.Error()
+	}
+	if err := s.db.Create(&entry).Error; err != nil {
+		log.Printf("Warning: Failed to record command to %s for device %s: %v", topic, device.ID, err)
+	}
+}
+
+// commandEnvelope wraps payload in a models.CommandEnvelope named after the last segment of topic.
+// Payloads that are not valid JSON are embedded as strings.
+func (s *Scheduler) commandEnvelope(topic, payload string) string {
+	raw := json.RawMessage(payload)
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(payload)
+	}
+	envelope := models.CommandEnvelope{
+		Cmd:     topic[strings.LastIndex(topic, "/")+1:],
+		TS:      s.now().Unix(),
+		Payload: raw,
+	}
+	b, _ := json.Marshal(envelope) // cannot fail: every field, including Payload, is valid JSON
+	return string(b)
 }
 
 // waitForFlag is a helper function to poll for a status change with a timeout.
@@ -324,16 +2424,20 @@ func (s *Scheduler) waitForFlag(deviceID string, timeout time.Duration, checkFun
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(s.pollInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("timed out waiting for flag for device %s", deviceID)
+			return fmt.Errorf("%w for device %s", ErrFlagTimeout, deviceID)
 		case <-ticker.C:
-			status := s.mqttClient.GetDeviceStatus(deviceID)
-			if status != nil && checkFunc(status) {
+			if !s.mqttClient.IsDeviceConnected(deviceID) {
+				return fmt.Errorf("%w while waiting for flag for device %s", ErrBrokerDisconnected, deviceID)
+			}
+			// A device that has not reported since startup cannot have met the condition.
+			status, ok := s.mqttClient.GetDeviceStatusCopy(deviceID)
+			if ok && checkFunc(&status) {
 				log.Printf("Flag condition met for device %s.", deviceID)
 				return nil
 			}
@@ -342,11 +2446,100 @@ func (s *Scheduler) waitForFlag(deviceID string, timeout time.Duration, checkFun
 	}
 }
 
+// failureStatus picks the history status for a failed wait, distinguishing broker disconnects from timeouts.
+func failureStatus(err error, timeoutStatus models.IrrigationStatus) models.IrrigationStatus {
+	if errors.Is(err, ErrBrokerDisconnected) {
+		return "BROKER_DISCONNECTED"
+	}
+	return timeoutStatus
+}
+
+// notifyProgress sends a task progress update when progress notifications are enabled.
+func (s *Scheduler) notifyProgress(device config.DeviceConfig, title string) {
+	if !s.cfg.Slack.ProgressUpdates {
+		return
+	}
+	log.Println(title)
+	s.notifyDevice(device, slack.NewInfoMessage(title, ""))
+}
+
+// runThread is the Slack thread a running job's notifications are sent to.
+type runThread struct {
+	channel string
+	ts      string
+}
+
+// startRunThread posts the start of a device job to Slack when SLACK_THREAD_RUNS is set, and
+// remembers the message so notifyDevice sends the job's later notifications as replies to it.
+func (s *Scheduler) startRunThread(device config.DeviceConfig, trigger Trigger) {
+	if !s.cfg.Slack.ThreadRuns || s.slackClient == nil || s.isBatched(device.ID) || device.MuteNotifications {
+		return
+	}
+	msg := slack.NewInfoMessage(fmt.Sprintf("▶️ Job Started: %s", device.ID), fmt.Sprintf("Starting %s job for device %s. Updates follow in this thread.", trigger.Source, device.ID))
+	msg.Channel = device.SlackChannelID
+	channel, ts := s.slackClient.StartThread(msg)
+	if ts == "" {
+		log.Printf("Slack thread for the %s job of device %s was not started; its updates are sent as separate messages.", trigger.Source, device.ID)
+		return
+	}
+	s.runThreads.Store(device.ID, runThread{channel: channel, ts: ts})
+}
+
+// notifyDevice sends a message about device, routed to the device's Slack channel when one is
+// configured, or as a reply in the thread of the device's running job. Info and success messages
+// are dropped while the device is part of a run reported by SLACK_BATCH_RUN_SUMMARY.
+func (s *Scheduler) notifyDevice(device config.DeviceConfig, msg slack.Message) {
+	if msg.Severity == slack.SeverityInfo || msg.Severity == slack.SeveritySuccess {
+		if device.MuteNotifications {
+			log.Printf("Slack message %q for device %s muted.", msg.Title, device.ID)
+			return
+		}
+		if s.isBatched(device.ID) {
+			log.Printf("Slack message %q for device %s left to the run summary.", msg.Title, device.ID)
+			return
+		}
+	}
+	if labels := s.notificationLabels(device); labels != "" {
+		msg.Details += "\n" + labels
+	}
+	if device.SlackChannelID != "" {
+		msg.Channel = device.SlackChannelID
+	}
+	if value, ok := s.runThreads.Load(device.ID); ok {
+		thread := value.(runThread)
+		msg.Channel = thread.channel
+		msg.ThreadTS = thread.ts
+	}
+	s.notifySlackRich(msg)
+}
+
+// notificationLabels renders the device labels listed in SLACK_NOTIFICATION_LABELS, e.g.
+// "Labels: zone=front, crop=tomato". Labels the device doesn't have are left out.
+func (s *Scheduler) notificationLabels(device config.DeviceConfig) string {
+	var pairs []string
+	for _, key := range s.cfg.Slack.NotificationLabels {
+		key = strings.TrimSpace(key)
+		if value, ok := device.Labels[key]; ok && key != "" {
+			pairs = append(pairs, key+"="+value)
+		}
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "Labels: " + strings.Join(pairs, ", ")
+}
+
+// isBatched reports whether the device's info and success messages are left to a run summary.
+func (s *Scheduler) isBatched(deviceID string) bool {
+	_, ok := s.batchedDevices.Load(deviceID)
+	return ok
+}
+
 // notifySlackRich sends a rich message to Slack if the client is configured and not rate limited.
-func (s *Scheduler) notifySlackRich(options slackclient.MsgOption) {
+func (s *Scheduler) notifySlackRich(msg slack.Message) {
 	if s.slackClient != nil {
-		if !s.slackClient.SendRichMessageSafe(options) {
-			log.Println("Slack message skipped due to rate limiting")
+		if !s.slackClient.Send(msg) {
+			log.Println("Slack message skipped due to rate limiting or an unknown channel")
 		}
 	}
 }
@@ -0,0 +1,3696 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/metrics"
+	"github.com/prite36/auto-irrigation-system/internal/models"
+	"github.com/prite36/auto-irrigation-system/internal/slack"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	slackclient "github.com/slack-go/slack"
+	"gorm.io/gorm"
+)
+
+// fakeDeviceClient is an in-memory DeviceClient used to drive the scheduler in tests.
+type fakeDeviceClient struct {
+	mu         sync.Mutex
+	connected  bool
+	sessions   map[string]bool // per-device session state; devices without one use connected
+	statuses   map[string]*models.DeviceStatus
+	published  []publishedMessage
+	onPublish  func(topic, payload string)
+	publishErr error
+	subscribed map[string]config.DeviceConfig
+	presence   [][]string // subscribed device IDs, sorted, at each PublishPresence call
+}
+
+type publishedMessage struct {
+	Topic    string
+	Payload  string
+	Retained bool
+}
+
+func newFakeDeviceClient() *fakeDeviceClient {
+	return &fakeDeviceClient{
+		connected:  true,
+		sessions:   make(map[string]bool),
+		statuses:   make(map[string]*models.DeviceStatus),
+		subscribed: make(map[string]config.DeviceConfig),
+	}
+}
+
+func (f *fakeDeviceClient) Publish(topic, payload string) error {
+	f.mu.Lock()
+	f.published = append(f.published, publishedMessage{Topic: topic, Payload: payload})
+	onPublish := f.onPublish
+	publishErr := f.publishErr
+	f.mu.Unlock()
+
+	if publishErr != nil {
+		return publishErr
+	}
+	if onPublish != nil {
+		onPublish(topic, payload)
+	}
+	return nil
+}
+
+func (f *fakeDeviceClient) PublishRetained(topic, payload string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, publishedMessage{Topic: topic, Payload: payload, Retained: true})
+	return f.publishErr
+}
+
+func (f *fakeDeviceClient) GetDeviceStatus(deviceID string) *models.DeviceStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status, ok := f.statuses[deviceID]
+	if !ok {
+		return &models.DeviceStatus{DeviceID: deviceID}
+	}
+	copied := *status
+	return &copied
+}
+
+func (f *fakeDeviceClient) GetDeviceStatusCopy(deviceID string) (models.DeviceStatus, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status, ok := f.statuses[deviceID]
+	if !ok {
+		return models.DeviceStatus{}, false
+	}
+	return *status, true
+}
+
+func (f *fakeDeviceClient) ResetDeviceStatus(deviceID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[deviceID] = &models.DeviceStatus{DeviceID: deviceID}
+}
+
+func (f *fakeDeviceClient) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+func (f *fakeDeviceClient) IsDeviceConnected(deviceID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if connected, ok := f.sessions[deviceID]; ok {
+		return connected
+	}
+	return f.connected
+}
+
+func (f *fakeDeviceClient) SubscribeToDeviceTopics(device config.DeviceConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribed[device.ID] = device
+	return nil
+}
+
+func (f *fakeDeviceClient) UnsubscribeFromDeviceTopics(device config.DeviceConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribed, device.ID)
+}
+
+func (f *fakeDeviceClient) PublishPresence() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := slices.Sorted(maps.Keys(f.subscribed))
+	f.presence = append(f.presence, ids)
+	return nil
+}
+
+func (f *fakeDeviceClient) setConnected(connected bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = connected
+}
+
+// setSessionConnected gives deviceID its own session, independent of the shared connection.
+func (f *fakeDeviceClient) setSessionConnected(deviceID string, connected bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions[deviceID] = connected
+}
+
+func (f *fakeDeviceClient) setStatus(status models.DeviceStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[status.DeviceID] = &status
+}
+
+func (f *fakeDeviceClient) publishedMessages() []publishedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]publishedMessage(nil), f.published...)
+}
+
+// fakeSlackAPI records the messages posted through the Slack client.
+type fakeSlackAPI struct {
+	mu       sync.Mutex
+	titles   []string
+	details  []string
+	channels []string
+	threads  []string // thread_ts of each message; empty for top-level messages
+	colors   []string // attachment color of each message, which reflects its severity
+	posts    int
+}
+
+func (f *fakeSlackAPI) PostMessage(channelID string, options ...slackclient.MsgOption) (string, string, error) {
+	_, values, err := slackclient.UnsafeApplyMsgOptions("", channelID, "", options...)
+	if err != nil {
+		return "", "", err
+	}
+	var attachments []slackclient.Attachment
+	if err := json.Unmarshal([]byte(values.Get("attachments")), &attachments); err != nil {
+		return "", "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, attachment := range attachments {
+		f.titles = append(f.titles, attachment.Title)
+		f.details = append(f.details, attachment.Text)
+		f.channels = append(f.channels, channelID)
+		f.threads = append(f.threads, values.Get("thread_ts"))
+		f.colors = append(f.colors, attachment.Color)
+	}
+	f.posts++
+	return channelID, fmt.Sprintf("1700000000.%06d", f.posts), nil
+}
+
+// titlesContaining returns the posted message titles that contain substr.
+func (f *fakeSlackAPI) titlesContaining(substr string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var matched []string
+	for _, title := range f.titles {
+		if strings.Contains(title, substr) {
+			matched = append(matched, title)
+		}
+	}
+	return matched
+}
+
+func newTestScheduler(cfg *config.Config, client DeviceClient) *Scheduler {
+	s := NewScheduler(cfg, client, nil, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	return s
+}
+
+// newTestDB opens an isolated in-memory database with the schema migrated.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.IrrigationHistory{}, &models.DeviceState{}, &models.CommandLog{}); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return db
+}
+
+// writeTaskFile writes a task definition for deviceID/taskID into dir.
+func writeTaskFile(t *testing.T, dir, deviceID, taskID, contents string) {
+	t.Helper()
+	path := filepath.Join(dir, deviceID+"_"+taskID+".json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("Failed to write task file: %v", err)
+	}
+}
+
+func TestWaitForFlagConditionMet(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := newTestScheduler(&config.Config{}, client)
+
+	client.setStatus(models.DeviceStatus{DeviceID: "sprinkler_01", TaskAllComplete: true})
+
+	err := s.waitForFlag("sprinkler_01", time.Second, func(status *models.DeviceStatus) bool {
+		return status.TaskAllComplete
+	})
+	if err != nil {
+		t.Errorf("Expected flag wait to succeed, got %v", err)
+	}
+}
+
+func TestWaitForFlagFailsFastOnDisconnect(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := newTestScheduler(&config.Config{}, client)
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		client.setConnected(false)
+	}()
+
+	start := time.Now()
+	err := s.waitForFlag("sprinkler_01", 5*time.Second, func(status *models.DeviceStatus) bool {
+		return status.TaskAllComplete
+	})
+
+	if !errors.Is(err, ErrBrokerDisconnected) {
+		t.Fatalf("Expected ErrBrokerDisconnected, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected wait to fail fast after disconnect, took %v", elapsed)
+	}
+}
+
+func TestWaitForFlagFollowsDeviceSession(t *testing.T) {
+	t.Run("session drops", func(t *testing.T) {
+		client := newFakeDeviceClient()
+		client.setSessionConnected("sprinkler_01", true)
+		s := newTestScheduler(&config.Config{}, client)
+
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			client.setSessionConnected("sprinkler_01", false)
+		}()
+
+		start := time.Now()
+		err := s.waitForFlag("sprinkler_01", 5*time.Second, func(status *models.DeviceStatus) bool {
+			return status.TaskAllComplete
+		})
+
+		if !errors.Is(err, ErrBrokerDisconnected) {
+			t.Fatalf("Expected ErrBrokerDisconnected, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected wait to fail fast after the session dropped, took %v", elapsed)
+		}
+	})
+
+	t.Run("shared connection drops", func(t *testing.T) {
+		client := newFakeDeviceClient()
+		client.setSessionConnected("sprinkler_01", true)
+		client.setConnected(false)
+		s := newTestScheduler(&config.Config{}, client)
+
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			client.setStatus(models.DeviceStatus{DeviceID: "sprinkler_01", TaskAllComplete: true})
+		}()
+
+		err := s.waitForFlag("sprinkler_01", time.Second, func(status *models.DeviceStatus) bool {
+			return status.TaskAllComplete
+		})
+		if err != nil {
+			t.Errorf("Expected the wait to succeed on the device's own session, got %v", err)
+		}
+	})
+}
+
+func TestFailureStatus(t *testing.T) {
+	if got := failureStatus(ErrBrokerDisconnected, "TASK_TIMEOUT"); got != "BROKER_DISCONNECTED" {
+		t.Errorf("Expected BROKER_DISCONNECTED, got %v", got)
+	}
+	if got := failureStatus(errors.New("timed out"), "TASK_TIMEOUT"); got != "TASK_TIMEOUT" {
+		t.Errorf("Expected TASK_TIMEOUT, got %v", got)
+	}
+}
+
+func TestHandleReconnectResumesInterruptedJobs(t *testing.T) {
+	client := newFakeDeviceClient()
+	cfg := &config.Config{MQTT: config.MQTTConfig{ResumeOnReconnect: true}}
+	s := newTestScheduler(cfg, client)
+	s.db = newTestDB(t)
+
+	client.setStatus(models.DeviceStatus{DeviceID: "plant_pot_01", HealthCheck: true})
+	s.pendingResume.Store("plant_pot_01", pendingJob{device: config.DeviceConfig{ID: "plant_pot_01", Type: "iot_plant_pot", ScheduleDuration: 30}, trigger: Trigger{Source: models.SourceScheduled}})
+
+	s.HandleReconnect()
+
+	deadline := time.Now().Add(time.Second)
+	for len(client.publishedMessages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	published := client.publishedMessages()
+	if len(published) != 1 || published[0].Topic != "plant_pot_01/cmd/trigger_solenoid_valve" {
+		t.Errorf("Expected resumed job to publish trigger command, got %v", published)
+	}
+	if _, pending := s.pendingResume.Load("plant_pot_01"); pending {
+		t.Error("Expected pending job to be cleared after resume")
+	}
+}
+
+func TestProcessDeviceUnknownType(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := newTestScheduler(&config.Config{}, client)
+	s.db = newTestDB(t)
+
+	err := s.processDevice(config.DeviceConfig{ID: "sprinkler_01", Type: "iot_sprinklr"}, Trigger{Source: models.SourceManual})
+	if !errors.Is(err, config.ErrUnknownDeviceType) {
+		t.Fatalf("Expected ErrUnknownDeviceType, got %v", err)
+	}
+	if published := client.publishedMessages(); len(published) != 0 {
+		t.Errorf("Expected no commands for an unknown device type, got %v", published)
+	}
+}
+
+func TestRunDeviceJobRoutesToDeviceChannel(t *testing.T) {
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(&config.Config{}, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C_DEFAULT"))
+
+	s.runDeviceJob(config.DeviceConfig{ID: "sprinkler_01", Type: "iot_sprinklr", SlackChannelID: "C_GARDEN"}, Trigger{Source: models.SourceManual})
+	s.runDeviceJob(config.DeviceConfig{ID: "sprinkler_02", Type: "iot_sprinklr"}, Trigger{Source: models.SourceManual})
+
+	slackAPI.mu.Lock()
+	defer slackAPI.mu.Unlock()
+	expected := []string{"C_GARDEN", "C_DEFAULT"}
+	if len(slackAPI.channels) != len(expected) {
+		t.Fatalf("Expected %d messages, got %v", len(expected), slackAPI.channels)
+	}
+	for i, channel := range expected {
+		if slackAPI.channels[i] != channel {
+			t.Errorf("Expected message %d in %s, got %s", i, channel, slackAPI.channels[i])
+		}
+	}
+}
+
+func TestRunDeviceTasksReportsProgress(t *testing.T) {
+	client := newFakeDeviceClient()
+	slackAPI := &fakeSlackAPI{}
+	cfg := &config.Config{Slack: config.SlackConfig{ProgressUpdates: true}}
+	s := NewScheduler(cfg, client, nil, slack.NewClientWithAPI(slackAPI, "C123"))
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2"}}
+	for _, taskID := range device.TaskIDs {
+		writeTaskFile(t, s.tasksDir, device.ID, taskID, `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	}
+
+	// The fake device walks through three steps after each task is set, then completes.
+	client.onPublish = func(topic, payload string) {
+		if !strings.HasSuffix(topic, "/cmd/task/set") {
+			return
+		}
+		go func() {
+			for index := 1; index <= 3; index++ {
+				client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskCurrentIndex: index, TaskCurrentCount: 3})
+				time.Sleep(40 * time.Millisecond)
+			}
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskCurrentIndex: 3, TaskCurrentCount: 3, TaskAllComplete: true})
+		}()
+	}
+
+	if err := s.runDeviceTasks(device, &models.IrrigationHistory{}, nil); err != nil {
+		t.Fatalf("Expected tasks to complete, got %v", err)
+	}
+
+	if got := slackAPI.titlesContaining("step"); len(got) < 2 {
+		t.Errorf("Expected step progress as the index advanced, got %v", got)
+	}
+	completed := slackAPI.titlesContaining("complete on")
+	if len(completed) != 2 || !strings.Contains(completed[0], "Task 1/2") || !strings.Contains(completed[1], "Task 2/2") {
+		t.Errorf("Expected a completion update per task, got %v", completed)
+	}
+}
+
+func TestRunDeviceTasksProgressDisabled(t *testing.T) {
+	client := newFakeDeviceClient()
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(&config.Config{}, client, nil, slack.NewClientWithAPI(slackAPI, "C123"))
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [], "timeoutMinutes": 1}`)
+	client.onPublish = func(topic, payload string) {
+		go client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskCurrentIndex: 1, TaskCurrentCount: 1, TaskAllComplete: true})
+	}
+
+	if err := s.runDeviceTasks(device, &models.IrrigationHistory{}, nil); err != nil {
+		t.Fatalf("Expected tasks to complete, got %v", err)
+	}
+	if got := slackAPI.titlesContaining("Task"); len(got) != 0 {
+		t.Errorf("Expected no progress updates when disabled, got %v", got)
+	}
+}
+
+// fakeWeather returns a fixed precipitation probability.
+type fakeWeather struct {
+	probability float64
+	err         error
+}
+
+func (f fakeWeather) PrecipitationProbability(ctx context.Context) (float64, error) {
+	return f.probability, f.err
+}
+
+func TestRunScheduledDeviceJobRainCheck(t *testing.T) {
+	testCases := []struct {
+		name        string
+		weather     fakeWeather
+		wantSkipped bool
+	}{
+		{name: "rain forecast", weather: fakeWeather{probability: 90}, wantSkipped: true},
+		{name: "no rain forecast", weather: fakeWeather{probability: 10}, wantSkipped: false},
+		{name: "forecast unavailable", weather: fakeWeather{err: errors.New("timeout")}, wantSkipped: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			db := newTestDB(t)
+			cfg := &config.Config{Weather: config.WeatherConfig{RainThreshold: 70}}
+			s := NewScheduler(cfg, client, db, nil)
+			s.SetWeatherProvider(tc.weather)
+
+			device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 30}
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true})
+
+			s.runScheduledDeviceJob(device)
+
+			var skipped []models.IrrigationHistory
+			db.Where("status = ?", models.StatusSkipped).Find(&skipped)
+			published := client.publishedMessages()
+
+			if tc.wantSkipped {
+				if len(skipped) != 1 || skipped[0].DeviceID != device.ID {
+					t.Errorf("Expected one skipped history row for %s, got %v", device.ID, skipped)
+				}
+				if len(published) != 0 {
+					t.Errorf("Expected no commands when rain is forecast, got %v", published)
+				}
+			} else {
+				if len(skipped) != 0 {
+					t.Errorf("Expected no skipped history rows, got %d", len(skipped))
+				}
+				if len(published) != 1 {
+					t.Errorf("Expected the watering command to be published, got %v", published)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCalibrationRecalibrateWindow(t *testing.T) {
+	now := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, RecalibrateAfterMinutes: 120}
+
+	testCases := []struct {
+		name          string
+		calibratedAgo time.Duration
+		wantHoming    bool
+	}{
+		{name: "within window skips homing", calibratedAgo: time.Hour, wantHoming: false},
+		{name: "expired window recalibrates", calibratedAgo: 3 * time.Hour, wantHoming: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			db := newTestDB(t)
+			s := newTestScheduler(&config.Config{}, client)
+			s.db = db
+			s.now = func() time.Time { return now }
+
+			lastCalibrated := now.Add(-tc.calibratedAgo)
+			db.Create(&models.DeviceState{DeviceID: device.ID, LastCalibratedAt: &lastCalibrated})
+
+			// The fake device reports calibration complete as soon as it is homed.
+			client.onPublish = func(topic, payload string) {
+				status := client.GetDeviceStatus(device.ID)
+				switch topic {
+				case device.ID + "/cmd/sprinkler/home":
+					status.SprinklerCalibComplete = true
+				case device.ID + "/cmd/valve/home":
+					status.ValveCalibComplete = true
+				}
+				client.setStatus(*status)
+			}
+
+			if err := s.runCalibration(device, &models.IrrigationHistory{}); err != nil {
+				t.Fatalf("Expected calibration to succeed, got %v", err)
+			}
+
+			homed := len(client.publishedMessages()) > 0
+			if homed != tc.wantHoming {
+				t.Errorf("Expected homing %v, got published %v", tc.wantHoming, client.publishedMessages())
+			}
+
+			// A skipped calibration must not extend the window.
+			want := lastCalibrated
+			if tc.wantHoming {
+				want = now
+			}
+			var state models.DeviceState
+			db.First(&state, "device_id = ?", device.ID)
+			if state.LastCalibratedAt == nil || !state.LastCalibratedAt.Equal(want) {
+				t.Errorf("Expected LastCalibratedAt %v, got %v", want, state.LastCalibratedAt)
+			}
+		})
+	}
+}
+
+func TestRunCalibrationRunsStepsGenerically(t *testing.T) {
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}
+	// A third axis reuses ValveIsAtTarget as its completion flag, as a second valve might.
+	steps := []calibrationStep{
+		{name: "Sprinkler", command: "cmd/sprinkler/home", calibrated: func(status *models.DeviceStatus) bool { return status.SprinklerCalibComplete }, timeout: time.Second, timeoutStatus: "SPRINKLER_CALIB_TIMEOUT"},
+		{name: "Water valve", command: "cmd/valve/home", calibrated: func(status *models.DeviceStatus) bool { return status.ValveCalibComplete }, timeout: time.Second, timeoutStatus: "VALVE_CALIB_TIMEOUT"},
+		{name: "Second valve", command: "cmd/valve2/home", calibrated: func(status *models.DeviceStatus) bool { return status.ValveIsAtTarget }, timeout: 50 * time.Millisecond, timeoutStatus: "VALVE2_CALIB_TIMEOUT"},
+	}
+
+	testCases := []struct {
+		name          string
+		initial       models.DeviceStatus
+		respondTo     []string
+		wantPublished []string
+		wantStatus    models.IrrigationStatus
+	}{
+		{
+			name:          "all steps home in order",
+			respondTo:     []string{"cmd/sprinkler/home", "cmd/valve/home", "cmd/valve2/home"},
+			wantPublished: []string{"sprinkler_01/cmd/sprinkler/home", "sprinkler_01/cmd/valve/home", "sprinkler_01/cmd/valve2/home"},
+		},
+		{
+			name:          "calibrated steps are skipped",
+			initial:       models.DeviceStatus{SprinklerCalibComplete: true},
+			respondTo:     []string{"cmd/valve/home", "cmd/valve2/home"},
+			wantPublished: []string{"sprinkler_01/cmd/valve/home", "sprinkler_01/cmd/valve2/home"},
+		},
+		{
+			name:          "third step times out",
+			respondTo:     []string{"cmd/sprinkler/home", "cmd/valve/home"},
+			wantPublished: []string{"sprinkler_01/cmd/sprinkler/home", "sprinkler_01/cmd/valve/home", "sprinkler_01/cmd/valve2/home"},
+			wantStatus:    "VALVE2_CALIB_TIMEOUT",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			s := newTestScheduler(&config.Config{}, client)
+			s.db = newTestDB(t)
+			s.calibrationSteps = steps
+			initial := tc.initial
+			initial.DeviceID = device.ID
+			client.setStatus(initial)
+
+			client.onPublish = func(topic, payload string) {
+				status := client.GetDeviceStatus(device.ID)
+				for _, command := range tc.respondTo {
+					if topic != device.ID+"/"+command {
+						continue
+					}
+					switch command {
+					case "cmd/sprinkler/home":
+						status.SprinklerCalibComplete = true
+					case "cmd/valve/home":
+						status.ValveCalibComplete = true
+					case "cmd/valve2/home":
+						status.ValveIsAtTarget = true
+					}
+				}
+				client.setStatus(*status)
+			}
+
+			history := &models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: time.Now(), Status: models.StatusStarted}
+			s.db.Create(history)
+			err := s.runCalibration(device, history)
+			if tc.wantStatus == "" && err != nil {
+				t.Fatalf("Expected calibration to succeed, got %v", err)
+			}
+			if tc.wantStatus != "" {
+				if err == nil {
+					t.Fatal("Expected calibration to fail")
+				}
+				if history.Status != tc.wantStatus || history.Notes != "Second valve calibration timed out." {
+					t.Errorf("Expected %s with notes, got %s: %q", tc.wantStatus, history.Status, history.Notes)
+				}
+			}
+
+			var published []string
+			for _, msg := range client.publishedMessages() {
+				published = append(published, msg.Topic)
+			}
+			if !reflect.DeepEqual(published, tc.wantPublished) {
+				t.Errorf("Expected published %v, got %v", tc.wantPublished, published)
+			}
+		})
+	}
+}
+
+func TestRunCalibrationReportsDisconnect(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.setSessionConnected("sprinkler_01", true)
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(&config.Config{}, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C123"))
+	s.pollInterval = 10 * time.Millisecond
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID})
+
+	// The device's session drops while it homes the sprinkler.
+	client.onPublish = func(topic, payload string) {
+		if topic == device.ID+"/cmd/sprinkler/home" {
+			client.setSessionConnected(device.ID, false)
+		}
+	}
+
+	history := &models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: time.Now(), Status: models.StatusStarted}
+	s.db.Create(history)
+	err := s.runCalibration(device, history)
+
+	if !errors.Is(err, ErrBrokerDisconnected) {
+		t.Fatalf("Expected ErrBrokerDisconnected, got %v", err)
+	}
+	if history.Status != "BROKER_DISCONNECTED" {
+		t.Errorf("Expected BROKER_DISCONNECTED, got %s", history.Status)
+	}
+	if history.Notes != "Sprinkler calibration interrupted: the MQTT broker disconnected." {
+		t.Errorf("Expected disconnect notes, got %q", history.Notes)
+	}
+	if got := slackAPI.titlesContaining("Calibration Interrupted"); len(got) != 1 {
+		t.Errorf("Expected a calibration interrupted alert, got %v", got)
+	}
+	if got := slackAPI.titlesContaining("Calibration Timeout"); len(got) != 0 {
+		t.Errorf("Expected no timeout alert, got %v", got)
+	}
+}
+
+func TestReloadDevices(t *testing.T) {
+	client := newFakeDeviceClient()
+	cfg := &config.Config{Devices: []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"08:00"}},
+		{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"08:10"}},
+		{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleTimes: []string{"07:00"}},
+	}}
+	s := newTestScheduler(cfg, client)
+	for _, device := range cfg.Devices {
+		client.SubscribeToDeviceTopics(device)
+		if err := s.scheduleDevice(device); err != nil {
+			t.Fatalf("Failed to schedule device: %v", err)
+		}
+	}
+
+	summary, err := s.ReloadDevices([]config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"08:00"}},
+		{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"09:00", "18:00"}},
+		{ID: "sprinkler_03", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"10:00"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected reload to succeed, got %v", err)
+	}
+
+	expected := ReloadSummary{Added: []string{"sprinkler_03"}, Removed: []string{"plant_pot_01"}, Changed: []string{"sprinkler_02"}}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected summary %+v, got %+v", expected, summary)
+	}
+
+	if jobs, _ := s.scheduler.FindJobsByTag("sprinkler_02"); len(jobs) != 2 {
+		t.Errorf("Expected changed device to be rescheduled with 2 jobs, got %d", len(jobs))
+	}
+	if _, err := s.scheduler.FindJobsByTag("plant_pot_01"); err == nil {
+		t.Error("Expected removed device jobs to be unscheduled")
+	}
+	if _, ok := client.subscribed["plant_pot_01"]; ok {
+		t.Error("Expected removed device to be unsubscribed")
+	}
+	if _, ok := client.subscribed["sprinkler_03"]; !ok {
+		t.Error("Expected added device to be subscribed")
+	}
+	if got := len(s.devices()); got != 3 {
+		t.Errorf("Expected 3 configured devices after reload, got %d", got)
+	}
+}
+
+func TestPausedScheduledRunsAreSkipped(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := newTestScheduler(&config.Config{}, client)
+	s.db = newTestDB(t)
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 30}
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true})
+
+	s.Pause()
+	s.runScheduledDeviceJob(device)
+	if published := client.publishedMessages(); len(published) != 0 {
+		t.Fatalf("Expected no commands while paused, got %v", published)
+	}
+
+	s.Resume()
+	s.runScheduledDeviceJob(device)
+	if published := client.publishedMessages(); len(published) != 1 {
+		t.Errorf("Expected the job to run after resume, got %v", published)
+	}
+}
+
+func TestManualRunsWhilePaused(t *testing.T) {
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 30}
+
+	testCases := []struct {
+		name        string
+		allowManual bool
+		wantErr     error
+	}{
+		{name: "manual allowed", allowManual: true, wantErr: nil},
+		{name: "manual refused", allowManual: false, wantErr: ErrSchedulerPaused},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			cfg := &config.Config{
+				Schedule: config.ScheduleConfig{Paused: true, AllowManualWhilePaused: tc.allowManual},
+				Devices:  []config.DeviceConfig{device},
+			}
+			s := newTestScheduler(cfg, client)
+			s.db = newTestDB(t)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true})
+
+			if !s.IsPaused() {
+				t.Fatal("Expected scheduler to start paused from config")
+			}
+			if err := s.RunJobForDevice(device.ID, Trigger{Source: models.SourceManual}); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr == nil {
+				return
+			}
+			if err := s.StartJobForDevice(device.ID, Trigger{Source: models.SourceManual}); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Expected StartJobForDevice to refuse with %v, got %v", tc.wantErr, err)
+			}
+			if s.IsDeviceRunning(device.ID) {
+				t.Error("Expected no job to be started while paused")
+			}
+		})
+	}
+}
+
+func TestManualRunReportsCompletionOnlyOnSuccess(t *testing.T) {
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 30}
+
+	testCases := []struct {
+		name            string
+		healthy         bool
+		expectCompleted bool
+	}{
+		{name: "successful run", healthy: true, expectCompleted: true},
+		{name: "failed run", healthy: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: tc.healthy})
+			slackAPI := &fakeSlackAPI{}
+			s := NewScheduler(&config.Config{Devices: []config.DeviceConfig{device}}, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C123"))
+
+			err := s.RunJobForDevice(device.ID, Trigger{Source: models.SourceManual})
+			if (err == nil) != tc.expectCompleted {
+				t.Fatalf("Expected the run error to reflect the job, got %v", err)
+			}
+			if completed := len(slackAPI.titlesContaining("Manual Run Completed")) == 1; completed != tc.expectCompleted {
+				t.Errorf("Expected completion notice %v, got titles %v", tc.expectCompleted, slackAPI.titles)
+			}
+		})
+	}
+}
+
+func TestCleanupHistory(t *testing.T) {
+	now := time.Date(2025, 6, 1, 3, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name       string
+		hardDelete bool
+	}{
+		{name: "soft delete", hardDelete: false},
+		{name: "hard delete", hardDelete: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			cfg := &config.Config{History: config.HistoryConfig{RetentionDays: 30, HardDelete: tc.hardDelete}}
+			s := NewScheduler(cfg, newFakeDeviceClient(), db, nil)
+			s.now = func() time.Time { return now }
+
+			for _, age := range []int{45, 31, 29, 1} {
+				created := now.AddDate(0, 0, -age)
+				row := models.IrrigationHistory{
+					Model:       gorm.Model{CreatedAt: created},
+					DeviceID:    fmt.Sprintf("age_%d", age),
+					ScheduledAt: created,
+					Status:      models.StatusCompleted,
+				}
+				if err := db.Create(&row).Error; err != nil {
+					t.Fatalf("Failed to seed history: %v", err)
+				}
+			}
+
+			removed, err := s.CleanupHistory()
+			if err != nil {
+				t.Fatalf("Expected cleanup to succeed, got %v", err)
+			}
+			if removed != 2 {
+				t.Errorf("Expected 2 rows removed, got %d", removed)
+			}
+
+			var remaining []models.IrrigationHistory
+			db.Order("device_id").Find(&remaining)
+			if len(remaining) != 2 || remaining[0].DeviceID != "age_1" || remaining[1].DeviceID != "age_29" {
+				t.Errorf("Expected only recent rows to remain, got %v", remaining)
+			}
+
+			var stored int64
+			db.Unscoped().Model(&models.IrrigationHistory{}).Count(&stored)
+			expected := int64(4)
+			if tc.hardDelete {
+				expected = 2
+			}
+			if stored != expected {
+				t.Errorf("Expected %d stored rows, got %d", expected, stored)
+			}
+		})
+	}
+}
+
+func TestRunDeviceTasksStopsOnPublishFailure(t *testing.T) {
+	client := newFakeDeviceClient()
+	client.publishErr = errors.New("publish not confirmed in time")
+	db := newTestDB(t)
+	s := NewScheduler(&config.Config{}, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2"}}
+	for _, taskID := range device.TaskIDs {
+		writeTaskFile(t, s.tasksDir, device.ID, taskID, `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	}
+
+	history := &models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: time.Now(), Status: models.StatusStarted}
+	db.Create(history)
+
+	start := time.Now()
+	err := s.runDeviceTasks(device, history, nil)
+	if !errors.Is(err, client.publishErr) {
+		t.Fatalf("Expected publish error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected job to stop without waiting for the task, took %v", elapsed)
+	}
+	if published := client.publishedMessages(); len(published) != 1 {
+		t.Errorf("Expected only the first task to be attempted, got %v", published)
+	}
+
+	var stored models.IrrigationHistory
+	db.First(&stored, history.ID)
+	if stored.Status != "PUBLISH_FAILED" {
+		t.Errorf("Expected status PUBLISH_FAILED, got %s", stored.Status)
+	}
+}
+
+func TestEstimateLiters(t *testing.T) {
+	testCases := []struct {
+		name     string
+		flowRate float64
+		duration time.Duration
+		expected float64
+	}{
+		{name: "whole minutes", flowRate: 4, duration: 15 * time.Minute, expected: 60},
+		{name: "partial minute", flowRate: 6, duration: 90 * time.Second, expected: 9},
+		{name: "no flow rate", flowRate: 0, duration: 15 * time.Minute, expected: 0},
+		{name: "no duration", flowRate: 4, duration: 0, expected: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := estimateLiters(tc.flowRate, tc.duration); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRecordWaterUsageIncrementsCounter(t *testing.T) {
+	s := newTestScheduler(&config.Config{}, newFakeDeviceClient())
+	device := config.DeviceConfig{ID: "usage_test_01", FlowRateLitersPerMinute: 2.5}
+	counter := metrics.WaterLitersTotal.WithLabelValues(device.ID)
+	before := testutil.ToFloat64(counter)
+
+	liters := s.recordWaterUsage(device, models.DeviceStatus{}, 10*time.Minute)
+	if liters != 25 {
+		t.Errorf("Expected 25 liters, got %v", liters)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 25 {
+		t.Errorf("Expected counter to increase by 25, got %v", got)
+	}
+}
+
+func TestRecordWaterUsageUsesReportedVolume(t *testing.T) {
+	testCases := []struct {
+		name     string
+		before   models.DeviceStatus
+		after    models.DeviceStatus
+		expected float64
+	}{
+		{
+			name:     "meter rise",
+			before:   models.DeviceStatus{VolumeLiters: 100, VolumeReports: 1},
+			after:    models.DeviceStatus{VolumeLiters: 112.5, VolumeReports: 2},
+			expected: 12.5,
+		},
+		{
+			name:     "no reading before the run",
+			after:    models.DeviceStatus{VolumeLiters: 112.5, VolumeReports: 1},
+			expected: 25,
+		},
+		{
+			name:     "no reading after the run",
+			before:   models.DeviceStatus{VolumeLiters: 100, VolumeReports: 1},
+			after:    models.DeviceStatus{VolumeLiters: 100, VolumeReports: 1},
+			expected: 25,
+		},
+		{
+			name:     "meter went back",
+			before:   models.DeviceStatus{VolumeLiters: 100, VolumeReports: 1},
+			after:    models.DeviceStatus{VolumeLiters: 3, VolumeReports: 2},
+			expected: 25,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := config.DeviceConfig{ID: "volume_test_01", FlowRateLitersPerMinute: 2.5, ReportsVolume: true}
+			client := newFakeDeviceClient()
+			tc.after.DeviceID = device.ID
+			client.setStatus(tc.after)
+			s := newTestScheduler(&config.Config{}, client)
+
+			if got := s.recordWaterUsage(device, tc.before, 10*time.Minute); got != tc.expected {
+				t.Errorf("Expected %v liters, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestFinishedRunRecordsDuration(t *testing.T) {
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 720, MoistureRecheck: &config.MoistureRecheck{}}
+	client := newFakeDeviceClient()
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true})
+	s := NewScheduler(&config.Config{}, client, newTestDB(t), nil)
+	now := time.Date(2026, 5, 1, 6, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.sleep = func(d time.Duration) { now = now.Add(d) }
+
+	if err := s.processPlantPotDevice(device, Trigger{Source: models.SourceScheduled}); err != nil {
+		t.Fatalf("Expected the run to succeed, got %v", err)
+	}
+	var run models.IrrigationHistory
+	if err := s.db.Where("device_id = ?", device.ID).First(&run).Error; err != nil {
+		t.Fatalf("Expected the run on history, got %v", err)
+	}
+	if run.Duration != 12 {
+		t.Errorf("Expected a duration of 12 minutes, got %d", run.Duration)
+	}
+}
+
+func TestPlantPotRecordsReportedVolume(t *testing.T) {
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 60, FlowRateLitersPerMinute: 2, ReportsVolume: true}
+	client := newFakeDeviceClient()
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, VolumeLiters: 40, VolumeReports: 1})
+	s := NewScheduler(&config.Config{}, client, newTestDB(t), nil)
+	s.sleep = func(time.Duration) {
+		client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, VolumeLiters: 41.5, VolumeReports: 2})
+	}
+
+	if err := s.processPlantPotDevice(device, Trigger{Source: models.SourceScheduled}); err != nil {
+		t.Fatalf("Expected the run to succeed, got %v", err)
+	}
+	var run models.IrrigationHistory
+	if err := s.db.Where("device_id = ?", device.ID).First(&run).Error; err != nil {
+		t.Fatalf("Expected the run on history, got %v", err)
+	}
+	if run.WaterLiters != 1.5 {
+		t.Errorf("Expected the reported 1.5 liters on history rather than the estimate, got %v", run.WaterLiters)
+	}
+}
+
+func TestSprinklerRequireHealthCheck(t *testing.T) {
+	testCases := []struct {
+		name           string
+		require        bool
+		healthy        bool
+		expectedStatus models.IrrigationStatus
+	}{
+		{name: "enabled and unhealthy aborts", require: true, healthy: false, expectedStatus: "HEALTH_CHECK_FAILED"},
+		{name: "enabled and healthy proceeds", require: true, healthy: true, expectedStatus: models.StatusCompleted},
+		{name: "disabled proceeds", require: false, healthy: false, expectedStatus: models.StatusCompleted},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			db := newTestDB(t)
+			s := NewScheduler(&config.Config{}, client, db, nil)
+			s.pollInterval = 10 * time.Millisecond
+
+			// Already calibrated and no tasks, so a job that passes the health check completes immediately.
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, RequireHealthCheck: tc.require}
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: tc.healthy, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+			err := s.processSprinklerDevice(device, Trigger{Source: models.SourceScheduled})
+			if tc.expectedStatus == models.StatusCompleted && err != nil {
+				t.Fatalf("Expected job to proceed, got %v", err)
+			}
+			if tc.expectedStatus != models.StatusCompleted && err == nil {
+				t.Fatal("Expected job to abort")
+			}
+
+			var history models.IrrigationHistory
+			db.Where("device_id = ?", device.ID).First(&history)
+			if history.Status != tc.expectedStatus {
+				t.Errorf("Expected status %s, got %s", tc.expectedStatus, history.Status)
+			}
+		})
+	}
+}
+
+func TestStartWaitsForStartupGrace(t *testing.T) {
+	testCases := []struct {
+		name      string
+		connectAt time.Duration // 0 never connects
+		armedBy   time.Duration
+	}{
+		{name: "grace period elapses", connectAt: 0, armedBy: 1500 * time.Millisecond},
+		{name: "connection confirmed", connectAt: 100 * time.Millisecond, armedBy: 500 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			client.setConnected(false)
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"06:00"}}
+			cfg := &config.Config{Devices: []config.DeviceConfig{device}, Schedule: config.ScheduleConfig{StartupGraceSeconds: 1}}
+			s := newTestScheduler(cfg, client)
+			defer s.Stop()
+
+			started := make(chan struct{})
+			go func() {
+				s.Start()
+				close(started)
+			}()
+			if tc.connectAt > 0 {
+				time.AfterFunc(tc.connectAt, func() { client.setConnected(true) })
+			}
+
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-started:
+				t.Fatal("Expected scheduling to wait for the grace period or connection")
+			default:
+			}
+
+			select {
+			case <-started:
+			case <-time.After(tc.armedBy):
+				t.Fatalf("Expected jobs to be armed within %v", tc.armedBy)
+			}
+			if jobs := len(s.scheduler.Jobs()); jobs != 1 {
+				t.Errorf("Expected 1 job, got %d", jobs)
+			}
+		})
+	}
+}
+
+func TestRunsRecordTriggerOnHistory(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	manual := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}
+	scheduled := config.DeviceConfig{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler}
+	pot := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 30}
+	s := NewScheduler(&config.Config{Devices: []config.DeviceConfig{manual, scheduled, pot}}, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+
+	// Already calibrated and no tasks, so both jobs complete immediately.
+	for _, device := range []config.DeviceConfig{manual, scheduled} {
+		client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+	}
+	client.setStatus(models.DeviceStatus{DeviceID: pot.ID, HealthCheck: true})
+
+	for _, deviceID := range []string{manual.ID, pot.ID} {
+		if err := s.RunJobForDevice(deviceID, Trigger{Source: models.SourceManual, TriggeredBy: "alice", Reason: "leaves wilting"}); err != nil {
+			t.Fatalf("Expected manual run of %s to succeed, got %v", deviceID, err)
+		}
+	}
+	s.runScheduledDeviceJob(scheduled)
+
+	var manualHistory, potHistory, scheduledHistory models.IrrigationHistory
+	db.Where("device_id = ?", manual.ID).First(&manualHistory)
+	db.Where("device_id = ?", pot.ID).First(&potHistory)
+	db.Where("device_id = ?", scheduled.ID).First(&scheduledHistory)
+
+	for _, history := range []models.IrrigationHistory{manualHistory, potHistory} {
+		if history.Source != models.SourceManual || history.TriggeredBy != "alice" || history.Reason != "leaves wilting" {
+			t.Errorf("Expected manual trigger to be recorded for %s, got source=%q by=%q reason=%q", history.DeviceID, history.Source, history.TriggeredBy, history.Reason)
+		}
+	}
+	if scheduledHistory.Source != models.SourceScheduled || scheduledHistory.TriggeredBy != "" || scheduledHistory.Reason != "" {
+		t.Errorf("Expected scheduled source, got source=%q by=%q reason=%q", scheduledHistory.Source, scheduledHistory.TriggeredBy, scheduledHistory.Reason)
+	}
+}
+
+func TestStartJobForDeviceRejectsBusyDevice(t *testing.T) {
+	client := newFakeDeviceClient()
+	device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 30}
+	s := newTestScheduler(&config.Config{Devices: []config.DeviceConfig{device}}, client)
+	s.db = newTestDB(t)
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true})
+
+	// Hold the first job inside its publish until released.
+	release := make(chan struct{})
+	published := make(chan struct{}, 1)
+	client.onPublish = func(topic, payload string) {
+		published <- struct{}{}
+		<-release
+	}
+
+	if err := s.StartJobForDevice(device.ID, Trigger{Source: models.SourceManual}); err != nil {
+		t.Fatalf("Expected first job to start, got %v", err)
+	}
+	<-published
+
+	if err := s.StartJobForDevice(device.ID, Trigger{Source: models.SourceManual}); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("Expected ErrDeviceBusy while the job runs, got %v", err)
+	}
+	if err := s.RunJobForDevice(device.ID, Trigger{Source: models.SourceManual}); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("Expected ErrDeviceBusy from RunJobForDevice, got %v", err)
+	}
+	s.runDeviceJob(device, Trigger{Source: models.SourceScheduled})
+	if got := len(client.publishedMessages()); got != 1 {
+		t.Errorf("Expected a scheduled run to be skipped while busy, got %d publishes", got)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for s.IsDeviceRunning(device.ID) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.IsDeviceRunning(device.ID) {
+		t.Fatal("Expected device to be released once the job finished")
+	}
+}
+
+func TestRunDeviceTasksPersistsTaskResults(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	s := NewScheduler(&config.Config{}, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2", "task_3"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	// A zero timeout expires immediately, so the second task times out without the device completing it.
+	writeTaskFile(t, s.tasksDir, device.ID, "task_2", `{"payload": [{"fr": 2}], "timeoutMinutes": 0}`)
+	writeTaskFile(t, s.tasksDir, device.ID, "task_3", `{"payload": [{"fr": 3}], "timeoutMinutes": 1}`)
+
+	client.onPublish = func(topic, payload string) {
+		if strings.Contains(payload, `"fr": 1`) {
+			go client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+		}
+	}
+
+	history := &models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: time.Now(), Status: models.StatusStarted}
+	db.Create(history)
+
+	if err := s.runDeviceTasks(device, history, nil); err == nil {
+		t.Fatal("Expected the second task to time out")
+	}
+
+	var stored models.IrrigationHistory
+	if err := db.First(&stored, history.ID).Error; err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if stored.Status != "TASK_TIMEOUT" {
+		t.Errorf("Expected status TASK_TIMEOUT, got %s", stored.Status)
+	}
+
+	expected := []struct {
+		taskID  string
+		outcome models.TaskOutcome
+	}{
+		{taskID: "task_1", outcome: models.TaskSucceeded},
+		{taskID: "task_2", outcome: models.TaskTimedOut},
+	}
+	if len(stored.TaskResults) != len(expected) {
+		t.Fatalf("Expected %d task results, got %+v", len(expected), stored.TaskResults)
+	}
+	for i, want := range expected {
+		got := stored.TaskResults[i]
+		if got.TaskID != want.taskID || got.Outcome != want.outcome {
+			t.Errorf("Expected result %d to be %s/%s, got %s/%s", i, want.taskID, want.outcome, got.TaskID, got.Outcome)
+		}
+		if got.StartedAt.IsZero() || got.EndedAt.Before(got.StartedAt) {
+			t.Errorf("Expected start and end times for %s, got %+v", got.TaskID, got)
+		}
+	}
+}
+
+func TestPublishCommandFormats(t *testing.T) {
+	now := time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		format   string
+		topic    string
+		payload  string
+		expected string
+	}{
+		{name: "raw by default", topic: "sprinkler_01/cmd/sprinkler/home", payload: "1", expected: "1"},
+		{name: "explicit raw", format: config.CommandFormatRaw, topic: "sprinkler_01/cmd/task/set", payload: `[{"fr":1}]`, expected: `[{"fr":1}]`},
+		{name: "json home", format: config.CommandFormatJSON, topic: "sprinkler_01/cmd/sprinkler/home", payload: "1", expected: `{"cmd":"home","ts":1748757600,"payload":1}`},
+		{name: "json task embeds payload", format: config.CommandFormatJSON, topic: "sprinkler_01/cmd/task/set", payload: `[{"fr":1}]`, expected: `{"cmd":"set","ts":1748757600,"payload":[{"fr":1}]}`},
+		{name: "json non-JSON payload", format: config.CommandFormatJSON, topic: "plant_pot_01/cmd/trigger_solenoid_valve", payload: "sixty", expected: `{"cmd":"trigger_solenoid_valve","ts":1748757600,"payload":"sixty"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			s := newTestScheduler(&config.Config{}, client)
+			s.now = func() time.Time { return now }
+
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, CommandFormat: tc.format}
+			if err := s.publishCommand(device, nil, tc.topic, tc.payload); err != nil {
+				t.Fatalf("Expected publish to succeed, got %v", err)
+			}
+
+			published := client.publishedMessages()
+			if len(published) != 1 || published[0].Topic != tc.topic {
+				t.Fatalf("Expected one publish to %s, got %v", tc.topic, published)
+			}
+			if published[0].Payload != tc.expected {
+				t.Errorf("Expected payload %s, got %s", tc.expected, published[0].Payload)
+			}
+		})
+	}
+}
+
+func TestStartJobForDeviceLimitsConcurrentManualRuns(t *testing.T) {
+	client := newFakeDeviceClient()
+	var devices []config.DeviceConfig
+	for _, id := range []string{"plant_pot_01", "plant_pot_02", "plant_pot_03"} {
+		devices = append(devices, config.DeviceConfig{ID: id, Type: config.DeviceTypePlantPot, ScheduleDuration: 30})
+		client.setStatus(models.DeviceStatus{DeviceID: id, HealthCheck: true})
+	}
+	cfg := &config.Config{Devices: devices, Schedule: config.ScheduleConfig{MaxConcurrentManual: 2}}
+	s := newTestScheduler(cfg, client)
+	s.db = newTestDB(t)
+
+	// Hold each job inside its publish until released.
+	release := make(chan struct{})
+	published := make(chan struct{}, len(devices))
+	client.onPublish = func(topic, payload string) {
+		published <- struct{}{}
+		<-release
+	}
+
+	if err := s.StartJobForDevice(devices[0].ID, Trigger{Source: models.SourceManual}); err != nil {
+		t.Fatalf("Expected job for %s to start, got %v", devices[0].ID, err)
+	}
+	<-published
+
+	// A busy device must give its slot back, so the second device still gets the last slot.
+	if err := s.StartJobForDevice(devices[0].ID, Trigger{Source: models.SourceManual}); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("Expected ErrDeviceBusy for the running device, got %v", err)
+	}
+	if err := s.StartJobForDevice(devices[1].ID, Trigger{Source: models.SourceManual}); err != nil {
+		t.Fatalf("Expected job for %s to start, got %v", devices[1].ID, err)
+	}
+	<-published
+
+	if err := s.StartJobForDevice(devices[2].ID, Trigger{Source: models.SourceManual}); !errors.Is(err, ErrTooManyManualRuns) {
+		t.Errorf("Expected ErrTooManyManualRuns for the third run, got %v", err)
+	}
+	if err := s.StartAllJobsOnce(); !errors.Is(err, ErrTooManyManualRuns) {
+		t.Errorf("Expected ErrTooManyManualRuns for a run of all devices, got %v", err)
+	}
+	if s.IsDeviceRunning(devices[2].ID) {
+		t.Error("Expected a rejected run not to claim its device")
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		err := s.StartJobForDevice(devices[2].ID, Trigger{Source: models.SourceManual})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrTooManyManualRuns) || time.Now().After(deadline) {
+			t.Fatalf("Expected a slot to free up once jobs finished, got %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegisteredDeviceTypeRunsThroughScheduler(t *testing.T) {
+	const valveType = "test_drip_valve"
+	var processed []string
+	RegisterDeviceType(valveType, config.DeviceType{
+		Topics: func(device config.DeviceConfig) []config.StatusTopic {
+			return []config.StatusTopic{{Path: "status/open", Flag: true}}
+		},
+	}, func(s *Scheduler, device config.DeviceConfig, trigger Trigger) error {
+		processed = append(processed, device.ID+"/"+string(trigger.Source))
+		return s.publishCommand(device, nil, device.ID+"/cmd/open", "1")
+	})
+
+	device := config.DeviceConfig{ID: "drip_01", Type: valveType, ScheduleTimes: []string{"06:00"}}
+	cfg := &config.Config{Devices: []config.DeviceConfig{device}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected registered type to validate, got %v", err)
+	}
+
+	client := newFakeDeviceClient()
+	s := newTestScheduler(cfg, client)
+	if _, err := s.ReloadDevices(cfg.Devices); err != nil {
+		t.Fatalf("Expected registered type to be scheduled, got %v", err)
+	}
+	s.runDeviceJob(device, Trigger{Source: models.SourceManual})
+
+	if len(processed) != 1 || processed[0] != "drip_01/manual" {
+		t.Errorf("Expected the registered processor to run once, got %v", processed)
+	}
+	published := client.publishedMessages()
+	if len(published) != 1 || published[0].Topic != "drip_01/cmd/open" {
+		t.Errorf("Expected the registered processor's command, got %v", published)
+	}
+}
+
+func TestLoadLocation(t *testing.T) {
+	testCases := []struct {
+		name        string
+		zone        string
+		expectError bool
+		expected    string
+	}{
+		{name: "schedule zone", zone: scheduleTimezone, expected: scheduleTimezone},
+		{name: "unknown zone falls back to UTC", zone: "Not/A_Zone", expectError: true, expected: "UTC"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			loc, err := loadLocation(tc.zone)
+			if (err != nil) != tc.expectError {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+			if loc == nil || loc.String() != tc.expected {
+				t.Errorf("Expected location %s, got %v", tc.expected, loc)
+			}
+		})
+	}
+}
+
+func TestConfirmValveClosed(t *testing.T) {
+	since := time.Now()
+
+	testCases := []struct {
+		name          string
+		confirmAfter  int
+		position      float64
+		reportedAt    time.Time     // when the position was received; zero if the device never reported it
+		closeAfter    time.Duration // when > 0, the valve reports closed after this delay
+		expectError   bool
+		expectedState models.IrrigationStatus
+	}{
+		{name: "check disabled", position: 45, expectedState: models.StatusStarted},
+		{name: "valve already closed", confirmAfter: 1, position: 0.2, reportedAt: since, expectedState: models.StatusStarted},
+		{name: "valve closes during wait", confirmAfter: 1, position: 45, reportedAt: since, closeAfter: 30 * time.Millisecond, expectedState: models.StatusStarted},
+		{name: "valve stuck open", confirmAfter: 1, position: 45, reportedAt: since, expectError: true, expectedState: "VALVE_NOT_CLOSED"},
+		{name: "device silent", confirmAfter: 1, expectError: true, expectedState: "VALVE_NOT_CLOSED"},
+		{name: "closed only before watering", confirmAfter: 1, reportedAt: since.Add(-time.Minute), expectError: true, expectedState: "VALVE_NOT_CLOSED"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ConfirmValveClosedSeconds: tc.confirmAfter}
+			client := newFakeDeviceClient()
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, ValvePosition: tc.position, ValvePositionAt: tc.reportedAt})
+			slackAPI := &fakeSlackAPI{}
+			s := NewScheduler(&config.Config{}, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C123"))
+			s.pollInterval = 10 * time.Millisecond
+			history := &models.IrrigationHistory{DeviceID: device.ID, Status: models.StatusStarted}
+			s.db.Create(history)
+
+			if tc.closeAfter > 0 {
+				time.AfterFunc(tc.closeAfter, func() {
+					client.setStatus(models.DeviceStatus{DeviceID: device.ID, ValvePosition: 0, ValvePositionAt: time.Now()})
+				})
+			}
+
+			err := s.confirmValveClosed(device, history, since)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("Expected error %v, got %v", tc.expectError, err)
+			}
+			if history.Status != tc.expectedState {
+				t.Errorf("Expected status %s, got %s", tc.expectedState, history.Status)
+			}
+			if alerted := len(slackAPI.titlesContaining("Valve Not Closed")) == 1; alerted != tc.expectError {
+				t.Errorf("Expected a Valve Not Closed alert %v, got %v", tc.expectError, slackAPI.titles)
+			}
+		})
+	}
+}
+
+func TestRunDeviceTasksAppliesTaskParams(t *testing.T) {
+	testCases := []struct {
+		name            string
+		payload         string
+		params          map[string]json.RawMessage
+		expectedPayload string
+	}{
+		{
+			name:            "no params publishes the file payload",
+			payload:         `[{"fr": 0, "to": 90, "ct": 10}]`,
+			expectedPayload: `[{"fr": 0, "to": 90, "ct": 10}]`,
+		},
+		{
+			name:            "params override every step",
+			payload:         `[{"fr": 0, "to": 90, "ct": 10}, {"fr": 90, "to": 0, "ct": 10}]`,
+			params:          map[string]json.RawMessage{"ct": json.RawMessage(`3`), "sp": json.RawMessage(`50`)},
+			expectedPayload: `[{"ct":3,"fr":0,"sp":50,"to":90},{"ct":3,"fr":90,"sp":50,"to":0}]`,
+		},
+		{
+			name:            "params override a single step object",
+			payload:         `{"fr": 0, "to": 90, "ct": 10}`,
+			params:          map[string]json.RawMessage{"ct": json.RawMessage(`1`)},
+			expectedPayload: `{"ct":1,"fr":0,"to":90}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			s := newTestScheduler(&config.Config{}, client)
+			s.db = newTestDB(t)
+			s.tasksDir = t.TempDir()
+
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+			writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": `+tc.payload+`, "timeoutMinutes": 1}`)
+			client.onPublish = func(topic, payload string) {
+				go client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+			}
+
+			if err := s.runDeviceTasks(device, &models.IrrigationHistory{}, tc.params); err != nil {
+				t.Fatalf("Expected tasks to complete, got %v", err)
+			}
+			published := client.publishedMessages()
+			if len(published) != 1 || published[0].Payload != tc.expectedPayload {
+				t.Errorf("Expected payload %s, got %+v", tc.expectedPayload, published)
+			}
+		})
+	}
+}
+
+func TestRunDeviceTasksRejectsParamsForNonObjectSteps(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := newTestScheduler(&config.Config{}, client)
+	s.db = newTestDB(t)
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [1, 2], "timeoutMinutes": 1}`)
+	history := &models.IrrigationHistory{DeviceID: device.ID}
+
+	if err := s.runDeviceTasks(device, history, map[string]json.RawMessage{"ct": json.RawMessage(`3`)}); err == nil {
+		t.Fatal("Expected params on a non-object payload to fail")
+	}
+	if history.Status != "TASK_ERROR" {
+		t.Errorf("Expected status TASK_ERROR, got %s", history.Status)
+	}
+	if published := client.publishedMessages(); len(published) != 0 {
+		t.Errorf("Expected nothing published, got %+v", published)
+	}
+}
+
+func TestCalibrateDevice(t *testing.T) {
+	steps := []calibrationStep{
+		{name: "Sprinkler", command: "cmd/sprinkler/home", calibrated: func(status *models.DeviceStatus) bool { return status.SprinklerCalibComplete }, timeout: 50 * time.Millisecond, timeoutStatus: "SPRINKLER_CALIB_TIMEOUT"},
+		{name: "Water valve", command: "cmd/valve/home", calibrated: func(status *models.DeviceStatus) bool { return status.ValveCalibComplete }, timeout: 50 * time.Millisecond, timeoutStatus: "VALVE_CALIB_TIMEOUT"},
+	}
+
+	testCases := []struct {
+		name           string
+		deviceID       string
+		respond        bool
+		expectedErr    error
+		expectedStatus models.IrrigationStatus
+	}{
+		{name: "calibrated", deviceID: "sprinkler_01", respond: true, expectedStatus: models.StatusCalibrated},
+		{name: "timeout", deviceID: "sprinkler_01", expectedErr: ErrFlagTimeout, expectedStatus: "SPRINKLER_CALIB_TIMEOUT"},
+		{name: "unknown device", deviceID: "sprinkler_99", expectedErr: ErrDeviceNotFound},
+		{name: "plant pot", deviceID: "plant_pot_01", expectedErr: ErrCalibrationUnsupported},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			cfg := &config.Config{Devices: []config.DeviceConfig{
+				{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler},
+				{ID: "plant_pot_01", Type: config.DeviceTypePlantPot},
+			}}
+			s := newTestScheduler(cfg, client)
+			s.db = newTestDB(t)
+			s.calibrationSteps = steps
+			// Stale flags from an earlier run must not count as calibrated.
+			client.setStatus(models.DeviceStatus{DeviceID: "sprinkler_01", SprinklerCalibComplete: true, ValveCalibComplete: true})
+			if tc.respond {
+				client.onPublish = func(topic, payload string) {
+					status := client.GetDeviceStatus("sprinkler_01")
+					status.SprinklerCalibComplete = status.SprinklerCalibComplete || strings.HasSuffix(topic, "/cmd/sprinkler/home")
+					status.ValveCalibComplete = status.ValveCalibComplete || strings.HasSuffix(topic, "/cmd/valve/home")
+					go client.setStatus(*status)
+				}
+			}
+
+			err := s.CalibrateDevice(tc.deviceID, Trigger{Source: models.SourceManual})
+			if !errors.Is(err, tc.expectedErr) || (err == nil) != (tc.expectedErr == nil) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if s.IsDeviceRunning(tc.deviceID) {
+				t.Error("Expected the device to be released after calibration")
+			}
+			if tc.expectedStatus == "" {
+				return
+			}
+
+			var history models.IrrigationHistory
+			if err := s.db.Where("device_id = ?", tc.deviceID).First(&history).Error; err != nil {
+				t.Fatalf("Failed to load history: %v", err)
+			}
+			if history.Status != tc.expectedStatus {
+				t.Errorf("Expected status %s, got %s", tc.expectedStatus, history.Status)
+			}
+			if tc.respond && len(client.publishedMessages()) != len(steps) {
+				t.Errorf("Expected every axis to be homed, got %+v", client.publishedMessages())
+			}
+		})
+	}
+}
+
+func TestEffectiveTimeoutMinutes(t *testing.T) {
+	limits := TaskTimeoutLimits{DefaultMinutes: 30, MaxMinutes: 120}
+
+	testCases := []struct {
+		name           string
+		fileMinutes    int
+		limits         TaskTimeoutLimits
+		expected       int
+		expectAdjusted bool
+	}{
+		{name: "within limits", fileMinutes: 15, limits: limits, expected: 15},
+		{name: "missing uses default", fileMinutes: 0, limits: limits, expected: 30, expectAdjusted: true},
+		{name: "typo is clamped", fileMinutes: 600, limits: limits, expected: 120, expectAdjusted: true},
+		{name: "at the maximum", fileMinutes: 120, limits: limits, expected: 120},
+		{name: "no limits", fileMinutes: 600, expected: 600},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, note := TaskDefinition{TimeoutMinutes: tc.fileMinutes}.EffectiveTimeoutMinutes(tc.limits)
+			if got != tc.expected {
+				t.Errorf("Expected %d minutes, got %d", tc.expected, got)
+			}
+			if (note != "") != tc.expectAdjusted {
+				t.Errorf("Expected adjusted %v, got note %q", tc.expectAdjusted, note)
+			}
+		})
+	}
+}
+
+func TestEstimateSprinklerTaskDuration(t *testing.T) {
+	testCases := []struct {
+		name      string
+		payload   string
+		expected  time.Duration
+		expectErr bool
+	}{
+		{
+			name:     "sample payload",
+			payload:  `[{"fr": 0, "to": 90, "sp": 3, "wv": 8, "wvea": "STOP", "ct": 10}, {"fr": 120, "to": 60, "sp": 2, "wv": 10, "wvea": "STOP", "ct": 2}]`,
+			expected: 360 * time.Second, // 10 sweeps of 30s plus 2 sweeps of 30s
+		},
+		{name: "no count sweeps once", payload: `[{"fr": 0, "to": 30, "sp": 1}]`, expected: 30 * time.Second},
+		{name: "not an array", payload: `{"fr": 0}`, expectErr: true},
+		{name: "unparseable", payload: `not json`, expectErr: true},
+		{name: "no steps", payload: `[]`, expectErr: true},
+		{name: "no speed", payload: `[{"fr": 0, "to": 30}]`, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := EstimateSprinklerTaskDuration(json.RawMessage(tc.payload))
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectErr, err)
+			}
+			if got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEffectiveTimeoutMinutesEstimated(t *testing.T) {
+	limits := TaskTimeoutLimitsFromConfig(config.ScheduleConfig{TaskDefaultTimeoutMins: 30, TaskMaxTimeoutMins: 120, TaskEstimateTimeout: true, TaskEstimateMarginPercent: 50})
+	testCases := []struct {
+		name        string
+		def         TaskDefinition
+		expected    int
+		noteContain string
+	}{
+		{
+			name:        "estimated with margin",
+			def:         TaskDefinition{Payload: json.RawMessage(`[{"fr": 0, "to": 90, "sp": 3, "ct": 10}, {"fr": 120, "to": 60, "sp": 2, "ct": 2}]`)},
+			expected:    9, // 6 minutes plus 50%
+			noteContain: "estimated 9 minutes",
+		},
+		{
+			name:        "short estimate rounds up",
+			def:         TaskDefinition{Payload: json.RawMessage(`[{"fr": 0, "to": 10, "sp": 1}]`)},
+			expected:    1,
+			noteContain: "estimated 1 minutes",
+		},
+		{
+			name:        "estimate clamped",
+			def:         TaskDefinition{Payload: json.RawMessage(`[{"fr": 0, "to": 3600, "sp": 1, "ct": 3}]`)},
+			expected:    120,
+			noteContain: "clamped to 120 minutes",
+		},
+		{
+			name:        "unparseable payload falls back to the default",
+			def:         TaskDefinition{Payload: json.RawMessage(`"home"`)},
+			expected:    30,
+			noteContain: "could not be estimated",
+		},
+		{
+			name:     "file timeout wins",
+			def:      TaskDefinition{Payload: json.RawMessage(`[{"fr": 0, "to": 10, "sp": 1}]`), TimeoutMinutes: 15},
+			expected: 15,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, note := tc.def.EffectiveTimeoutMinutes(limits)
+			if got != tc.expected {
+				t.Errorf("Expected %d minutes, got %d", tc.expected, got)
+			}
+			if !strings.Contains(note, tc.noteContain) || (tc.noteContain == "" && note != "") {
+				t.Errorf("Expected note containing %q, got %q", tc.noteContain, note)
+			}
+		})
+	}
+}
+
+func TestReadTaskDefinitionRetries(t *testing.T) {
+	transient := errors.New("read tasks/sprinkler_01_task_1.json: input/output error")
+	testCases := []struct {
+		name          string
+		errs          []error // returned by successive reads; reads after these succeed
+		expectErr     error
+		expectedReads int
+	}{
+		{name: "transient error succeeds on retry", errs: []error{transient, transient}, expectedReads: 3},
+		{name: "not found fails at once", errs: []error{fs.ErrNotExist}, expectErr: fs.ErrNotExist, expectedReads: 1},
+		{name: "persistent error gives up", errs: []error{transient, transient, transient}, expectErr: transient, expectedReads: 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestScheduler(&config.Config{Schedule: config.ScheduleConfig{TaskReadRetries: 2, TaskReadRetryDelayMs: 500}}, newFakeDeviceClient())
+			var slept []time.Duration
+			s.sleep = func(d time.Duration) { slept = append(slept, d) }
+			reads := 0
+			s.readTaskFile = func(path string) (*TaskDefinition, error) {
+				reads++
+				if reads <= len(tc.errs) {
+					return nil, tc.errs[reads-1]
+				}
+				return &TaskDefinition{Payload: json.RawMessage(`[{"fr": 1}]`), TimeoutMinutes: 1}, nil
+			}
+
+			taskDef, err := s.readTaskDefinition(config.DeviceConfig{ID: "sprinkler_01"}, "tasks/sprinkler_01_task_1.json")
+			if !errors.Is(err, tc.expectErr) {
+				t.Fatalf("Expected error %v, got %v", tc.expectErr, err)
+			}
+			if tc.expectErr == nil && taskDef == nil {
+				t.Fatal("Expected the task definition once a read succeeds")
+			}
+			if reads != tc.expectedReads {
+				t.Errorf("Expected %d reads, got %d", tc.expectedReads, reads)
+			}
+			if len(slept) != reads-1 || (len(slept) > 0 && slept[0] != 500*time.Millisecond) {
+				t.Errorf("Expected a 500ms delay before each retry, got %v", slept)
+			}
+		})
+	}
+}
+
+func TestValidateTaskFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTaskFile(t, dir, "sprinkler_01", "good", `{"payload": [{"fr": 0, "to": 90, "sp": 3}], "timeoutMinutes": 5}`)
+	writeTaskFile(t, dir, "sprinkler_01", "default", `{"payload": [{"fr": 0, "to": 90, "sp": 3}]}`)
+	writeTaskFile(t, dir, "sprinkler_02", "garbled", `{"payload": [`)
+	writeTaskFile(t, dir, "sprinkler_02", "empty", `{"payload": [], "timeoutMinutes": 5}`)
+	writeTaskFile(t, dir, "sprinkler_02", "no_timeout", `{"payload": [{"fr": 0, "to": 90, "sp": 3}], "timeoutMinutes": 0}`)
+	good := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"good", "default"}}
+	// Plant pots have no task files.
+	pot := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, TaskIDs: []string{"missing"}}
+
+	if err := ValidateTaskFiles(dir, []config.DeviceConfig{good, pot}, TaskTimeoutLimits{DefaultMinutes: 30}); err != nil {
+		t.Errorf("Expected valid task files to pass, got %v", err)
+	}
+
+	broken := config.DeviceConfig{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"garbled", "empty", "no_timeout", "missing"}}
+	err := ValidateTaskFiles(dir, []config.DeviceConfig{good, broken}, TaskTimeoutLimits{})
+	if !errors.Is(err, ErrBrokenTaskFile) {
+		t.Fatalf("Expected ErrBrokenTaskFile, got %v", err)
+	}
+	expected := []string{
+		"device 'sprinkler_01', task 'default': timeoutMinutes is 0 and no default applies",
+		"device 'sprinkler_02', task 'garbled': " + ErrInvalidTask.Error(),
+		"device 'sprinkler_02', task 'empty': the payload is empty",
+		"device 'sprinkler_02', task 'no_timeout': timeoutMinutes is 0",
+		"device 'sprinkler_02', task 'missing': " + filepath.Join(dir, "sprinkler_02_missing.json") + " does not exist",
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(lines), err)
+	}
+	for i, want := range expected {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("Expected problem %d to contain %q, got %q", i+1, want, lines[i])
+		}
+	}
+}
+
+func TestValidateTaskFilesShippedTasks(t *testing.T) {
+	devices, err := config.LoadDevices(filepath.Join("..", "..", "devices.json"), config.ScheduleConfig{})
+	if err != nil {
+		t.Fatalf("Failed to load devices.json: %v", err)
+	}
+	limits := TaskTimeoutLimitsFromConfig(config.ScheduleConfig{TaskDefaultTimeoutMins: 30})
+	if err := ValidateTaskFiles(filepath.Join("..", "..", DefaultTasksDir), devices, limits); err != nil {
+		t.Errorf("Expected the shipped task files to be valid, got %v", err)
+	}
+}
+
+func TestRunDeviceTasksRecordsEffectiveTimeout(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := newTestScheduler(&config.Config{Schedule: config.ScheduleConfig{TaskDefaultTimeoutMins: 1, TaskMaxTimeoutMins: 2}}, client)
+	s.db = newTestDB(t)
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"missing", "typo"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "missing", `{"payload": [{"fr": 1}]}`)
+	writeTaskFile(t, s.tasksDir, device.ID, "typo", `{"payload": [{"fr": 2}], "timeoutMinutes": 600}`)
+	client.onPublish = func(topic, payload string) {
+		go client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+	}
+
+	history := &models.IrrigationHistory{DeviceID: device.ID}
+	if err := s.runDeviceTasks(device, history, nil); err != nil {
+		t.Fatalf("Expected tasks to complete, got %v", err)
+	}
+	if len(history.TaskResults) != 2 || history.TaskResults[0].TimeoutMinutes != 1 || history.TaskResults[1].TimeoutMinutes != 2 {
+		t.Errorf("Expected effective timeouts of 1 and 2 minutes, got %+v", history.TaskResults)
+	}
+}
+
+// fakeSubscriptionProbe reports a fixed set of devices as not yet subscribed.
+type fakeSubscriptionProbe []string
+
+func (f fakeSubscriptionProbe) PendingDevices(deviceIDs []string, requireStatus bool) []string {
+	return f
+}
+
+func TestRunSelfTest(t *testing.T) {
+	devices := []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler},
+		{ID: "plant_pot_01", Type: config.DeviceTypePlantPot},
+	}
+
+	testCases := []struct {
+		name             string
+		pending          fakeSubscriptionProbe
+		healthy          bool
+		healthyAfter     time.Duration // when > 0, the plant pot reports healthy after this delay
+		expectedProblems map[string]bool
+		expectedTitle    string
+	}{
+		{name: "all healthy", healthy: true, expectedProblems: map[string]bool{}, expectedTitle: "Self-Test Passed"},
+		{name: "health reported during wait", healthyAfter: 30 * time.Millisecond, expectedProblems: map[string]bool{}, expectedTitle: "Self-Test Passed"},
+		{name: "dead plant pot", expectedProblems: map[string]bool{"plant_pot_01": true}, expectedTitle: "Self-Test Failed (1/2 devices)"},
+		{name: "unsubscribed sprinkler", pending: fakeSubscriptionProbe{"sprinkler_01"}, healthy: true, expectedProblems: map[string]bool{"sprinkler_01": true}, expectedTitle: "Self-Test Failed (1/2 devices)"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			slackAPI := &fakeSlackAPI{}
+			s := NewScheduler(&config.Config{Devices: devices}, client, nil, slack.NewClientWithAPI(slackAPI, "C123"))
+			s.pollInterval = 10 * time.Millisecond
+			client.setStatus(models.DeviceStatus{DeviceID: "plant_pot_01", HealthCheck: tc.healthy})
+			if tc.healthyAfter > 0 {
+				time.AfterFunc(tc.healthyAfter, func() {
+					client.setStatus(models.DeviceStatus{DeviceID: "plant_pot_01", HealthCheck: true})
+				})
+			}
+
+			results := s.RunSelfTest(tc.pending, 200*time.Millisecond)
+			if len(results) != len(devices) {
+				t.Fatalf("Expected %d results, got %+v", len(devices), results)
+			}
+			for _, result := range results {
+				if (result.Problem != "") != tc.expectedProblems[result.DeviceID] {
+					t.Errorf("Expected problem %v for %s, got %q", tc.expectedProblems[result.DeviceID], result.DeviceID, result.Problem)
+				}
+			}
+			if got := slackAPI.titlesContaining(tc.expectedTitle); len(got) != 1 {
+				t.Errorf("Expected a %q summary, got %v", tc.expectedTitle, slackAPI.titlesContaining("Self-Test"))
+			}
+		})
+	}
+}
+
+func TestCheckCooldown(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	zero, twoHours := 0, 120
+
+	testCases := []struct {
+		name           string
+		globalMinutes  int
+		deviceMinutes  *int
+		lastRunAgo     time.Duration // 0 seeds no run
+		lastRunStatus  models.IrrigationStatus
+		runType        string // runs a job of a device of this type now instead of seeding a run
+		expectCooldown bool
+	}{
+		{name: "disabled", lastRunAgo: time.Minute, lastRunStatus: models.StatusCompleted},
+		{name: "no previous run", globalMinutes: 60},
+		{name: "within cooldown", globalMinutes: 60, lastRunAgo: 30 * time.Minute, lastRunStatus: models.StatusCompleted, expectCooldown: true},
+		{name: "failed run counts", globalMinutes: 60, lastRunAgo: 30 * time.Minute, lastRunStatus: "TASK_TIMEOUT", expectCooldown: true},
+		{name: "after cooldown", globalMinutes: 60, lastRunAgo: 90 * time.Minute, lastRunStatus: models.StatusCompleted},
+		{name: "calibration does not count", globalMinutes: 60, lastRunAgo: 30 * time.Minute, lastRunStatus: models.StatusCalibrated},
+		{name: "device override extends", globalMinutes: 60, deviceMinutes: &twoHours, lastRunAgo: 90 * time.Minute, lastRunStatus: models.StatusCompleted, expectCooldown: true},
+		{name: "device override disables", globalMinutes: 60, deviceMinutes: &zero, lastRunAgo: 30 * time.Minute, lastRunStatus: models.StatusCompleted},
+		{name: "plant pot run counts", globalMinutes: 60, runType: config.DeviceTypePlantPot, expectCooldown: true},
+		{name: "sprinkler run counts", globalMinutes: 60, runType: config.DeviceTypeSprinkler, expectCooldown: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			s := newTestScheduler(&config.Config{Schedule: config.ScheduleConfig{CooldownMinutes: tc.globalMinutes}}, client)
+			s.db = newTestDB(t)
+			s.now = func() time.Time { return now }
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, CooldownMinutes: tc.deviceMinutes}
+			if tc.lastRunAgo > 0 {
+				startedAt := now.Add(-tc.lastRunAgo)
+				s.db.Create(&models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: startedAt, StartedAt: &startedAt, Status: tc.lastRunStatus})
+			}
+			if tc.runType != "" {
+				// Already healthy and calibrated, with no tasks, so the job completes immediately.
+				device = config.DeviceConfig{ID: tc.runType + "_01", Type: tc.runType, ScheduleDuration: 30, CooldownMinutes: tc.deviceMinutes}
+				client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, SprinklerCalibComplete: true, ValveCalibComplete: true})
+				if err := s.processDevice(device, Trigger{Source: models.SourceScheduled}); err != nil {
+					t.Fatalf("Expected the %s run to succeed, got %v", tc.runType, err)
+				}
+				var run models.IrrigationHistory
+				if err := s.db.Where("device_id = ?", device.ID).First(&run).Error; err != nil {
+					t.Fatalf("Expected the %s run on history, got %v", tc.runType, err)
+				}
+				if run.Status != models.StatusCompleted || run.Source != models.SourceScheduled || run.EndedAt == nil {
+					t.Errorf("Expected a completed scheduled run, got %+v", run)
+				}
+			}
+
+			err := s.checkCooldown(device)
+			if errors.Is(err, ErrCoolingDown) != tc.expectCooldown {
+				t.Fatalf("Expected cooldown %v, got %v", tc.expectCooldown, err)
+			}
+			var cooldown *CooldownError
+			if tc.expectCooldown && (!errors.As(err, &cooldown) || !cooldown.LastRun.Equal(now.Add(-tc.lastRunAgo))) {
+				t.Errorf("Expected the last run time in the error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStartJobForDeviceRecordsCooldownSkip(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}
+	s := newTestScheduler(&config.Config{Devices: []config.DeviceConfig{device}, Schedule: config.ScheduleConfig{CooldownMinutes: 60, AllowManualWhilePaused: true}}, newFakeDeviceClient())
+	s.db = newTestDB(t)
+	s.now = func() time.Time { return now }
+	startedAt := now.Add(-10 * time.Minute)
+	s.db.Create(&models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: startedAt, StartedAt: &startedAt, Status: models.StatusCompleted})
+
+	err := s.StartJobForDevice(device.ID, Trigger{Source: models.SourceManual, TriggeredBy: "alice"})
+	if !errors.Is(err, ErrCoolingDown) {
+		t.Fatalf("Expected ErrCoolingDown, got %v", err)
+	}
+	if s.IsDeviceRunning(device.ID) {
+		t.Error("Expected the device to be released after the refusal")
+	}
+
+	var skipped models.IrrigationHistory
+	if err := s.db.Where("device_id = ? AND status = ?", device.ID, models.StatusSkipped).First(&skipped).Error; err != nil {
+		t.Fatalf("Expected a skipped history row, got %v", err)
+	}
+	if skipped.Source != models.SourceManual || skipped.TriggeredBy != "alice" || !strings.Contains(skipped.Notes, "cooldown") && !strings.Contains(skipped.Notes, "next run allowed") {
+		t.Errorf("Expected the skipped row to record the trigger and reason, got %+v", skipped)
+	}
+}
+
+func TestProcessPlantPotDeviceConfirmsValveClosed(t *testing.T) {
+	testCases := []struct {
+		name         string
+		confirmAfter int
+		reports      bool    // the valve reports its position after the watering command
+		position     float64 // the reported position, or the stale one when the valve does not report
+		expectError  bool
+		expectedMsg  string
+	}{
+		{name: "check disabled", position: 1, expectedMsg: "Plant Pot Job Completed"},
+		{name: "valve closed", confirmAfter: 1, reports: true, position: 0, expectedMsg: "Plant Pot Job Completed"},
+		{name: "valve never closed", confirmAfter: 1, reports: true, position: 1, expectError: true, expectedMsg: "Valve Not Closed"},
+		{name: "device silent", confirmAfter: 1, position: 0, expectError: true, expectedMsg: "Valve Not Closed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ConfirmValveClosedSeconds: tc.confirmAfter}
+			client := newFakeDeviceClient()
+			// A position received before the run must not count, however closed it reads.
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, ValvePosition: tc.position, ValvePositionAt: time.Now().Add(-time.Hour)})
+			if tc.reports {
+				client.onPublish = func(topic, payload string) {
+					client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, ValvePosition: tc.position, ValvePositionAt: time.Now()})
+				}
+			}
+			slackAPI := &fakeSlackAPI{}
+			s := NewScheduler(&config.Config{}, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C_DEFAULT"))
+			s.pollInterval = 10 * time.Millisecond
+
+			err := s.processPlantPotDevice(device, Trigger{Source: models.SourceScheduled})
+			if (err != nil) != tc.expectError {
+				t.Fatalf("Expected error %v, got %v", tc.expectError, err)
+			}
+			if len(slackAPI.titlesContaining(tc.expectedMsg)) != 1 {
+				t.Errorf("Expected a %q notification, got %v", tc.expectedMsg, slackAPI.titles)
+			}
+			if tc.expectError && len(slackAPI.titlesContaining("Plant Pot Job Completed")) != 0 {
+				t.Error("Expected no success notification when the valve did not close")
+			}
+		})
+	}
+}
+
+func TestWaitForFlagIgnoresDevicesThatNeverReported(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := newTestScheduler(&config.Config{}, client)
+	alwaysMet := func(status *models.DeviceStatus) bool { return true }
+
+	if err := s.waitForFlag("sprinkler_01", 50*time.Millisecond, alwaysMet); !errors.Is(err, ErrFlagTimeout) {
+		t.Errorf("Expected ErrFlagTimeout for a device without a status, got %v", err)
+	}
+
+	client.setStatus(models.DeviceStatus{DeviceID: "sprinkler_01"})
+	if err := s.waitForFlag("sprinkler_01", time.Second, alwaysMet); err != nil {
+		t.Errorf("Expected the flag to be met once the device reported, got %v", err)
+	}
+}
+
+func TestSprinklerRunRecordsCommandLog(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	s := NewScheduler(&config.Config{}, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2"}}
+	for _, taskID := range device.TaskIDs {
+		writeTaskFile(t, s.tasksDir, device.ID, taskID, `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	}
+
+	// The fake device reports each command done shortly after receiving it.
+	client.onPublish = func(topic, payload string) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			status := client.GetDeviceStatus(device.ID)
+			switch {
+			case strings.HasSuffix(topic, "/cmd/sprinkler/home"):
+				status.SprinklerCalibComplete = true
+			case strings.HasSuffix(topic, "/cmd/valve/home"):
+				status.ValveCalibComplete = true
+			case strings.HasSuffix(topic, "/cmd/task/set"):
+				status.TaskAllComplete = true
+			}
+			client.setStatus(*status)
+		}()
+	}
+
+	if err := s.processSprinklerDevice(device, Trigger{Source: models.SourceManual, TriggeredBy: "alice"}); err != nil {
+		t.Fatalf("Expected the run to complete, got %v", err)
+	}
+
+	var history models.IrrigationHistory
+	if err := db.Where("device_id = ?", device.ID).First(&history).Error; err != nil {
+		t.Fatalf("Expected a history row, got %v", err)
+	}
+	var commands []models.CommandLog
+	db.Where("device_id = ?", device.ID).Order("id").Find(&commands)
+
+	expected := []string{"sprinkler_01/cmd/sprinkler/home", "sprinkler_01/cmd/valve/home", "sprinkler_01/cmd/task/set", "sprinkler_01/cmd/task/set"}
+	var topics []string
+	for _, command := range commands {
+		topics = append(topics, command.Topic)
+		if command.HistoryID == nil || *command.HistoryID != history.ID || command.Source != models.SourceManual || command.Error != "" {
+			t.Errorf("Expected command %s linked to run %d from a manual trigger, got %+v", command.Topic, history.ID, command)
+		}
+	}
+	if !reflect.DeepEqual(topics, expected) {
+		t.Errorf("Expected commands %v, got %v", expected, topics)
+	}
+}
+
+func TestHandleReconnectAlertsWhenBrokerFlaps(t *testing.T) {
+	slackAPI := &fakeSlackAPI{}
+	cfg := &config.Config{MQTT: config.MQTTConfig{FlapThreshold: 3, FlapWindowMins: 10}}
+	s := NewScheduler(cfg, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C_DEFAULT"))
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	reconnectAt := func(offset time.Duration) {
+		now = now.Add(offset)
+		s.HandleReconnect()
+	}
+
+	// Two reconnects, then a third outside the window: no alert.
+	reconnectAt(0)
+	reconnectAt(time.Minute)
+	reconnectAt(15 * time.Minute)
+	if got := slackAPI.titlesContaining("Flapping"); len(got) != 0 {
+		t.Fatalf("Expected no flapping alert for spread out reconnects, got %v", got)
+	}
+
+	// Three within the window alert once; more in the same window don't repeat it.
+	reconnectAt(time.Minute)
+	reconnectAt(time.Minute)
+	reconnectAt(time.Minute)
+	if got := slackAPI.titlesContaining("Flapping"); len(got) != 1 {
+		t.Fatalf("Expected one flapping alert, got %v", got)
+	}
+
+	// Once the window has passed, continued flapping alerts again.
+	reconnectAt(8 * time.Minute)
+	reconnectAt(time.Minute)
+	reconnectAt(time.Minute)
+	if got := slackAPI.titlesContaining("Flapping"); len(got) != 2 {
+		t.Errorf("Expected a second flapping alert after the window, got %v", got)
+	}
+}
+
+func TestStartJobForDeviceRejectsUnknownTaskIDs(t *testing.T) {
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2"}}
+	s := newTestScheduler(&config.Config{Devices: []config.DeviceConfig{device}, Schedule: config.ScheduleConfig{AllowManualWhilePaused: true}}, newFakeDeviceClient())
+
+	err := s.StartJobForDevice(device.ID, Trigger{Source: models.SourceManual, TaskIDs: []string{"task_2", "task_9"}})
+	if !errors.Is(err, ErrUnknownTask) || !strings.Contains(err.Error(), "task_9") || strings.Contains(err.Error(), "task_2") {
+		t.Fatalf("Expected ErrUnknownTask naming only task_9, got %v", err)
+	}
+	if s.IsDeviceRunning(device.ID) {
+		t.Error("Expected the device to be released after the refusal")
+	}
+}
+
+func TestSprinklerRunPublishesOnlyRequestedTasks(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	s := NewScheduler(&config.Config{}, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2", "task_3"}}
+	for _, taskID := range device.TaskIDs {
+		writeTaskFile(t, s.tasksDir, device.ID, taskID, fmt.Sprintf(`{"payload": {"id": %q}, "timeoutMinutes": 1}`, taskID))
+	}
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+	client.onPublish = func(topic, payload string) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+		}()
+	}
+
+	if err := s.processSprinklerDevice(device, Trigger{Source: models.SourceManual, TaskIDs: []string{"task_3", "task_1"}}); err != nil {
+		t.Fatalf("Expected the run to complete, got %v", err)
+	}
+
+	var payloads []string
+	for _, msg := range client.publishedMessages() {
+		if strings.HasSuffix(msg.Topic, "/cmd/task/set") {
+			payloads = append(payloads, msg.Payload)
+		}
+	}
+	expected := []string{`{"id": "task_3"}`, `{"id": "task_1"}`}
+	if !reflect.DeepEqual(payloads, expected) {
+		t.Errorf("Expected only the requested tasks %v, got %v", expected, payloads)
+	}
+}
+
+func TestTaskResetGuard(t *testing.T) {
+	reported := func(complete bool, reports int) *models.DeviceStatus {
+		return &models.DeviceStatus{TaskAllComplete: complete, TaskAllCompleteReports: reports}
+	}
+	restartedIndex := &models.DeviceStatus{TaskAllComplete: true, TaskAllCompleteReports: 1, TaskIndexReported: true}
+
+	tests := []struct {
+		name     string
+		verify   bool
+		statuses []*models.DeviceStatus
+		expected []bool
+	}{
+		{"disabled accepts any completion", false, []*models.DeviceStatus{{TaskAllComplete: true}}, []bool{true}},
+		{"stale true is ignored", true, []*models.DeviceStatus{reported(true, 1), reported(true, 1)}, []bool{false, false}},
+		{"true after a reported false", true, []*models.DeviceStatus{reported(true, 1), reported(false, 2), reported(true, 3)}, []bool{false, false, true}},
+		{"index reset arms without accepting the stale true", true, []*models.DeviceStatus{restartedIndex, reported(true, 2)}, []bool{false, true}},
+		{"local reset alone does not arm", true, []*models.DeviceStatus{{}, reported(true, 1)}, []bool{false, false}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			guard := newTaskResetGuard(tc.verify)
+			for i, status := range tc.statuses {
+				done := guard.ready(status) && guard.complete(status)
+				if done != tc.expected[i] {
+					t.Errorf("Status %d: expected complete %v, got %v", i, tc.expected[i], done)
+				}
+			}
+		})
+	}
+}
+
+func TestSprinklerRunIgnoresStaleTaskCompletion(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := NewScheduler(&config.Config{Schedule: config.ScheduleConfig{VerifyTaskReset: true}}, client, newTestDB(t), nil)
+	s.pollInterval = 5 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": {"id": "task_1"}, "timeoutMinutes": 1}`)
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+	var completedAt time.Time
+	var mu sync.Mutex
+	client.onPublish = func(topic, payload string) {
+		if !strings.HasSuffix(topic, "/cmd/task/set") {
+			return
+		}
+		go func() {
+			// A retained true from the previous run arrives first, then the device starts and finishes.
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true, TaskAllCompleteReports: 1})
+			time.Sleep(50 * time.Millisecond)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: false, TaskAllCompleteReports: 2})
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			completedAt = time.Now()
+			mu.Unlock()
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true, TaskAllCompleteReports: 3})
+		}()
+	}
+
+	if err := s.processSprinklerDevice(device, Trigger{Source: models.SourceManual}); err != nil {
+		t.Fatalf("Expected the run to complete, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if completedAt.IsZero() {
+		t.Error("Expected the run to wait for the real completion, but it finished on the stale flag")
+	}
+}
+
+func TestSprinklerRunFailsWhenTaskNotAcknowledged(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	s := NewScheduler(&config.Config{Schedule: config.ScheduleConfig{TaskAckTimeoutSecs: 1}}, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+	err := s.processSprinklerDevice(device, Trigger{Source: models.SourceManual})
+	if !errors.Is(err, ErrTaskNotAcknowledged) {
+		t.Fatalf("Expected ErrTaskNotAcknowledged, got %v", err)
+	}
+
+	var history models.IrrigationHistory
+	if err := db.Where("device_id = ?", device.ID).First(&history).Error; err != nil {
+		t.Fatalf("Expected a history row, got %v", err)
+	}
+	if history.Status != "TASK_NOT_ACKNOWLEDGED" {
+		t.Errorf("Expected status TASK_NOT_ACKNOWLEDGED, got %s", history.Status)
+	}
+	if len(history.TaskResults) != 1 || history.TaskResults[0].Outcome != models.TaskNotAcknowledged {
+		t.Errorf("Expected one not acknowledged task result, got %+v", history.TaskResults)
+	}
+}
+
+func TestSprinklerRunWaitsForTaskAckThenCompletion(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := NewScheduler(&config.Config{Schedule: config.ScheduleConfig{TaskAckTimeoutSecs: 1}}, client, newTestDB(t), nil)
+	s.pollInterval = 5 * time.Millisecond
+	s.taskSettleDelay = time.Hour // must not be used while acknowledgements are awaited
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}, {"fr": 2}], "timeoutMinutes": 1}`)
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+	client.onPublish = func(topic, payload string) {
+		if !strings.HasSuffix(topic, "/cmd/task/set") {
+			return
+		}
+		go func() {
+			for index := 1; index <= 2; index++ {
+				time.Sleep(20 * time.Millisecond)
+				client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskCurrentCount: 2, TaskCurrentIndex: index})
+			}
+			time.Sleep(20 * time.Millisecond)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskCurrentCount: 2, TaskCurrentIndex: 2, TaskAllComplete: true})
+		}()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.processSprinklerDevice(device, Trigger{Source: models.SourceManual}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected the run to complete, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the run to complete once the device acknowledged and finished the task")
+	}
+}
+
+func TestSprinklerRunSettlesThroughSleep(t *testing.T) {
+	client := newFakeDeviceClient()
+	s := NewScheduler(&config.Config{}, client, newTestDB(t), nil)
+	s.pollInterval = 5 * time.Millisecond
+	s.taskSettleDelay = time.Hour
+	var slept []time.Duration
+	s.sleep = func(d time.Duration) { slept = append(slept, d) }
+	s.tasksDir = t.TempDir()
+
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+	client.onPublish = func(topic, payload string) {
+		if strings.HasSuffix(topic, "/cmd/task/set") {
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskCurrentCount: 1, TaskCurrentIndex: 1, TaskAllComplete: true})
+		}
+	}
+
+	if err := s.processSprinklerDevice(device, Trigger{Source: models.SourceManual}); err != nil {
+		t.Fatalf("Expected the run to complete, got %v", err)
+	}
+	if !slices.Contains(slept, time.Hour) {
+		t.Errorf("Expected the settle delay to go through the scheduler's sleep, got %v", slept)
+	}
+}
+
+func TestStartPostsScheduleSummary(t *testing.T) {
+	devices := []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"06:00", "18:00"}},
+		{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleTimes: []string{"07:30"}},
+		{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler},
+	}
+	cfg := &config.Config{
+		Devices:  devices,
+		Schedule: config.ScheduleConfig{NotifyStartup: true},
+		History:  config.HistoryConfig{RetentionDays: 30},
+	}
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(cfg, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C123"))
+	defer s.Stop()
+
+	s.Start()
+
+	slackAPI.mu.Lock()
+	defer slackAPI.mu.Unlock()
+	if len(slackAPI.titles) != 1 || !strings.Contains(slackAPI.titles[0], "Scheduler Started") {
+		t.Fatalf("Expected one startup summary, got %v", slackAPI.titles)
+	}
+	details := slackAPI.details[0]
+	for _, expected := range []string{"Devices: 3", "Scheduled jobs: 3", "sprinkler_01: next run", "plant_pot_01: next run", "sprinkler_02: no schedule times"} {
+		if !strings.Contains(details, expected) {
+			t.Errorf("Expected the summary to contain %q, got %q", expected, details)
+		}
+	}
+	if strings.Contains(details, "0001") {
+		t.Errorf("Expected real next run times, got %q", details)
+	}
+}
+
+func TestStartSkipsScheduleSummaryWhenDisabled(t *testing.T) {
+	cfg := &config.Config{Devices: []config.DeviceConfig{{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"06:00"}}}}
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(cfg, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C123"))
+	defer s.Stop()
+
+	s.Start()
+
+	if titles := slackAPI.titlesContaining("Scheduler Started"); len(titles) != 0 {
+		t.Errorf("Expected no startup summary, got %v", titles)
+	}
+}
+
+func TestStartReportsUnschedulableTimes(t *testing.T) {
+	// Validation normally rejects such times; Start must still not exit the process.
+	devices := []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"25:99"}},
+		{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"06:00"}},
+	}
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(&config.Config{Devices: devices}, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C123"))
+	defer s.Stop()
+
+	err := s.Start()
+	if err == nil || !strings.Contains(err.Error(), "device 'sprinkler_01' at 25:99") {
+		t.Fatalf("Expected an error naming the unschedulable time, got %v", err)
+	}
+	if runs := s.UpcomingRuns(1); len(runs) != 1 || runs[0].DeviceID != "sprinkler_02" {
+		t.Errorf("Expected the other device to stay scheduled, got %+v", runs)
+	}
+	if titles := slackAPI.titlesContaining("Scheduling Failed"); len(titles) != 1 {
+		t.Errorf("Expected the failure to be reported to Slack, got %v", slackAPI.titles)
+	}
+}
+
+func TestRunAllJobsOnceProcessesDevicesByPriority(t *testing.T) {
+	// Devices of an unknown type are reported to Slack without running, which shows the processing order.
+	devices := []config.DeviceConfig{
+		{ID: "lawn_01", Type: "iot_sprinklr"},
+		{ID: "seedlings_01", Type: "iot_sprinklr", Priority: 10},
+		{ID: "lawn_02", Type: "iot_sprinklr"},
+		{ID: "herbs_01", Type: "iot_sprinklr", Priority: 5},
+		{ID: "seedlings_02", Type: "iot_sprinklr", Priority: 10},
+	}
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(&config.Config{Devices: devices}, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C123"))
+
+	s.RunAllJobsOnce()
+
+	var order []string
+	for _, title := range slackAPI.titlesContaining("Unknown Device Type") {
+		order = append(order, title[strings.LastIndex(title, " ")+1:])
+	}
+	expected := []string{"seedlings_01", "seedlings_02", "herbs_01", "lawn_01", "lawn_02"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected devices processed in order %v, got %v", expected, order)
+	}
+	if s.Devices()[0].ID != "lawn_01" {
+		t.Errorf("Expected the configured device order to be left unchanged, got %s first", s.Devices()[0].ID)
+	}
+}
+
+func TestRunJobsOnceReportsResults(t *testing.T) {
+	devices := []config.DeviceConfig{
+		{ID: "lawn_01", Type: "iot_sprinklr"},
+		{ID: "seedlings_01", Type: "iot_sprinklr", Priority: 10},
+		{ID: "herbs_01", Type: "iot_sprinklr"},
+	}
+	slackAPI := &fakeSlackAPI{}
+	s := NewScheduler(&config.Config{Devices: devices}, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C123"))
+
+	results := s.RunJobsOnce([]string{"lawn_01", "missing_01", "seedlings_01"})
+
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result.DeviceID)
+	}
+	if expected := []string{"missing_01", "seedlings_01", "lawn_01"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected results for %v, got %v", expected, ids)
+	}
+	if !errors.Is(results[0].Err, ErrDeviceNotFound) || !results[0].Skipped() {
+		t.Errorf("Expected the unknown device to be skipped as not found, got %v", results[0].Err)
+	}
+	for _, result := range results[1:] {
+		if !errors.Is(result.Err, config.ErrUnknownDeviceType) || result.Skipped() {
+			t.Errorf("Expected %s to fail with an unknown device type, got %v", result.DeviceID, result.Err)
+		}
+	}
+	if titles := slackAPI.titlesContaining("Unknown Device Type"); len(titles) != 2 {
+		t.Errorf("Expected only the selected devices to run, got %v", titles)
+	}
+
+	s.Pause()
+	for _, result := range s.RunJobsOnce(nil) {
+		if !errors.Is(result.Err, ErrSchedulerPaused) || !result.Skipped() {
+			t.Errorf("Expected %s to be skipped while paused, got %v", result.DeviceID, result.Err)
+		}
+	}
+}
+
+func TestRunJobsOnceBatchedSummary(t *testing.T) {
+	client := newFakeDeviceClient()
+	slackAPI := &fakeSlackAPI{}
+	devices := []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}, Priority: 10},
+		{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}},
+	}
+	cfg := &config.Config{Devices: devices, Slack: config.SlackConfig{BatchRunSummary: true, ThreadRuns: true}}
+	s := NewScheduler(cfg, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C123"))
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+	writeTaskFile(t, s.tasksDir, "sprinkler_01", "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`) // sprinkler_02 has none, so it fails
+	for _, device := range devices {
+		client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+	}
+	client.onPublish = func(topic, payload string) {
+		if topic == "sprinkler_01/cmd/task/set" {
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				client.setStatus(models.DeviceStatus{DeviceID: "sprinkler_01", SprinklerCalibComplete: true, ValveCalibComplete: true, TaskAllComplete: true})
+			}()
+		}
+	}
+
+	s.RunJobsOnce([]string{"sprinkler_02", "sprinkler_01", "missing_01"})
+
+	slackAPI.mu.Lock()
+	titles, details, colors := slices.Clone(slackAPI.titles), slices.Clone(slackAPI.details), slices.Clone(slackAPI.colors)
+	slackAPI.mu.Unlock()
+	var summaries []int
+	for i, title := range titles {
+		if strings.Contains(title, "Manual Run Summary") {
+			summaries = append(summaries, i)
+		}
+		if strings.Contains(title, "Job Started") || strings.Contains(title, "Job Completed") || strings.Contains(title, "Manual Run Started") {
+			t.Errorf("Expected no per-device or run start messages in batched mode, got %q", title)
+		}
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("Expected a single summary, got titles %v", titles)
+	}
+	summary := summaries[0]
+	if summary != len(titles)-1 || titles[summary] != "📋 Manual Run Summary: 1 of 3 failed" || colors[summary] != slack.ColorDanger {
+		t.Errorf("Expected a final error summary counting one failure, got %q (%s) at %d of %v", titles[summary], colors[summary], summary, titles)
+	}
+	lines := strings.Split(details[summary], "\n")
+	if len(lines) != 3 ||
+		!strings.HasPrefix(lines[0], "⏭️ missing_01 skipped: device not found") ||
+		!strings.HasPrefix(lines[1], "✅ sprinkler_01 completed in") ||
+		!strings.HasPrefix(lines[2], "🚨 sprinkler_02 failed after") {
+		t.Errorf("Expected each device's result in run order, got %q", details[summary])
+	}
+	if len(slackAPI.titlesContaining("Task Error")) != 1 {
+		t.Errorf("Expected the failing device's error to still be sent, got %v", titles)
+	}
+	if s.isBatched("sprinkler_01") || s.isBatched("sprinkler_02") {
+		t.Error("Expected devices to leave the batch once the run ends")
+	}
+}
+
+func TestFailureThresholdDisablesDevice(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	slackAPI := &fakeSlackAPI{}
+	// The first run calibrates from the cached flags; later runs skip calibration as recent.
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}, RecalibrateAfterMinutes: 60}
+	cfg := &config.Config{Devices: []config.DeviceConfig{device}, Schedule: config.ScheduleConfig{FailureThreshold: 3, AllowManualWhilePaused: true}}
+	s := NewScheduler(cfg, client, db, slack.NewClientWithAPI(slackAPI, "C123"))
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir() // no task files, so every run fails
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+	for run := 1; run <= 3; run++ {
+		s.runDeviceJob(device, Trigger{Source: models.SourceScheduled})
+		state, err := s.DeviceState(device.ID)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if state.ConsecutiveFailures != run {
+			t.Errorf("Run %d: expected %d consecutive failures, got %d", run, run, state.ConsecutiveFailures)
+		}
+		if disabled := state.DisabledAt != nil; disabled != (run == 3) {
+			t.Errorf("Run %d: expected disabled %v, got %v", run, run == 3, disabled)
+		}
+	}
+	if titles := slackAPI.titlesContaining("Device Disabled"); len(titles) != 1 {
+		t.Errorf("Expected one disabled alert, got %v", titles)
+	}
+
+	var runs int64
+	db.Model(&models.IrrigationHistory{}).Where("device_id = ?", device.ID).Count(&runs)
+	s.runDeviceJob(device, Trigger{Source: models.SourceScheduled})
+	var runsAfter int64
+	db.Model(&models.IrrigationHistory{}).Where("device_id = ?", device.ID).Count(&runsAfter)
+	if runsAfter != runs {
+		t.Errorf("Expected the disabled device's run to be skipped, got %d new history rows", runsAfter-runs)
+	}
+	if err := s.StartJobForDevice(device.ID, Trigger{Source: models.SourceManual}); !errors.Is(err, ErrDeviceDisabled) {
+		t.Errorf("Expected ErrDeviceDisabled for a manual run, got %v", err)
+	}
+	if s.IsDeviceRunning(device.ID) {
+		t.Error("Expected the device to be released after the refusal")
+	}
+
+	state, err := s.EnableDevice(device.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if state.DisabledAt != nil || state.ConsecutiveFailures != 0 {
+		t.Errorf("Expected re-enabling to clear the disabled state and failure count, got %+v", state)
+	}
+	if _, err := s.EnableDevice("sprinkler_99"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("Expected ErrDeviceNotFound for an unknown device, got %v", err)
+	}
+}
+
+func TestSuccessfulRunResetsFailureCount(t *testing.T) {
+	client := newFakeDeviceClient()
+	// The first run calibrates from the cached flags; later runs skip calibration as recent.
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}, RecalibrateAfterMinutes: 60}
+	cfg := &config.Config{Devices: []config.DeviceConfig{device}, Schedule: config.ScheduleConfig{FailureThreshold: 3}}
+	s := NewScheduler(cfg, client, newTestDB(t), nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+	for run := 0; run < 2; run++ {
+		s.runDeviceJob(device, Trigger{Source: models.SourceScheduled})
+	}
+	if state, _ := s.DeviceState(device.ID); state.ConsecutiveFailures != 2 {
+		t.Fatalf("Expected 2 consecutive failures, got %d", state.ConsecutiveFailures)
+	}
+
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	client.onPublish = func(topic, payload string) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+		}()
+	}
+	s.runDeviceJob(device, Trigger{Source: models.SourceScheduled})
+
+	state, _ := s.DeviceState(device.ID)
+	if state.ConsecutiveFailures != 0 || state.DisabledAt != nil {
+		t.Errorf("Expected a successful run to reset the failure count, got %+v", state)
+	}
+}
+
+func TestJobStatusPublishedToMQTT(t *testing.T) {
+	testCases := []struct {
+		name     string
+		taskFile bool
+		expected []models.JobStatus
+	}{
+		{name: "successful run", taskFile: true, expected: []models.JobStatus{models.JobStarted, models.JobCompleted}},
+		{name: "failed run", taskFile: false, expected: []models.JobStatus{models.JobStarted, models.JobFailed}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+			cfg := &config.Config{Devices: []config.DeviceConfig{device}, MQTT: config.MQTTConfig{JobStatusTopic: "irrigation/{deviceId}/job/status"}}
+			s := NewScheduler(cfg, client, newTestDB(t), nil)
+			s.pollInterval = 10 * time.Millisecond
+			s.taskSettleDelay = 0
+			s.tasksDir = t.TempDir()
+			if tc.taskFile {
+				writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+			}
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+			client.onPublish = func(topic, payload string) {
+				if strings.HasSuffix(topic, "/cmd/task/set") {
+					go func() {
+						time.Sleep(20 * time.Millisecond)
+						client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+					}()
+				}
+			}
+
+			s.runDeviceJob(device, Trigger{Source: models.SourceManual})
+
+			var statuses []models.JobStatus
+			for _, msg := range client.publishedMessages() {
+				if msg.Topic != "irrigation/sprinkler_01/job/status" {
+					continue
+				}
+				if !msg.Retained {
+					t.Errorf("Expected job status to be retained, got %+v", msg)
+				}
+				var event models.JobStatusEvent
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					t.Fatalf("Expected a JSON job status, got %q: %v", msg.Payload, err)
+				}
+				if event.DeviceID != device.ID || event.Trigger != models.SourceManual {
+					t.Errorf("Expected the event to name the device and trigger, got %+v", event)
+				}
+				if (event.Status == models.JobFailed) != (event.Error != "") {
+					t.Errorf("Expected an error only on failed events, got %+v", event)
+				}
+				statuses = append(statuses, event.Status)
+			}
+			if !reflect.DeepEqual(statuses, tc.expected) {
+				t.Errorf("Expected job statuses %v, got %v", tc.expected, statuses)
+			}
+		})
+	}
+}
+
+func TestThreadRunsRepliesInJobThread(t *testing.T) {
+	client := newFakeDeviceClient()
+	slackAPI := &fakeSlackAPI{}
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}, SlackChannelID: "C_GARDEN"}
+	cfg := &config.Config{Devices: []config.DeviceConfig{device}, Slack: config.SlackConfig{ThreadRuns: true}}
+	s := NewScheduler(cfg, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C123"))
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir() // no task files, so the run reports an error
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+	s.runDeviceJob(device, Trigger{Source: models.SourceScheduled})
+	s.notifyDevice(device, slack.NewInfoMessage("After the run", ""))
+
+	slackAPI.mu.Lock()
+	defer slackAPI.mu.Unlock()
+	if len(slackAPI.titles) < 3 {
+		t.Fatalf("Expected a start message, run updates and a later message, got %v", slackAPI.titles)
+	}
+	last := len(slackAPI.titles) - 1
+	if !strings.Contains(slackAPI.titles[0], "Job Started: sprinkler_01") || slackAPI.threads[0] != "" {
+		t.Errorf("Expected the run to start with a top-level start message, got %q in thread %q", slackAPI.titles[0], slackAPI.threads[0])
+	}
+	for i := 1; i < last; i++ {
+		if slackAPI.threads[i] != "1700000000.000001" || slackAPI.channels[i] != "C_GARDEN" {
+			t.Errorf("Expected %q to reply in the start message's thread in C_GARDEN, got thread %q in %s", slackAPI.titles[i], slackAPI.threads[i], slackAPI.channels[i])
+		}
+	}
+	if slackAPI.threads[last] != "" {
+		t.Errorf("Expected messages after the run to be top-level, got thread %q", slackAPI.threads[last])
+	}
+}
+
+func TestRequireFreshCalibration(t *testing.T) {
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}
+	stale := time.Now().Add(-time.Hour)
+
+	testCases := []struct {
+		name          string
+		fresh         bool
+		reply         func(calibAt *time.Time) // sets the receive time of the device's answer to a home command
+		wantPublished int
+		wantErr       bool
+	}{
+		{
+			name:          "stale flags skip homing without the option",
+			fresh:         false,
+			wantPublished: 0,
+		},
+		{
+			name:  "stale flags are re-homed and fresh reports accepted",
+			fresh: true,
+			reply: func(calibAt *time.Time) {
+				*calibAt = time.Now()
+			},
+			wantPublished: 2,
+		},
+		{
+			name:  "a stale report after the home command is ignored",
+			fresh: true,
+			reply: func(calibAt *time.Time) {
+				*calibAt = stale
+			},
+			wantPublished: 1,
+			wantErr:       true,
+		},
+		{
+			name:          "no report after the home command times out",
+			fresh:         true,
+			wantPublished: 1,
+			wantErr:       true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			s := newTestScheduler(&config.Config{Schedule: config.ScheduleConfig{RequireFreshCalibration: tc.fresh}}, client)
+			s.db = newTestDB(t)
+			s.calibrationSteps = slices.Clone(sprinklerCalibrationSteps)
+			for i := range s.calibrationSteps {
+				s.calibrationSteps[i].timeout = 50 * time.Millisecond
+			}
+			// Flags left over from an earlier run.
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true, SprinklerCalibAt: stale, ValveCalibAt: stale})
+
+			client.onPublish = func(topic, payload string) {
+				if tc.reply == nil {
+					return
+				}
+				status := client.GetDeviceStatus(device.ID)
+				switch topic {
+				case device.ID + "/cmd/sprinkler/home":
+					status.SprinklerCalibComplete = true
+					tc.reply(&status.SprinklerCalibAt)
+				case device.ID + "/cmd/valve/home":
+					status.ValveCalibComplete = true
+					tc.reply(&status.ValveCalibAt)
+				}
+				client.setStatus(*status)
+			}
+
+			history := &models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: time.Now(), Status: models.StatusStarted}
+			s.db.Create(history)
+			err := s.runCalibration(device, history)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if published := len(client.publishedMessages()); published != tc.wantPublished {
+				t.Errorf("Expected %d home commands, got %d", tc.wantPublished, published)
+			}
+		})
+	}
+}
+
+func TestSprinklerRunWarmsUpBeforeFirstTask(t *testing.T) {
+	testCases := []struct {
+		name     string
+		warmup   *config.WarmupCommand
+		expected []string
+	}{
+		{
+			name:     "warmup publishes then waits before the tasks",
+			warmup:   &config.WarmupCommand{Topic: "cmd/pump/prime", Payload: "on", DelaySeconds: 20},
+			expected: []string{"sprinkler_01/cmd/pump/prime on", "sleep 20s", "sprinkler_01/cmd/task/set"},
+		},
+		{
+			name:     "warmup without a delay",
+			warmup:   &config.WarmupCommand{Topic: "cmd/pump/prime", Payload: "on"},
+			expected: []string{"sprinkler_01/cmd/pump/prime on", "sprinkler_01/cmd/task/set"},
+		},
+		{
+			name:     "no warmup",
+			expected: []string{"sprinkler_01/cmd/task/set"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}, WarmupCommand: tc.warmup}
+			s := NewScheduler(&config.Config{Devices: []config.DeviceConfig{device}}, client, newTestDB(t), nil)
+			s.pollInterval = 10 * time.Millisecond
+			s.taskSettleDelay = 0
+			s.tasksDir = t.TempDir()
+			writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+			var mu sync.Mutex
+			var events []string
+			s.sleep = func(d time.Duration) {
+				if d == 0 {
+					return // the task settle delay, disabled above
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, fmt.Sprintf("sleep %v", d))
+			}
+			client.onPublish = func(topic, payload string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if strings.HasSuffix(topic, "/cmd/task/set") {
+					events = append(events, topic)
+					go func() {
+						time.Sleep(20 * time.Millisecond)
+						client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+					}()
+					return
+				}
+				events = append(events, topic+" "+payload)
+			}
+
+			if err := s.processSprinklerDevice(device, Trigger{Source: models.SourceScheduled}); err != nil {
+				t.Fatalf("Expected the run to succeed, got %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(events, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, events)
+			}
+		})
+	}
+}
+
+func TestPlantPotHealthProbe(t *testing.T) {
+	testCases := []struct {
+		name          string
+		replies       bool // whether the device answers the request
+		healthy       bool // the health it reports in its answer
+		expectErr     bool
+		expectTrigger bool
+	}{
+		{name: "healthy reply", replies: true, healthy: true, expectTrigger: true},
+		{name: "unhealthy reply", replies: true, healthy: false, expectErr: true},
+		{name: "no reply", replies: false, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			cfg := &config.Config{Schedule: config.ScheduleConfig{HealthProbeTimeoutSecs: 1, HealthProbeTopic: "cmd/health_check", HealthProbePayload: "ping"}}
+			s := newTestScheduler(cfg, client)
+			s.db = newTestDB(t)
+			device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 5}
+
+			// The cached value passes, so only a fresh reply can decide the outcome.
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, HealthCheckReports: 3})
+			client.onPublish = func(topic, payload string) {
+				if topic != "plant_pot_01/cmd/health_check" || !tc.replies {
+					return
+				}
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: tc.healthy, HealthCheckReports: 4})
+				}()
+			}
+
+			err := s.processPlantPotDevice(device, Trigger{Source: models.SourceScheduled})
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectErr, err)
+			}
+
+			var topics []string
+			for _, msg := range client.publishedMessages() {
+				topics = append(topics, msg.Topic+" "+msg.Payload)
+			}
+			expected := []string{"plant_pot_01/cmd/health_check ping"}
+			if tc.expectTrigger {
+				expected = append(expected, "plant_pot_01/cmd/trigger_solenoid_valve 5")
+			}
+			if !reflect.DeepEqual(topics, expected) {
+				t.Errorf("Expected commands %v, got %v", expected, topics)
+			}
+		})
+	}
+}
+
+func TestPlantPotMoistureRecheck(t *testing.T) {
+	testCases := []struct {
+		name      string
+		before    float64 // moisture reported before watering; 0 if none
+		after     float64 // moisture reported while settling; 0 if the device stays silent
+		wantAlert string  // expected warning title fragment; empty for no alert
+		wantSleep []string
+	}{
+		{name: "rise detected", before: 30, after: 42, wantSleep: []string{"sleep 5s", "sleep 2m0s"}},
+		{name: "no rise", before: 30, after: 31, wantAlert: "Moisture Did Not Rise: plant_pot_01", wantSleep: []string{"sleep 5s", "sleep 2m0s"}},
+		{name: "no reading after watering", before: 30, wantAlert: "Moisture Did Not Rise: plant_pot_01", wantSleep: []string{"sleep 5s", "sleep 2m0s"}},
+		{name: "no reading before watering", after: 42, wantSleep: []string{"sleep 5s"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			slackAPI := &fakeSlackAPI{}
+			device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 5, MoistureRecheck: &config.MoistureRecheck{SettleSeconds: 120, MinRise: 5}}
+			s := NewScheduler(&config.Config{Devices: []config.DeviceConfig{device}}, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C123"))
+
+			status := models.DeviceStatus{DeviceID: device.ID, HealthCheck: true}
+			if tc.before != 0 {
+				status.Moisture, status.MoistureReports = tc.before, 1
+			}
+			client.setStatus(status)
+			var sleeps []string
+			s.sleep = func(d time.Duration) {
+				sleeps = append(sleeps, fmt.Sprintf("sleep %v", d))
+				if d == 2*time.Minute && tc.after != 0 {
+					status.Moisture, status.MoistureReports = tc.after, status.MoistureReports+1
+					client.setStatus(status)
+				}
+			}
+
+			if err := s.processPlantPotDevice(device, Trigger{Source: models.SourceScheduled}); err != nil {
+				t.Fatalf("Expected the job to succeed despite the re-check, got %v", err)
+			}
+			if !reflect.DeepEqual(sleeps, tc.wantSleep) {
+				t.Errorf("Expected %v, got %v", tc.wantSleep, sleeps)
+			}
+
+			slackAPI.mu.Lock()
+			defer slackAPI.mu.Unlock()
+			alerted := false
+			for _, title := range slackAPI.titles {
+				if strings.Contains(title, "Moisture Did Not Rise") {
+					alerted = true
+					if !strings.Contains(title, tc.wantAlert) || tc.wantAlert == "" {
+						t.Errorf("Expected alert %q, got %q", tc.wantAlert, title)
+					}
+				}
+			}
+			if alerted != (tc.wantAlert != "") {
+				t.Errorf("Expected alert %v, got titles %v", tc.wantAlert != "", slackAPI.titles)
+			}
+		})
+	}
+}
+
+func TestPlantPotHealthProbeRetries(t *testing.T) {
+	testCases := []struct {
+		name       string
+		answerOn   int // request number the device answers; 0 if it never does
+		expectErr  bool
+		wantColors []string // severity colors of the retry and failure messages, in order
+	}{
+		{name: "success on retry 2", answerOn: 2, wantColors: []string{slack.ColorInfo}},
+		{name: "exhausted", expectErr: true, wantColors: []string{slack.ColorInfo, slack.ColorWarning, slack.ColorDanger}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			slackAPI := &fakeSlackAPI{}
+			cfg := &config.Config{Schedule: config.ScheduleConfig{HealthProbeTimeoutSecs: 1, HealthProbeTopic: "cmd/health_check", HealthProbePayload: "ping"}}
+			s := NewScheduler(cfg, client, newTestDB(t), slack.NewClientWithAPI(slackAPI, "C123"))
+			s.pollInterval = 10 * time.Millisecond
+			device := config.DeviceConfig{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleDuration: 5, HealthCheckRetries: 2}
+
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, HealthCheckReports: 3})
+			requests := 0
+			client.onPublish = func(topic, payload string) {
+				if topic != "plant_pot_01/cmd/health_check" {
+					return
+				}
+				requests++
+				if requests == tc.answerOn {
+					client.setStatus(models.DeviceStatus{DeviceID: device.ID, HealthCheck: true, HealthCheckReports: 4})
+				}
+			}
+
+			err := s.processPlantPotDevice(device, Trigger{Source: models.SourceScheduled})
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectErr, err)
+			}
+
+			slackAPI.mu.Lock()
+			defer slackAPI.mu.Unlock()
+			var colors []string
+			for i, title := range slackAPI.titles {
+				if strings.Contains(title, "Health Check Retry") || strings.Contains(title, "ERROR") {
+					colors = append(colors, slackAPI.colors[i])
+				}
+			}
+			if !reflect.DeepEqual(colors, tc.wantColors) {
+				t.Errorf("Expected message colors %v, got %v (titles %v)", tc.wantColors, colors, slackAPI.titles)
+			}
+		})
+	}
+}
+
+func TestHandlePresenceChangeAlertsDeviceChannel(t *testing.T) {
+	slackAPI := &fakeSlackAPI{}
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, SlackChannelID: "C_GARDEN"}
+	cfg := &config.Config{Devices: []config.DeviceConfig{device}}
+	s := NewScheduler(cfg, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C123"))
+	lastSeen := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+
+	s.HandlePresenceChange("sprinkler_01", false, lastSeen)
+	s.HandlePresenceChange("sprinkler_01", true, lastSeen.Add(time.Hour))
+	s.HandlePresenceChange("pot_99", false, lastSeen)
+
+	slackAPI.mu.Lock()
+	defer slackAPI.mu.Unlock()
+	expected := []struct{ title, channel string }{
+		{"Device Offline: sprinkler_01", "C_GARDEN"},
+		{"Device Online: sprinkler_01", "C_GARDEN"},
+		{"Device Offline: pot_99", "C123"},
+	}
+	if len(slackAPI.titles) != len(expected) {
+		t.Fatalf("Expected %d alerts, got %v", len(expected), slackAPI.titles)
+	}
+	for i, want := range expected {
+		if !strings.Contains(slackAPI.titles[i], want.title) || slackAPI.channels[i] != want.channel {
+			t.Errorf("Expected %q in %s, got %q in %s", want.title, want.channel, slackAPI.titles[i], slackAPI.channels[i])
+		}
+	}
+}
+
+func TestReloadDevicesPublishesPresence(t *testing.T) {
+	client := newFakeDeviceClient()
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"08:00"}}
+	s := newTestScheduler(&config.Config{Devices: []config.DeviceConfig{device}}, client)
+	client.SubscribeToDeviceTopics(device)
+
+	if _, err := s.ReloadDevices([]config.DeviceConfig{device}); err != nil {
+		t.Fatalf("Expected reload to succeed, got %v", err)
+	}
+	if len(client.presence) != 0 {
+		t.Errorf("Expected no presence update for an unchanged configuration, got %v", client.presence)
+	}
+
+	_, err := s.ReloadDevices([]config.DeviceConfig{
+		{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleTimes: []string{"07:00"}},
+		{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"09:00"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected reload to succeed, got %v", err)
+	}
+	expected := [][]string{{"plant_pot_01", "sprinkler_02"}}
+	if !reflect.DeepEqual(client.presence, expected) {
+		t.Errorf("Expected presence %v after reload, got %v", expected, client.presence)
+	}
+}
+
+func TestUpcomingRuns(t *testing.T) {
+	cfg := &config.Config{Devices: []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"06:00", "18:00"}, TaskIDs: []string{"task_1"}},
+		{ID: "plant_pot_01", Type: config.DeviceTypePlantPot, ScheduleTimes: []string{"12:00"}},
+	}}
+	s := newTestScheduler(cfg, newFakeDeviceClient())
+	for _, device := range cfg.Devices {
+		if err := s.scheduleDevice(device); err != nil {
+			t.Fatalf("Failed to schedule device: %v", err)
+		}
+	}
+	s.scheduler.StartAsync()
+	defer s.scheduler.Stop()
+
+	if runs := s.UpcomingRuns(0); len(runs) != 0 {
+		t.Errorf("Expected no runs for count 0, got %v", runs)
+	}
+
+	runs := s.UpcomingRuns(7)
+	if len(runs) != 7 {
+		t.Fatalf("Expected 7 runs, got %d: %v", len(runs), runs)
+	}
+	counts := make(map[string]int)
+	for i, run := range runs {
+		counts[run.DeviceID]++
+		if i > 0 && run.Time.Before(runs[i-1].Time) {
+			t.Errorf("Expected runs sorted ascending, got %v before %v", runs[i-1].Time, run.Time)
+		}
+		if !run.Time.After(time.Now()) {
+			t.Errorf("Expected only future runs, got %v", run.Time)
+		}
+		if run.DeviceID == "sprinkler_01" && !reflect.DeepEqual(run.TaskIDs, []string{"task_1"}) {
+			t.Errorf("Expected sprinkler_01 runs to list its tasks, got %v", run.TaskIDs)
+		}
+	}
+	// Three runs a day, so the seventh run is the first one's job two days later.
+	if counts["sprinkler_01"] < 4 || counts["plant_pot_01"] < 2 {
+		t.Errorf("Expected runs projected over the following days, got %v", counts)
+	}
+	if last := runs[6]; last.DeviceID != runs[0].DeviceID || !last.Time.Equal(runs[0].Time.AddDate(0, 0, 2)) {
+		t.Errorf("Expected the seventh run to repeat %v two days later, got %v", runs[0], last)
+	}
+}
+
+func TestSprinklerRunRecordsPhase(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	s := NewScheduler(&config.Config{}, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2"}}
+	writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+	client.onPublish = func(topic, payload string) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true, TaskAllComplete: true})
+		}()
+	}
+
+	// task_2 has no file, so the run stops there.
+	if err := s.processSprinklerDevice(device, Trigger{Source: models.SourceScheduled}); err == nil {
+		t.Fatal("Expected the run to fail on the missing task file")
+	}
+
+	var stored models.IrrigationHistory
+	if err := db.First(&stored).Error; err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if stored.Phase != models.PhaseTasks || stored.TaskIndex != 1 || stored.CurrentTaskID != "task_2" {
+		t.Errorf("Expected the run to record task 2 in progress, got phase %q, index %d, task %q", stored.Phase, stored.TaskIndex, stored.CurrentTaskID)
+	}
+}
+
+func TestResolveInterruptedJobs(t *testing.T) {
+	testCases := []struct {
+		name         string
+		action       string
+		expectResume bool
+	}{
+		{name: "fail", action: config.InterruptedJobsFail},
+		{name: "resume", action: config.InterruptedJobsResume, expectResume: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			db := newTestDB(t)
+			slackAPI := &fakeSlackAPI{}
+			devices := []config.DeviceConfig{
+				{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2", "task_3"}},
+				{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}},
+			}
+			cfg := &config.Config{Devices: devices, Schedule: config.ScheduleConfig{InterruptedJobs: tc.action}}
+			s := NewScheduler(cfg, client, db, slack.NewClientWithAPI(slackAPI, "C123"))
+			s.pollInterval = 10 * time.Millisecond
+			s.taskSettleDelay = 0
+			s.tasksDir = t.TempDir() // no task files, so a resumed run fails on its first task
+			client.setStatus(models.DeviceStatus{DeviceID: "sprinkler_01", SprinklerCalibComplete: true, ValveCalibComplete: true})
+
+			started := time.Now().Add(-time.Hour)
+			rows := []models.IrrigationHistory{
+				{DeviceID: "sprinkler_01", ScheduledAt: started, StartedAt: &started, Status: models.StatusStarted, Source: models.SourceScheduled, Phase: models.PhaseTasks, TaskIndex: 1, CurrentTaskID: "task_2"},
+				{DeviceID: "sprinkler_02", ScheduledAt: started, StartedAt: &started, Status: models.StatusStarted, Phase: models.PhaseValveCheck},
+				{DeviceID: "removed_01", ScheduledAt: started, StartedAt: &started, Status: models.StatusStarted, Phase: models.PhaseCalibration},
+				{DeviceID: "sprinkler_01", ScheduledAt: started, StartedAt: &started, EndedAt: &started, Status: models.StatusCompleted, Phase: models.PhaseValveCheck},
+			}
+			for i := range rows {
+				if err := db.Create(&rows[i]).Error; err != nil {
+					t.Fatalf("Failed to create history: %v", err)
+				}
+			}
+
+			s.resolveInterruptedJobs()
+
+			var resolved []models.IrrigationHistory
+			if err := db.Order("id").Limit(len(rows)).Find(&resolved).Error; err != nil {
+				t.Fatalf("Failed to load history: %v", err)
+			}
+			expectedNotes := []string{
+				"Interrupted by a controller restart during task 2 (task_2).",
+				"Interrupted by a controller restart during valve check.",
+				"Interrupted by a controller restart during calibration.",
+			}
+			if tc.expectResume {
+				expectedNotes[0] += " Resuming with task_2, task_3."
+				expectedNotes[1] += " Not resumed: its tasks had finished."
+				expectedNotes[2] += " Not resumed: the device is no longer configured."
+			}
+			for i, want := range expectedNotes {
+				if resolved[i].Status != models.StatusInterrupted || resolved[i].EndedAt == nil || resolved[i].Notes != want {
+					t.Errorf("Row %d: expected interrupted with notes %q, got %s with %q", i+1, want, resolved[i].Status, resolved[i].Notes)
+				}
+			}
+			if resolved[3].Status != models.StatusCompleted {
+				t.Errorf("Expected the finished run to be left alone, got %s", resolved[3].Status)
+			}
+			if alerts := slackAPI.titlesContaining("Run Interrupted"); len(alerts) != 3 {
+				t.Errorf("Expected an alert per interrupted run, got %v", alerts)
+			}
+
+			// A resumed run happens in the background; wait for it to finish.
+			var resumed models.IrrigationHistory
+			found := false
+			for deadline := time.Now().Add(time.Second); !found && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				_, running := s.inFlight.Load("sprinkler_01")
+				found = !running && db.Where("reason LIKE ? AND status <> ?", "resumes run%", models.StatusStarted).Limit(1).Find(&resumed).RowsAffected > 0
+			}
+			if found != tc.expectResume {
+				t.Fatalf("Expected resumed %v, got %v", tc.expectResume, found)
+			}
+			if !tc.expectResume {
+				return
+			}
+			if resumed.DeviceID != "sprinkler_01" || resumed.Source != models.SourceScheduled || resumed.Reason != fmt.Sprintf("resumes run %d, interrupted by a restart", rows[0].ID) {
+				t.Errorf("Expected a scheduled re-run of sprinkler_01 pointing at run %d, got %+v", rows[0].ID, resumed)
+			}
+			if len(resumed.TaskResults) == 0 || resumed.TaskResults[0].TaskID != "task_2" {
+				t.Errorf("Expected the re-run to start with task_2, got %+v", resumed.TaskResults)
+			}
+		})
+	}
+}
+
+func TestDryRunDeviceSkipsPublishes(t *testing.T) {
+	client := newFakeDeviceClient()
+	db := newTestDB(t)
+	live := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	dryRun := config.DeviceConfig{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}, DryRun: true}
+	cfg := &config.Config{Devices: []config.DeviceConfig{live, dryRun}}
+	s := NewScheduler(cfg, client, db, nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+	for _, device := range cfg.Devices {
+		// A zero timeout ends each run right after the task is sent.
+		writeTaskFile(t, s.tasksDir, device.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 0}`)
+		client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+	}
+
+	for _, device := range cfg.Devices {
+		if err := s.processSprinklerDevice(device, Trigger{Source: models.SourceManual}); err == nil {
+			t.Fatalf("Expected device %s to time out", device.ID)
+		}
+	}
+
+	var topics []string
+	for _, msg := range client.publishedMessages() {
+		topics = append(topics, msg.Topic)
+	}
+	if expected := []string{"sprinkler_01/cmd/task/set"}; !reflect.DeepEqual(topics, expected) {
+		t.Errorf("Expected only the live device to publish %v, got %v", expected, topics)
+	}
+
+	var commands []models.CommandLog
+	if err := db.Order("id").Find(&commands).Error; err != nil {
+		t.Fatalf("Failed to load command log: %v", err)
+	}
+	if len(commands) != 2 {
+		t.Fatalf("Expected a logged command per device, got %d", len(commands))
+	}
+	for _, command := range commands {
+		if command.DryRun != (command.DeviceID == dryRun.ID) {
+			t.Errorf("Expected dry run %v for the command of %s, got %v", command.DeviceID == dryRun.ID, command.DeviceID, command.DryRun)
+		}
+	}
+}
+
+func TestSleepCommandAfterRun(t *testing.T) {
+	testCases := []struct {
+		name      string
+		onFailure bool
+		timeout   int
+		wantSleep bool
+	}{
+		{name: "success sleeps", timeout: 1, wantSleep: true},
+		{name: "failure stays awake", timeout: 0},
+		{name: "failure sleeps when configured", onFailure: true, timeout: 0, wantSleep: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			s := NewScheduler(&config.Config{}, client, newTestDB(t), nil)
+			s.pollInterval = 10 * time.Millisecond
+			s.taskSettleDelay = 0
+			s.tasksDir = t.TempDir()
+			device := config.DeviceConfig{
+				ID:           "sprinkler_01",
+				Type:         config.DeviceTypeSprinkler,
+				TaskIDs:      []string{"task_1"},
+				SleepCommand: &config.SleepCommand{Topic: "cmd/power/sleep", Payload: "1", OnFailure: tc.onFailure},
+			}
+			// A zero timeout fails the run as soon as the task is sent.
+			writeTaskFile(t, s.tasksDir, device.ID, "task_1", fmt.Sprintf(`{"payload": [{"fr": 1}], "timeoutMinutes": %d}`, tc.timeout))
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+			client.onPublish = func(topic, payload string) {
+				if topic == "sprinkler_01/cmd/task/set" && tc.timeout > 0 {
+					go func() {
+						time.Sleep(20 * time.Millisecond)
+						client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true, TaskAllComplete: true})
+					}()
+				}
+			}
+
+			err := s.executeDeviceJob(device, Trigger{Source: models.SourceScheduled})
+			if (err != nil) != (tc.timeout == 0) {
+				t.Fatalf("Expected failure %v, got %v", tc.timeout == 0, err)
+			}
+
+			var topics []string
+			for _, msg := range client.publishedMessages() {
+				topics = append(topics, msg.Topic)
+			}
+			expected := []string{"sprinkler_01/cmd/task/set"}
+			if tc.wantSleep {
+				expected = append(expected, "sprinkler_01/cmd/power/sleep")
+			}
+			if !reflect.DeepEqual(topics, expected) {
+				t.Errorf("Expected publishes %v, got %v", expected, topics)
+			}
+		})
+	}
+}
+
+func TestSafeAbortOnTaskTimeout(t *testing.T) {
+	testCases := []struct {
+		name        string
+		safeAbort   bool
+		taskFile    string
+		expectErr   bool
+		wantCleanup bool
+	}{
+		{name: "task timeout cleans up", safeAbort: true, taskFile: `{"payload": [{"fr": 1}], "timeoutMinutes": 0}`, expectErr: true, wantCleanup: true},
+		{name: "disabled", taskFile: `{"payload": [{"fr": 1}], "timeoutMinutes": 0}`, expectErr: true},
+		{name: "success needs no cleanup", safeAbort: true, taskFile: `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			db := newTestDB(t)
+			cfg := &config.Config{Schedule: config.ScheduleConfig{SafeAbort: tc.safeAbort, SafeAbortStopTopic: "cmd/task/stop"}}
+			s := NewScheduler(cfg, client, db, nil)
+			s.pollInterval = 10 * time.Millisecond
+			s.taskSettleDelay = 0
+			s.tasksDir = t.TempDir()
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+			writeTaskFile(t, s.tasksDir, device.ID, "task_1", tc.taskFile)
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+			if !tc.expectErr {
+				client.onPublish = func(topic, payload string) {
+					if topic == "sprinkler_01/cmd/task/set" {
+						go func() {
+							time.Sleep(20 * time.Millisecond)
+							client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true, TaskAllComplete: true})
+						}()
+					}
+				}
+			}
+
+			err := s.processSprinklerDevice(device, Trigger{Source: models.SourceScheduled})
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("Expected error %v, got %v", tc.expectErr, err)
+			}
+
+			var topics []string
+			for _, msg := range client.publishedMessages() {
+				topics = append(topics, msg.Topic)
+			}
+			expected := []string{"sprinkler_01/cmd/task/set"}
+			if tc.wantCleanup {
+				expected = append(expected, "sprinkler_01/cmd/task/stop", "sprinkler_01/cmd/valve/home", "sprinkler_01/cmd/sprinkler/home")
+			}
+			if !reflect.DeepEqual(topics, expected) {
+				t.Errorf("Expected publishes %v, got %v", expected, topics)
+			}
+
+			var stored models.IrrigationHistory
+			if err := db.Order("id DESC").First(&stored).Error; err != nil {
+				t.Fatalf("Failed to load history: %v", err)
+			}
+			if strings.Contains(stored.Notes, "Safe abort") != tc.wantCleanup {
+				t.Errorf("Expected safe abort noted %v, got notes %q", tc.wantCleanup, stored.Notes)
+			}
+			if tc.wantCleanup && stored.Status != "TASK_TIMEOUT" {
+				t.Errorf("Expected the failure status to be kept, got %s", stored.Status)
+			}
+		})
+	}
+}
+
+func TestMutedDeviceSuppressesInfoNotErrors(t *testing.T) {
+	slackAPI := &fakeSlackAPI{}
+	muted := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, MuteNotifications: true}
+	loud := config.DeviceConfig{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler}
+	cfg := &config.Config{Devices: []config.DeviceConfig{muted, loud}}
+	s := NewScheduler(cfg, newFakeDeviceClient(), nil, slack.NewClientWithAPI(slackAPI, "C123"))
+
+	for _, device := range cfg.Devices {
+		s.notifyDevice(device, slack.NewInfoMessage("Info "+device.ID, "details"))
+		s.notifyDevice(device, slack.NewSuccessMessage("Success "+device.ID, "details"))
+		s.notifyDevice(device, slack.NewWarningMessage("Warning "+device.ID, "details"))
+		s.notifyDevice(device, slack.NewErrorMessage("Error "+device.ID, "details"))
+	}
+
+	expected := []string{"Warning sprinkler_01", "Error sprinkler_01"}
+	if got := slackAPI.titlesContaining(muted.ID); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected only %v for the muted device, got %v", expected, got)
+	}
+	if got := slackAPI.titlesContaining(loud.ID); len(got) != 4 {
+		t.Errorf("Expected all 4 messages for the unmuted device, got %v", got)
+	}
+}
+
+func TestDeviceLabelsInNotificationsAndHistory(t *testing.T) {
+	slackAPI := &fakeSlackAPI{}
+	db := newTestDB(t)
+	device := config.DeviceConfig{
+		ID:     "sprinkler_01",
+		Type:   config.DeviceTypeSprinkler,
+		Labels: map[string]string{"zone": "front", "crop": "tomato", "owner": "sam"},
+	}
+	cfg := &config.Config{
+		Devices: []config.DeviceConfig{device},
+		Slack:   config.SlackConfig{NotificationLabels: []string{"crop", "zone", "missing"}},
+	}
+	s := NewScheduler(cfg, newFakeDeviceClient(), db, slack.NewClientWithAPI(slackAPI, "C123"))
+
+	s.recordCooldownSkip(device, Trigger{Source: models.SourceManual}, errors.New("watered recently"))
+
+	slackAPI.mu.Lock()
+	details := slices.Clone(slackAPI.details)
+	slackAPI.mu.Unlock()
+	if len(details) != 1 || !strings.HasSuffix(details[0], "\nLabels: crop=tomato, zone=front") {
+		t.Errorf("Expected the selected labels at the end of the notification, got %q", details)
+	}
+
+	var history models.IrrigationHistory
+	if err := db.First(&history).Error; err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if !reflect.DeepEqual(map[string]string(history.Labels), device.Labels) {
+		t.Errorf("Expected labels %v on the history row, got %v", device.Labels, history.Labels)
+	}
+}
+
+func TestTaskFailurePolicy(t *testing.T) {
+	testCases := []struct {
+		name            string
+		policy          string
+		completes       []string // task payloads the device completes
+		expectPartial   bool
+		expectStatus    models.IrrigationStatus
+		expectOutcomes  []models.TaskOutcome
+		expectSucceeded int
+		expectFailed    int
+	}{
+		{
+			name:            "abort stops at the failed task",
+			policy:          config.TaskFailureAbort,
+			completes:       []string{`"fr": 1`, `"fr": 3`},
+			expectStatus:    "TASK_TIMEOUT",
+			expectOutcomes:  []models.TaskOutcome{models.TaskSucceeded, models.TaskTimedOut},
+			expectSucceeded: 1,
+			expectFailed:    1,
+		},
+		{
+			name:            "continue runs the remaining tasks",
+			policy:          config.TaskFailureContinue,
+			completes:       []string{`"fr": 1`, `"fr": 3`},
+			expectPartial:   true,
+			expectStatus:    models.StatusPartial,
+			expectOutcomes:  []models.TaskOutcome{models.TaskSucceeded, models.TaskTimedOut, models.TaskSucceeded},
+			expectSucceeded: 2,
+			expectFailed:    1,
+		},
+		{
+			name:           "continue with every task failing",
+			policy:         config.TaskFailureContinue,
+			expectStatus:   "TASK_TIMEOUT",
+			expectOutcomes: []models.TaskOutcome{models.TaskTimedOut, models.TaskTimedOut, models.TaskTimedOut},
+			expectFailed:   3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeDeviceClient()
+			db := newTestDB(t)
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1", "task_2", "task_3"}}
+			cfg := &config.Config{Devices: []config.DeviceConfig{device}, Schedule: config.ScheduleConfig{TaskFailurePolicy: tc.policy}}
+			s := NewScheduler(cfg, client, db, nil)
+			s.pollInterval = 10 * time.Millisecond
+			s.taskSettleDelay = 0
+			s.tasksDir = t.TempDir()
+			for i, taskID := range device.TaskIDs {
+				// A zero timeout fails task_2 right away, and every task when the device completes none.
+				timeout := 1
+				if taskID == "task_2" || len(tc.completes) == 0 {
+					timeout = 0
+				}
+				writeTaskFile(t, s.tasksDir, device.ID, taskID, fmt.Sprintf(`{"payload": [{"fr": %d}], "timeoutMinutes": %d}`, i+1, timeout))
+			}
+			client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+			client.onPublish = func(topic, payload string) {
+				for _, complete := range tc.completes {
+					if strings.Contains(payload, complete) {
+						go client.setStatus(models.DeviceStatus{DeviceID: device.ID, TaskAllComplete: true})
+					}
+				}
+			}
+
+			err := s.processSprinklerDevice(device, Trigger{Source: models.SourceManual})
+			if err == nil {
+				t.Fatal("Expected the run to report the failed task")
+			}
+			if errors.Is(err, ErrPartialRun) != tc.expectPartial {
+				t.Errorf("Expected partial run %v, got %v", tc.expectPartial, err)
+			}
+
+			var history models.IrrigationHistory
+			if err := db.First(&history).Error; err != nil {
+				t.Fatalf("Failed to load history: %v", err)
+			}
+			if history.Status != tc.expectStatus {
+				t.Errorf("Expected status %s, got %s (%s)", tc.expectStatus, history.Status, history.Notes)
+			}
+			var outcomes []models.TaskOutcome
+			for _, result := range history.TaskResults {
+				outcomes = append(outcomes, result.Outcome)
+			}
+			if !reflect.DeepEqual(outcomes, tc.expectOutcomes) {
+				t.Errorf("Expected outcomes %v, got %v", tc.expectOutcomes, outcomes)
+			}
+			if history.TasksSucceeded != tc.expectSucceeded || history.TasksFailed != tc.expectFailed {
+				t.Errorf("Expected %d succeeded and %d failed tasks, got %d and %d", tc.expectSucceeded, tc.expectFailed, history.TasksSucceeded, history.TasksFailed)
+			}
+			if tc.expectPartial && (history.EndedAt == nil || history.Notes != "2 of 3 tasks completed. Failed: task_2 (timeout).") {
+				t.Errorf("Expected an ended run noting the failed task, got %v with %q", history.EndedAt, history.Notes)
+			}
+		})
+	}
+}
+
+func TestStatsCountRuns(t *testing.T) {
+	client := newFakeDeviceClient()
+	ok := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}
+	failing := config.DeviceConfig{ID: "sprinkler_02", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}} // has no task file
+	unknown := config.DeviceConfig{ID: "mystery_01", Type: "iot_mystery"}
+	cfg := &config.Config{Devices: []config.DeviceConfig{ok, failing, unknown}}
+	s := NewScheduler(cfg, client, newTestDB(t), nil)
+	s.pollInterval = 10 * time.Millisecond
+	s.taskSettleDelay = 0
+	s.tasksDir = t.TempDir()
+	writeTaskFile(t, s.tasksDir, ok.ID, "task_1", `{"payload": [{"fr": 1}], "timeoutMinutes": 1}`)
+	for _, device := range []config.DeviceConfig{ok, failing} {
+		client.setStatus(models.DeviceStatus{DeviceID: device.ID, SprinklerCalibComplete: true, ValveCalibComplete: true})
+	}
+	client.onPublish = func(topic, payload string) {
+		if topic == "sprinkler_01/cmd/task/set" {
+			go client.setStatus(models.DeviceStatus{DeviceID: ok.ID, SprinklerCalibComplete: true, ValveCalibComplete: true, TaskAllComplete: true})
+		}
+	}
+
+	for _, device := range []config.DeviceConfig{ok, failing, ok} {
+		s.executeDeviceJob(device, Trigger{Source: models.SourceManual})
+	}
+	// Jobs of an unknown type fail right away, so these all finish at about the same time.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.executeDeviceJob(unknown, Trigger{Source: models.SourceScheduled})
+		}()
+	}
+	wg.Wait()
+	s.now = func() time.Time { return s.startedAt.Add(90 * time.Second) }
+
+	stats := s.Stats()
+	if expected := (RunCounts{Runs: 23, Succeeded: 2, Failed: 21}); stats.RunCounts != expected {
+		t.Errorf("Expected totals %+v, got %+v", expected, stats.RunCounts)
+	}
+	expected := map[string]RunCounts{
+		ok.ID:      {Runs: 2, Succeeded: 2},
+		failing.ID: {Runs: 1, Failed: 1},
+		unknown.ID: {Runs: 20, Failed: 20},
+	}
+	if !reflect.DeepEqual(stats.Devices, expected) {
+		t.Errorf("Expected device counts %+v, got %+v", expected, stats.Devices)
+	}
+	if stats.UptimeSeconds != 90 || !stats.StartedAt.Equal(s.startedAt) {
+		t.Errorf("Expected 90s uptime since %v, got %ds since %v", s.startedAt, stats.UptimeSeconds, stats.StartedAt)
+	}
+}
+
+// subscribeOrderClient records the scheduler's state whenever a device is subscribed.
+type subscribeOrderClient struct {
+	*fakeDeviceClient
+	s    *Scheduler
+	db   *gorm.DB
+	seen []string // per subscription: armed jobs, whether gocron runs, and the interrupted run's status
+}
+
+func (c *subscribeOrderClient) SubscribeToDeviceTopics(device config.DeviceConfig) error {
+	var run models.IrrigationHistory
+	c.db.First(&run)
+	c.seen = append(c.seen, fmt.Sprintf("%s: %d jobs, running %v, run %s", device.ID, len(c.s.scheduler.Jobs()), c.s.scheduler.IsRunning(), run.Status))
+	return c.fakeDeviceClient.SubscribeToDeviceTopics(device)
+}
+
+func TestSubscribeAfterStart(t *testing.T) {
+	testCases := []struct {
+		name     string
+		enabled  bool
+		expected []string
+	}{
+		{name: "disabled leaves subscribing to the caller"},
+		{name: "enabled subscribes once armed", enabled: true, expected: []string{"sprinkler_01: 2 jobs, running false, run started"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t)
+			device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"06:00", "18:00"}, TaskIDs: []string{"task_1"}}
+			cfg := &config.Config{
+				Devices:  []config.DeviceConfig{device},
+				MQTT:     config.MQTTConfig{SubscribeAfterStart: tc.enabled},
+				Schedule: config.ScheduleConfig{InterruptedJobs: config.InterruptedJobsFail},
+			}
+			client := &subscribeOrderClient{fakeDeviceClient: newFakeDeviceClient(), db: db}
+			s := NewScheduler(cfg, client, db, nil)
+			client.s = s
+			started := time.Now().Add(-time.Hour)
+			if err := db.Create(&models.IrrigationHistory{DeviceID: device.ID, ScheduledAt: started, StartedAt: &started, Status: models.StatusStarted}).Error; err != nil {
+				t.Fatalf("Failed to create history: %v", err)
+			}
+
+			if err := s.Start(); err != nil {
+				t.Fatalf("Failed to start: %v", err)
+			}
+			defer s.Stop()
+
+			if !reflect.DeepEqual(client.seen, tc.expected) {
+				t.Errorf("Expected subscriptions %v, got %v", tc.expected, client.seen)
+			}
+			var run models.IrrigationHistory
+			if err := db.First(&run).Error; err != nil || run.Status != models.StatusInterrupted {
+				t.Errorf("Expected the interrupted run to be resolved by Start, got %s (%v)", run.Status, err)
+			}
+		})
+	}
+}
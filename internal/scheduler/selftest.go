@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/slack"
+)
+
+// SubscriptionProbe reports devices whose status topics are not all subscribed yet.
+type SubscriptionProbe interface {
+	PendingDevices(deviceIDs []string, requireStatus bool) []string
+}
+
+// SelfTestResult is the boot self-test outcome for one device.
+type SelfTestResult struct {
+	DeviceID string
+	Problem  string // empty when the device passed
+}
+
+// RunSelfTest waits up to timeout for every device's status topics to be subscribed and for devices
+// that report health (plant pots, and sprinklers with requireHealthCheck) to report healthy.
+// The results are sent to Slack as a boot summary and returned in device order.
+func (s *Scheduler) RunSelfTest(probe SubscriptionProbe, timeout time.Duration) []SelfTestResult {
+	devices := s.devices()
+	log.Printf("Running boot self-test for %d devices (timeout: %v)...", len(devices), timeout)
+
+	deadline := time.Now().Add(timeout)
+	results := s.selfTestResults(probe, devices, timeout)
+	for failedCount(results) > 0 && time.Now().Before(deadline) {
+		time.Sleep(s.pollInterval)
+		results = s.selfTestResults(probe, devices, timeout)
+	}
+
+	failed := failedCount(results)
+	if failed == 0 {
+		log.Printf("Boot self-test passed for all %d devices.", len(results))
+		s.notifySlackRich(slack.NewSuccessMessage("✅ Boot Self-Test Passed", fmt.Sprintf("All %d devices are subscribed and healthy.", len(results))))
+		return results
+	}
+
+	var lines []string
+	for _, result := range results {
+		if result.Problem != "" {
+			lines = append(lines, fmt.Sprintf("• %s: %s", result.DeviceID, result.Problem))
+		}
+	}
+	log.Printf("Boot self-test failed for %d of %d devices:\n%s", failed, len(results), strings.Join(lines, "\n"))
+	s.notifySlackRich(slack.NewErrorMessage(
+		fmt.Sprintf("🚨 Boot Self-Test Failed (%d/%d devices)", failed, len(results)),
+		strings.Join(lines, "\n"),
+	))
+	return results
+}
+
+// selfTestResults checks each device once.
+func (s *Scheduler) selfTestResults(probe SubscriptionProbe, devices []config.DeviceConfig, timeout time.Duration) []SelfTestResult {
+	ids := make([]string, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+	}
+	pending := make(map[string]bool)
+	for _, id := range probe.PendingDevices(ids, false) {
+		pending[id] = true
+	}
+
+	results := make([]SelfTestResult, len(devices))
+	for i, device := range devices {
+		results[i].DeviceID = device.ID
+		switch {
+		case pending[device.ID]:
+			results[i].Problem = "status topics are not subscribed"
+		case reportsHealth(device) && !s.mqttClient.GetDeviceStatus(device.ID).HealthCheck:
+			results[i].Problem = fmt.Sprintf("no healthy health_check within %v", timeout)
+		}
+	}
+	return results
+}
+
+// reportsHealth reports whether the device publishes a health_check flag.
+func reportsHealth(device config.DeviceConfig) bool {
+	return device.Type == config.DeviceTypePlantPot || device.RequireHealthCheck
+}
+
+func failedCount(results []SelfTestResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Problem != "" {
+			failed++
+		}
+	}
+	return failed
+}
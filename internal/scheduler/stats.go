@@ -0,0 +1,66 @@
+package scheduler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// runCounters counts finished device jobs. The counts are updated atomically, so jobs running
+// concurrently need no lock.
+type runCounters struct {
+	runs      atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+}
+
+// add counts a finished job; a non-nil err counts as a failure.
+func (c *runCounters) add(err error) {
+	c.runs.Add(1)
+	if err != nil {
+		c.failed.Add(1)
+	} else {
+		c.succeeded.Add(1)
+	}
+}
+
+func (c *runCounters) counts() RunCounts {
+	return RunCounts{Runs: c.runs.Load(), Succeeded: c.succeeded.Load(), Failed: c.failed.Load()}
+}
+
+// RunCounts are the numbers of finished device jobs and how they ended.
+type RunCounts struct {
+	Runs      int64 `json:"runs"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+}
+
+// RunStats is a snapshot of the job counters kept in memory since the scheduler was created.
+// They start over on restart; history holds the durable record.
+type RunStats struct {
+	StartedAt     time.Time `json:"startedAt"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	RunCounts
+	Devices map[string]RunCounts `json:"devices"` // by device ID; only devices that have run
+}
+
+// countRun adds a finished job of the device to the totals and to the device's counts.
+func (s *Scheduler) countRun(deviceID string, err error) {
+	s.runTotals.add(err)
+	value, _ := s.deviceRuns.LoadOrStore(deviceID, &runCounters{})
+	value.(*runCounters).add(err)
+}
+
+// Stats returns the job counters and the time since the scheduler was created.
+func (s *Scheduler) Stats() RunStats {
+	stats := RunStats{
+		StartedAt:     s.startedAt,
+		UptimeSeconds: int64(s.now().Sub(s.startedAt).Seconds()),
+		RunCounts:     s.runTotals.counts(),
+		Devices:       make(map[string]RunCounts),
+	}
+	s.deviceRuns.Range(func(key, value any) bool {
+		stats.Devices[key.(string)] = value.(*runCounters).counts()
+		return true
+	})
+	return stats
+}
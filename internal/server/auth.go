@@ -0,0 +1,28 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+)
+
+// requireAPIToken wraps a handler so it only serves requests carrying the configured bearer token.
+// Protected endpoints are disabled entirely when no token is configured.
+func requireAPIToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			log.Printf("[WARN] Rejected request to %s: API_TOKEN is not configured", r.URL.Path)
+			http.Error(w, "API token not configured", http.StatusForbidden)
+			return
+		}
+
+		provided := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte("Bearer "+token)) != 1 {
+			log.Printf("[WARN] Unauthorized request to %s", r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultCommandLimit = 50
+	maxCommandLimit     = 500
+)
+
+// CommandRecord is the API representation of a command log row.
+type CommandRecord struct {
+	ID          uint                 `json:"id"`
+	DeviceID    string               `json:"deviceId"`
+	Topic       string               `json:"topic"`
+	Payload     string               `json:"payload"`
+	PublishedAt time.Time            `json:"publishedAt"`
+	HistoryID   *uint                `json:"historyId,omitempty"`
+	Source      models.TriggerSource `json:"source,omitempty"`
+	Error       string               `json:"error,omitempty"`
+}
+
+func newCommandRecord(c models.CommandLog) CommandRecord {
+	return CommandRecord{
+		ID:          c.ID,
+		DeviceID:    c.DeviceID,
+		Topic:       c.Topic,
+		Payload:     c.Payload,
+		PublishedAt: c.PublishedAt,
+		HistoryID:   c.HistoryID,
+		Source:      c.Source,
+		Error:       c.Error,
+	}
+}
+
+// DeviceCommandsHandler creates an http.HandlerFunc returning the most recent commands published to
+// the device in the path, newest first. The optional limit query parameter defaults to 50, up to 500.
+func DeviceCommandsHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.PathValue("id")
+		limit := defaultCommandLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit: expected a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxCommandLimit)
+		}
+
+		var rows []models.CommandLog
+		if err := db.Where("device_id = ?", deviceID).Order("published_at DESC, id DESC").Limit(limit).Find(&rows).Error; err != nil {
+			log.Printf("[ERROR] Failed to list commands for device %s: %v", deviceID, err)
+			http.Error(w, "Failed to list commands", http.StatusInternalServerError)
+			return
+		}
+
+		records := make([]CommandRecord, 0, len(rows))
+		for _, c := range rows {
+			records = append(records, newCommandRecord(c))
+		}
+		writeJSON(w, http.StatusOK, records)
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/config"
+)
+
+// ConfigSource exposes the parts of the running configuration that can change after startup.
+type ConfigSource interface {
+	Devices() []config.DeviceConfig
+	Location() *time.Location
+}
+
+// ConfigHandler creates an http.HandlerFunc returning the effective configuration, including the
+// current devices and the schedule time zone. Secret settings are omitted entirely.
+func ConfigHandler(cfg *config.Config, source ConfigSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := cfg.Public(source.Devices())
+		resp["timezone"] = source.Location().String()
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
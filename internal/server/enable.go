@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/models"
+	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+)
+
+// DeviceToggler disables devices and re-enables them.
+type DeviceToggler interface {
+	EnableDevice(deviceID string) (models.DeviceState, error)
+	DisableDevice(deviceID, reason string) (models.DeviceState, error)
+}
+
+// DisableDeviceRequest is the optional request body for the DisableDeviceHandler.
+type DisableDeviceRequest struct {
+	Reason string `json:"reason"`
+}
+
+// DeviceEnabledResponse is the response body for the enable and disable endpoints.
+type DeviceEnabledResponse struct {
+	DeviceID            string     `json:"deviceId"`
+	Enabled             bool       `json:"enabled"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	DisabledAt          *time.Time `json:"disabledAt,omitempty"`
+	DisabledReason      string     `json:"disabledReason,omitempty"`
+	Error               string     `json:"error,omitempty"`
+}
+
+func newDeviceEnabledResponse(state models.DeviceState) DeviceEnabledResponse {
+	return DeviceEnabledResponse{
+		DeviceID:            state.DeviceID,
+		Enabled:             state.DisabledAt == nil,
+		ConsecutiveFailures: state.ConsecutiveFailures,
+		DisabledAt:          state.DisabledAt,
+		DisabledReason:      state.DisabledReason,
+	}
+}
+
+// EnableDeviceHandler creates an http.HandlerFunc that re-enables the device in the path and resets
+// its failure count.
+func EnableDeviceHandler(toggler DeviceToggler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.PathValue("id")
+		log.Printf("[INFO] Received API request to enable device %s.", deviceID)
+		state, err := toggler.EnableDevice(deviceID)
+		writeDeviceEnabled(w, deviceID, state, err)
+	}
+}
+
+// DisableDeviceHandler creates an http.HandlerFunc that disables the device in the path, with an
+// optional reason in the body, so its runs are skipped until it is re-enabled.
+func DisableDeviceHandler(toggler DeviceToggler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.PathValue("id")
+		var req DisableDeviceRequest
+		if r.Body != nil && r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if isBodyTooLarge(err) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil && err != io.EOF {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "disabled through the API"
+		}
+
+		log.Printf("[INFO] Received API request to disable device %s (reason: %q).", deviceID, req.Reason)
+		state, err := toggler.DisableDevice(deviceID, req.Reason)
+		writeDeviceEnabled(w, deviceID, state, err)
+	}
+}
+
+// writeDeviceEnabled writes the device's state after an enable or disable request, or the error.
+func writeDeviceEnabled(w http.ResponseWriter, deviceID string, state models.DeviceState, err error) {
+	if err == nil {
+		writeJSON(w, http.StatusOK, newDeviceEnabledResponse(state))
+		return
+	}
+	statusCode := http.StatusInternalServerError
+	if errors.Is(err, scheduler.ErrDeviceNotFound) {
+		statusCode = http.StatusNotFound
+	} else {
+		log.Printf("[ERROR] Failed to update device %s: %v", deviceID, err)
+	}
+	writeJSON(w, statusCode, DeviceEnabledResponse{DeviceID: deviceID, Error: err.Error()})
+}
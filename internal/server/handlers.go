@@ -2,34 +2,49 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/slack-go/slack"
-	"github.com/slack-go/slack/slackevents"
 	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/models"
 	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
 )
 
 // SlackEventsHandler creates a new http.HandlerFunc for handling Slack events.
 // It verifies the request signature using the signing secret.
 func SlackEventsHandler(cfg *config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Missing headers and stale timestamps are the sender's fault, not ours: reject them as unauthorized.
 		verifier, err := slack.NewSecretsVerifier(r.Header, cfg.Slack.SigningSecret)
 		if err != nil {
-			log.Printf("[ERROR] Failed to create secrets verifier: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("[WARN] Rejected Slack request: %v (%s)", err, slackTimestampSkew(r.Header, time.Now()))
+			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("[ERROR] Failed to read request body: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		body, captured := rawBody(r)
+		if !captured {
+			body, err = io.ReadAll(r.Body)
+			if err != nil {
+				if isBodyTooLarge(err) {
+					log.Printf("[WARN] Rejected oversized Slack event body: %v", err)
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
+				log.Printf("[ERROR] Failed to read request body: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		}
 		// We need to read the body twice, so we create a new reader with the same content.
 		r.Body = io.NopCloser(bytes.NewBuffer(body))
@@ -41,7 +56,9 @@ func SlackEventsHandler(cfg *config.Config) http.HandlerFunc {
 		}
 
 		if err := verifier.Ensure(); err != nil {
-			log.Printf("[WARN] Invalid Slack signature: %v", err)
+			// A proxy that rewrites the body or headers breaks the signature; the details help tell that
+			// apart from a wrong signing secret.
+			log.Printf("[WARN] Invalid Slack signature: %v (%s, %d body bytes, raw body captured: %v)", err, slackTimestampSkew(r.Header, time.Now()), len(body), captured)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -60,6 +77,11 @@ func SlackEventsHandler(cfg *config.Config) http.HandlerFunc {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			if r == nil || r.Challenge == "" {
+				log.Printf("[WARN] Slack URL verification request without a challenge.")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 			w.Header().Set("Content-Type", "text/plain")
 			w.Write([]byte(r.Challenge))
 			log.Printf("[INFO] Responded to Slack URL verification challenge.")
@@ -79,10 +101,40 @@ func SlackEventsHandler(cfg *config.Config) http.HandlerFunc {
 // TriggerTaskRequest is the request body for the TriggerTaskHandler
 type TriggerTaskRequest struct {
 	DeviceID string `json:"deviceId"`
+	Reason   string `json:"reason,omitempty"` // recorded on the run's history
+	// TaskParams override fields of every task step for this run only, e.g. {"ct": 5}. Requires a device.
+	TaskParams map[string]json.RawMessage `json:"taskParams,omitempty"`
+	// TaskIDs runs only these of the device's tasks, e.g. to re-run a failed one. Requires a device.
+	TaskIDs []string `json:"taskIds,omitempty"`
+}
+
+// triggeredByHeader names who requested a manual run; it is recorded on the run's history.
+const triggeredByHeader = "X-Triggered-By"
+
+// busyRetryAfter is the Retry-After hint sent when a device already has a job in flight.
+const busyRetryAfter = 60 * time.Second
+
+// retryAfterSeconds formats a Retry-After value for a wait of d, rounded up to whole seconds and
+// at least 1.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(d.Seconds())), 1))
+}
+
+// JobRunner is the subset of the scheduler used by the trigger handlers.
+type JobRunner interface {
+	StartJobForDevice(deviceID string, trigger scheduler.Trigger) error
+	StartAllJobsOnce() error
 }
 
 // TriggerTaskHandler creates an http.HandlerFunc to manually trigger an irrigation task.
-func TriggerTaskHandler(sched *scheduler.Scheduler) http.HandlerFunc {
+// The device is taken from the {id} path value when present, otherwise from the request body.
+// An optional body reason and X-Triggered-By header are recorded on the run's history.
+// Requests carrying an Idempotency-Key header replay the original response for that device and key.
+func TriggerTaskHandler(sched JobRunner) http.HandlerFunc {
+	return triggerTaskHandler(sched, newIdempotencyStore(defaultIdempotencyTTL))
+}
+
+func triggerTaskHandler(sched JobRunner, idempotency *idempotencyStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -91,29 +143,426 @@ func TriggerTaskHandler(sched *scheduler.Scheduler) http.HandlerFunc {
 
 		var req TriggerTaskRequest
 		// Decode the request body.
-		if r.Body != nil && r.ContentLength > 0 {
+		if r.Body != nil && r.ContentLength != 0 {
 			err := json.NewDecoder(r.Body).Decode(&req)
+			if isBodyTooLarge(err) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil && err != io.EOF {
 				http.Error(w, "Error parsing request body", http.StatusBadRequest)
 				return
 			}
 		}
+		if id := r.PathValue("id"); id != "" {
+			req.DeviceID = id
+		}
+		if len(req.TaskParams) > 0 && req.DeviceID == "" {
+			http.Error(w, "taskParams require a device", http.StatusBadRequest)
+			return
+		}
+		if len(req.TaskIDs) > 0 && req.DeviceID == "" {
+			http.Error(w, "taskIds require a device", http.StatusBadRequest)
+			return
+		}
 
-		if req.DeviceID != "" {
-			log.Printf("[INFO] Received API request to trigger task for device: %s", req.DeviceID)
-			go func() {
-				if err := sched.RunJobForDevice(req.DeviceID); err != nil {
+		trigger := scheduler.Trigger{
+			Source:      models.SourceManual,
+			TriggeredBy: r.Header.Get(triggeredByHeader),
+			Reason:      req.Reason,
+			TaskParams:  req.TaskParams,
+			TaskIDs:     req.TaskIDs,
+		}
+
+		retryAfter := busyRetryAfter
+		launch := func() (int, string) {
+			if req.DeviceID != "" {
+				log.Printf("[INFO] Received API request to trigger task for device: %s (by: %q, reason: %q)", req.DeviceID, trigger.TriggeredBy, trigger.Reason)
+				if err := sched.StartJobForDevice(req.DeviceID, trigger); err != nil {
+					if errors.Is(err, scheduler.ErrDeviceBusy) {
+						return http.StatusTooManyRequests, fmt.Sprintf("A job for device %s is already running. Retry later.", req.DeviceID)
+					}
+					if errors.Is(err, scheduler.ErrTooManyManualRuns) {
+						return http.StatusTooManyRequests, "Too many manual runs are in progress. Retry later."
+					}
+					if errors.Is(err, scheduler.ErrDeviceNotFound) {
+						return http.StatusNotFound, fmt.Sprintf("Device %s not found.", req.DeviceID)
+					}
+					if errors.Is(err, scheduler.ErrUnknownTask) {
+						return http.StatusUnprocessableEntity, err.Error()
+					}
+					if errors.Is(err, scheduler.ErrSchedulerPaused) {
+						return http.StatusConflict, "The scheduler is paused and manual runs are not allowed. Resume it with POST /api/v1/scheduler/resume."
+					}
+					if errors.Is(err, scheduler.ErrDeviceDisabled) {
+						return http.StatusConflict, fmt.Sprintf("Device %s is disabled. Re-enable it with POST /api/v1/devices/%s/enable.", req.DeviceID, req.DeviceID)
+					}
+					var cooldown *scheduler.CooldownError
+					if errors.As(err, &cooldown) {
+						retryAfter = time.Until(cooldown.Until)
+						return http.StatusTooManyRequests, fmt.Sprintf("Device %s is cooling down: it last ran at %s. Retry after %s.", req.DeviceID, cooldown.LastRun.Format(time.RFC3339), cooldown.Until.Format(time.RFC3339))
+					}
 					log.Printf("[ERROR] Failed to trigger job for device %s: %v", req.DeviceID, err)
+					return http.StatusInternalServerError, fmt.Sprintf("Failed to trigger job for device %s.", req.DeviceID)
 				}
-			}()
-			w.WriteHeader(http.StatusAccepted)
-			fmt.Fprintf(w, "Task trigger request for device %s accepted.", req.DeviceID)
-		} else {
+				return http.StatusAccepted, fmt.Sprintf("Task trigger request for device %s accepted.", req.DeviceID)
+			}
 			log.Println("[INFO] Received API request to trigger all tasks.")
-			go sched.RunAllJobsOnce()
-			w.WriteHeader(http.StatusAccepted)
-			fmt.Fprintln(w, "Task trigger request for all devices accepted.")
+			if err := sched.StartAllJobsOnce(); err != nil {
+				if errors.Is(err, scheduler.ErrTooManyManualRuns) {
+					return http.StatusTooManyRequests, "Too many manual runs are in progress. Retry later."
+				}
+				log.Printf("[ERROR] Failed to trigger all jobs: %v", err)
+				return http.StatusInternalServerError, "Failed to trigger jobs for all devices."
+			}
+			return http.StatusAccepted, "Task trigger request for all devices accepted.\n"
+		}
+
+		statusCode, body := 0, ""
+		if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+			var replayed bool
+			statusCode, body, replayed = idempotency.do(req.DeviceID+"/"+key, launch)
+			if replayed {
+				log.Printf("[INFO] Replaying response for duplicate Idempotency-Key %q (device: %q)", key, req.DeviceID)
+			}
+		} else {
+			statusCode, body = launch()
+		}
+
+		if statusCode == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		}
+		w.WriteHeader(statusCode)
+		fmt.Fprint(w, body)
+	}
+}
+
+// DeviceReloader applies a new device configuration.
+type DeviceReloader interface {
+	ReloadDevices(devices []config.DeviceConfig) (scheduler.ReloadSummary, error)
+}
+
+// ReloadDevicesResponse is the response body for the ReloadDevicesHandler.
+type ReloadDevicesResponse struct {
+	scheduler.ReloadSummary
+	Error string `json:"error,omitempty"`
+}
+
+// ReloadDevicesHandler creates an http.HandlerFunc that re-reads the device config file and applies it.
+// A malformed or invalid file is rejected with 422, and a missing or unreadable one with 500; either
+// way the running configuration is left untouched.
+func ReloadDevicesHandler(cfg *config.Config, reloader DeviceReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.DeviceCfgPath == "" {
+			writeJSON(w, http.StatusInternalServerError, ReloadDevicesResponse{Error: "DEVICE_CONFIG_PATH is not configured"})
+			return
+		}
+
+		devices, err := config.LoadDevices(cfg.DeviceCfgPath, cfg.Schedule)
+		if errors.Is(err, config.ErrDeviceConfigMissing) || errors.Is(err, config.ErrDeviceConfigUnreadable) {
+			log.Printf("[ERROR] Device config reload failed: %v", err)
+			writeJSON(w, http.StatusInternalServerError, ReloadDevicesResponse{Error: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("[WARN] Rejected device config reload: %v", err)
+			writeJSON(w, http.StatusUnprocessableEntity, ReloadDevicesResponse{Error: err.Error()})
+			return
+		}
+
+		summary, err := reloader.ReloadDevices(devices)
+		if err != nil {
+			log.Printf("[ERROR] Device config reload applied with errors: %v", err)
+			writeJSON(w, http.StatusInternalServerError, ReloadDevicesResponse{ReloadSummary: summary, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, ReloadDevicesResponse{ReloadSummary: summary})
+	}
+}
+
+// PauseController pauses and resumes scheduled jobs.
+type PauseController interface {
+	Pause()
+	Resume()
+	IsPaused() bool
+}
+
+// SchedulerState is the response body for the scheduler state endpoints.
+type SchedulerState struct {
+	Paused bool `json:"paused"`
+}
+
+// SchedulerStateHandler creates an http.HandlerFunc returning whether the scheduler is paused.
+func SchedulerStateHandler(ctrl PauseController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, SchedulerState{Paused: ctrl.IsPaused()})
+	}
+}
+
+// PauseSchedulerHandler creates an http.HandlerFunc that pauses scheduled jobs.
+func PauseSchedulerHandler(ctrl PauseController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("[INFO] Received API request to pause the scheduler.")
+		ctrl.Pause()
+		writeJSON(w, http.StatusOK, SchedulerState{Paused: ctrl.IsPaused()})
+	}
+}
+
+// ResumeSchedulerHandler creates an http.HandlerFunc that resumes scheduled jobs.
+func ResumeSchedulerHandler(ctrl PauseController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("[INFO] Received API request to resume the scheduler.")
+		ctrl.Resume()
+		writeJSON(w, http.StatusOK, SchedulerState{Paused: ctrl.IsPaused()})
+	}
+}
+
+// StatusProvider exposes the latest status reported by each device.
+type StatusProvider interface {
+	GetDeviceStatus(deviceID string) *models.DeviceStatus
+}
+
+// DeviceStatusHandler creates an http.HandlerFunc returning the cached status for the device in the path.
+func DeviceStatusHandler(statuses StatusProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, statuses.GetDeviceStatus(r.PathValue("id")))
+	}
+}
+
+// DeviceCalibrator re-homes a device on demand.
+type DeviceCalibrator interface {
+	CalibrateDevice(deviceID string, trigger scheduler.Trigger) error
+}
+
+// CalibrateResponse is the response body for the CalibrateDeviceHandler.
+type CalibrateResponse struct {
+	DeviceID   string `json:"deviceId"`
+	Calibrated bool   `json:"calibrated"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CalibrateDeviceHandler creates an http.HandlerFunc that calibrates the device in the path and waits
+// for the result. A device that does not report calibrated in time returns 408.
+func CalibrateDeviceHandler(calibrator DeviceCalibrator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.PathValue("id")
+		trigger := scheduler.Trigger{Source: models.SourceManual, TriggeredBy: r.Header.Get(triggeredByHeader)}
+		log.Printf("[INFO] Received API request to calibrate device %s (by: %q)", deviceID, trigger.TriggeredBy)
+
+		// Homing can take minutes, longer than the server's write timeout allows.
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("[WARN] Failed to lift the write deadline for calibrating device %s: %v", deviceID, err)
+		}
+
+		err := calibrator.CalibrateDevice(deviceID, trigger)
+		if err == nil {
+			writeJSON(w, http.StatusOK, CalibrateResponse{DeviceID: deviceID, Calibrated: true})
+			return
+		}
+
+		statusCode := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, scheduler.ErrDeviceNotFound):
+			statusCode = http.StatusNotFound
+		case errors.Is(err, scheduler.ErrCalibrationUnsupported):
+			statusCode = http.StatusUnprocessableEntity
+		case errors.Is(err, scheduler.ErrSchedulerPaused):
+			statusCode = http.StatusConflict
+		case errors.Is(err, scheduler.ErrDeviceBusy), errors.Is(err, scheduler.ErrTooManyManualRuns):
+			statusCode = http.StatusTooManyRequests
+			w.Header().Set("Retry-After", retryAfterSeconds(busyRetryAfter))
+		case errors.Is(err, scheduler.ErrFlagTimeout):
+			statusCode = http.StatusRequestTimeout
+		case errors.Is(err, scheduler.ErrBrokerDisconnected):
+			statusCode = http.StatusServiceUnavailable
+		default:
+			log.Printf("[ERROR] Calibration of device %s failed: %v", deviceID, err)
 		}
+		writeJSON(w, statusCode, CalibrateResponse{DeviceID: deviceID, Error: err.Error()})
+	}
+}
+
+// StatusResetter clears the cached status of a device.
+type StatusResetter interface {
+	StatusProvider
+	ResetDeviceStatus(deviceID string)
+}
+
+// ResetDeviceStatusHandler creates an http.HandlerFunc that clears the cached status for the device in
+// the path, e.g. when a stale flag blocks a run, and returns the status after the reset.
+func ResetDeviceStatusHandler(statuses StatusResetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.PathValue("id")
+		log.Printf("[INFO] Received API request to reset the cached status of device %s.", deviceID)
+		statuses.ResetDeviceStatus(deviceID)
+		writeJSON(w, http.StatusOK, statuses.GetDeviceStatus(deviceID))
+	}
+}
+
+// StatusInjector stores a crafted device status, for exercising the scheduler without hardware.
+type StatusInjector interface {
+	StatusProvider
+	InjectDeviceStatus(status models.DeviceStatus)
+}
+
+// InjectDeviceStatusHandler creates an http.HandlerFunc that stores the status in the body as if the
+// device in the path had reported it, and returns the stored status. It is only registered in TEST_MODE.
+func InjectDeviceStatusHandler(statuses StatusInjector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.PathValue("id")
+		var status models.DeviceStatus
+		err := json.NewDecoder(r.Body).Decode(&status)
+		if isBodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error parsing request body", http.StatusBadRequest)
+			return
+		}
+		status.DeviceID = deviceID
+		log.Printf("[INFO] Received API request to inject a status for device %s.", deviceID)
+		statuses.InjectDeviceStatus(status)
+		writeJSON(w, http.StatusOK, statuses.GetDeviceStatus(deviceID))
+	}
+}
+
+// DeviceLister exposes the IDs of the configured devices.
+type DeviceLister interface {
+	DeviceIDs() []string
+}
+
+// ReadinessProbe reports whether the controller can observe its devices.
+type ReadinessProbe interface {
+	IsConnected() bool
+	PendingDevices(deviceIDs []string, requireStatus bool) []string
+	ConnectionStats() models.ConnectionStats
+}
+
+// DeviceObserver is the MQTT side of the server: device statuses and readiness.
+type DeviceObserver interface {
+	StatusResetter
+	StatusInjector
+	ReadinessProbe
+}
+
+// ReadinessResponse is returned by the readiness endpoint.
+type ReadinessResponse struct {
+	Ready          bool     `json:"ready"`
+	MQTTConnected  bool     `json:"mqttConnected"`
+	PendingDevices []string `json:"pendingDevices,omitempty"`
+	// Degraded is set when no devices are configured: the controller is up but has nothing to water.
+	Degraded bool `json:"degraded,omitempty"`
+	// Connection counts broker connection losses and reconnects, to spot a flapping broker.
+	Connection models.ConnectionStats `json:"connection"`
+}
+
+// ReadinessHandler creates an http.HandlerFunc that returns 200 once the broker is connected and every
+// configured device's topics are subscribed (and, with requireStatus, each device has reported a status),
+// and 503 until then. An empty device list is reported as degraded, and with requireDevices as not ready.
+func ReadinessHandler(devices DeviceLister, probe ReadinessProbe, requireStatus, requireDevices bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceIDs := devices.DeviceIDs()
+		resp := ReadinessResponse{
+			MQTTConnected:  probe.IsConnected(),
+			PendingDevices: probe.PendingDevices(deviceIDs, requireStatus),
+			Degraded:       len(deviceIDs) == 0,
+			Connection:     probe.ConnectionStats(),
+		}
+		resp.Ready = resp.MQTTConnected && len(resp.PendingDevices) == 0 && !(resp.Degraded && requireDevices)
+
+		statusCode := http.StatusOK
+		if !resp.Ready {
+			statusCode = http.StatusServiceUnavailable
+		}
+		writeJSON(w, statusCode, resp)
+	}
+}
+
+// limitRequestBody rejects requests whose declared Content-Length exceeds maxBytes with 413
+// and caps the body of all others, so handlers never read more than maxBytes.
+// A non-positive maxBytes disables the limit.
+func limitRequestBody(maxBytes int64, next http.Handler) http.Handler {
+	if maxBytes <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			log.Printf("[WARN] Rejected request to %s with Content-Length %d (limit %d)", r.URL.Path, r.ContentLength, maxBytes)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rawBodyKey is the context key under which captureRawBody stores a request body.
+type rawBodyKey struct{}
+
+// captureRawBody reads the body of requests to path before any other middleware sees it and stores
+// the bytes in the request context, so handlers can verify signatures against exactly what arrived.
+// Bodies over maxBytes are rejected with 413; a non-positive maxBytes disables the limit.
+func captureRawBody(path string, maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reader := io.Reader(r.Body)
+		if maxBytes > 0 {
+			reader = io.LimitReader(r.Body, maxBytes+1)
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			log.Printf("[ERROR] Failed to read request body for %s: %v", path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if maxBytes > 0 && int64(len(body)) > maxBytes {
+			log.Printf("[WARN] Rejected request to %s with a body over %d bytes", path, maxBytes)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rawBodyKey{}, body)))
+	})
+}
+
+// rawBody returns the body captured by captureRawBody, if any.
+func rawBody(r *http.Request) ([]byte, bool) {
+	body, ok := r.Context().Value(rawBodyKey{}).([]byte)
+	return body, ok
+}
+
+// slackTimestampSkew describes how far a Slack request's timestamp is from now, for logging rejected requests.
+func slackTimestampSkew(header http.Header, now time.Time) string {
+	raw := header.Get("X-Slack-Request-Timestamp")
+	timestamp, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return fmt.Sprintf("invalid request timestamp %q", raw)
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew < 0 {
+		return fmt.Sprintf("request timestamp is %v ahead of the server clock", -skew)
+	}
+	return fmt.Sprintf("request timestamp is %v behind the server clock", skew)
+}
+
+// isBodyTooLarge reports whether err was caused by reading past the request body limit.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERROR] Failed to encode JSON response: %v", err)
 	}
 }
 
@@ -0,0 +1,1670 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/models"
+	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+	"gorm.io/gorm"
+)
+
+// fakeJobRunner records the jobs started through the trigger handlers.
+// With holdRuns set, started device jobs never finish, so later triggers see the device as busy
+// and, with limit set, are rejected once limit jobs are running.
+type fakeJobRunner struct {
+	mu         sync.Mutex
+	deviceRuns []string
+	triggers   []scheduler.Trigger
+	allRuns    int
+	holdRuns   bool
+	limit      int
+	running    map[string]bool
+	startErr   error // returned by StartJobForDevice when set
+	done       chan struct{}
+}
+
+func newFakeJobRunner() *fakeJobRunner {
+	return &fakeJobRunner{done: make(chan struct{}, 16)}
+}
+
+func (f *fakeJobRunner) StartJobForDevice(deviceID string, trigger scheduler.Trigger) error {
+	f.mu.Lock()
+	if f.startErr != nil {
+		f.mu.Unlock()
+		return f.startErr
+	}
+	if f.limit > 0 && len(f.running) >= f.limit {
+		f.mu.Unlock()
+		return scheduler.ErrTooManyManualRuns
+	}
+	if f.running[deviceID] {
+		f.mu.Unlock()
+		return scheduler.ErrDeviceBusy
+	}
+	if f.holdRuns {
+		if f.running == nil {
+			f.running = make(map[string]bool)
+		}
+		f.running[deviceID] = true
+	}
+	f.deviceRuns = append(f.deviceRuns, deviceID)
+	f.triggers = append(f.triggers, trigger)
+	f.mu.Unlock()
+	f.done <- struct{}{}
+	return nil
+}
+
+func (f *fakeJobRunner) StartAllJobsOnce() error {
+	f.mu.Lock()
+	if f.limit > 0 && len(f.running) >= f.limit {
+		f.mu.Unlock()
+		return scheduler.ErrTooManyManualRuns
+	}
+	f.allRuns++
+	f.mu.Unlock()
+	f.done <- struct{}{}
+	return nil
+}
+
+func (f *fakeJobRunner) runs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.deviceRuns) + f.allRuns
+}
+
+// waitForRuns waits until n jobs have been started or the timeout elapses.
+func (f *fakeJobRunner) waitForRuns(n int) {
+	deadline := time.After(time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-f.done:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func newTriggerMux(handler http.HandlerFunc) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/irrigate/device/{id}", handler)
+	return mux
+}
+
+func triggerDevice(mux *http.ServeMux, deviceID, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/"+deviceID, nil)
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTriggerTaskHandlerIdempotencyKey(t *testing.T) {
+	now := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	store := newIdempotencyStore(10 * time.Minute)
+	store.now = func() time.Time { return now }
+
+	runner := newFakeJobRunner()
+	mux := newTriggerMux(triggerTaskHandler(runner, store))
+
+	first := triggerDevice(mux, "sprinkler_01", "retry-1")
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 for first trigger, got %d", first.Code)
+	}
+	runner.waitForRuns(1)
+
+	// Duplicate key within the TTL replays the response without a new job.
+	now = now.Add(5 * time.Minute)
+	dup := triggerDevice(mux, "sprinkler_01", "retry-1")
+	if dup.Code != first.Code || dup.Body.String() != first.Body.String() {
+		t.Errorf("Expected replayed response %d %q, got %d %q", first.Code, first.Body.String(), dup.Code, dup.Body.String())
+	}
+
+	// The same key for another device is a different request.
+	triggerDevice(mux, "sprinkler_02", "retry-1")
+	runner.waitForRuns(1)
+
+	// Once the TTL has passed the key starts a new job.
+	now = now.Add(6 * time.Minute)
+	triggerDevice(mux, "sprinkler_01", "retry-1")
+	runner.waitForRuns(1)
+
+	if got := runner.runs(); got != 3 {
+		t.Errorf("Expected 3 jobs to be started, got %d", got)
+	}
+}
+
+func TestTriggerTaskHandlerIdempotencyKeyReplaysConflict(t *testing.T) {
+	runner := newFakeJobRunner()
+	runner.startErr = fmt.Errorf("%w: sprinkler_01", scheduler.ErrDeviceDisabled)
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(10*time.Minute)))
+
+	first := triggerDevice(mux, "sprinkler_01", "retry-1")
+	if first.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a disabled device, got %d", first.Code)
+	}
+
+	// Re-enabled in the meantime, but the retry replays the 409 instead of running the job.
+	runner.mu.Lock()
+	runner.startErr = nil
+	runner.mu.Unlock()
+	retry := triggerDevice(mux, "sprinkler_01", "retry-1")
+	if retry.Code != http.StatusConflict || retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected the 409 to be replayed, got %d %q", retry.Code, retry.Body.String())
+	}
+	if got := runner.runs(); got != 0 {
+		t.Errorf("Expected no job for a replayed 409, got %d", got)
+	}
+}
+
+func TestIdempotencyStoreDoesNotBlockOtherKeys(t *testing.T) {
+	store := newIdempotencyStore(time.Minute)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slowDone := make(chan int, 1)
+	go func() {
+		code, _, _ := store.do("sprinkler_01/retry-1", func() (int, string) {
+			close(started)
+			<-release // e.g. a cooldown skip waiting on a slow database or Slack
+			return http.StatusTooManyRequests, "cooling down"
+		})
+		slowDone <- code
+	}()
+	<-started
+
+	otherDone := make(chan int, 1)
+	go func() {
+		code, _, _ := store.do("sprinkler_02/retry-1", func() (int, string) { return http.StatusAccepted, "accepted" })
+		otherDone <- code
+	}()
+	select {
+	case code := <-otherDone:
+		if code != http.StatusAccepted {
+			t.Errorf("Expected 202 for the other device, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a trigger for another device to complete while the first one is running")
+	}
+
+	// A duplicate of the running request waits for it; its 429 was not stored, so it runs itself.
+	dupDone := make(chan int, 1)
+	go func() {
+		code, _, replayed := store.do("sprinkler_01/retry-1", func() (int, string) { return http.StatusAccepted, "accepted" })
+		if replayed {
+			code = -1
+		}
+		dupDone <- code
+	}()
+	select {
+	case <-dupDone:
+		t.Fatal("Expected the duplicate to wait for the running request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if code := <-slowDone; code != http.StatusTooManyRequests {
+		t.Errorf("Expected the slow request's 429, got %d", code)
+	}
+	if code := <-dupDone; code != http.StatusAccepted {
+		t.Errorf("Expected the duplicate to run once the 429 was released, got %d", code)
+	}
+
+	// The duplicate's 202 was stored and is now replayed.
+	if code, _, replayed := store.do("sprinkler_01/retry-1", func() (int, string) { return http.StatusInternalServerError, "" }); !replayed || code != http.StatusAccepted {
+		t.Errorf("Expected the stored 202 to be replayed, got %d (replayed %v)", code, replayed)
+	}
+}
+
+func TestTriggerTaskHandlerWithoutIdempotencyKey(t *testing.T) {
+	runner := newFakeJobRunner()
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	triggerDevice(mux, "sprinkler_01", "")
+	triggerDevice(mux, "sprinkler_01", "")
+	runner.waitForRuns(2)
+
+	if got := runner.runs(); got != 2 {
+		t.Errorf("Expected 2 jobs without an idempotency key, got %d", got)
+	}
+}
+
+func TestTriggerTaskHandlerRejectsBusyDevice(t *testing.T) {
+	runner := newFakeJobRunner()
+	runner.holdRuns = true
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	if first := triggerDevice(mux, "sprinkler_01", "retry-1"); first.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 for first trigger, got %d", first.Code)
+	}
+
+	second := triggerDevice(mux, "sprinkler_01", "retry-2")
+	if second.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for a busy device, got %d", second.Code)
+	}
+	if got := second.Header().Get("Retry-After"); got != strconv.Itoa(int(busyRetryAfter.Seconds())) {
+		t.Errorf("Expected Retry-After header, got %q", got)
+	}
+
+	// A rejected request is not remembered, so the same key can be retried once the device is free.
+	runner.mu.Lock()
+	runner.running = nil
+	runner.mu.Unlock()
+	if retry := triggerDevice(mux, "sprinkler_01", "retry-2"); retry.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 when retrying after the device is free, got %d", retry.Code)
+	}
+	if other := triggerDevice(mux, "sprinkler_02", ""); other.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 for another device, got %d", other.Code)
+	}
+}
+
+func TestTriggerTaskHandlerRecordsTrigger(t *testing.T) {
+	runner := newFakeJobRunner()
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/sprinkler_01", strings.NewReader(`{"reason": "leaves wilting"}`))
+	req.Header.Set(triggeredByHeader, "alice")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", rec.Code)
+	}
+	runner.waitForRuns(1)
+
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	expected := scheduler.Trigger{Source: models.SourceManual, TriggeredBy: "alice", Reason: "leaves wilting"}
+	if len(runner.triggers) != 1 || !reflect.DeepEqual(runner.triggers[0], expected) {
+		t.Errorf("Expected trigger %+v, got %+v", expected, runner.triggers)
+	}
+}
+
+func TestTriggerTaskHandlerPassesTaskParams(t *testing.T) {
+	runner := newFakeJobRunner()
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/sprinkler_01", strings.NewReader(`{"taskParams": {"ct": 3}}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", rec.Code)
+	}
+	runner.waitForRuns(1)
+
+	runner.mu.Lock()
+	params := runner.triggers[0].TaskParams
+	runner.mu.Unlock()
+	if len(params) != 1 || string(params["ct"]) != "3" {
+		t.Errorf("Expected taskParams {ct: 3}, got %v", params)
+	}
+
+	rec = httptest.NewRecorder()
+	triggerTaskHandler(runner, newIdempotencyStore(time.Minute))(rec, httptest.NewRequest(http.MethodPost, "/api/v1/trigger-task", strings.NewReader(`{"taskParams": {"ct": 3}}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for taskParams without a device, got %d", rec.Code)
+	}
+}
+
+func TestTriggerTaskHandlerTaskSubset(t *testing.T) {
+	runner := newFakeJobRunner()
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/sprinkler_01", strings.NewReader(`{"taskIds": ["task_2"]}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", rec.Code)
+	}
+	runner.waitForRuns(1)
+	runner.mu.Lock()
+	taskIDs := runner.triggers[0].TaskIDs
+	runner.mu.Unlock()
+	if !reflect.DeepEqual(taskIDs, []string{"task_2"}) {
+		t.Errorf("Expected taskIds [task_2], got %v", taskIDs)
+	}
+
+	rec = httptest.NewRecorder()
+	triggerTaskHandler(runner, newIdempotencyStore(time.Minute))(rec, httptest.NewRequest(http.MethodPost, "/api/v1/trigger-task", strings.NewReader(`{"taskIds": ["task_2"]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for taskIds without a device, got %d", rec.Code)
+	}
+
+	runner = newFakeJobRunner()
+	runner.startErr = fmt.Errorf("%w for device sprinkler_01: task_9", scheduler.ErrUnknownTask)
+	mux = newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/sprinkler_01", strings.NewReader(`{"taskIds": ["task_9"]}`)))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "task_9") {
+		t.Errorf("Expected 422 naming the unknown task, got %d: %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTriggerTaskHandlerUnknownDeviceWithTaskIDs(t *testing.T) {
+	sched := scheduler.NewScheduler(&config.Config{Devices: []config.DeviceConfig{{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, TaskIDs: []string{"task_1"}}}}, nil, nil, nil)
+	mux := newTriggerMux(triggerTaskHandler(sched, newIdempotencyStore(time.Minute)))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/sprinkler_99", strings.NewReader(`{"taskIds": ["task_1"]}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown device, got %d: %q", rec.Code, rec.Body.String())
+	}
+	if sched.IsDeviceRunning("sprinkler_99") {
+		t.Error("Expected no job to be started for an unknown device")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/sprinkler_01", strings.NewReader(`{"taskIds": ["task_9"]}`)))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "task_9") {
+		t.Errorf("Expected 422 naming the unknown task, got %d: %q", rec.Code, rec.Body.String())
+	}
+}
+
+// fakeDeviceReloader records the device configurations it was asked to apply.
+type fakeDeviceReloader struct {
+	reloaded [][]config.DeviceConfig
+}
+
+func (f *fakeDeviceReloader) ReloadDevices(devices []config.DeviceConfig) (scheduler.ReloadSummary, error) {
+	f.reloaded = append(f.reloaded, devices)
+	return scheduler.ReloadSummary{Added: []string{devices[0].ID}, Removed: []string{}, Changed: []string{}}, nil
+}
+
+func writeDeviceFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "devices.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("Failed to write device file: %v", err)
+	}
+	return path
+}
+
+func reloadDevices(handler http.HandlerFunc, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/config/devices/reload", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestReloadDevicesHandler(t *testing.T) {
+	path := writeDeviceFile(t, `{"devices": [{"id": "sprinkler_09", "type": "iot_sprinkler", "scheduleTimes": ["08:00"]}]}`)
+	cfg := &config.Config{DeviceCfgPath: path, Server: config.ServerConfig{APIToken: "secret"}}
+	reloader := &fakeDeviceReloader{}
+	handler := requireAPIToken(cfg.Server.APIToken, ReloadDevicesHandler(cfg, reloader))
+
+	rec := reloadDevices(handler, "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp ReloadDevicesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Added) != 1 || resp.Added[0] != "sprinkler_09" {
+		t.Errorf("Expected sprinkler_09 to be reported as added, got %+v", resp.ReloadSummary)
+	}
+	if len(reloader.reloaded) != 1 {
+		t.Errorf("Expected one reload to be applied, got %d", len(reloader.reloaded))
+	}
+}
+
+func TestReloadDevicesHandlerRejectsInvalidConfig(t *testing.T) {
+	path := writeDeviceFile(t, `{"devices": [{"id": "sprinkler_09", "type": "iot_sprinklr"}]}`)
+	cfg := &config.Config{DeviceCfgPath: path}
+	reloader := &fakeDeviceReloader{}
+
+	rec := reloadDevices(ReloadDevicesHandler(cfg, reloader), "")
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "iot_sprinklr") {
+		t.Errorf("Expected the error to describe the invalid device, got %s", rec.Body.String())
+	}
+	if len(reloader.reloaded) != 0 {
+		t.Error("Expected an invalid config not to be applied")
+	}
+}
+
+func TestReloadDevicesHandlerMissingFile(t *testing.T) {
+	cfg := &config.Config{DeviceCfgPath: filepath.Join(t.TempDir(), "devices.json")}
+	reloader := &fakeDeviceReloader{}
+
+	rec := reloadDevices(ReloadDevicesHandler(cfg, reloader), "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for a missing file, got %d", rec.Code)
+	}
+	if len(reloader.reloaded) != 0 {
+		t.Error("Expected nothing to be applied")
+	}
+}
+
+func TestRequireAPIToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	testCases := []struct {
+		name       string
+		configured string
+		provided   string
+		expected   int
+	}{
+		{name: "valid token", configured: "secret", provided: "secret", expected: http.StatusOK},
+		{name: "wrong token", configured: "secret", provided: "guess", expected: http.StatusUnauthorized},
+		{name: "missing token", configured: "secret", provided: "", expected: http.StatusUnauthorized},
+		{name: "no token configured", configured: "", provided: "", expected: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := reloadDevices(requireAPIToken(tc.configured, ok), tc.provided)
+			if rec.Code != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
+
+// fakeStatusProvider serves fixed device statuses.
+type fakeStatusProvider map[string]*models.DeviceStatus
+
+func (f fakeStatusProvider) GetDeviceStatus(deviceID string) *models.DeviceStatus {
+	if status, ok := f[deviceID]; ok {
+		return status
+	}
+	return &models.DeviceStatus{DeviceID: deviceID}
+}
+
+func (f fakeStatusProvider) ResetDeviceStatus(deviceID string) {
+	f[deviceID] = &models.DeviceStatus{DeviceID: deviceID}
+}
+
+func (f fakeStatusProvider) InjectDeviceStatus(status models.DeviceStatus) {
+	f[status.DeviceID] = &status
+}
+
+func TestDeviceStatusHandlerExposesTaskSteps(t *testing.T) {
+	statuses := fakeStatusProvider{"sprinkler_01": {
+		DeviceID:  "sprinkler_01",
+		TaskArray: `[{"fr":297,"to":328,"sp":100,"wv":8,"wvea":"STOP","ct":10}]`,
+		TaskSteps: []models.TaskStep{{From: 297, To: 328, Speed: 100, ValvePosition: 8, ValveEndAction: "STOP", Count: 10}},
+	}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/devices/{id}/status", DeviceStatusHandler(statuses))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/devices/sprinkler_01/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+
+	var status models.DeviceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(status.TaskSteps) != 1 || status.TaskSteps[0].Count != 10 {
+		t.Errorf("Expected parsed task steps in the response, got %+v", status.TaskSteps)
+	}
+}
+
+// fakePauseController tracks the pause state in memory.
+type fakePauseController struct {
+	paused bool
+}
+
+func (f *fakePauseController) Pause()         { f.paused = true }
+func (f *fakePauseController) Resume()        { f.paused = false }
+func (f *fakePauseController) IsPaused() bool { return f.paused }
+
+func TestSchedulerPauseResumeHandlers(t *testing.T) {
+	ctrl := &fakePauseController{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/scheduler/state", SchedulerStateHandler(ctrl))
+	mux.HandleFunc("POST /api/v1/scheduler/pause", PauseSchedulerHandler(ctrl))
+	mux.HandleFunc("POST /api/v1/scheduler/resume", ResumeSchedulerHandler(ctrl))
+
+	steps := []struct {
+		method string
+		path   string
+		paused bool
+	}{
+		{http.MethodGet, "/api/v1/scheduler/state", false},
+		{http.MethodPost, "/api/v1/scheduler/pause", true},
+		{http.MethodGet, "/api/v1/scheduler/state", true},
+		{http.MethodPost, "/api/v1/scheduler/resume", false},
+	}
+
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(step.method, step.path, nil))
+
+		var state SchedulerState
+		if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+			t.Fatalf("%s %s: failed to decode response: %v", step.method, step.path, err)
+		}
+		if state.Paused != step.paused {
+			t.Errorf("%s %s: expected paused=%v, got %v", step.method, step.path, step.paused, state.Paused)
+		}
+	}
+}
+
+// unsizedBody hides the length of a reader so requests are sent without a Content-Length.
+type unsizedBody struct {
+	io.Reader
+}
+
+func TestOversizedBodiesAreRejected(t *testing.T) {
+	const limit = 64
+	oversized := `{"deviceId": "` + strings.Repeat("x", 2*limit) + `"}`
+	cfg := &config.Config{Slack: config.SlackConfig{SigningSecret: "secret"}}
+
+	testCases := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		sized   bool
+	}{
+		{name: "trigger with content length", path: "/api/v1/trigger-task", handler: TriggerTaskHandler(newFakeJobRunner()), sized: true},
+		{name: "trigger without content length", path: "/api/v1/trigger-task", handler: TriggerTaskHandler(newFakeJobRunner()), sized: false},
+		{name: "slack with content length", path: "/slack/events", handler: SlackEventsHandler(cfg), sized: true},
+		{name: "slack without content length", path: "/slack/events", handler: SlackEventsHandler(cfg), sized: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(oversized)
+			if !tc.sized {
+				body = unsizedBody{body}
+			}
+			req := httptest.NewRequest(http.MethodPost, tc.path, body)
+			if !tc.sized {
+				req.ContentLength = -1
+			}
+			req.Header.Set("X-Slack-Signature", "v0=00")
+			req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+
+			rec := httptest.NewRecorder()
+			limitRequestBody(limit, tc.handler).ServeHTTP(rec, req)
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected 413, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+// newTestDB opens an isolated in-memory database with the schema migrated.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	if err := db.AutoMigrate(&models.IrrigationHistory{}, &models.DeviceState{}, &models.CommandLog{}); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return db
+}
+
+func TestHistoryRecordHandler(t *testing.T) {
+	db := newTestDB(t)
+	started := time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC)
+	ended := started.Add(15 * time.Minute)
+	seeded := models.IrrigationHistory{
+		DeviceID:    "sprinkler_01",
+		ScheduledAt: started,
+		StartedAt:   &started,
+		EndedAt:     &ended,
+		Status:      models.StatusCompleted,
+		Duration:    15,
+		Notes:       "All tasks completed",
+	}
+	if err := db.Create(&seeded).Error; err != nil {
+		t.Fatalf("Failed to seed history: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/history/{id}", HistoryRecordHandler(db))
+
+	testCases := []struct {
+		name     string
+		id       string
+		expected int
+	}{
+		{name: "found", id: strconv.FormatUint(uint64(seeded.ID), 10), expected: http.StatusOK},
+		{name: "not found", id: "9999", expected: http.StatusNotFound},
+		{name: "invalid id", id: "abc", expected: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/history/"+tc.id, nil))
+			if rec.Code != tc.expected {
+				t.Fatalf("Expected %d, got %d", tc.expected, rec.Code)
+			}
+			if tc.expected != http.StatusOK {
+				return
+			}
+
+			var record HistoryRecord
+			if err := json.NewDecoder(rec.Body).Decode(&record); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if record.ID != seeded.ID || record.DeviceID != "sprinkler_01" || record.Status != models.StatusCompleted {
+				t.Errorf("Expected seeded record, got %+v", record)
+			}
+			if record.Duration != 15 || record.Notes != "All tasks completed" {
+				t.Errorf("Expected duration and notes to be returned, got %+v", record)
+			}
+			if record.StartedAt == nil || !record.StartedAt.Equal(started) || record.EndedAt == nil || !record.EndedAt.Equal(ended) {
+				t.Errorf("Expected timestamps to be returned, got %+v", record)
+			}
+		})
+	}
+}
+
+func seedHistoryForList(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	seeded := []models.IrrigationHistory{
+		{DeviceID: "sprinkler_01", ScheduledAt: time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC), Status: models.StatusCompleted, Duration: 15, WaterLiters: 30, Notes: "All tasks completed", Source: models.SourceScheduled, Labels: models.Labels{"zone": "greenhouse", "crop": "tomato"}},
+		{DeviceID: "sprinkler_01", ScheduledAt: time.Date(2025, 6, 2, 6, 0, 0, 0, time.UTC), Status: models.StatusFailed, Duration: 15, Notes: "Calibration timed out", Source: models.SourceScheduled, Labels: models.Labels{"zone": "front"}},
+		{DeviceID: "plant_pot_01", ScheduledAt: time.Date(2025, 6, 2, 7, 0, 0, 0, time.UTC), Status: models.StatusCompleted, Duration: 1, Source: models.SourceManual, Labels: models.Labels{"zone": "greenhouse", "bed.row": "2"}},
+	}
+	if err := db.Create(&seeded).Error; err != nil {
+		t.Fatalf("Failed to seed history: %v", err)
+	}
+}
+
+func TestHistoryListHandlerFilters(t *testing.T) {
+	db := newTestDB(t)
+	seedHistoryForList(t, db)
+	handler := HistoryListHandler(db)
+
+	testCases := []struct {
+		name     string
+		query    string
+		expected int
+		status   int
+	}{
+		{name: "no filters", query: "", expected: 3, status: http.StatusOK},
+		{name: "by device", query: "?device=sprinkler_01", expected: 2, status: http.StatusOK},
+		{name: "by status", query: "?status=completed", expected: 2, status: http.StatusOK},
+		{name: "by date", query: "?from=2025-06-02&to=2025-06-02", expected: 2, status: http.StatusOK},
+		{name: "by timestamp", query: "?to=2025-06-02T06:30:00Z", expected: 2, status: http.StatusOK},
+		{name: "combined", query: "?device=sprinkler_01&status=failed&from=2025-06-02", expected: 1, status: http.StatusOK},
+		{name: "by label", query: "?label.zone=greenhouse", expected: 2, status: http.StatusOK},
+		{name: "by several labels", query: "?label.zone=greenhouse&label.crop=tomato", expected: 1, status: http.StatusOK},
+		{name: "by label and device", query: "?label.zone=greenhouse&device=plant_pot_01", expected: 1, status: http.StatusOK},
+		{name: "by label key with a dot", query: "?label.bed.row=2", expected: 1, status: http.StatusOK},
+		{name: "by missing label", query: "?label.owner=sam", expected: 0, status: http.StatusOK},
+		{name: "limited", query: "?limit=2", expected: 2, status: http.StatusOK},
+		{name: "offset", query: "?limit=2&offset=2", expected: 1, status: http.StatusOK},
+		{name: "invalid date", query: "?from=yesterday", status: http.StatusBadRequest},
+		{name: "empty label key", query: "?label.=greenhouse", status: http.StatusBadRequest},
+		{name: "invalid limit", query: "?limit=0", status: http.StatusBadRequest},
+		{name: "invalid offset", query: "?offset=-1", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/history"+tc.query, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("Expected %d, got %d", tc.status, rec.Code)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var records []HistoryRecord
+			if err := json.NewDecoder(rec.Body).Decode(&records); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(records) != tc.expected {
+				t.Errorf("Expected %d records, got %d", tc.expected, len(records))
+			}
+		})
+	}
+}
+
+func TestHistoryListHandlerLimits(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC)
+	seeded := make([]models.IrrigationHistory, maxHistoryLimit+5)
+	for i := range seeded {
+		seeded[i] = models.IrrigationHistory{DeviceID: "sprinkler_01", ScheduledAt: start.Add(time.Duration(i) * time.Minute), Status: models.StatusCompleted}
+	}
+	if err := db.CreateInBatches(&seeded, 200).Error; err != nil {
+		t.Fatalf("Failed to seed history: %v", err)
+	}
+	handler := HistoryListHandler(db)
+
+	testCases := []struct {
+		name     string
+		query    string
+		expected int
+		newest   time.Time
+	}{
+		{name: "default limit", query: "", expected: defaultHistoryLimit, newest: seeded[len(seeded)-1].ScheduledAt},
+		{name: "limit above max", query: "?limit=5000", expected: maxHistoryLimit, newest: seeded[len(seeded)-1].ScheduledAt},
+		{name: "offset skips the newest", query: "?limit=10&offset=3", expected: 10, newest: seeded[len(seeded)-4].ScheduledAt},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/history"+tc.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected %d, got %d", http.StatusOK, rec.Code)
+			}
+
+			var records []HistoryRecord
+			if err := json.NewDecoder(rec.Body).Decode(&records); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if len(records) != tc.expected {
+				t.Fatalf("Expected %d records, got %d", tc.expected, len(records))
+			}
+			if !records[0].ScheduledAt.Equal(tc.newest) {
+				t.Errorf("Expected the page to start at %v, got %v", tc.newest, records[0].ScheduledAt)
+			}
+		})
+	}
+}
+
+func TestHistoryCSVHandler(t *testing.T) {
+	db := newTestDB(t)
+	seedHistoryForList(t, db)
+
+	rec := httptest.NewRecorder()
+	HistoryCSVHandler(db)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/history.csv?device=sprinkler_01&status=completed", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Expected Content-Type text/csv, got %q", ct)
+	}
+
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Expected header and 1 row, got %d rows", len(rows))
+	}
+	if got := strings.Join(rows[0], ","); got != strings.Join(historyCSVHeader, ",") {
+		t.Errorf("Expected header %v, got %v", historyCSVHeader, rows[0])
+	}
+
+	row := rows[1]
+	expected := map[string]string{
+		"device_id":        "sprinkler_01",
+		"status":           "completed",
+		"scheduled_at":     "2025-06-01T06:00:00Z",
+		"started_at":       "",
+		"duration_minutes": "15",
+		"water_liters":     "30",
+		"notes":            "All tasks completed",
+		"source":           "scheduled",
+	}
+	for i, column := range historyCSVHeader {
+		if want, ok := expected[column]; ok && row[i] != want {
+			t.Errorf("Expected %s %q, got %q", column, want, row[i])
+		}
+	}
+}
+
+// fakeReadiness is a DeviceLister and ReadinessProbe whose state tests change directly.
+type fakeReadiness struct {
+	ids        []string
+	connected  bool
+	reconnects int64
+	subscribed map[string]bool
+	reported   map[string]bool
+}
+
+func (f *fakeReadiness) DeviceIDs() []string { return f.ids }
+func (f *fakeReadiness) IsConnected() bool   { return f.connected }
+func (f *fakeReadiness) ConnectionStats() models.ConnectionStats {
+	return models.ConnectionStats{Reconnects: f.reconnects}
+}
+
+func (f *fakeReadiness) PendingDevices(deviceIDs []string, requireStatus bool) []string {
+	var pending []string
+	for _, id := range deviceIDs {
+		if !f.subscribed[id] || (requireStatus && !f.reported[id]) {
+			pending = append(pending, id)
+		}
+	}
+	return pending
+}
+
+func TestReadinessHandlerTransitionsToReady(t *testing.T) {
+	probe := &fakeReadiness{
+		ids:        []string{"sprinkler_01", "plant_pot_01"},
+		subscribed: map[string]bool{},
+		reported:   map[string]bool{},
+	}
+	handler := ReadinessHandler(probe, probe, true, false)
+
+	check := func(expected int, expectedPending int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+		if rec.Code != expected {
+			t.Fatalf("Expected %d, got %d", expected, rec.Code)
+		}
+		var resp ReadinessResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.Ready != (expected == http.StatusOK) || len(resp.PendingDevices) != expectedPending {
+			t.Errorf("Unexpected readiness response %+v", resp)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, 2)
+
+	probe.connected = true
+	probe.subscribed["sprinkler_01"] = true
+	probe.subscribed["plant_pot_01"] = true
+	check(http.StatusServiceUnavailable, 2)
+
+	probe.reported["sprinkler_01"] = true
+	check(http.StatusServiceUnavailable, 1)
+
+	probe.reported["plant_pot_01"] = true
+	check(http.StatusOK, 0)
+
+	probe.connected = false
+	check(http.StatusServiceUnavailable, 0)
+}
+
+func TestReadinessHandlerReportsNoDevicesAsDegraded(t *testing.T) {
+	testCases := []struct {
+		name           string
+		requireDevices bool
+		expected       int
+	}{
+		{name: "degraded but ready", expected: http.StatusOK},
+		{name: "required devices", requireDevices: true, expected: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			probe := &fakeReadiness{connected: true, reconnects: 2}
+			rec := httptest.NewRecorder()
+			ReadinessHandler(probe, probe, false, tc.requireDevices)(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+			if rec.Code != tc.expected {
+				t.Fatalf("Expected %d, got %d", tc.expected, rec.Code)
+			}
+			var resp ReadinessResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if !resp.Degraded {
+				t.Errorf("Expected an empty device list to be reported as degraded, got %+v", resp)
+			}
+			if resp.Connection.Reconnects != 2 {
+				t.Errorf("Expected the reconnect count in the response, got %+v", resp.Connection)
+			}
+		})
+	}
+}
+
+func TestNewSetsServerTimeouts(t *testing.T) {
+	srv := New(&config.Config{Server: config.ServerConfig{
+		ReadTimeoutSecs:       30,
+		ReadHeaderTimeoutSecs: 10,
+		WriteTimeoutSecs:      60,
+		IdleTimeoutSecs:       120,
+	}}, nil, nil, nil)
+
+	expected := map[string][2]time.Duration{
+		"ReadTimeout":       {srv.ReadTimeout, 30 * time.Second},
+		"ReadHeaderTimeout": {srv.ReadHeaderTimeout, 10 * time.Second},
+		"WriteTimeout":      {srv.WriteTimeout, time.Minute},
+		"IdleTimeout":       {srv.IdleTimeout, 2 * time.Minute},
+	}
+	for name, values := range expected {
+		if values[0] != values[1] {
+			t.Errorf("Expected %s %v, got %v", name, values[1], values[0])
+		}
+	}
+}
+
+func TestInjectDeviceStatusRequiresTestMode(t *testing.T) {
+	type observer struct {
+		fakeStatusProvider
+		*fakeReadiness
+	}
+
+	testCases := []struct {
+		name           string
+		testMode       bool
+		token          string
+		expectedStatus int
+	}{
+		{name: "disabled without test mode", token: "secret", expectedStatus: http.StatusNotFound},
+		{name: "missing token", testMode: true, expectedStatus: http.StatusUnauthorized},
+		{name: "injected", testMode: true, token: "secret", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			statuses := fakeStatusProvider{}
+			cfg := &config.Config{Server: config.ServerConfig{APIToken: "secret", MaxBodyBytes: 1 << 20, TestMode: tc.testMode}}
+			handler := New(cfg, nil, observer{statuses, &fakeReadiness{}}, nil).Handler
+
+			body := `{"sprinklerCalibComplete": true, "valveCalibComplete": true, "taskAllComplete": true, "deviceId": "other"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/devices/sprinkler_01/status", strings.NewReader(body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("Expected %d, got %d", tc.expectedStatus, rec.Code)
+			}
+
+			expected := models.DeviceStatus{DeviceID: "sprinkler_01"}
+			if tc.expectedStatus == http.StatusOK {
+				expected = models.DeviceStatus{DeviceID: "sprinkler_01", SprinklerCalibComplete: true, ValveCalibComplete: true, TaskAllComplete: true}
+				var returned models.DeviceStatus
+				if err := json.Unmarshal(rec.Body.Bytes(), &returned); err != nil {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+				if !reflect.DeepEqual(returned, expected) {
+					t.Errorf("Expected the injected status to be returned, got %+v", returned)
+				}
+			}
+			if stored := statuses.GetDeviceStatus("sprinkler_01"); !reflect.DeepEqual(*stored, expected) {
+				t.Errorf("Expected stored status %+v, got %+v", expected, *stored)
+			}
+			if _, ok := statuses["other"]; ok {
+				t.Error("Expected the device in the path to override the one in the body")
+			}
+		})
+	}
+}
+
+func TestCORSAllowsTriggerHeaders(t *testing.T) {
+	handler := New(&config.Config{}, nil, nil, nil).Handler
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/v1/irrigate/device/sprinkler_01", nil)
+	req.Header.Set("Origin", "https://dashboard.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	req.Header.Set("Access-Control-Request-Headers", "idempotency-key,x-triggered-by")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	allowed := strings.ToLower(rec.Header().Get("Access-Control-Allow-Headers"))
+	if !strings.Contains(allowed, "idempotency-key") || !strings.Contains(allowed, "x-triggered-by") {
+		t.Errorf("Expected the preflight to allow Idempotency-Key and X-Triggered-By, got %q", allowed)
+	}
+}
+
+func TestRootRouteOnlyServesExactPath(t *testing.T) {
+	handler := New(&config.Config{}, nil, nil, nil).Handler
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		expected int
+	}{
+		{name: "status page", method: http.MethodGet, path: "/", expected: http.StatusOK},
+		{name: "unknown path", method: http.MethodGet, path: "/api/v1/irrigte/now", expected: http.StatusNotFound},
+		{name: "unknown path with post", method: http.MethodPost, path: "/api/v1/irrigte/now", expected: http.StatusNotFound},
+		{name: "root with post", method: http.MethodPost, path: "/", expected: http.StatusMethodNotAllowed},
+		{name: "registered route still matches", method: http.MethodGet, path: "/health", expected: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+			if rec.Code != tc.expected {
+				t.Fatalf("Expected %d, got %d", tc.expected, rec.Code)
+			}
+			if tc.path != "/" || tc.expected != http.StatusOK {
+				return
+			}
+
+			var resp StatusResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode status: %v", err)
+			}
+			if resp.Status != "ok" {
+				t.Errorf("Expected status ok, got %q", resp.Status)
+			}
+		})
+	}
+}
+
+func TestTriggerTaskHandlerRejectsBeyondManualRunLimit(t *testing.T) {
+	runner := newFakeJobRunner()
+	runner.holdRuns = true
+	runner.limit = 2
+	handler := TriggerTaskHandler(runner)
+
+	trigger := func(deviceID string) *httptest.ResponseRecorder {
+		body := "{}"
+		if deviceID != "" {
+			body = `{"deviceId": "` + deviceID + `"}`
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/trigger-task", strings.NewReader(body)))
+		return rec
+	}
+
+	for _, deviceID := range []string{"sprinkler_01", "sprinkler_02"} {
+		if rec := trigger(deviceID); rec.Code != http.StatusAccepted {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusAccepted, deviceID, rec.Code)
+		}
+	}
+
+	for _, deviceID := range []string{"sprinkler_03", ""} {
+		rec := trigger(deviceID)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("Expected %d for %q, got %d", http.StatusTooManyRequests, deviceID, rec.Code)
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected a Retry-After header for %q", deviceID)
+		}
+	}
+	if got := runner.runs(); got != 2 {
+		t.Errorf("Expected 2 runs to start, got %d", got)
+	}
+}
+
+func TestTaskFileHandler(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sprinkler_01_morning.json": `{"payload": [{"fr": 0, "to": 90}], "timeoutMinutes": 5}`,
+		"sprinkler_01_broken.json":  `{"payload": [`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatalf("Failed to write task file: %v", err)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/tasks/{deviceId}/{taskId}", TaskFileHandler(dir, scheduler.TaskTimeoutLimits{}))
+
+	testCases := []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{name: "valid task", path: "/api/v1/tasks/sprinkler_01/morning", expectedStatus: http.StatusOK},
+		{name: "missing task", path: "/api/v1/tasks/sprinkler_01/evening", expectedStatus: http.StatusNotFound},
+		{name: "malformed task", path: "/api/v1/tasks/sprinkler_01/broken", expectedStatus: http.StatusUnprocessableEntity},
+		{name: "escaped path separator", path: "/api/v1/tasks/..%2Fsecrets/morning", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("Expected %d, got %d: %s", tc.expectedStatus, rec.Code, rec.Body.String())
+			}
+			if rec.Code == http.StatusBadRequest {
+				return
+			}
+
+			var resp TaskFileResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				if resp.Error == "" {
+					t.Error("Expected a descriptive error")
+				}
+				return
+			}
+			if resp.TimeoutMinutes != 5 || resp.Timeout != "5m0s" {
+				t.Errorf("Expected a 5 minute timeout, got %d (%s)", resp.TimeoutMinutes, resp.Timeout)
+			}
+			if string(resp.Payload) != `[{"fr":0,"to":90}]` {
+				t.Errorf("Expected payload to round-trip, got %s", resp.Payload)
+			}
+		})
+	}
+}
+
+func TestResetDeviceStatusHandler(t *testing.T) {
+	statuses := fakeStatusProvider{"sprinkler_01": {DeviceID: "sprinkler_01", TaskAllComplete: true, TaskCurrentIndex: 3, ValveCalibComplete: true}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /api/v1/devices/{id}/status", requireAPIToken("secret", ResetDeviceStatusHandler(statuses)))
+
+	testCases := []struct {
+		name           string
+		token          string
+		expectedStatus int
+		expectReset    bool
+	}{
+		{name: "missing token", expectedStatus: http.StatusUnauthorized},
+		{name: "valid token", token: "secret", expectedStatus: http.StatusOK, expectReset: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/api/v1/devices/sprinkler_01/status", nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("Expected %d, got %d", tc.expectedStatus, rec.Code)
+			}
+
+			tracked := statuses.GetDeviceStatus("sprinkler_01")
+			if reset := !tracked.TaskAllComplete && tracked.TaskCurrentIndex == 0; reset != tc.expectReset {
+				t.Errorf("Expected reset %v, got tracked status %+v", tc.expectReset, tracked)
+			}
+			if !tc.expectReset {
+				return
+			}
+
+			var returned models.DeviceStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &returned); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if !reflect.DeepEqual(returned, models.DeviceStatus{DeviceID: "sprinkler_01"}) {
+				t.Errorf("Expected an empty status to be returned, got %+v", returned)
+			}
+		})
+	}
+}
+
+// fakeCalibrator returns a fixed calibration result.
+type fakeCalibrator struct {
+	err error
+}
+
+func (f fakeCalibrator) CalibrateDevice(deviceID string, trigger scheduler.Trigger) error {
+	return f.err
+}
+
+func TestCalibrateDeviceHandler(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		expectedStatus int
+	}{
+		{name: "calibrated", expectedStatus: http.StatusOK},
+		{name: "timeout", err: fmt.Errorf("sprinkler calibration timed out: %w", scheduler.ErrFlagTimeout), expectedStatus: http.StatusRequestTimeout},
+		{name: "busy", err: scheduler.ErrDeviceBusy, expectedStatus: http.StatusTooManyRequests},
+		{name: "unknown device", err: fmt.Errorf("%w: sprinkler_99", scheduler.ErrDeviceNotFound), expectedStatus: http.StatusNotFound},
+		{name: "broker disconnected", err: scheduler.ErrBrokerDisconnected, expectedStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /api/v1/devices/{id}/calibrate", CalibrateDeviceHandler(fakeCalibrator{err: tc.err}))
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/devices/sprinkler_01/calibrate", nil))
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("Expected %d, got %d", tc.expectedStatus, rec.Code)
+			}
+
+			var resp CalibrateResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.DeviceID != "sprinkler_01" || resp.Calibrated != (tc.err == nil) {
+				t.Errorf("Expected calibrated %v for sprinkler_01, got %+v", tc.err == nil, resp)
+			}
+		})
+	}
+}
+
+func TestVersionHandlerReturnsInjectedValues(t *testing.T) {
+	original := [...]string{Version, Commit, BuildTime}
+	t.Cleanup(func() { Version, Commit, BuildTime = original[0], original[1], original[2] })
+	Version, Commit, BuildTime = "v1.2.0", "abc123", "2026-01-02T03:04:05Z"
+	t.Setenv("APP_ENV", "production")
+
+	rec := httptest.NewRecorder()
+	New(&config.Config{}, nil, nil, nil).Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+
+	var resp VersionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := VersionResponse{Version: "v1.2.0", Commit: "abc123", BuildTime: "2026-01-02T03:04:05Z", Environment: "production"}
+	if resp != expected {
+		t.Errorf("Expected %+v, got %+v", expected, resp)
+	}
+}
+
+func TestVersionHandlerDefaults(t *testing.T) {
+	t.Setenv("APP_ENV", "")
+
+	rec := httptest.NewRecorder()
+	VersionHandler()(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	var resp VersionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := VersionResponse{Version: "dev", Commit: "unknown", BuildTime: "unknown", Environment: "development"}
+	if resp != expected {
+		t.Errorf("Expected %+v, got %+v", expected, resp)
+	}
+}
+
+// fakeConfigSource serves fixed devices in a fixed time zone.
+type fakeConfigSource []config.DeviceConfig
+
+func (f fakeConfigSource) Devices() []config.DeviceConfig { return f }
+func (f fakeConfigSource) Location() *time.Location       { return time.UTC }
+
+func TestConfigHandlerOmitsSecrets(t *testing.T) {
+	cfg := &config.Config{
+		MQTT:     config.MQTTConfig{Broker: "tcp://broker:1883", Username: "irrigation", Password: "mqtt-hunter2"},
+		Database: config.DatabaseConfig{Host: "db", Password: "pg-hunter2"},
+		Slack:    config.SlackConfig{BotToken: "xoxb-hunter2", SigningSecret: "signing-hunter2", ChannelID: "C123"},
+		Server:   config.ServerConfig{APIToken: "api-hunter2"},
+		Weather:  config.WeatherConfig{Endpoint: "https://weather.example", APIKey: "weather-hunter2"},
+	}
+	devices := fakeConfigSource{{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, ScheduleTimes: []string{"06:00"}}}
+
+	rec := httptest.NewRecorder()
+	ConfigHandler(cfg, devices)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, secret := range []string{"mqtt-hunter2", "pg-hunter2", "xoxb-hunter2", "signing-hunter2", "api-hunter2", "weather-hunter2", "***"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Expected %q to be omitted, got %s", secret, body)
+		}
+	}
+	for _, field := range []string{`"Password"`, `"BotToken"`, `"SigningSecret"`, `"APIToken"`, `"APIKey"`} {
+		if strings.Contains(body, field) {
+			t.Errorf("Expected secret field %s to be omitted entirely, got %s", field, body)
+		}
+	}
+
+	var resp struct {
+		Timezone string                `json:"timezone"`
+		Devices  []config.DeviceConfig `json:"devices"`
+		MQTT     config.MQTTConfig     `json:"mqtt"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Timezone != "UTC" || len(resp.Devices) != 1 || resp.MQTT.Username != "irrigation" {
+		t.Errorf("Expected timezone, devices and non-secret settings, got %s", body)
+	}
+}
+
+func TestTriggerTaskHandlerRejectsDeviceInCooldown(t *testing.T) {
+	lastRun := time.Date(2026, 5, 1, 6, 0, 0, 0, time.UTC)
+	runner := newFakeJobRunner()
+	runner.startErr = &scheduler.CooldownError{DeviceID: "sprinkler_01", LastRun: lastRun, Until: lastRun.Add(time.Hour)}
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	rec := triggerDevice(mux, "sprinkler_01", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "cooling down") || !strings.Contains(rec.Body.String(), "2026-05-01T07:00:00Z") {
+		t.Errorf("Expected a cooldown message with the next allowed time, got %q", rec.Body.String())
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1 for a cooldown already over, got %q", got)
+	}
+
+	runner.startErr = &scheduler.CooldownError{DeviceID: "sprinkler_01", LastRun: time.Now(), Until: time.Now().Add(90 * time.Minute)}
+	rec = triggerDevice(mux, "sprinkler_01", "")
+	if got := rec.Header().Get("Retry-After"); got != "5400" {
+		t.Errorf("Expected Retry-After until the cooldown ends, got %q", got)
+	}
+}
+
+func TestDeviceCommandsHandler(t *testing.T) {
+	db := newTestDB(t)
+	base := time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC)
+	for i, topic := range []string{"sprinkler_01/cmd/sprinkler/home", "sprinkler_01/cmd/valve/home", "sprinkler_01/cmd/task/set"} {
+		db.Create(&models.CommandLog{DeviceID: "sprinkler_01", Topic: topic, Payload: "1", PublishedAt: base.Add(time.Duration(i) * time.Minute), Source: models.SourceManual})
+	}
+	db.Create(&models.CommandLog{DeviceID: "plant_pot_01", Topic: "plant_pot_01/cmd/trigger_solenoid_valve", Payload: "30", PublishedAt: base})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/devices/{id}/commands", DeviceCommandsHandler(db))
+
+	testCases := []struct {
+		name           string
+		path           string
+		status         int
+		expectedTopics []string
+	}{
+		{
+			name:           "newest first",
+			path:           "/api/v1/devices/sprinkler_01/commands",
+			status:         http.StatusOK,
+			expectedTopics: []string{"sprinkler_01/cmd/task/set", "sprinkler_01/cmd/valve/home", "sprinkler_01/cmd/sprinkler/home"},
+		},
+		{
+			name:           "limited",
+			path:           "/api/v1/devices/sprinkler_01/commands?limit=1",
+			status:         http.StatusOK,
+			expectedTopics: []string{"sprinkler_01/cmd/task/set"},
+		},
+		{name: "unknown device", path: "/api/v1/devices/sprinkler_02/commands", status: http.StatusOK, expectedTopics: []string{}},
+		{name: "invalid limit", path: "/api/v1/devices/sprinkler_01/commands?limit=0", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("Expected %d, got %d", tc.status, rec.Code)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var records []CommandRecord
+			if err := json.NewDecoder(rec.Body).Decode(&records); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			topics := []string{}
+			for _, record := range records {
+				topics = append(topics, record.Topic)
+			}
+			if !reflect.DeepEqual(topics, tc.expectedTopics) {
+				t.Errorf("Expected %v, got %v", tc.expectedTopics, topics)
+			}
+		})
+	}
+}
+
+// fakeUpcomingScheduler records the count it was asked for and returns that many runs.
+type fakeUpcomingScheduler struct {
+	requested int
+}
+
+func (f *fakeUpcomingScheduler) UpcomingRuns(count int) []scheduler.UpcomingRun {
+	f.requested = count
+	runs := make([]scheduler.UpcomingRun, count)
+	for i := range runs {
+		runs[i] = scheduler.UpcomingRun{DeviceID: "sprinkler_01", Time: time.Date(2025, 6, 1+i, 6, 0, 0, 0, time.UTC)}
+	}
+	return runs
+}
+
+func TestUpcomingScheduleHandler(t *testing.T) {
+	testCases := []struct {
+		name      string
+		query     string
+		status    int
+		requested int
+	}{
+		{name: "default count", status: http.StatusOK, requested: 10},
+		{name: "requested count", query: "?count=20", status: http.StatusOK, requested: 20},
+		{name: "capped count", query: "?count=100000", status: http.StatusOK, requested: 200},
+		{name: "zero count", query: "?count=0", status: http.StatusBadRequest},
+		{name: "invalid count", query: "?count=abc", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sched := &fakeUpcomingScheduler{}
+			rec := httptest.NewRecorder()
+			UpcomingScheduleHandler(sched)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/schedule/upcoming"+tc.query, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("Expected %d, got %d", tc.status, rec.Code)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var runs []scheduler.UpcomingRun
+			if err := json.NewDecoder(rec.Body).Decode(&runs); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if sched.requested != tc.requested || len(runs) != tc.requested {
+				t.Errorf("Expected %d runs, got %d (requested %d)", tc.requested, len(runs), sched.requested)
+			}
+		})
+	}
+}
+
+type fakeStatsProvider scheduler.RunStats
+
+func (f fakeStatsProvider) Stats() scheduler.RunStats { return scheduler.RunStats(f) }
+
+func TestStatsHandler(t *testing.T) {
+	stats := fakeStatsProvider{
+		StartedAt:     time.Date(2025, 6, 1, 6, 0, 0, 0, time.UTC),
+		UptimeSeconds: 3600,
+		RunCounts:     scheduler.RunCounts{Runs: 3, Succeeded: 2, Failed: 1},
+		Devices: map[string]scheduler.RunCounts{
+			"sprinkler_01": {Runs: 2, Succeeded: 2},
+			"sprinkler_02": {Runs: 1, Failed: 1},
+		},
+	}
+	rec := httptest.NewRecorder()
+	StatsHandler(stats)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body["runs"] != 3.0 || body["succeeded"] != 2.0 || body["failed"] != 1.0 || body["uptimeSeconds"] != 3600.0 {
+		t.Errorf("Expected the totals and uptime at the top level, got %v", body)
+	}
+	devices, _ := body["devices"].(map[string]any)
+	if device, _ := devices["sprinkler_02"].(map[string]any); device["failed"] != 1.0 {
+		t.Errorf("Expected per-device counts, got %v", body["devices"])
+	}
+}
+
+// signedSlackRequest builds a Slack events request signed with secret at the given time.
+func signedSlackRequest(secret, body string, at time.Time) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+
+	req := httptest.NewRequest(http.MethodPost, "/slack/events", strings.NewReader(body))
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestSlackEventsHandlerURLVerification(t *testing.T) {
+	cfg := &config.Config{Slack: config.SlackConfig{SigningSecret: "secret"}}
+	challenge := `{"type": "url_verification", "token": "t", "challenge": "abc123"}`
+
+	testCases := []struct {
+		name         string
+		secret       string
+		at           time.Time
+		rawBody      bool
+		expectedCode int
+		expectedBody string
+	}{
+		{name: "valid challenge", secret: "secret", at: time.Now(), expectedCode: http.StatusOK, expectedBody: "abc123"},
+		{name: "valid challenge with raw body capture", secret: "secret", at: time.Now(), rawBody: true, expectedCode: http.StatusOK, expectedBody: "abc123"},
+		{name: "stale timestamp", secret: "secret", at: time.Now().Add(-10 * time.Minute), expectedCode: http.StatusUnauthorized},
+		{name: "wrong secret", secret: "other", at: time.Now(), expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var handler http.Handler = SlackEventsHandler(cfg)
+			if tc.rawBody {
+				handler = captureRawBody("/slack/events", 1024, limitRequestBody(1024, handler))
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, signedSlackRequest(tc.secret, challenge, tc.at))
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("Expected %d, got %d", tc.expectedCode, rec.Code)
+			}
+			if tc.expectedBody != "" && rec.Body.String() != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCaptureRawBodyRejectsOversizedBodies(t *testing.T) {
+	handler := captureRawBody("/slack/events", 16, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the handler not to run for an oversized body")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/slack/events", unsizedBody{strings.NewReader(strings.Repeat("x", 64))})
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d", rec.Code)
+	}
+}
+
+func TestSlackTimestampSkew(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	testCases := []struct {
+		timestamp string
+		expected  string
+	}{
+		{timestamp: "1699999400", expected: "request timestamp is 10m0s behind the server clock"},
+		{timestamp: "1700000030", expected: "request timestamp is 30s ahead of the server clock"},
+		{timestamp: "", expected: `invalid request timestamp ""`},
+	}
+
+	for _, tc := range testCases {
+		header := http.Header{}
+		header.Set("X-Slack-Request-Timestamp", tc.timestamp)
+		if got := slackTimestampSkew(header, now); got != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, got)
+		}
+	}
+}
+
+// fakeToggler disables and re-enables the devices in states.
+type fakeToggler struct {
+	states map[string]models.DeviceState
+}
+
+func (f *fakeToggler) EnableDevice(deviceID string) (models.DeviceState, error) {
+	if _, ok := f.states[deviceID]; !ok {
+		return models.DeviceState{}, fmt.Errorf("%w: %s", scheduler.ErrDeviceNotFound, deviceID)
+	}
+	state := models.DeviceState{DeviceID: deviceID}
+	f.states[deviceID] = state
+	return state, nil
+}
+
+func (f *fakeToggler) DisableDevice(deviceID, reason string) (models.DeviceState, error) {
+	state, ok := f.states[deviceID]
+	if !ok {
+		return models.DeviceState{}, fmt.Errorf("%w: %s", scheduler.ErrDeviceNotFound, deviceID)
+	}
+	disabledAt := time.Now()
+	state.DisabledAt = &disabledAt
+	state.DisabledReason = reason
+	f.states[deviceID] = state
+	return state, nil
+}
+
+func TestEnableAndDisableDeviceHandlers(t *testing.T) {
+	toggler := &fakeToggler{states: map[string]models.DeviceState{"sprinkler_01": {DeviceID: "sprinkler_01", ConsecutiveFailures: 4}}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/devices/{id}/enable", EnableDeviceHandler(toggler))
+	mux.HandleFunc("POST /api/v1/devices/{id}/disable", DisableDeviceHandler(toggler))
+
+	testCases := []struct {
+		name            string
+		path            string
+		body            string
+		expectedStatus  int
+		expectedEnabled bool
+		expectedReason  string
+	}{
+		{name: "disable with reason", path: "/api/v1/devices/sprinkler_01/disable", body: `{"reason": "valve replaced"}`, expectedStatus: http.StatusOK, expectedReason: "valve replaced"},
+		{name: "enable", path: "/api/v1/devices/sprinkler_01/enable", expectedStatus: http.StatusOK, expectedEnabled: true},
+		{name: "disable without body", path: "/api/v1/devices/sprinkler_01/disable", expectedStatus: http.StatusOK, expectedReason: "disabled through the API"},
+		{name: "unknown device", path: "/api/v1/devices/sprinkler_99/enable", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+			if rec.Code != tc.expectedStatus {
+				t.Fatalf("Expected %d, got %d", tc.expectedStatus, rec.Code)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var resp DeviceEnabledResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Enabled != tc.expectedEnabled || resp.DisabledReason != tc.expectedReason {
+				t.Errorf("Expected enabled %v with reason %q, got %+v", tc.expectedEnabled, tc.expectedReason, resp)
+			}
+			if tc.expectedEnabled && resp.ConsecutiveFailures != 0 {
+				t.Errorf("Expected re-enabling to reset the failure count, got %d", resp.ConsecutiveFailures)
+			}
+		})
+	}
+}
+
+func TestTriggerTaskHandlerRejectsDisabledDevice(t *testing.T) {
+	runner := newFakeJobRunner()
+	runner.startErr = fmt.Errorf("%w: sprinkler_01", scheduler.ErrDeviceDisabled)
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/irrigate/device/sprinkler_01", nil))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "/enable") {
+		t.Errorf("Expected 409 pointing at the enable endpoint, got %d: %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTriggerTaskHandlerRejectsWhilePaused(t *testing.T) {
+	runner := newFakeJobRunner()
+	runner.startErr = scheduler.ErrSchedulerPaused
+	mux := newTriggerMux(triggerTaskHandler(runner, newIdempotencyStore(time.Minute)))
+
+	rec := triggerDevice(mux, "sprinkler_01", "")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "paused") {
+		t.Errorf("Expected 409 for a paused scheduler, got %d: %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/models"
+	"gorm.io/gorm"
+)
+
+// HistoryRecord is the API representation of an irrigation history row.
+type HistoryRecord struct {
+	ID          uint                    `json:"id"`
+	DeviceID    string                  `json:"deviceId"`
+	Status      models.IrrigationStatus `json:"status"`
+	ScheduledAt time.Time               `json:"scheduledAt"`
+	StartedAt   *time.Time              `json:"startedAt"`
+	EndedAt     *time.Time              `json:"endedAt"`
+	Duration    int                     `json:"duration"` // in minutes
+	WaterLiters float64                 `json:"waterLiters"`
+	Notes       string                  `json:"notes"`
+	Source      models.TriggerSource    `json:"source"`
+	TriggeredBy string                  `json:"triggeredBy,omitempty"`
+	Reason      string                  `json:"reason,omitempty"`
+	TaskResults []models.TaskResult     `json:"taskResults,omitempty"`
+	Labels      map[string]string       `json:"labels,omitempty"`
+	CreatedAt   time.Time               `json:"createdAt"`
+	UpdatedAt   time.Time               `json:"updatedAt"`
+
+	// Where a sprinkler run got to: its phase and, in the tasks phase, the task in progress.
+	Phase         models.JobPhase `json:"phase,omitempty"`
+	CurrentTaskID string          `json:"currentTaskId,omitempty"`
+
+	// How many of the run's tasks succeeded and failed.
+	TasksSucceeded int `json:"tasksSucceeded"`
+	TasksFailed    int `json:"tasksFailed"`
+}
+
+func newHistoryRecord(h models.IrrigationHistory) HistoryRecord {
+	return HistoryRecord{
+		ID:          h.ID,
+		DeviceID:    h.DeviceID,
+		Status:      h.Status,
+		ScheduledAt: h.ScheduledAt,
+		StartedAt:   h.StartedAt,
+		EndedAt:     h.EndedAt,
+		Duration:    h.Duration,
+		WaterLiters: h.WaterLiters,
+		Notes:       h.Notes,
+		Source:      h.Source,
+		TriggeredBy: h.TriggeredBy,
+		Reason:      h.Reason,
+		TaskResults: h.TaskResults,
+		Labels:      h.Labels,
+		CreatedAt:   h.CreatedAt,
+		UpdatedAt:   h.UpdatedAt,
+
+		Phase:         h.Phase,
+		CurrentTaskID: h.CurrentTaskID,
+
+		TasksSucceeded: h.TasksSucceeded,
+		TasksFailed:    h.TasksFailed,
+	}
+}
+
+// HistoryRecordHandler creates an http.HandlerFunc returning the history row with the ID in the path.
+func HistoryRecordHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid history ID", http.StatusBadRequest)
+			return
+		}
+
+		var history models.IrrigationHistory
+		if err := db.First(&history, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				http.Error(w, "History record not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("[ERROR] Failed to load history record %d: %v", id, err)
+			http.Error(w, "Failed to load history record", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, newHistoryRecord(history))
+	}
+}
+
+// historyFilter narrows history queries by the device, status, scheduled date range and
+// device labels given in the query string.
+type historyFilter struct {
+	deviceID string
+	status   models.IrrigationStatus
+	from     *time.Time
+	to       *time.Time
+	labels   map[string]string // label key to value, from label.<key>=<value> parameters
+}
+
+// labelParamPrefix starts a query parameter filtering by a device label, e.g. label.zone=greenhouse.
+const labelParamPrefix = "label."
+
+// parseHistoryFilter reads the device, status, from, to and label.<key> query parameters.
+// Dates may be RFC 3339 timestamps or YYYY-MM-DD; a bare "to" date includes the whole day.
+func parseHistoryFilter(r *http.Request) (historyFilter, error) {
+	q := r.URL.Query()
+	filter := historyFilter{
+		deviceID: q.Get("device"),
+		status:   models.IrrigationStatus(q.Get("status")),
+	}
+	if v := q.Get("from"); v != "" {
+		from, _, err := parseHistoryDate(v)
+		if err != nil {
+			return historyFilter{}, fmt.Errorf("invalid from: %w", err)
+		}
+		filter.from = &from
+	}
+	if v := q.Get("to"); v != "" {
+		to, dateOnly, err := parseHistoryDate(v)
+		if err != nil {
+			return historyFilter{}, fmt.Errorf("invalid to: %w", err)
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.to = &to
+	}
+	for param, values := range q {
+		key, ok := strings.CutPrefix(param, labelParamPrefix)
+		if !ok {
+			continue
+		}
+		if key == "" || strings.Contains(key, `"`) {
+			return historyFilter{}, fmt.Errorf("invalid label filter %q", param)
+		}
+		if filter.labels == nil {
+			filter.labels = make(map[string]string)
+		}
+		filter.labels[key] = values[0]
+	}
+	return filter, nil
+}
+
+func parseHistoryDate(v string) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, false, nil
+	}
+	t, err = time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("expected RFC 3339 or YYYY-MM-DD, got %q", v)
+	}
+	return t, true, nil
+}
+
+// apply adds the filter's conditions to a history query, ordered newest first.
+func (f historyFilter) apply(db *gorm.DB) *gorm.DB {
+	query := db.Model(&models.IrrigationHistory{})
+	if f.deviceID != "" {
+		query = query.Where("device_id = ?", f.deviceID)
+	}
+	if f.status != "" {
+		query = query.Where("status = ?", f.status)
+	}
+	if f.from != nil {
+		query = query.Where("scheduled_at >= ?", *f.from)
+	}
+	if f.to != nil {
+		query = query.Where("scheduled_at < ?", *f.to)
+	}
+	keys := make([]string, 0, len(f.labels))
+	for key := range f.labels {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		query = labelCondition(query, db.Dialector.Name(), key, f.labels[key])
+	}
+	return query.Order("scheduled_at DESC, id DESC")
+}
+
+// labelCondition matches rows whose JSON labels column has the value for key. PostgreSQL reads the
+// column as jsonb; SQLite and MySQL use json_extract with a quoted key, so keys may contain dots.
+func labelCondition(query *gorm.DB, dialect, key, value string) *gorm.DB {
+	if dialect == "postgres" {
+		return query.Where("labels::jsonb ->> ? = ?", key, value)
+	}
+	return query.Where("json_extract(labels, ?) = ?", `$."`+key+`"`, value)
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// HistoryListHandler creates an http.HandlerFunc returning a page of the history rows matching the
+// query filters, newest first. The optional limit query parameter defaults to 100, up to 1000, and
+// offset skips that many rows, so the whole table is never loaded at once.
+func HistoryListHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseHistoryFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := defaultHistoryLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit: expected a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxHistoryLimit)
+		}
+		offset := 0
+		if v := r.URL.Query().Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid offset: expected a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			offset = n
+		}
+
+		var rows []models.IrrigationHistory
+		if err := filter.apply(db).Limit(limit).Offset(offset).Find(&rows).Error; err != nil {
+			log.Printf("[ERROR] Failed to list history: %v", err)
+			http.Error(w, "Failed to list history", http.StatusInternalServerError)
+			return
+		}
+
+		records := make([]HistoryRecord, 0, len(rows))
+		for _, h := range rows {
+			records = append(records, newHistoryRecord(h))
+		}
+		writeJSON(w, http.StatusOK, records)
+	}
+}
+
+// historyCSVHeader is the header row of the CSV export; columns follow HistoryRecord.
+var historyCSVHeader = []string{
+	"id", "device_id", "status", "scheduled_at", "started_at", "ended_at", "duration_minutes",
+	"water_liters", "notes", "source", "triggered_by", "reason", "created_at", "updated_at",
+}
+
+// HistoryCSVHandler creates an http.HandlerFunc streaming the history rows matching the
+// query filters as CSV. Rows are written as they are read so the table is never held in memory.
+func HistoryCSVHandler(db *gorm.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseHistoryFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rows, err := filter.apply(db).Rows()
+		if err != nil {
+			log.Printf("[ERROR] Failed to export history: %v", err)
+			http.Error(w, "Failed to export history", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="irrigation_history.csv"`)
+		out := csv.NewWriter(w)
+		out.Write(historyCSVHeader)
+
+		for rows.Next() {
+			var h models.IrrigationHistory
+			if err := db.ScanRows(rows, &h); err != nil {
+				// Headers are already sent, so the export can only be cut short.
+				log.Printf("[ERROR] Failed to read history row during export: %v", err)
+				break
+			}
+			out.Write(historyCSVRow(h))
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("[ERROR] Failed to export history: %v", err)
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			log.Printf("[ERROR] Failed to write history export: %v", err)
+		}
+	}
+}
+
+func historyCSVRow(h models.IrrigationHistory) []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatUint(uint64(h.ID), 10),
+		h.DeviceID,
+		string(h.Status),
+		formatTime(&h.ScheduledAt),
+		formatTime(h.StartedAt),
+		formatTime(h.EndedAt),
+		strconv.Itoa(h.Duration),
+		strconv.FormatFloat(h.WaterLiters, 'f', -1, 64),
+		h.Notes,
+		string(h.Source),
+		h.TriggeredBy,
+		h.Reason,
+		formatTime(&h.CreatedAt),
+		formatTime(&h.UpdatedAt),
+	}
+}
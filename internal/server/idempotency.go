@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader  = "Idempotency-Key"
+	defaultIdempotencyTTL = 10 * time.Minute
+)
+
+// idempotencyEntry is a previously returned response for an idempotency key, or, while
+// pending is open, a request for the key that is still running.
+type idempotencyEntry struct {
+	statusCode int
+	body       string
+	expiresAt  time.Time
+	pending    chan struct{} // closed once the running request finished; nil for stored responses
+}
+
+// idempotencyStore remembers trigger responses for a TTL so retried requests
+// replay the original response instead of launching a duplicate job.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]*idempotencyEntry
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// do returns the stored response for key if it has not expired. Otherwise it calls fn,
+// stores its response and returns it, so a retry replays the original 202 or 409 rather than
+// running again. Transient failures (429 while the device is busy, and server errors) are not
+// stored, so the request can be retried with the same key.
+// The lock is held only to look up and reserve the key, not while fn runs, so a slow request
+// does not hold up requests with other keys. A duplicate arriving while the key's request is
+// still running waits for it and then replays its response, or runs itself if none was stored.
+func (s *idempotencyStore) do(key string, fn func() (int, string)) (statusCode int, body string, replayed bool) {
+	s.mu.Lock()
+	for {
+		now := s.now()
+		for k, entry := range s.entries {
+			if entry.pending == nil && now.After(entry.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+
+		entry, ok := s.entries[key]
+		if !ok {
+			break
+		}
+		if entry.pending == nil {
+			s.mu.Unlock()
+			return entry.statusCode, entry.body, true
+		}
+		pending := entry.pending
+		s.mu.Unlock()
+		<-pending
+		s.mu.Lock()
+	}
+	reserved := &idempotencyEntry{pending: make(chan struct{})}
+	s.entries[key] = reserved
+	s.mu.Unlock()
+
+	// Release the key even if fn panics, so duplicates are not left waiting.
+	stored := false
+	defer func() {
+		s.mu.Lock()
+		if !stored {
+			delete(s.entries, key)
+		}
+		close(reserved.pending)
+		reserved.pending = nil
+		s.mu.Unlock()
+	}()
+
+	statusCode, body = fn()
+	if statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError {
+		return statusCode, body, false
+	}
+	s.mu.Lock()
+	reserved.statusCode, reserved.body, reserved.expiresAt = statusCode, body, s.now().Add(s.ttl)
+	stored = true
+	s.mu.Unlock()
+	return statusCode, body, false
+}
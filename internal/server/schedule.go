@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+)
+
+const (
+	defaultUpcomingCount = 10
+	maxUpcomingCount     = 200
+)
+
+// UpcomingScheduler lists future scheduled runs.
+type UpcomingScheduler interface {
+	UpcomingRuns(count int) []scheduler.UpcomingRun
+}
+
+// UpcomingScheduleHandler creates an http.HandlerFunc returning the next scheduled runs across all
+// devices, earliest first. The optional count query parameter defaults to 10, up to 200.
+func UpcomingScheduleHandler(sched UpcomingScheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		count := defaultUpcomingCount
+		if v := r.URL.Query().Get("count"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid count: expected a positive integer", http.StatusBadRequest)
+				return
+			}
+			count = min(n, maxUpcomingCount)
+		}
+		writeJSON(w, http.StatusOK, sched.UpcomingRuns(count))
+	}
+}
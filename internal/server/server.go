@@ -6,10 +6,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/prite36/auto-irrigation-system/internal/config"
 	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"gorm.io/gorm"
 )
 
 type StatusResponse struct {
@@ -18,7 +21,7 @@ type StatusResponse struct {
 }
 
 // New creates a new HTTP server and sets up the routes.
-func New(cfg *config.Config, sched *scheduler.Scheduler) *http.Server {
+func New(cfg *config.Config, sched *scheduler.Scheduler, devices DeviceObserver, db *gorm.DB) *http.Server {
 	mux := http.NewServeMux()
 
 	// Health check endpoint
@@ -26,33 +29,71 @@ func New(cfg *config.Config, sched *scheduler.Scheduler) *http.Server {
 		fmt.Fprintf(w, "OK")
 	})
 
+	// Readiness endpoint for load balancers: ready once every device can be observed
+	mux.HandleFunc("GET /health/ready", ReadinessHandler(sched, devices, cfg.Server.ReadyRequireStatus, cfg.Server.ReadyRequireDevices))
+
+	// Prometheus metrics endpoint
+	mux.Handle("GET /metrics", promhttp.Handler())
+
 	// Slack events endpoint
 	mux.HandleFunc("/slack/events", SlackEventsHandler(cfg))
 
-	// API endpoint to trigger a task
-	mux.HandleFunc("/api/v1/trigger-task", TriggerTaskHandler(sched))
+	// API endpoints to trigger a task, either for the device in the body or in the path
+	triggerTask := TriggerTaskHandler(sched)
+	mux.HandleFunc("/api/v1/trigger-task", triggerTask)
+	mux.HandleFunc("POST /api/v1/irrigate/device/{id}", triggerTask)
 
-	// API endpoint to get application status
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	// API endpoints to pause, resume and inspect scheduled watering
+	mux.HandleFunc("GET /api/v1/scheduler/state", SchedulerStateHandler(sched))
+	mux.HandleFunc("POST /api/v1/scheduler/pause", requireAPIToken(cfg.Server.APIToken, PauseSchedulerHandler(sched)))
+	mux.HandleFunc("POST /api/v1/scheduler/resume", requireAPIToken(cfg.Server.APIToken, ResumeSchedulerHandler(sched)))
 
-		env := os.Getenv("APP_ENV")
-		if env == "" {
-			env = "development"
-		}
+	// API endpoint to preview the next scheduled runs across all devices
+	mux.HandleFunc("GET /api/v1/schedule/upcoming", UpcomingScheduleHandler(sched))
 
-		response := StatusResponse{
-			Environment: env,
-			Status:      "ok",
-		}
+	// API endpoint for in-process job counters, a quick view without a metrics backend
+	mux.HandleFunc("GET /api/v1/stats", StatsHandler(sched))
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
-	})
+	// API endpoint to re-home a device without running its tasks
+	mux.HandleFunc("POST /api/v1/devices/{id}/calibrate", CalibrateDeviceHandler(sched))
+
+	// API endpoints to disable a device and re-enable it, e.g. after repeated failures
+	mux.HandleFunc("POST /api/v1/devices/{id}/enable", requireAPIToken(cfg.Server.APIToken, EnableDeviceHandler(sched)))
+	mux.HandleFunc("POST /api/v1/devices/{id}/disable", requireAPIToken(cfg.Server.APIToken, DisableDeviceHandler(sched)))
+
+	// API endpoints to get the latest status reported by a device, or reset it
+	mux.HandleFunc("GET /api/v1/devices/{id}/status", DeviceStatusHandler(devices))
+	mux.HandleFunc("DELETE /api/v1/devices/{id}/status", requireAPIToken(cfg.Server.APIToken, ResetDeviceStatusHandler(devices)))
+	if cfg.Server.TestMode {
+		// Staging only: store a crafted status as if the device had reported it
+		log.Println("[WARN] TEST_MODE is set: device statuses can be injected through the API.")
+		mux.HandleFunc("POST /api/v1/devices/{id}/status", requireAPIToken(cfg.Server.APIToken, InjectDeviceStatusHandler(devices)))
+	}
+
+	// API endpoint to audit the commands recently published to a device
+	mux.HandleFunc("GET /api/v1/devices/{id}/commands", DeviceCommandsHandler(db))
+
+	// API endpoints to list irrigation history, as JSON or as a CSV export
+	mux.HandleFunc("GET /api/v1/history", HistoryListHandler(db))
+	mux.HandleFunc("GET /api/v1/history.csv", HistoryCSVHandler(db))
+
+	// API endpoint to get a single irrigation history record
+	mux.HandleFunc("GET /api/v1/history/{id}", HistoryRecordHandler(db))
+
+	// API endpoint to inspect a task file as the scheduler would run it
+	mux.HandleFunc("GET /api/v1/tasks/{deviceId}/{taskId}", TaskFileHandler(scheduler.DefaultTasksDir, scheduler.TaskTimeoutLimitsFromConfig(cfg.Schedule)))
+
+	// API endpoint to get the effective configuration, without secrets
+	mux.HandleFunc("GET /api/v1/config", ConfigHandler(cfg, sched))
+
+	// API endpoint to reload the device configuration file
+	mux.HandleFunc("POST /api/v1/config/devices/reload", requireAPIToken(cfg.Server.APIToken, ReloadDevicesHandler(cfg, sched)))
+
+	// Build information
+	mux.HandleFunc("GET /version", VersionHandler())
+
+	// API endpoint to get application status
+	mux.HandleFunc("/", StatusHandler())
 
 	addr := ":3005" // You can make this configurable
 	log.Printf("API Server configured to listen on %s", addr)
@@ -60,13 +101,52 @@ func New(cfg *config.Config, sched *scheduler.Scheduler) *http.Server {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With", idempotencyKeyHeader, triggeredByHeader},
 		AllowCredentials: false,
 	})
-	handler := c.Handler(mux)
+	handler := c.Handler(limitRequestBody(cfg.Server.MaxBodyBytes, mux))
+	if cfg.Slack.VerifyRawBody {
+		handler = captureRawBody("/slack/events", cfg.Server.MaxBodyBytes, handler)
+	}
 
 	return &http.Server{
-		Addr:    addr,
-		Handler: handler,
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(cfg.Server.ReadTimeoutSecs) * time.Second,
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeoutSecs) * time.Second,
+		WriteTimeout:      time.Duration(cfg.Server.WriteTimeoutSecs) * time.Second,
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeoutSecs) * time.Second,
+	}
+}
+
+// StatusHandler creates an http.HandlerFunc returning the application status for "/".
+// It is registered as the catch-all route, so any other unmatched path gets 404.
+func StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		response := StatusResponse{
+			Environment: appEnv(),
+			Status:      "ok",
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// appEnv returns APP_ENV, or "development" when it is not set.
+func appEnv() string {
+	if env := os.Getenv("APP_ENV"); env != "" {
+		return env
 	}
+	return "development"
 }
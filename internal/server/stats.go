@@ -0,0 +1,20 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+)
+
+// StatsProvider reports the in-process job counters.
+type StatsProvider interface {
+	Stats() scheduler.RunStats
+}
+
+// StatsHandler creates an http.HandlerFunc returning the job counters kept since the controller
+// started: total, succeeded and failed runs, per device, and the uptime.
+func StatsHandler(stats StatsProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, stats.Stats())
+	}
+}
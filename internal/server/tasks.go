@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/scheduler"
+)
+
+// TaskFileResponse is the response body for the TaskFileHandler.
+type TaskFileResponse struct {
+	DeviceID       string `json:"deviceId"`
+	TaskID         string `json:"taskId"`
+	Path           string `json:"path"`
+	TimeoutMinutes int    `json:"timeoutMinutes,omitempty"` // as written in the file
+	Timeout        string `json:"timeout,omitempty"`        // effective timeout the scheduler waits
+	TimeoutNote    string `json:"timeoutNote,omitempty"`    // why the effective timeout differs from the file
+
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// TaskFileHandler creates an http.HandlerFunc that reads the task file for the device and task in the
+// path from tasksDir and returns it as the scheduler would run it, with limits applied to its timeout.
+// A missing file returns 404 and a malformed one 422, with the reason in the error field.
+func TaskFileHandler(tasksDir string, limits scheduler.TaskTimeoutLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceID, taskID := r.PathValue("deviceId"), r.PathValue("taskId")
+		if !isTaskFileSegment(deviceID) || !isTaskFileSegment(taskID) {
+			http.Error(w, "Invalid device or task ID", http.StatusBadRequest)
+			return
+		}
+
+		resp := TaskFileResponse{
+			DeviceID: deviceID,
+			TaskID:   taskID,
+			Path:     scheduler.TaskFilePath(tasksDir, deviceID, taskID),
+		}
+		taskDef, err := scheduler.ReadTaskDefinition(resp.Path)
+		if err != nil {
+			resp.Error = err.Error()
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				writeJSON(w, http.StatusNotFound, resp)
+			case errors.Is(err, scheduler.ErrInvalidTask):
+				writeJSON(w, http.StatusUnprocessableEntity, resp)
+			default:
+				log.Printf("[ERROR] Failed to read task file %s: %v", resp.Path, err)
+				writeJSON(w, http.StatusInternalServerError, resp)
+			}
+			return
+		}
+
+		effectiveMinutes, note := taskDef.EffectiveTimeoutMinutes(limits)
+		resp.TimeoutMinutes = taskDef.TimeoutMinutes
+		resp.Timeout = (time.Duration(effectiveMinutes) * time.Minute).String()
+		resp.TimeoutNote = note
+		resp.Payload = taskDef.Payload
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// isTaskFileSegment reports whether id can be used in a task file name without leaving the tasks directory.
+func isTaskFileSegment(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`) && !strings.Contains(id, "..")
+}
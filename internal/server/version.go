@@ -0,0 +1,36 @@
+package server
+
+import "net/http"
+
+// Build information, injected at build time, e.g.:
+//
+//	go build -ldflags "-X github.com/prite36/auto-irrigation-system/internal/server.Version=v1.2.0 \
+//	  -X github.com/prite36/auto-irrigation-system/internal/server.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/prite36/auto-irrigation-system/internal/server.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Builds without the flags report the defaults below.
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// VersionResponse is the response body for the VersionHandler.
+type VersionResponse struct {
+	Version     string `json:"version"`
+	Commit      string `json:"commit"`
+	BuildTime   string `json:"buildTime"`
+	Environment string `json:"environment"`
+}
+
+// VersionHandler creates an http.HandlerFunc returning the build information and APP_ENV.
+func VersionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, VersionResponse{
+			Version:     Version,
+			Commit:      Commit,
+			BuildTime:   BuildTime,
+			Environment: appEnv(),
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/config"
+	"github.com/prite36/auto-irrigation-system/internal/models"
+)
+
+// Timing controls how long the simulated devices take to respond to commands.
+// Delays longer than the scheduler's timeouts can be used to exercise its timeout handling.
+type Timing struct {
+	CalibrationDelay time.Duration // delay before a homing command reports calibration complete
+	StepDelay        time.Duration // delay between task steps
+}
+
+// Publisher sends a status payload on a topic. Retained messages are delivered to later subscribers.
+type Publisher func(topic, payload string, retained bool)
+
+// Simulator answers device commands with the status messages real hardware would publish.
+type Simulator struct {
+	devices map[string]config.DeviceConfig
+	timing  Timing
+	publish Publisher
+}
+
+// New creates a simulator for the given devices that publishes status through publish.
+func New(devices []config.DeviceConfig, timing Timing, publish Publisher) *Simulator {
+	byID := make(map[string]config.DeviceConfig, len(devices))
+	for _, device := range devices {
+		byID[device.ID] = device
+	}
+	return &Simulator{devices: byID, timing: timing, publish: publish}
+}
+
+// CommandTopics returns the command topic filters to subscribe to, one per device.
+func (s *Simulator) CommandTopics() []string {
+	topics := make([]string, 0, len(s.devices))
+	for id := range s.devices {
+		topics = append(topics, fmt.Sprintf("%s/cmd/#", id))
+	}
+	return topics
+}
+
+// Announce publishes the initial device state, such as a passing health check for devices that report one.
+func (s *Simulator) Announce() {
+	for id, device := range s.devices {
+		if device.Type == config.DeviceTypePlantPot || device.RequireHealthCheck {
+			s.publish(fmt.Sprintf("%s/status/health_check", id), "true", true)
+		}
+	}
+}
+
+// HandleCommand reacts to a command published on topic. The response is published asynchronously.
+func (s *Simulator) HandleCommand(topic string, payload []byte) {
+	deviceID, command, ok := strings.Cut(topic, "/cmd/")
+	if !ok {
+		return
+	}
+	device, known := s.devices[deviceID]
+	if !known {
+		log.Printf("Simulator: ignoring command for unknown device %s", deviceID)
+		return
+	}
+	if device.CommandFormat == config.CommandFormatJSON {
+		var envelope models.CommandEnvelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			log.Printf("Simulator: %s rejected malformed command envelope: %v", deviceID, err)
+			return
+		}
+		payload = envelope.Payload
+	}
+
+	log.Printf("Simulator: %s received %s: %s", deviceID, command, payload)
+	switch command {
+	case "sprinkler/home":
+		go s.calibrate(deviceID, "sprinkler")
+	case "valve/home":
+		go s.calibrate(deviceID, "valve")
+	case "task/set":
+		var steps []models.TaskStep
+		if err := json.Unmarshal(payload, &steps); err != nil {
+			log.Printf("Simulator: %s rejected malformed task payload: %v", deviceID, err)
+			return
+		}
+		go s.runTask(deviceID, payload, steps)
+	case "trigger_solenoid_valve", "health_check":
+		s.publish(fmt.Sprintf("%s/status/health_check", deviceID), "true", true)
+	default:
+		log.Printf("Simulator: %s has no handler for command %s", deviceID, command)
+	}
+}
+
+// calibrate homes the sprinkler or valve and reports completion.
+func (s *Simulator) calibrate(deviceID, part string) {
+	time.Sleep(s.timing.CalibrationDelay)
+	s.publish(fmt.Sprintf("%s/status/%s/position", deviceID, part), "0", false)
+	s.publish(fmt.Sprintf("%s/status/%s/calib_complete", deviceID, part), "true", false)
+}
+
+// runTask walks through the task steps, reporting progress, then signals completion.
+func (s *Simulator) runTask(deviceID string, payload []byte, steps []models.TaskStep) {
+	s.publish(fmt.Sprintf("%s/status/task/array", deviceID), string(payload), false)
+	s.publish(fmt.Sprintf("%s/status/task/current_count", deviceID), strconv.Itoa(len(steps)), false)
+	for i, step := range steps {
+		time.Sleep(s.timing.StepDelay)
+		s.publish(fmt.Sprintf("%s/status/task/current_index", deviceID), strconv.Itoa(i+1), false)
+		s.publish(fmt.Sprintf("%s/status/sprinkler/position", deviceID), strconv.FormatFloat(step.To, 'f', -1, 64), false)
+		s.publish(fmt.Sprintf("%s/status/valve/position", deviceID), strconv.FormatFloat(step.ValvePosition, 'f', -1, 64), false)
+	}
+	s.publish(fmt.Sprintf("%s/status/task/all_complete", deviceID), "true", false)
+}
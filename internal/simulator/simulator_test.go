@@ -0,0 +1,93 @@
+package simulator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/config"
+)
+
+// recorder collects published status messages.
+type recorder struct {
+	mu       sync.Mutex
+	messages map[string]string
+}
+
+func newRecorder() *recorder {
+	return &recorder{messages: make(map[string]string)}
+}
+
+func (r *recorder) publish(topic, payload string, retained bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages[topic] = payload
+}
+
+func (r *recorder) get(topic string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	payload, ok := r.messages[topic]
+	return payload, ok
+}
+
+// waitFor polls until topic has been published with payload or the deadline passes.
+func (r *recorder) waitFor(topic, payload string) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if got, ok := r.get(topic); ok && got == payload {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestHandleCommand(t *testing.T) {
+	devices := []config.DeviceConfig{
+		{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler},
+		{ID: "plant_pot_01", Type: config.DeviceTypePlantPot},
+	}
+	rec := newRecorder()
+	sim := New(devices, Timing{}, rec.publish)
+
+	sim.Announce()
+	if payload, _ := rec.get("plant_pot_01/status/health_check"); payload != "true" {
+		t.Errorf("Expected plant pot health check to be announced, got %q", payload)
+	}
+
+	sim.HandleCommand("sprinkler_01/cmd/sprinkler/home", []byte("1"))
+	if !rec.waitFor("sprinkler_01/status/sprinkler/calib_complete", "true") {
+		t.Error("Expected sprinkler calibration to complete")
+	}
+
+	sim.HandleCommand("sprinkler_01/cmd/task/set", []byte(`[{"fr": 0, "to": 90}, {"fr": 90, "to": 0}]`))
+	if !rec.waitFor("sprinkler_01/status/task/all_complete", "true") {
+		t.Fatal("Expected task to complete")
+	}
+	if payload, _ := rec.get("sprinkler_01/status/task/current_index"); payload != "2" {
+		t.Errorf("Expected final step index 2, got %q", payload)
+	}
+}
+
+func TestHandleCommandMalformedTaskNeverCompletes(t *testing.T) {
+	rec := newRecorder()
+	sim := New([]config.DeviceConfig{{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler}}, Timing{}, rec.publish)
+
+	sim.HandleCommand("sprinkler_01/cmd/task/set", []byte("not json"))
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := rec.get("sprinkler_01/status/task/all_complete"); ok {
+		t.Error("Expected malformed task to never report completion")
+	}
+}
+
+func TestHandleCommandUnwrapsJSONEnvelope(t *testing.T) {
+	rec := newRecorder()
+	device := config.DeviceConfig{ID: "sprinkler_01", Type: config.DeviceTypeSprinkler, CommandFormat: config.CommandFormatJSON}
+	sim := New([]config.DeviceConfig{device}, Timing{}, rec.publish)
+
+	sim.HandleCommand("sprinkler_01/cmd/task/set", []byte(`{"cmd":"set","ts":1700000000,"payload":[{"fr":0,"to":90}]}`))
+	if !rec.waitFor("sprinkler_01/status/task/all_complete", "true") {
+		t.Fatal("Expected enveloped task to complete")
+	}
+}
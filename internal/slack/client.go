@@ -1,32 +1,92 @@
 package slack
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/slack-go/slack"
 )
 
+// API is the subset of the Slack Web API used by the client.
+type API interface {
+	PostMessage(channelID string, options ...slack.MsgOption) (string, string, error)
+}
+
+// clock tells the client the current time, so tests can move past a rate limit backoff without waiting.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
 // Client wraps the slack client
 type Client struct {
-	api       *slack.Client
+	api       API
 	channelID string
-	rateLimitBackoff time.Duration
+	clock     clock
+	mu               sync.Mutex
+	rateLimitedUntil time.Time // end of the current rate limit backoff; zero when there is none
+	severityChannels map[Severity]string
+	plainText        bool // strip emoji and prefix titles with the severity
+	simpleText       bool // send plain text instead of Block Kit attachments
+	retryAttempts    int           // retries after a transient network or 5xx error
+	retryBackoff     time.Duration // wait before the first retry; doubled for each further retry
+	sleep            func(time.Duration)
+	suppressed         atomic.Int64 // messages dropped during the current rate limit backoff
+	suppressionSummary bool         // post how many messages were dropped once the backoff ends
+	inFlight           atomic.Int64 // messages being posted, including retries
+	invalidChannels    sync.Map     // channels Slack reported as not found; nothing more is posted to them
 }
 
+const (
+	defaultRetryAttempts = 2
+	defaultRetryBackoff  = 500 * time.Millisecond
+	// maxRetryBackoff caps each wait so a failing Slack never blocks the caller for long.
+	maxRetryBackoff = 5 * time.Second
+	// flushPollInterval is how often Flush checks for messages still being posted.
+	flushPollInterval = 10 * time.Millisecond
+)
+
 // NewClient creates a new slack client
 func NewClient(token, channelID string) *Client {
 	if token == "" || channelID == "" {
 		log.Println("Slack token or channel ID is not configured. Slack notifications will be disabled.")
 		return nil // Return nil if not configured
 	}
-	api := slack.New(token)
+	return NewClientWithAPI(slack.New(token), channelID)
+}
+
+// NewClientWithAPI creates a slack client that posts through the given API implementation.
+func NewClientWithAPI(api API, channelID string) *Client {
 	return &Client{
 		api:              api,
 		channelID:        channelID,
-		rateLimitBackoff: 0,
+		clock:            systemClock{},
+		retryAttempts:    defaultRetryAttempts,
+		retryBackoff:     defaultRetryBackoff,
+		sleep:            time.Sleep,
+		suppressionSummary: true,
+	}
+}
+
+// SetRetry configures how often a message is retried after a transient network or 5xx error,
+// and the wait before the first retry, which doubles for each further retry. 0 attempts disables retries.
+func (c *Client) SetRetry(attempts int, backoff time.Duration) {
+	if c == nil {
+		return
 	}
+	c.retryAttempts = attempts
+	c.retryBackoff = backoff
 }
 
 // SendMessage sends a simple text message, now wrapped as an info block.
@@ -34,33 +94,158 @@ func (c *Client) SendMessage(message string) {
 	if c == nil || c.api == nil {
 		return // Do nothing if client is not initialized
 	}
-	c.SendRichMessage(NewInfoMessage("Scheduler Notification", message))
+	msg := NewInfoMessage("Scheduler Notification", message)
+	c.SendRichMessageTo(c.channelFor(msg), c.render(msg))
+}
+
+// SetSuppressionSummary controls whether a summary of the messages dropped during a rate limit
+// backoff is posted, with the first message sent after it ends. It is enabled by default.
+func (c *Client) SetSuppressionSummary(enabled bool) {
+	if c == nil {
+		return
+	}
+	c.suppressionSummary = enabled
+}
+
+// SetPlainText strips emoji from messages and prefixes their titles with [INFO], [OK], [WARN] or [ERROR].
+func (c *Client) SetPlainText(enabled bool) {
+	if c == nil {
+		return
+	}
+	c.plainText = enabled
+}
+
+// SetSimpleText sends messages as plain text instead of rich attachments.
+func (c *Client) SetSimpleText(enabled bool) {
+	if c == nil {
+		return
+	}
+	c.simpleText = enabled
+}
+
+// render formats msg according to the client's plain and simple text settings.
+func (c *Client) render(msg Message) slack.MsgOption {
+	if c.plainText {
+		msg = msg.Plain()
+	}
+	option := msg.Option()
+	if c.simpleText {
+		option = msg.TextOption()
+	}
+	if msg.ThreadTS != "" {
+		return slack.MsgOptionCompose(option, slack.MsgOptionTS(msg.ThreadTS))
+	}
+	return option
+}
+
+// SetSeverityChannel routes messages of the given severity to channelID instead of the default channel.
+func (c *Client) SetSeverityChannel(severity Severity, channelID string) {
+	if c == nil || channelID == "" {
+		return
+	}
+	if c.severityChannels == nil {
+		c.severityChannels = make(map[Severity]string)
+	}
+	c.severityChannels[severity] = channelID
+}
+
+// channelFor picks the channel for msg: its own channel, then the severity channel, then the default.
+func (c *Client) channelFor(msg Message) string {
+	if msg.Channel != "" {
+		return msg.Channel
+	}
+	if channelID, ok := c.severityChannels[msg.Severity]; ok {
+		return channelID
+	}
+	return c.channelID
 }
 
 // SendRichMessage sends a message using block kit options with rate limit handling.
 func (c *Client) SendRichMessage(options slack.MsgOption) {
+	c.SendRichMessageTo("", options)
+}
+
+// SendRichMessageTo sends a rich message to channelID, or to the default channel when empty.
+func (c *Client) SendRichMessageTo(channelID string, options slack.MsgOption) {
+	c.post(channelID, options)
+}
+
+// post sends a rich message to channelID, or to the default channel when empty, and returns the
+// channel and timestamp Slack reports for it. Both are empty when the message was not posted.
+func (c *Client) post(channelID string, options slack.MsgOption) (string, string) {
 	if c == nil || c.api == nil {
-		return // Do nothing if client is not initialized
+		return "", "" // Do nothing if client is not initialized
+	}
+	if channelID == "" {
+		channelID = c.channelID
+	}
+	if c.channelDisabled(channelID) {
+		return "", ""
 	}
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
 
 	// Check if we're in a backoff period
-	if c.rateLimitBackoff > 0 {
-		if time.Now().Before(time.Now().Add(-c.rateLimitBackoff)) {
-			log.Printf("Skipping Slack message due to rate limit backoff (remaining: %v)", c.rateLimitBackoff)
-			return
-		}
-		// Reset backoff if enough time has passed
-		c.rateLimitBackoff = 0
+	if remaining := c.backoffRemaining(); remaining > 0 {
+		log.Printf("Skipping Slack message due to rate limit backoff (remaining: %v)", remaining)
+		c.suppressed.Add(1)
+		return "", ""
 	}
+	c.endExpiredBackoff()
 
-	_, _, err := c.api.PostMessage(c.channelID, options)
+	postedChannel, ts, err := c.api.PostMessage(channelID, options)
+	backoff := c.retryBackoff
+	for attempt := 1; err != nil && attempt <= c.retryAttempts && isTransientError(err); attempt++ {
+		wait := min(backoff, maxRetryBackoff)
+		log.Printf("Transient error sending Slack message (%v). Retrying in %v (attempt %d of %d).", err, wait, attempt, c.retryAttempts)
+		c.sleep(wait)
+		backoff *= 2
+		postedChannel, ts, err = c.api.PostMessage(channelID, options)
+	}
 	if err != nil {
 		if c.isRateLimitError(err) {
 			c.handleRateLimit(err)
+		} else if isChannelNotFoundError(err) {
+			c.disableChannel(channelID, err)
 		} else {
 			log.Printf("Failed to send rich Slack message: %v", err)
 		}
+		return "", ""
+	}
+	return postedChannel, ts
+}
+
+// Flush waits for messages still being posted, including their retries, so notifications sent
+// from background jobs are not lost on shutdown. It returns an error wrapping ctx.Err() when they
+// have not all been posted before ctx is done.
+func (c *Client) Flush(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for c.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d Slack notifications still in flight: %w", c.inFlight.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// isTransientError reports whether err is a network failure or a Slack server error that may
+// succeed on retry. Slack API errors such as invalid_auth or channel_not_found are permanent.
+func isTransientError(err error) bool {
+	var statusErr slack.StatusCodeError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
 	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
 }
 
 // isRateLimitError checks if the error is related to rate limiting
@@ -71,6 +256,40 @@ func (c *Client) isRateLimitError(err error) bool {
 		   strings.Contains(errStr, "too_many_requests")
 }
 
+// isChannelNotFoundError reports whether Slack rejected a message because its channel does not exist
+// or the bot cannot see it. Retrying such a message never succeeds.
+func isChannelNotFoundError(err error) bool {
+	var slackErr slack.SlackErrorResponse
+	if errors.As(err, &slackErr) {
+		return slackErr.Err == "channel_not_found"
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "channel_not_found")
+}
+
+// disableChannel stops posting to a channel Slack reported as not found, with a single warning.
+// When it is the default channel, the client stops posting altogether.
+func (c *Client) disableChannel(channelID string, err error) {
+	if _, loaded := c.invalidChannels.LoadOrStore(channelID, struct{}{}); loaded {
+		return
+	}
+	if channelID == c.channelID {
+		log.Printf("WARNING: Slack channel %s (SLACK_CHANNEL_ID) was not found: %v. Slack notifications are disabled; fix the channel ID, invite the bot to the channel and restart.", channelID, err)
+		return
+	}
+	log.Printf("WARNING: Slack channel %s was not found: %v. Messages for it are no longer sent; check SLACK_ALERTS_CHANNEL_ID and the device slackChannelId settings.", channelID, err)
+}
+
+// channelDisabled reports whether posts to channelID are skipped because Slack reported it, or the
+// default channel, as not found.
+func (c *Client) channelDisabled(channelID string) bool {
+	for _, id := range []string{channelID, c.channelID} {
+		if _, ok := c.invalidChannels.Load(id); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // handleRateLimit implements exponential backoff for rate limit errors
 func (c *Client) handleRateLimit(err error) {
 	// Start with 1 minute backoff, can be extended based on error type
@@ -82,15 +301,68 @@ func (c *Client) handleRateLimit(err error) {
 		backoffDuration = 5 * time.Minute
 	}
 	
-	c.rateLimitBackoff = backoffDuration
+	c.mu.Lock()
+	c.rateLimitedUntil = c.now().Add(backoffDuration)
+	c.mu.Unlock()
 	log.Printf("Slack rate limit detected (%v). Messages will be suppressed for %v", err, backoffDuration)
-	
-	// Schedule backoff reset
-	go func() {
-		time.Sleep(backoffDuration)
-		c.rateLimitBackoff = 0
+}
+
+// now returns the current time from the client's clock.
+func (c *Client) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// backoffRemaining returns how long the current rate limit backoff lasts, or 0 when there is none.
+func (c *Client) backoffRemaining() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rateLimitedUntil.IsZero() {
+		return 0
+	}
+	return max(c.rateLimitedUntil.Sub(c.now()), 0)
+}
+
+// endExpiredBackoff ends a rate limit backoff that has run out. It is called before each post, so
+// the suppression summary goes out with the first message after the backoff.
+func (c *Client) endExpiredBackoff() {
+	c.mu.Lock()
+	expired := !c.rateLimitedUntil.IsZero() && !c.now().Before(c.rateLimitedUntil)
+	c.mu.Unlock()
+	if expired {
+		c.endBackoff()
+	}
+}
+
+// endBackoff clears the rate limit backoff and, when messages were dropped during it,
+// posts a single summary so the channel knows there is a gap.
+func (c *Client) endBackoff() {
+	c.mu.Lock()
+	ended := !c.rateLimitedUntil.IsZero()
+	c.rateLimitedUntil = time.Time{}
+	c.mu.Unlock()
+	if ended {
 		log.Println("Slack rate limit backoff period ended. Messages will resume.")
-	}()
+	}
+
+	suppressed := c.suppressed.Swap(0)
+	if suppressed == 0 || !c.suppressionSummary {
+		return
+	}
+	noun := "notifications"
+	if suppressed == 1 {
+		noun = "notification"
+	}
+	msg := NewWarningMessage("⚠️ Slack Notifications Resumed", fmt.Sprintf("Suppressed %d %s during rate limit.", suppressed, noun))
+	c.SendRichMessageTo(c.channelFor(msg), c.render(msg))
+}
+
+// suppress counts a message dropped because of the rate limit backoff and reports false.
+func (c *Client) suppress() bool {
+	c.suppressed.Add(1)
+	return false
 }
 
 // IsRateLimited returns true if the client is currently in a rate limit backoff period
@@ -98,12 +370,18 @@ func (c *Client) IsRateLimited() bool {
 	if c == nil {
 		return false
 	}
-	return c.rateLimitBackoff > 0
+	return c.backoffRemaining() > 0
 }
 
 // SendMessageSafe sends a message only if not rate limited, returns true if sent
 func (c *Client) SendMessageSafe(message string) bool {
-	if c == nil || c.IsRateLimited() {
+	if c == nil {
+		return false
+	}
+	if c.IsRateLimited() {
+		return c.suppress()
+	}
+	if c.channelDisabled(c.channelID) {
 		return false
 	}
 	c.SendMessage(message)
@@ -112,9 +390,46 @@ func (c *Client) SendMessageSafe(message string) bool {
 
 // SendRichMessageSafe sends a rich message only if not rate limited, returns true if sent
 func (c *Client) SendRichMessageSafe(options slack.MsgOption) bool {
-	if c == nil || c.IsRateLimited() {
+	if c == nil {
+		return false
+	}
+	if c.IsRateLimited() {
+		return c.suppress()
+	}
+	if c.channelDisabled(c.channelID) {
 		return false
 	}
 	c.SendRichMessage(options)
 	return true
-}
\ No newline at end of file
+}
+
+// Send sends msg to its routed channel only if not rate limited and the channel was not reported
+// as not found, returns true if sent
+func (c *Client) Send(msg Message) bool {
+	if c == nil {
+		return false
+	}
+	if c.IsRateLimited() {
+		return c.suppress()
+	}
+	channelID := c.channelFor(msg)
+	if c.channelDisabled(channelID) {
+		return false
+	}
+	c.SendRichMessageTo(channelID, c.render(msg))
+	return true
+}
+
+// StartThread sends msg like Send and returns the channel and timestamp of the posted message,
+// so later messages can reply in its thread by setting Channel and ThreadTS. The timestamp is
+// empty when the message was not posted, e.g. during a rate limit backoff.
+func (c *Client) StartThread(msg Message) (string, string) {
+	if c == nil {
+		return "", ""
+	}
+	if c.IsRateLimited() {
+		c.suppress()
+		return "", ""
+	}
+	return c.post(c.channelFor(msg), c.render(msg))
+}
@@ -1,9 +1,17 @@
 package slack
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/slack-go/slack"
 )
 
 func TestIsRateLimitError(t *testing.T) {
@@ -51,29 +59,44 @@ func TestIsRateLimitError(t *testing.T) {
 	}
 }
 
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time { return f.now }
+
+func (f *fakeClock) advance(d time.Duration) { f.now = f.now.Add(d) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 6, 1, 6, 0, 0, 0, time.UTC)}
+}
+
 func TestHandleRateLimit(t *testing.T) {
-	client := &Client{}
+	clock := newFakeClock()
+	client := &Client{clock: clock}
 	
 	// Test message_limit_exceeded gets longer backoff
 	err := errors.New("message_limit_exceeded")
 	client.handleRateLimit(err)
 	
-	if client.rateLimitBackoff != 5*time.Minute {
-		t.Errorf("Expected 5 minute backoff for message_limit_exceeded, got %v", client.rateLimitBackoff)
+	if remaining := client.backoffRemaining(); remaining != 5*time.Minute {
+		t.Errorf("Expected 5 minute backoff for message_limit_exceeded, got %v", remaining)
 	}
 	
 	// Test other rate limit errors get shorter backoff
-	client.rateLimitBackoff = 0
+	client.endBackoff()
 	err = errors.New("rate_limited")
 	client.handleRateLimit(err)
 	
-	if client.rateLimitBackoff != 1*time.Minute {
-		t.Errorf("Expected 1 minute backoff for rate_limited, got %v", client.rateLimitBackoff)
+	if remaining := client.backoffRemaining(); remaining != 1*time.Minute {
+		t.Errorf("Expected 1 minute backoff for rate_limited, got %v", remaining)
 	}
 }
 
 func TestIsRateLimited(t *testing.T) {
-	client := &Client{}
+	clock := newFakeClock()
+	client := &Client{clock: clock}
 	
 	// Initially not rate limited
 	if client.IsRateLimited() {
@@ -81,14 +104,405 @@ func TestIsRateLimited(t *testing.T) {
 	}
 	
 	// Set backoff
-	client.rateLimitBackoff = 1 * time.Minute
+	client.handleRateLimit(errors.New("rate_limited"))
 	if !client.IsRateLimited() {
 		t.Error("Expected client to be rate limited after setting backoff")
 	}
+
+	// Still limited just before the backoff ends
+	clock.advance(time.Minute - time.Second)
+	if !client.IsRateLimited() {
+		t.Error("Expected client to be rate limited until the backoff ends")
+	}
 	
-	// Clear backoff
-	client.rateLimitBackoff = 0
+	// Backoff over
+	clock.advance(time.Second)
 	if client.IsRateLimited() {
-		t.Error("Expected client to not be rate limited after clearing backoff")
+		t.Error("Expected client to not be rate limited once the backoff ends")
+	}
+}
+
+func TestSendResumesAfterBackoff(t *testing.T) {
+	api := &recordingAPI{}
+	clock := newFakeClock()
+	client := NewClientWithAPI(api, "C_DEFAULT")
+	client.clock = clock
+	client.SetSimpleText(true)
+	client.handleRateLimit(errors.New("rate_limited"))
+
+	if client.Send(NewInfoMessage("dropped", "")) || len(api.options) != 0 {
+		t.Fatalf("Expected the message to be suppressed during backoff, got %d posts", len(api.options))
+	}
+
+	clock.advance(time.Minute)
+	if !client.Send(NewInfoMessage("hello", "")) {
+		t.Fatal("Expected the message to be sent once the clock passes the backoff")
+	}
+	if len(api.options) != 2 {
+		t.Fatalf("Expected the suppression summary and the message, got %d posts", len(api.options))
+	}
+	var texts []string
+	for _, options := range api.options {
+		_, values, err := slack.UnsafeApplyMsgOptions("", "C_DEFAULT", "", options...)
+		if err != nil {
+			t.Fatalf("Failed to apply message options: %v", err)
+		}
+		texts = append(texts, values.Get("text"))
+	}
+	if !strings.Contains(texts[0], "Suppressed 1 notification during rate limit.") || !strings.Contains(texts[1], "hello") {
+		t.Errorf("Expected the summary before the message, got %q", texts)
+	}
+}
+type recordingAPI struct {
+	channels []string
+	options  [][]slack.MsgOption
+}
+
+func (r *recordingAPI) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	r.channels = append(r.channels, channelID)
+	r.options = append(r.options, options)
+	return channelID, fmt.Sprintf("1700000000.%06d", len(r.channels)), nil
+}
+
+// threadTS returns the thread_ts the i-th posted message was sent with.
+func (r *recordingAPI) threadTS(t *testing.T, i int) string {
+	_, values, err := slack.UnsafeApplyMsgOptions("", r.channels[i], "", r.options[i]...)
+	if err != nil {
+		t.Fatalf("Failed to apply message options: %v", err)
+	}
+	return values.Get("thread_ts")
+}
+
+func TestStartThreadRepliesCarryThreadTimestamp(t *testing.T) {
+	for _, simpleText := range []bool{false, true} {
+		api := &recordingAPI{}
+		client := NewClientWithAPI(api, "C_DEFAULT")
+		client.SetSeverityChannel(SeverityError, "C_ALERTS")
+		client.SetSimpleText(simpleText)
+
+		channel, ts := client.StartThread(NewInfoMessage("Job Started", ""))
+		if channel != "C_DEFAULT" || ts != "1700000000.000001" {
+			t.Fatalf("Expected the parent in C_DEFAULT at 1700000000.000001, got %s at %q", channel, ts)
+		}
+		reply := NewErrorMessage("Task Timeout", "")
+		reply.Channel = channel
+		reply.ThreadTS = ts
+		client.Send(reply)
+
+		if got := api.threadTS(t, 0); got != "" {
+			t.Errorf("Expected the parent to be top-level, got thread %q", got)
+		}
+		if got := api.threadTS(t, 1); got != ts || api.channels[1] != "C_DEFAULT" {
+			t.Errorf("Expected the reply in thread %s of C_DEFAULT (simple text %v), got thread %q in %s", ts, simpleText, got, api.channels[1])
+		}
+	}
+}
+
+func TestStartThreadWhileRateLimited(t *testing.T) {
+	api := &recordingAPI{}
+	client := NewClientWithAPI(api, "C_DEFAULT")
+	client.handleRateLimit(errors.New("rate_limited"))
+
+	if _, ts := client.StartThread(NewInfoMessage("Job Started", "")); ts != "" || len(api.channels) != 0 {
+		t.Errorf("Expected no thread while rate limited, got %q after %d posts", ts, len(api.channels))
+	}
+}
+
+func TestSendRoutesByChannelOverride(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      Message
+		expected string
+	}{
+		{name: "error goes to alerts", msg: NewErrorMessage("boom", ""), expected: "C_ALERTS"},
+		{name: "info goes to default", msg: NewInfoMessage("hello", ""), expected: "C_DEFAULT"},
+		{name: "success goes to default", msg: NewSuccessMessage("done", ""), expected: "C_DEFAULT"},
+		{name: "message channel wins", msg: Message{Severity: SeverityError, Title: "boom", Channel: "C_DEVICE"}, expected: "C_DEVICE"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &recordingAPI{}
+			client := NewClientWithAPI(api, "C_DEFAULT")
+			client.SetSeverityChannel(SeverityError, "C_ALERTS")
+
+			if !client.Send(tc.msg) {
+				t.Fatal("Expected message to be sent")
+			}
+			if len(api.channels) != 1 || api.channels[0] != tc.expected {
+				t.Errorf("Expected post to %s, got %v", tc.expected, api.channels)
+			}
+		})
+	}
+}
+
+func TestSetSeverityChannelIgnoresEmptyChannel(t *testing.T) {
+	api := &recordingAPI{}
+	client := NewClientWithAPI(api, "C_DEFAULT")
+	client.SetSeverityChannel(SeverityError, "")
+
+	client.Send(NewErrorMessage("boom", ""))
+	if len(api.channels) != 1 || api.channels[0] != "C_DEFAULT" {
+		t.Errorf("Expected post to C_DEFAULT, got %v", api.channels)
+	}
+}
+
+// flakyAPI fails with the queued errors before succeeding.
+type flakyAPI struct {
+	errs  []error
+	calls int
+}
+
+func (f *flakyAPI) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return "", "", err
+	}
+	return channelID, "", nil
+}
+
+func TestSendRichMessageRetriesTransientErrors(t *testing.T) {
+	testCases := []struct {
+		name          string
+		errs          []error
+		expectedCalls int
+		expectedWaits []time.Duration
+	}{
+		{
+			name:          "network error then success",
+			errs:          []error{&net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			expectedCalls: 2,
+			expectedWaits: []time.Duration{100 * time.Millisecond},
+		},
+		{
+			name:          "server errors exhaust retries",
+			errs:          []error{slack.StatusCodeError{Code: 503}, slack.StatusCodeError{Code: 502}, slack.StatusCodeError{Code: 500}},
+			expectedCalls: 3,
+			expectedWaits: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			name:          "invalid auth is permanent",
+			errs:          []error{slack.SlackErrorResponse{Err: "invalid_auth"}},
+			expectedCalls: 1,
+		},
+		{
+			name:          "client error is permanent",
+			errs:          []error{slack.StatusCodeError{Code: 404}},
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &flakyAPI{errs: tc.errs}
+			client := NewClientWithAPI(api, "C_DEFAULT")
+			client.SetRetry(2, 100*time.Millisecond)
+			var waits []time.Duration
+			client.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+			client.Send(NewInfoMessage("hello", ""))
+			if api.calls != tc.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", tc.expectedCalls, api.calls)
+			}
+			if len(waits) != len(tc.expectedWaits) {
+				t.Fatalf("Expected waits %v, got %v", tc.expectedWaits, waits)
+			}
+			for i := range waits {
+				if waits[i] != tc.expectedWaits[i] {
+					t.Errorf("Expected waits %v, got %v", tc.expectedWaits, waits)
+				}
+			}
+		})
+	}
+}
+
+func TestSendRichMessageCapsRetryBackoff(t *testing.T) {
+	api := &flakyAPI{errs: []error{slack.StatusCodeError{Code: 500}}}
+	client := NewClientWithAPI(api, "C_DEFAULT")
+	client.SetRetry(1, time.Minute)
+	var waits []time.Duration
+	client.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	client.Send(NewInfoMessage("hello", ""))
+	if len(waits) != 1 || waits[0] != maxRetryBackoff {
+		t.Errorf("Expected a single wait of %v, got %v", maxRetryBackoff, waits)
+	}
+}
+
+func TestEndBackoffPostsSuppressionSummary(t *testing.T) {
+	testCases := []struct {
+		name       string
+		suppressed int
+		disabled   bool
+		expected   string // empty when no summary should be posted
+	}{
+		{name: "nothing suppressed", suppressed: 0},
+		{name: "one suppressed", suppressed: 1, expected: "Suppressed 1 notification during rate limit."},
+		{name: "several suppressed", suppressed: 3, expected: "Suppressed 3 notifications during rate limit."},
+		{name: "summary disabled", suppressed: 3, disabled: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &recordingAPI{}
+			client := NewClientWithAPI(api, "C_DEFAULT")
+			client.SetSimpleText(true)
+			client.SetSuppressionSummary(!tc.disabled)
+			client.handleRateLimit(errors.New("rate_limited"))
+
+			for i := 0; i < tc.suppressed; i++ {
+				if client.Send(NewInfoMessage("hello", "")) {
+					t.Fatal("Expected the message to be suppressed during backoff")
+				}
+			}
+			client.endBackoff()
+
+			if client.IsRateLimited() {
+				t.Error("Expected the backoff to be cleared")
+			}
+			if tc.expected == "" {
+				if len(api.options) != 0 {
+					t.Errorf("Expected no summary, got %d posts", len(api.options))
+				}
+				return
+			}
+			if len(api.options) != 1 {
+				t.Fatalf("Expected a single summary, got %d posts", len(api.options))
+			}
+			_, values, err := slack.UnsafeApplyMsgOptions("", "C_DEFAULT", "", api.options[0]...)
+			if err != nil {
+				t.Fatalf("Failed to apply message options: %v", err)
+			}
+			if text := values.Get("text"); !strings.Contains(text, tc.expected) {
+				t.Errorf("Expected the summary to contain %q, got %q", tc.expected, text)
+			}
+
+			// The count starts over for the next backoff.
+			client.endBackoff()
+			if len(api.options) != 1 {
+				t.Errorf("Expected no second summary, got %d posts", len(api.options))
+			}
+		})
+	}
+}
+
+// blockingAPI holds each post until release is closed, like a slow Slack API.
+type blockingAPI struct {
+	release   chan struct{}
+	delivered atomic.Int32
+}
+
+func (b *blockingAPI) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	<-b.release
+	b.delivered.Add(1)
+	return channelID, "1700000000.000001", nil
+}
+
+func TestFlushDeliversInFlightMessages(t *testing.T) {
+	api := &blockingAPI{release: make(chan struct{})}
+	client := NewClientWithAPI(api, "C123")
+	for i := 0; i < 3; i++ {
+		go client.Send(NewInfoMessage(fmt.Sprintf("Job %d", i), ""))
+	}
+	for client.inFlight.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	flushed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		flushed <- client.Flush(ctx)
+	}()
+	select {
+	case err := <-flushed:
+		t.Fatalf("Expected Flush to wait for messages in flight, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(api.release)
+	if err := <-flushed; err != nil {
+		t.Fatalf("Expected Flush to succeed, got %v", err)
+	}
+	if delivered := api.delivered.Load(); delivered != 3 {
+		t.Errorf("Expected 3 delivered messages, got %d", delivered)
+	}
+}
+
+func TestFlushGivesUpAtDeadline(t *testing.T) {
+	api := &blockingAPI{release: make(chan struct{})}
+	defer close(api.release)
+	client := NewClientWithAPI(api, "C123")
+	go client.Send(NewInfoMessage("Job", ""))
+	for client.inFlight.Load() < 1 {
+		time.Sleep(time.Millisecond)
 	}
-}
\ No newline at end of file
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+// channelNotFoundAPI fails posts to the listed channels with channel_not_found, like Slack does
+// for a wrong channel ID, and records the channel of every attempt.
+type channelNotFoundAPI struct {
+	missing  map[string]bool
+	attempts []string
+}
+
+func (a *channelNotFoundAPI) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	a.attempts = append(a.attempts, channelID)
+	if a.missing[channelID] {
+		return "", "", slack.SlackErrorResponse{Err: "channel_not_found"}
+	}
+	return channelID, "1700000000.000001", nil
+}
+
+func TestChannelNotFoundStopsSends(t *testing.T) {
+	testCases := []struct {
+		name             string
+		missing          string
+		expectedAttempts []string
+		expectedSent     []bool // Send results for info, error, error and info messages
+	}{
+		{
+			name:             "default channel disables the client",
+			missing:          "C_DEFAULT",
+			expectedAttempts: []string{"C_DEFAULT"},
+			expectedSent:     []bool{true, false, false, false},
+		},
+		{
+			name:             "alerts channel only stops alerts",
+			missing:          "C_ALERTS",
+			expectedAttempts: []string{"C_DEFAULT", "C_ALERTS", "C_DEFAULT"},
+			expectedSent:     []bool{true, true, false, true},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &channelNotFoundAPI{missing: map[string]bool{tc.missing: true}}
+			client := NewClientWithAPI(api, "C_DEFAULT")
+			client.SetSeverityChannel(SeverityError, "C_ALERTS")
+			client.SetRetry(2, time.Millisecond)
+
+			sent := []bool{
+				client.Send(NewInfoMessage("first", "")),
+				client.Send(NewErrorMessage("alert", "")),
+				client.Send(NewErrorMessage("another alert", "")),
+				client.Send(NewInfoMessage("second", "")),
+			}
+
+			if !slices.Equal(sent, tc.expectedSent) {
+				t.Errorf("Expected Send results %v, got %v", tc.expectedSent, sent)
+			}
+			if !slices.Equal(api.attempts, tc.expectedAttempts) {
+				t.Errorf("Expected attempts %v, got %v", tc.expectedAttempts, api.attempts)
+			}
+		})
+	}
+}
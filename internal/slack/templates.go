@@ -3,7 +3,9 @@ package slack
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/slack-go/slack"
 )
@@ -15,6 +17,86 @@ const (
 	ColorInfo    = "#2962ff"
 )
 
+// Severity classifies a notification. It selects the message color and can route it to a channel.
+type Severity string
+
+const (
+	SeverityInfo    Severity = "info"
+	SeveritySuccess Severity = "success"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Message is a notification that is rendered into a rich Slack message when sent.
+type Message struct {
+	Severity Severity
+	Title    string
+	Details  string
+	Channel  string // overrides the channel chosen by the client when set
+	ThreadTS string // posts the message as a reply in the thread of this parent message when set
+}
+
+// Option renders the message as a Slack message option.
+func (m Message) Option() slack.MsgOption {
+	return createMessageBlock(m.color(), m.Title, m.Details)
+}
+
+// TextOption renders the message as plain text without attachments, for clients that don't show rich formatting.
+func (m Message) TextOption() slack.MsgOption {
+	text := m.Title
+	if m.Details != "" {
+		text += "\n" + m.Details
+	}
+	return slack.MsgOptionText(text, false)
+}
+
+// Plain returns the message with emoji removed and the title prefixed with its severity, e.g. "[ERROR] Task Timeout".
+func (m Message) Plain() Message {
+	m.Title = m.prefix() + " " + stripEmoji(m.Title)
+	m.Details = stripEmoji(m.Details)
+	return m
+}
+
+func (m Message) prefix() string {
+	switch m.Severity {
+	case SeverityError:
+		return "[ERROR]"
+	case SeverityWarning:
+		return "[WARN]"
+	case SeveritySuccess:
+		return "[OK]"
+	default:
+		return "[INFO]"
+	}
+}
+
+// stripEmoji removes pictographic symbols and the joiners and variation selectors that combine them.
+func stripEmoji(s string) string {
+	stripped := strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u200d', r == '\ufe0f':
+			return -1
+		case r >= 0x2190 && unicode.Is(unicode.So, r):
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(stripped), " ")
+}
+
+func (m Message) color() string {
+	switch m.Severity {
+	case SeverityError:
+		return ColorDanger
+	case SeverityWarning:
+		return ColorWarning
+	case SeveritySuccess:
+		return ColorGood
+	default:
+		return ColorInfo
+	}
+}
+
 // createMessageBlock generates a rich message block for Slack.
 func createMessageBlock(color, title, details string) slack.MsgOption {
 	return slack.MsgOptionAttachments(slack.Attachment{
@@ -29,16 +111,21 @@ func createMessageBlock(color, title, details string) slack.MsgOption {
 }
 
 // NewErrorMessage creates a new error message block.
-func NewErrorMessage(title, details string) slack.MsgOption {
-	return createMessageBlock(ColorDanger, title, details)
+func NewErrorMessage(title, details string) Message {
+	return Message{Severity: SeverityError, Title: title, Details: details}
 }
 
 // NewSuccessMessage creates a new success message block.
-func NewSuccessMessage(title, details string) slack.MsgOption {
-	return createMessageBlock(ColorGood, title, details)
+func NewSuccessMessage(title, details string) Message {
+	return Message{Severity: SeveritySuccess, Title: title, Details: details}
+}
+
+// NewWarningMessage creates a new warning message block.
+func NewWarningMessage(title, details string) Message {
+	return Message{Severity: SeverityWarning, Title: title, Details: details}
 }
 
 // NewInfoMessage creates a new info message block.
-func NewInfoMessage(title, details string) slack.MsgOption {
-	return createMessageBlock(ColorInfo, title, details)
+func NewInfoMessage(title, details string) Message {
+	return Message{Severity: SeverityInfo, Title: title, Details: details}
 }
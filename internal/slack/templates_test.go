@@ -0,0 +1,88 @@
+package slack
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/slack-go/slack"
+)
+
+func TestPlainMessageTitles(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      Message
+		expected string
+	}{
+		{name: "error", msg: NewErrorMessage("🚨 Task Timeout", ""), expected: "[ERROR] Task Timeout"},
+		{name: "success", msg: NewSuccessMessage("✅ Sprinkler Job Completed: sprinkler_01", ""), expected: "[OK] Sprinkler Job Completed: sprinkler_01"},
+		{name: "warning with variation selector", msg: NewWarningMessage("⚠️ Unknown Device Type: x", ""), expected: "[WARN] Unknown Device Type: x"},
+		{name: "info", msg: NewInfoMessage("🌧️ Watering Skipped: sprinkler_01", ""), expected: "[INFO] Watering Skipped: sprinkler_01"},
+		{name: "no emoji", msg: NewInfoMessage("Scheduler Notification", ""), expected: "[INFO] Scheduler Notification"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			plain := tc.msg.Plain()
+			if plain.Title != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, plain.Title)
+			}
+			for _, r := range plain.Title {
+				if r > unicode.MaxASCII {
+					t.Errorf("Expected an emoji-free title, got %q", plain.Title)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestPlainMessageKeepsNonEmojiSymbols(t *testing.T) {
+	msg := NewInfoMessage("Soil 24°C", "✔️ Task 1/2 — done").Plain()
+	if msg.Title != "[INFO] Soil 24°C" {
+		t.Errorf("Expected degree sign to be kept, got %q", msg.Title)
+	}
+	if msg.Details != "Task 1/2 — done" {
+		t.Errorf("Expected emoji-free details, got %q", msg.Details)
+	}
+}
+
+func TestClientRendersConfiguredFormat(t *testing.T) {
+	testCases := []struct {
+		name        string
+		plainText   bool
+		simpleText  bool
+		wantText    string
+		attachments bool
+	}{
+		{name: "rich by default", attachments: true},
+		{name: "plain attachments", plainText: true, attachments: true},
+		{name: "simple text keeps emoji", simpleText: true, wantText: "🚨 Task Timeout\nstuck"},
+		{name: "plain simple text", plainText: true, simpleText: true, wantText: "[ERROR] Task Timeout\nstuck"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewClientWithAPI(&recordingAPI{}, "C_DEFAULT")
+			client.SetPlainText(tc.plainText)
+			client.SetSimpleText(tc.simpleText)
+
+			_, values, err := slack.UnsafeApplyMsgOptions("", "C_DEFAULT", "", client.render(NewErrorMessage("🚨 Task Timeout", "stuck")))
+			if err != nil {
+				t.Fatalf("Failed to apply message options: %v", err)
+			}
+			if got := values.Get("attachments") != ""; got != tc.attachments {
+				t.Errorf("Expected attachments %v, got %v", tc.attachments, got)
+			}
+			if tc.attachments {
+				if isPlain := strings.Contains(values.Get("attachments"), "[ERROR] Task Timeout"); isPlain != tc.plainText {
+					t.Errorf("Expected plain text %v, got attachments %s", tc.plainText, values.Get("attachments"))
+				}
+				return
+			}
+			if got := values.Get("text"); got != tc.wantText {
+				t.Errorf("Expected text %q, got %q", tc.wantText, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prite36/auto-irrigation-system/internal/config"
+)
+
+// Provider reports the forecast probability of precipitation, in percent (0-100).
+type Provider interface {
+	PrecipitationProbability(ctx context.Context) (float64, error)
+}
+
+// forecastResponse is the JSON body expected from the weather endpoint.
+type forecastResponse struct {
+	PrecipitationProbability float64 `json:"precipitation_probability"`
+}
+
+// HTTPProvider queries a configurable HTTP weather endpoint for the forecast.
+type HTTPProvider struct {
+	endpoint   string
+	apiKey     string
+	latitude   float64
+	longitude  float64
+	httpClient *http.Client
+}
+
+// NewHTTPProvider creates a weather provider for the configured endpoint and location.
+func NewHTTPProvider(cfg config.WeatherConfig) *HTTPProvider {
+	return &HTTPProvider{
+		endpoint:   cfg.Endpoint,
+		apiKey:     cfg.APIKey,
+		latitude:   cfg.Latitude,
+		longitude:  cfg.Longitude,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PrecipitationProbability calls the endpoint with lat, lon and apikey query parameters
+// and expects a JSON body of the form {"precipitation_probability": 80}.
+func (p *HTTPProvider) PrecipitationProbability(ctx context.Context) (float64, error) {
+	u, err := url.Parse(p.endpoint)
+	if err != nil {
+		return 0, fmt.Errorf("invalid weather endpoint: %w", err)
+	}
+	query := u.Query()
+	query.Set("lat", strconv.FormatFloat(p.latitude, 'f', -1, 64))
+	query.Set("lon", strconv.FormatFloat(p.longitude, 'f', -1, 64))
+	if p.apiKey != "" {
+		query.Set("apikey", p.apiKey)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create weather request: %w", err)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("weather request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("weather endpoint returned status %d", resp.StatusCode)
+	}
+
+	var forecast forecastResponse
+	if err := json.NewDecoder(resp.Body).Decode(&forecast); err != nil {
+		return 0, fmt.Errorf("failed to decode weather response: %w", err)
+	}
+	return forecast.PrecipitationProbability, nil
+}
@@ -0,0 +1,48 @@
+package weather
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prite36/auto-irrigation-system/internal/config"
+)
+
+func TestHTTPProviderPrecipitationProbability(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("lat") != "13.75" || query.Get("lon") != "100.5" || query.Get("apikey") != "secret" {
+			t.Errorf("Unexpected query parameters: %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"precipitation_probability": 85}`))
+	}))
+	defer server.Close()
+
+	provider := NewHTTPProvider(config.WeatherConfig{
+		Endpoint:  server.URL,
+		APIKey:    "secret",
+		Latitude:  13.75,
+		Longitude: 100.5,
+	})
+
+	probability, err := provider.PrecipitationProbability(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if probability != 85 {
+		t.Errorf("Expected probability 85, got %v", probability)
+	}
+}
+
+func TestHTTPProviderErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	provider := NewHTTPProvider(config.WeatherConfig{Endpoint: server.URL})
+	if _, err := provider.PrecipitationProbability(context.Background()); err == nil {
+		t.Error("Expected an error for a non-200 response")
+	}
+}